@@ -0,0 +1,73 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package poly
+
+import (
+	"github.com/wdamron/poly/ast"
+	"github.com/wdamron/poly/internal/astutil"
+)
+
+// Dependency analysis of grouped let-bindings (LetGroup and Where expressions) within an expression. The bindings of
+// each group are sorted into strongly-connected components in dependency order, as they would be during inference.
+type Analysis struct {
+	groups  []ast.Expr
+	sccs    [][][]ast.LetBinding
+	invalid ast.Expr
+}
+
+// Analyze dependencies between grouped let-bindings within e, without inferring types. Analysis fails if a group
+// contains duplicate bindings or recursive bindings which are not functions; the invalid expression is available from
+// the returned analysis.
+func Analyze(e ast.Expr) (*Analysis, error) {
+	var analysis astutil.Analysis
+	analysis.Init()
+	err := analysis.Analyze(e)
+	a := &Analysis{invalid: analysis.Invalid}
+	if err != nil {
+		return a, err
+	}
+	a.groups = make([]ast.Expr, len(analysis.Graphs))
+	a.sccs = make([][][]ast.LetBinding, len(analysis.Graphs))
+	for i := range analysis.Graphs {
+		graph := &analysis.Graphs[i]
+		a.groups[i] = graph.Expr
+		a.sccs[i] = make([][]ast.LetBinding, len(analysis.SCC[i]))
+		for j, scc := range analysis.SCC[i] {
+			bindings := make([]ast.LetBinding, len(scc))
+			for k, bindNum := range scc {
+				bindings[k] = graph.Vars[bindNum]
+			}
+			a.sccs[i][j] = bindings
+		}
+	}
+	return a, nil
+}
+
+// Get the grouping expressions (LetGroup or Where) within the analyzed expression, in the order they are analyzed.
+func (a *Analysis) Groups() []ast.Expr { return a.groups }
+
+// Get the bindings of the group at index i (see Groups), sorted into strongly-connected components in dependency order.
+func (a *Analysis) StronglyConnectedComponents(i int) [][]ast.LetBinding { return a.sccs[i] }
+
+// Get the expression which failed analysis, or nil if analysis succeeded.
+func (a *Analysis) InvalidExpr() ast.Expr { return a.invalid }
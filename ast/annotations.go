@@ -0,0 +1,58 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ast
+
+import (
+	"github.com/wdamron/poly/types"
+)
+
+// Get the annotated type of e. The type is only available after inference with annotation enabled.
+//
+// If e does not record a type (e.g. Variant), or no type has been assigned to e, false is returned. The types of
+// Let, LetGroup, Where, and Definition expressions are the types of their bodies (or values).
+func TypeOf(e Expr) (types.Type, bool) {
+	var t types.Type
+	switch e := e.(type) {
+	case *Let:
+		return TypeOf(e.Body)
+	case *LetGroup:
+		return TypeOf(e.Body)
+	case *Where:
+		return TypeOf(e.Body)
+	case *Definition:
+		if e.Value == nil {
+			return nil, false
+		}
+		return TypeOf(e.Value)
+	case *Variant:
+		return nil, false
+	case nil:
+		return nil, false
+	default:
+		t = e.Type()
+	}
+	if t = types.RealType(t); t == nil {
+		return nil, false
+	}
+	return t, true
+}
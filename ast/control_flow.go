@@ -25,6 +25,7 @@ package ast
 import (
 	"errors"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/wdamron/poly/internal/util"
@@ -78,11 +79,14 @@ type ControlFlow struct {
 	Locals []string
 	Entry  Block
 	// Return determines the result type of a control flow expression
-	Return   Block
-	Blocks   []Block
-	Jumps    []Jump
-	sccs     [][]Block
-	inferred types.Type
+	Return Block
+	Blocks []Block
+	Jumps  []Jump
+	// Returns are indexes of additional blocks which return from a control flow expression
+	Returns     []int
+	sccs        [][]Block
+	inferred    types.Type
+	returnTypes map[int]types.Type
 }
 
 // Create a new control flow expression.
@@ -104,6 +108,32 @@ func (e *ControlFlow) Type() types.Type { return types.RealType(e.inferred) }
 // Assign a type to e. Type assignments should occur indirectly, during inference.
 func (e *ControlFlow) SetType(t types.Type) { e.inferred = t }
 
+// Get the inferred (or assigned) result type of a return point (the return block or a block within Returns) for e.
+func (e *ControlFlow) ReturnPointType(index int) types.Type {
+	return types.RealType(e.returnTypes[index])
+}
+
+// Assign a result type to a return point for e. Type assignments should occur indirectly, during inference.
+func (e *ControlFlow) SetReturnPointType(index int, t types.Type) {
+	if e.returnTypes == nil {
+		e.returnTypes = make(map[int]types.Type, len(e.Returns)+1)
+	}
+	e.returnTypes[index] = t
+}
+
+// Check if b is a return point for e: the return block, or a block within Returns.
+func (e *ControlFlow) IsReturnPoint(b Block) bool {
+	if b.IsReturn() {
+		return true
+	}
+	for _, index := range e.Returns {
+		if index == b.Index {
+			return true
+		}
+	}
+	return false
+}
+
 // Check if e has been validated and not modified since the last validation.
 func (e *ControlFlow) IsValidated() bool { return len(e.sccs) != 0 }
 
@@ -124,6 +154,16 @@ func (e *ControlFlow) AddBlock(block ...Expr) Block {
 	return e.Blocks[len(e.Blocks)-1]
 }
 
+// Add a new block to e which returns from the control flow expression. The last expression within the block
+// is a result for the control flow expression, and must have the same type as the result of the return block.
+// A jump from the new block to the return block will be added, which marks the exit from the control flow graph.
+func (e *ControlFlow) AddReturnBlock(block ...Expr) Block {
+	b := e.AddBlock(block...)
+	e.Returns = append(e.Returns, b.Index)
+	e.AddJump(b, e.Return)
+	return b
+}
+
 // Add a jump for a pair of blocks. The return block determines the result type of a control flow expression.
 func (e *ControlFlow) AddJump(from, to Block) {
 	if !e.HasJump(from, to) {
@@ -158,17 +198,18 @@ func (e *ControlFlow) Validate(annotate bool) (sccs [][]Block, err error) {
 	if len(sccs) < 2 {
 		return nil, errors.New("Control flow must reach the entry and return blocks")
 	}
+	// Ensure all blocks and cycles in the strongly connected components for e reach the return block,
+	// directly or transitively. Non-productive cycles would otherwise be reported as misplaced entry
+	// or return blocks below:
+	if err = e.checkReturnReachability(sccs); err != nil {
+		return nil, err
+	}
 	if len(sccs[0]) != 1 || sccs[0][0].Index != ControlFlowEntryIndex {
 		return nil, errors.New("Control flow must begin at a non-cyclical entry block")
 	}
 	if len(sccs[len(sccs)-1]) != 1 || sccs[len(sccs)-1][0].Index != ControlFlowReturnIndex {
 		return nil, errors.New("Control flow must end at a non-cyclical return block")
 	}
-	// Ensure all blocks and cycles in the strongly connected components for e reach the return block,
-	// directly or transitively:
-	if err = e.checkReturnReachability(sccs); err != nil {
-		return nil, err
-	}
 	if annotate {
 		e.sccs = sccs
 	}
@@ -257,6 +298,7 @@ func (e *ControlFlow) checkReturnReachability(stronglyConnectedComponents [][]Bl
 
 func (e *ControlFlow) checkReturnReachabilityLarge(stronglyConnectedComponents [][]Block) (err error) {
 	reachesReturn, entryReachesReturn, jumpsMarked := make([]bool, len(e.Blocks)), false, 0
+	var stuck []Block
 	for {
 		changed := false
 		for _, jump := range e.Jumps {
@@ -291,16 +333,17 @@ func (e *ControlFlow) checkReturnReachabilityLarge(stronglyConnectedComponents [
 			} else if block.IsReturn() || reachesReturn[block.Index] {
 				continue
 			}
-			return errors.New("Control flow contains blocks which do not reach the return block")
+			stuck = append(stuck, block)
 		}
 	}
-	return nil
+	return stuckBlocksErr(stuck)
 }
 
 func (e *ControlFlow) checkReturnReachabilitySmall(stronglyConnectedComponents [][]Block) (err error) {
 	hasBit := func(bits uint64, bit int) bool { return bits&(1<<uint(bit)) != 0 }
 	setBit := func(bits uint64, bit int) uint64 { return bits | (1 << uint(bit)) }
 	reachesReturn, entryReachesReturn, jumpsMarked := uint64(0), false, 0
+	var stuck []Block
 	for {
 		changed := false
 		for _, jump := range e.Jumps {
@@ -335,10 +378,26 @@ func (e *ControlFlow) checkReturnReachabilitySmall(stronglyConnectedComponents [
 			} else if block.IsReturn() || hasBit(reachesReturn, block.Index) {
 				continue
 			}
-			return errors.New("Control flow contains blocks which do not reach the return block")
+			stuck = append(stuck, block)
+		}
+	}
+	return stuckBlocksErr(stuck)
+}
+
+// Create an error listing the labels of blocks which do not reach the return block.
+func stuckBlocksErr(stuck []Block) error {
+	if len(stuck) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString("Control flow contains blocks which do not reach the return block: ")
+	for i, block := range stuck {
+		if i > 0 {
+			sb.WriteString(", ")
 		}
+		printBlockLabel(&sb, block.Index)
 	}
-	return nil
+	return errors.New(sb.String())
 }
 
 // Copy and sort jumps in ascending order by {From, To}.
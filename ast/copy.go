@@ -22,10 +22,23 @@
 
 package ast
 
-func CopyExpr(e Expr) Expr {
+// Copy e and all of its sub-expressions. Annotations are retained within the copy.
+func CopyExpr(e Expr) Expr { return copyExpr(e, nil) }
+
+// Copy e and all of its sub-expressions, replacing each copied expression with the result of f (if f is not nil).
+// Sub-expressions are replaced before their parents.
+func copyExpr(e Expr, f func(Expr) Expr) Expr {
+	copied := copyNode(e, f)
+	if f != nil && copied != nil {
+		return f(copied)
+	}
+	return copied
+}
+
+func copyNode(e Expr, f func(Expr) Expr) Expr {
 	switch e := e.(type) {
 	case *Literal:
-		return &Literal{e.Syntax, e.Using, e.Construct, e.inferred}
+		return &Literal{e.Syntax, e.Using, e.Construct, e.inferred, e.scheme}
 
 	case *Var:
 		return &Var{e.Name, e.inferred, e.scope}
@@ -39,65 +52,154 @@ func CopyExpr(e Expr) Expr {
 	case *Call:
 		args := make([]Expr, len(e.Args))
 		for i, arg := range e.Args {
-			args[i] = CopyExpr(arg)
+			args[i] = copyExpr(arg, f)
 		}
-		return &Call{CopyExpr(e.Func), args, e.inferred, e.inferredFunc}
+		return &Call{copyExpr(e.Func, f), args, e.inferred, e.inferredFunc}
 
 	case *Func:
-		return &Func{e.ArgNames, CopyExpr(e.Body), e.inferred}
+		return &Func{e.ArgNames, copyExpr(e.Body, f), e.inferred, e.captures}
+
+	case *Fix:
+		if e.Func == nil {
+			return &Fix{nil, e.inferred}
+		}
+		return &Fix{copyExpr(e.Func, f).(*Func), e.inferred}
 
 	case *Pipe:
 		seq := make([]Expr, len(e.Sequence))
 		for i, step := range e.Sequence {
-			seq[i] = CopyExpr(step)
+			seq[i] = copyExpr(step, f)
 		}
-		return &Pipe{CopyExpr(e.Source), e.As, seq, e.inferred}
+		return &Pipe{copyExpr(e.Source, f), e.As, seq, e.inferred}
 
 	case *Let:
-		return &Let{e.Var, CopyExpr(e.Value), CopyExpr(e.Body)}
+		return &Let{e.Var, copyExpr(e.Value, f), copyExpr(e.Body, f)}
 
 	case *LetGroup:
 		vars := make([]LetBinding, len(e.Vars))
 		for i, v := range e.Vars {
-			vars[i] = LetBinding{v.Var, CopyExpr(v.Value)}
+			vars[i] = LetBinding{v.Var, copyExpr(v.Value, f)}
 		}
-		return &LetGroup{vars, CopyExpr(e.Body), e.sccs}
+		return &LetGroup{vars, copyExpr(e.Body, f), e.sccs, e.schemes}
+
+	case *Where:
+		vars := make([]LetBinding, len(e.Vars))
+		for i, v := range e.Vars {
+			vars[i] = LetBinding{v.Var, copyExpr(v.Value, f)}
+		}
+		return &Where{copyExpr(e.Body, f), vars, e.sccs}
 
 	case *RecordSelect:
-		return &RecordSelect{CopyExpr(e.Record), e.Label, e.inferred}
+		return &RecordSelect{copyExpr(e.Record, f), e.Label, e.inferred}
+
+	case *FieldPath:
+		path := make([]string, len(e.Path))
+		copy(path, e.Path)
+		return &FieldPath{copyExpr(e.Record, f), path, e.inferred}
+
+	case *Try:
+		return &Try{copyExpr(e.Expr, f), e.inferred}
+
+	case *Signature:
+		return &Signature{copyExpr(e.Value, f), e.Sig, e.Partial, e.inferred}
+
+	case *EqualityConstraint:
+		return &EqualityConstraint{e.Left, e.Right, copyExpr(e.Body, f)}
+
+	case *TypeAbstraction:
+		return &TypeAbstraction{e.Names, copyExpr(e.Body, f)}
+
+	case *WithInstance:
+		methods := make(map[string]Expr, len(e.Methods))
+		for name, method := range e.Methods {
+			methods[name] = copyExpr(method, f)
+		}
+		return &WithInstance{e.Class, e.Param, methods, copyExpr(e.Body, f)}
+
+	case *OptionChain:
+		return &OptionChain{copyExpr(e.Expr, f), e.Label, e.inferred}
 
 	case *RecordExtend:
 		labels := make([]LabelValue, len(e.Labels))
 		for i, v := range e.Labels {
-			labels[i] = LabelValue{v.Label, CopyExpr(v.Value)}
+			labels[i] = LabelValue{v.Label, copyExpr(v.Value, f), v.Lazy}
 		}
 		record := e.Record
 		if record == nil {
 			record = &RecordEmpty{}
 		} else {
-			record = CopyExpr(record)
+			record = copyExpr(record, f)
 		}
-		return &RecordExtend{record, labels, e.inferred}
+		return &RecordExtend{record, labels, e.inferred, e.fieldOrder}
+
+	case *RecordUpdate:
+		labels := make([]LabelValue, len(e.Labels))
+		for i, v := range e.Labels {
+			labels[i] = LabelValue{v.Label, copyExpr(v.Value, f), v.Lazy}
+		}
+		return &RecordUpdate{copyExpr(e.Record, f), labels, e.inferred}
 
 	case *RecordRestrict:
-		return &RecordRestrict{CopyExpr(e.Record), e.Label, e.inferred}
+		return &RecordRestrict{copyExpr(e.Record, f), e.Label, e.inferred}
+
+	case *Definition:
+		return &Definition{e.Name, copyExpr(e.Value, f)}
+
+	case *RecordMerge:
+		return &RecordMerge{copyExpr(e.Left, f), copyExpr(e.Right, f), e.Defaults, e.inferred}
 
 	case *RecordEmpty:
 		return &RecordEmpty{e.inferred}
 
+	case *Hole:
+		return &Hole{e.Name, e.inferred}
+
+	case *SizedArrayLit:
+		elems := make([]Expr, len(e.Elems))
+		for i, elem := range e.Elems {
+			elems[i] = copyExpr(elem, f)
+		}
+		return &SizedArrayLit{elems, e.inferred}
+
+	case *TupleLit:
+		elems := make([]Expr, len(e.Elems))
+		for i, elem := range e.Elems {
+			elems[i] = copyExpr(elem, f)
+		}
+		return &TupleLit{elems, e.inferred}
+
 	case *Variant:
-		return &Variant{e.Label, CopyExpr(e.Value)}
+		return &Variant{e.Label, copyExpr(e.Value, f)}
+
+	case *VariantN:
+		values := make([]Expr, len(e.Values))
+		for i, value := range e.Values {
+			values[i] = copyExpr(value, f)
+		}
+		return &VariantN{e.Label, values, e.inferred}
 
 	case *Match:
 		cases := make([]MatchCase, len(e.Cases))
 		for i, v := range e.Cases {
-			cases[i] = MatchCase{v.Label, v.Var, CopyExpr(v.Value), v.varType}
+			cases[i] = MatchCase{v.Label, v.Var, copyVariantPattern(v.Nested), copyExpr(v.Value, f), v.varType}
 		}
 		defaultCase := e.Default
 		if defaultCase != nil {
-			defaultCase = &MatchCase{defaultCase.Label, defaultCase.Var, CopyExpr(defaultCase.Value), defaultCase.varType}
+			defaultCase = &MatchCase{defaultCase.Label, defaultCase.Var, copyVariantPattern(defaultCase.Nested), copyExpr(defaultCase.Value, f), defaultCase.varType}
 		}
-		return &Match{CopyExpr(e.Value), cases, defaultCase, e.inferred}
+		return &Match{copyExpr(e.Value, f), cases, defaultCase, e.inferred, e.residual}
+
+	case *MatchTuple:
+		return &MatchTuple{copyExpr(e.Value, f), e.Pattern, copyExpr(e.Body, f), e.inferred}
+
+	case *MatchRecord:
+		return &MatchRecord{copyExpr(e.Value, f), e.Pattern, copyExpr(e.Body, f), e.inferred}
+
+	case *Absurd:
+		return &Absurd{copyExpr(e.Value, f), e.inferred}
+
+	case *Compare:
+		return &Compare{e.Op, copyExpr(e.Left, f), copyExpr(e.Right, f), e.inferred}
 
 	case *ControlFlow:
 		next := NewControlFlow(e.Name, e.Locals...)
@@ -105,21 +207,37 @@ func CopyExpr(e Expr) Expr {
 		for i, b := range e.Blocks {
 			blocks[i].Sequence = make([]Expr, len(b.Sequence))
 			for j, sub := range b.Sequence {
-				blocks[i].Sequence[j] = CopyExpr(sub)
+				blocks[i].Sequence[j] = copyExpr(sub, f)
 			}
 			blocks[i].Index = b.Index
 		}
 		next.Blocks = blocks
 		next.Entry.Sequence = make([]Expr, len(e.Entry.Sequence))
 		for i, sub := range e.Entry.Sequence {
-			next.Entry.Sequence[i] = CopyExpr(sub)
+			next.Entry.Sequence[i] = copyExpr(sub, f)
 		}
 		next.Return.Sequence = make([]Expr, len(e.Return.Sequence))
 		for i, sub := range e.Return.Sequence {
-			next.Return.Sequence[i] = CopyExpr(sub)
+			next.Return.Sequence[i] = copyExpr(sub, f)
 		}
+		next.Jumps = make([]Jump, len(e.Jumps))
 		copy(next.Jumps, e.Jumps)
+		if len(e.Returns) != 0 {
+			next.Returns = make([]int, len(e.Returns))
+			copy(next.Returns, e.Returns)
+		}
 		return next
+
+	case nil:
+		return nil
 	}
 	panic("unknown expression type: " + e.ExprName())
 }
+
+func copyVariantPattern(p *VariantPattern) *VariantPattern {
+	if p == nil {
+		return nil
+	}
+	next := *p
+	return &next
+}
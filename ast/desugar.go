@@ -0,0 +1,81 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ast
+
+import "strconv"
+
+// Rewrite each pipeline within e into equivalent nested let-bindings, which rebind the placeholder to the result of
+// the previous step: `pipe $ = x |> f($) |> g($)` is rewritten to `let $ = x in let $ = f($) in g($)`. A pipeline
+// with no steps is rewritten to its source.
+//
+// Since let-bound functions may refer to themselves, a step which is a function is bound to a fresh name before
+// rebinding the placeholder: `pipe $ = x |> fn y -> f($, y) |> $(x)` is rewritten to
+// `let $ = x in let $1(y) = f($, y) in let $ = $1 in $(x)`.
+//
+// The expression is copied (see CopyExpr); e is not modified.
+func DesugarPipe(e Expr) Expr {
+	return copyExpr(e, func(e Expr) Expr {
+		pipe, ok := e.(*Pipe)
+		if !ok {
+			return e
+		}
+		if len(pipe.Sequence) == 0 {
+			return pipe.Source
+		}
+		names := pipeNames(pipe)
+		body := pipe.Sequence[len(pipe.Sequence)-1]
+		for i := len(pipe.Sequence) - 2; i >= 0; i-- {
+			body = bindPipeStep(pipe.As, names, pipe.Sequence[i], body)
+		}
+		return bindPipeStep(pipe.As, names, pipe.Source, body)
+	})
+}
+
+// Bind the placeholder to the result of a step within body, without allowing the step to refer to itself.
+func bindPipeStep(as string, names map[string]bool, step, body Expr) Expr {
+	if !IsFunc(step) {
+		return &Let{Var: as, Value: step, Body: body}
+	}
+	fresh := as
+	for i := 1; names[fresh]; i++ {
+		fresh = as + strconv.Itoa(i)
+	}
+	names[fresh] = true
+	return &Let{Var: fresh, Value: step, Body: &Let{Var: as, Value: &Var{Name: fresh}, Body: body}}
+}
+
+// Collect the placeholder and each variable referenced within a pipeline.
+func pipeNames(pipe *Pipe) map[string]bool {
+	names := map[string]bool{pipe.As: true}
+	WalkExpr(pipe, func(e Expr) {
+		switch e := e.(type) {
+		case *Var:
+			names[e.Name] = true
+		case *Literal:
+			for _, name := range e.Using {
+				names[name] = true
+			}
+		}
+	})
+	return names
+}
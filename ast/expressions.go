@@ -24,43 +24,83 @@
 //
 //   Literal:         semi-opaque literal value
 //   Var:             variable
+//   Hole:            placeholder for an unknown expression
 //   Deref:           dereference
 //   DerefAssign:     dereference and assign
 //   ControlFlow:     control-flow graph
 //   Pipe:            pipeline
 //   Call:            function call
 //   Func:            function abstraction
+//   Fix:             recursive anonymous function
+//   Try:             unwrapping a result, propagating errors
+//   Signature:       explicit type signature
+//   EqualityConstraint: type equality
+//   TypeAbstraction: scoped type-variables
+//   WithInstance:    local type-class instance
 //   Let:             let-binding
 //   LetGroup:        grouped let-bindings
+//   Where:           grouped post-bindings
 //   RecordSelect:    selecting (scoped) value of label
+//   FieldPath:       selecting value of nested labels
+//   OptionChain:     selecting value of label within an optional record
 //   RecordExtend:    extending record
+//   RecordUpdate:    updating (scoped) labels
 //   RecordRestrict:  deleting (scoped) label
+//   RecordMerge:     merging records
 //   RecordEmpty:     empty record
+//   SizedArrayLit:   fixed-size array literal
+//   TupleLit:        tuple literal
 //   Variant:         tagged (ad-hoc) variant
+//   VariantN:        tagged (ad-hoc) variant with multiple payloads
 //   Match:           variant-matching switch
+//   MatchTuple:      tuple-destructuring match
+//   MatchRecord:     record-destructuring match
+//   Absurd:          eliminating an empty variant
+//   Compare:         comparison
 package ast
 
 import (
+	"sort"
+
 	"github.com/wdamron/poly/types"
 )
 
 var (
 	_ Expr = (*Literal)(nil)
 	_ Expr = (*Var)(nil)
+	_ Expr = (*Hole)(nil)
 	_ Expr = (*Deref)(nil)
 	_ Expr = (*DerefAssign)(nil)
 	_ Expr = (*ControlFlow)(nil)
 	_ Expr = (*Pipe)(nil)
 	_ Expr = (*Call)(nil)
 	_ Expr = (*Func)(nil)
+	_ Expr = (*Fix)(nil)
+	_ Expr = (*Try)(nil)
+	_ Expr = (*Signature)(nil)
+	_ Expr = (*EqualityConstraint)(nil)
+	_ Expr = (*TypeAbstraction)(nil)
+	_ Expr = (*WithInstance)(nil)
 	_ Expr = (*Let)(nil)
 	_ Expr = (*LetGroup)(nil)
+	_ Expr = (*Where)(nil)
 	_ Expr = (*RecordSelect)(nil)
+	_ Expr = (*FieldPath)(nil)
+	_ Expr = (*OptionChain)(nil)
 	_ Expr = (*RecordExtend)(nil)
+	_ Expr = (*RecordUpdate)(nil)
 	_ Expr = (*RecordRestrict)(nil)
+	_ Expr = (*RecordMerge)(nil)
 	_ Expr = (*RecordEmpty)(nil)
+	_ Expr = (*SizedArrayLit)(nil)
+	_ Expr = (*TupleLit)(nil)
 	_ Expr = (*Variant)(nil)
+	_ Expr = (*VariantN)(nil)
 	_ Expr = (*Match)(nil)
+	_ Expr = (*MatchTuple)(nil)
+	_ Expr = (*MatchRecord)(nil)
+	_ Expr = (*Absurd)(nil)
+	_ Expr = (*Compare)(nil)
 )
 
 // Expr is the base for all expressions.
@@ -69,20 +109,39 @@ var (
 //
 //   Literal:         semi-opaque literal value
 //   Var:             variable
+//   Hole:            placeholder for an unknown expression
 //   Deref:           dereference
 //   DerefAssign:     dereference and assign
 //   ControlFlow:     control-flow graph
 //   Pipe:            pipeline
 //   Call:            function call
 //   Func:            function abstraction
+//   Fix:             recursive anonymous function
+//   Try:             unwrapping a result, propagating errors
+//   Signature:       explicit type signature
+//   EqualityConstraint: type equality
+//   TypeAbstraction: scoped type-variables
+//   WithInstance:    local type-class instance
 //   Let:             let-binding
 //   LetGroup:        grouped let-bindings
+//   Where:           grouped post-bindings
 //   RecordSelect:    selecting (scoped) value of label
+//   FieldPath:       selecting value of nested labels
+//   OptionChain:     selecting value of label within an optional record
 //   RecordExtend:    extending record
+//   RecordUpdate:    updating (scoped) labels
 //   RecordRestrict:  deleting (scoped) label
+//   RecordMerge:     merging records
 //   RecordEmpty:     empty record
+//   SizedArrayLit:   fixed-size array literal
+//   TupleLit:        tuple literal
 //   Variant:         tagged (ad-hoc) variant
+//   VariantN:        tagged (ad-hoc) variant with multiple payloads
 //   Match:           variant-matching switch
+//   MatchTuple:      tuple-destructuring match
+//   MatchRecord:     record-destructuring match
+//   Absurd:          eliminating an empty variant
+//   Compare:         comparison
 type Expr interface {
 	// Name of the syntax-type of the expression.
 	ExprName() string
@@ -111,6 +170,7 @@ type Literal struct {
 	// types derived from variables which are already in scope (retrieved from the type-environment).
 	Construct func(env types.TypeEnv, level uint, using []types.Type) (types.Type, error)
 	inferred  types.Type
+	scheme    types.Type
 }
 
 // Returns the syntax of e.
@@ -122,6 +182,13 @@ func (e *Literal) Type() types.Type { return types.RealType(e.inferred) }
 // Assign a type to e. Type assignments should occur indirectly, during inference.
 func (e *Literal) SetType(t types.Type) { e.inferred = t }
 
+// Get the constructed (or assigned) type of e before instantiation. The scheme may contain generic
+// type-variables, and will be assigned if e is inferred with annotation enabled.
+func (e *Literal) Scheme() types.Type { return e.scheme }
+
+// Assign the constructed type of e before instantiation. Assignments should occur indirectly, during inference.
+func (e *Literal) SetScheme(t types.Type) { e.scheme = t }
+
 // Variable
 type Var struct {
 	Name     string
@@ -144,6 +211,23 @@ func (e *Var) SetType(t types.Type) { e.inferred = t }
 // Assign a binding scope for e. Scope assignments should occur indirectly, during inference.
 func (e *Var) SetScope(scope *Scope) { e.scope = scope }
 
+// Placeholder for an unknown expression: `?name`
+//
+// A hole is inferred as a fresh type-variable, which is constrained by the surrounding expression.
+type Hole struct {
+	Name     string
+	inferred types.Type
+}
+
+// "Hole"
+func (e *Hole) ExprName() string { return "Hole" }
+
+// Get the inferred (or assigned) type of e.
+func (e *Hole) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *Hole) SetType(t types.Type) { e.inferred = t }
+
 // Dereference: `*x`
 type Deref struct {
 	Ref      Expr
@@ -203,13 +287,19 @@ type Func struct {
 	ArgNames []string
 	Body     Expr
 	inferred *types.Arrow
+	captures []string
 }
 
 // "Func"
 func (e *Func) ExprName() string { return "Func" }
 
-// Get the inferred (or assigned) type of e.
-func (e *Func) Type() types.Type { return types.RealType(e.inferred) }
+// Get the inferred (or assigned) type of e. The type is nil (rather than a nil pointer) if no type has been assigned.
+func (e *Func) Type() types.Type {
+	if e.inferred == nil {
+		return nil
+	}
+	return e.inferred
+}
 
 // Assign a type to e. Type assignments should occur indirectly, during inference.
 func (e *Func) SetType(ft *types.Arrow) { e.inferred = ft }
@@ -220,6 +310,148 @@ func (e *Func) ArgType(index int) types.Type { return types.RealType(e.inferred.
 // Get the inferred (or assigned) return type of e.
 func (e *Func) RetType() types.Type { return types.RealType(e.inferred.Return) }
 
+// Get the names of variables captured by e from enclosing scopes, in order of first use. Captures will be
+// assigned if e is inferred with annotation enabled. Predeclared (top-level) variables are not captured.
+func (e *Func) Captures() []string { return e.captures }
+
+// Assign the names of variables captured by e. Assignments should occur indirectly, during inference.
+func (e *Func) SetCaptures(names []string) { e.captures = names }
+
+// Recursive anonymous function: `fix (fn (self) -> fn (x) -> self(x))`
+//
+// The single argument of Func is bound to the function returned by Func. The body of Func must be a function.
+type Fix struct {
+	Func     *Func
+	inferred types.Type
+}
+
+// "Fix"
+func (e *Fix) ExprName() string { return "Fix" }
+
+// Get the inferred (or assigned) type of e.
+func (e *Fix) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *Fix) SetType(t types.Type) { e.inferred = t }
+
+// Unwrapping a result, propagating errors: `try e`
+//
+// The result must be a variant with labels `ok` and `err`. The value of the `ok` case is returned, and the value of
+// the `err` case is returned early from the enclosing function, which must return a result with the same error type.
+type Try struct {
+	Expr     Expr
+	inferred types.Type
+}
+
+// "Try"
+func (e *Try) ExprName() string { return "Try" }
+
+// Get the inferred (or assigned) type of e.
+func (e *Try) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *Try) SetType(t types.Type) { e.inferred = t }
+
+// Explicit type signature: `(e : T)`
+//
+// Type-variables within the signature are generalized (as with declared types) and rigid; the inferred type of the
+// value must be at least as general as the signature. When a let-bound function carries a signature, recursive references to the function are
+// instantiated from the signature, which allows polymorphic recursion.
+//
+// Type-variables within a partial signature are flexible rather than rigid: the signature is unified with the inferred
+// type of the value, and the type of the expression is the inferred type. A partial signature with an open record
+// type, e.g. `(e : partial {x : int | 'r})`, requires only the specified labels; the tail absorbs the other labels of
+// the value. Let-bound values with partial signatures are not treated as functions, so they may not be recursive.
+type Signature struct {
+	Value    Expr
+	Sig      types.Type
+	Partial  bool
+	inferred types.Type
+}
+
+// "Signature"
+func (e *Signature) ExprName() string { return "Signature" }
+
+// Get the inferred (or assigned) type of e.
+func (e *Signature) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *Signature) SetType(t types.Type) { e.inferred = t }
+
+// Type equality: `(L ~ R) => e`
+//
+// The types Left and Right are unified before Body is inferred, and a failing equality is reported before Body is
+// checked. Unbound type-variables within Left and Right are linked by the equality; generic type-variables within
+// Left and Right are equated within signatures in Body (e.g. a signature `'a -> 'b` within the body of `'a ~ 'b`
+// is checked as `'a -> 'a`).
+type EqualityConstraint struct {
+	Left, Right types.Type
+	Body        Expr
+}
+
+// "EqualityConstraint"
+func (e *EqualityConstraint) ExprName() string { return "EqualityConstraint" }
+
+// Get the inferred (or assigned) type of e.
+func (e *EqualityConstraint) Type() types.Type { return e.Body.Type() }
+
+// Scoped type-variables: `forall a b. e`
+//
+// A fresh rigid type-variable is bound to each name while Body is inferred. Signatures within Body may refer to the
+// bound type-variables through scoped type constants (see types.Const); each reference within Body refers to the same
+// type-variable, which must not be bound to another type, equated with another scoped type-variable, constrained, or
+// unified with type-variables from outside of the abstraction. References to names which are not bound by an
+// enclosing abstraction are rejected.
+type TypeAbstraction struct {
+	Names []string
+	Body  Expr
+}
+
+// "TypeAbstraction"
+func (e *TypeAbstraction) ExprName() string { return "TypeAbstraction" }
+
+// Get the inferred (or assigned) type of e.
+func (e *TypeAbstraction) Type() types.Type { return e.Body.Type() }
+
+// Local type-class instance: `with-instance C T {m = e} in body`
+//
+// The instance of Class for the type-parameter Param is available only while Body is inferred. Each method of Class
+// (and its super-classes) must be implemented by an expression within Methods.
+type WithInstance struct {
+	Class   *types.TypeClass
+	Param   types.Type
+	Methods map[string]Expr
+	Body    Expr
+}
+
+// "WithInstance"
+func (e *WithInstance) ExprName() string { return "WithInstance" }
+
+// Get the inferred (or assigned) type of e.
+func (e *WithInstance) Type() types.Type { return e.Body.Type() }
+
+// Get the names of the implemented methods, in sorted order.
+func (e *WithInstance) MethodNames() []string {
+	names := make([]string, 0, len(e.Methods))
+	for name := range e.Methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check if e is a function, or a function with an explicit (non-partial) signature.
+func IsFunc(e Expr) bool {
+	if sig, ok := e.(*Signature); ok {
+		if sig.Partial {
+			return false
+		}
+		e = sig.Value
+	}
+	_, ok := e.(*Func)
+	return ok
+}
+
 // Let-binding: `let a = 1 in e`
 type Let struct {
 	Var   string
@@ -235,9 +467,10 @@ func (e *Let) Type() types.Type { return e.Body.Type() }
 
 // Grouped let-bindings: `let a = 1 and b = 2 in e`
 type LetGroup struct {
-	Vars []LetBinding
-	Body Expr
-	sccs [][]LetBinding
+	Vars    []LetBinding
+	Body    Expr
+	sccs    [][]LetBinding
+	schemes map[string]types.Type
 }
 
 // "LetGroup"
@@ -259,6 +492,41 @@ func (e *LetGroup) StronglyConnectedComponents() [][]LetBinding { return e.sccs
 // Each component should be a variable bound by e.
 func (e *LetGroup) SetStronglyConnectedComponents(sccs [][]LetBinding) { e.sccs = sccs }
 
+// Get the generalized type of each variable bound by e. The type-schemes will be assigned if e is inferred with
+// annotation enabled.
+func (e *LetGroup) Schemes() map[string]types.Type { return e.schemes }
+
+// Assign the generalized type of each variable bound by e. Assignments should occur indirectly, during inference.
+func (e *LetGroup) SetSchemes(schemes map[string]types.Type) { e.schemes = schemes }
+
+// Grouped post-bindings: `e where a = 1 and b = 2`
+//
+// Where is inferred identically to LetGroup, with the body preceding the bindings.
+type Where struct {
+	Body Expr
+	Vars []LetBinding
+	sccs [][]LetBinding
+}
+
+// "Where"
+func (e *Where) ExprName() string { return "Where" }
+
+// Get the inferred (or assigned) type of e.
+func (e *Where) Type() types.Type { return e.Body.Type() }
+
+// Get the strongly connected components inferred for e, in dependency order.
+// The strongly connected components will be assigned if e is inferred with
+// annotation enabled.
+//
+// Each component is a variable bound by e.
+func (e *Where) StronglyConnectedComponents() [][]LetBinding { return e.sccs }
+
+// Assign the strongly connected components for e. Assignments should occur indirectly,
+// during inference.
+//
+// Each component should be a variable bound by e.
+func (e *Where) SetStronglyConnectedComponents(sccs [][]LetBinding) { e.sccs = sccs }
+
 // Paired identifier and value
 type LetBinding struct {
 	Var   string
@@ -284,26 +552,105 @@ func (e *RecordSelect) Type() types.Type { return types.RealType(e.inferred) }
 // Assign a type to e. Type assignments should occur indirectly, during inference.
 func (e *RecordSelect) SetType(t types.Type) { e.inferred = t }
 
+// Selecting value of nested labels: `r.a.b.c`
+//
+// A field path is equivalent to nested record selections. An error at any step reports the path selected up to the failure.
+type FieldPath struct {
+	Record   Expr
+	Path     []string
+	inferred types.Type
+}
+
+// "FieldPath"
+func (e *FieldPath) ExprName() string { return "FieldPath" }
+
+// Get the inferred (or assigned) type of e.
+func (e *FieldPath) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *FieldPath) SetType(t types.Type) { e.inferred = t }
+
+// Selecting value of label within an optional record: `r?.a`
+//
+// The optional record must be a variant with labels `some` and `none`, where the `some` case contains a record.
+// The result is an option of the selected value: `[some : 'a, none : 'b]`. The `none` case passes through unchanged.
+type OptionChain struct {
+	Expr     Expr
+	Label    string
+	inferred types.Type
+}
+
+// "OptionChain"
+func (e *OptionChain) ExprName() string { return "OptionChain" }
+
+// Get the inferred (or assigned) type of e.
+func (e *OptionChain) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *OptionChain) SetType(t types.Type) { e.inferred = t }
+
 // Extending record: `{a = 1, b = 2 | r}`
 type RecordExtend struct {
-	Record   Expr
-	Labels   []LabelValue
-	inferred *types.Record
+	Record     Expr
+	Labels     []LabelValue
+	inferred   *types.Record
+	fieldOrder []string
 }
 
 // "RecordExtend"
 func (e *RecordExtend) ExprName() string { return "RecordExtend" }
 
-// Get the inferred (or assigned) type of e.
-func (e *RecordExtend) Type() types.Type { return types.RealType(e.inferred) }
+// Get the inferred (or assigned) type of e. The type is nil (rather than a nil pointer) if no type has been assigned.
+func (e *RecordExtend) Type() types.Type {
+	if e.inferred == nil {
+		return nil
+	}
+	return e.inferred
+}
 
 // Assign a type to e. Type assignments should occur indirectly, during inference.
 func (e *RecordExtend) SetType(rt *types.Record) { e.inferred = rt }
 
+// Get the source order of the labels within e. The labels of the inferred record-type are ordered canonically; the
+// source order of distinct labels within the extension is recorded during inference (with annotation enabled).
+// Labels of the extended record are not included.
+func (e *RecordExtend) FieldOrder() []string { return e.fieldOrder }
+
+// Assign the source order of the labels within e. Field order assignments should occur indirectly, during inference.
+func (e *RecordExtend) SetFieldOrder(order []string) { e.fieldOrder = order }
+
+// Updating (scoped) labels: `{r | a = 1, b = 2}`
+//
+// Each label must be present within the updated record. The type of each updated label is replaced by the type
+// of its value, and other labels are preserved.
+type RecordUpdate struct {
+	Record   Expr
+	Labels   []LabelValue
+	inferred *types.Record
+}
+
+// "RecordUpdate"
+func (e *RecordUpdate) ExprName() string { return "RecordUpdate" }
+
+// Get the inferred (or assigned) type of e. The type is nil (rather than a nil pointer) if no type has been assigned.
+func (e *RecordUpdate) Type() types.Type {
+	if e.inferred == nil {
+		return nil
+	}
+	return e.inferred
+}
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *RecordUpdate) SetType(rt *types.Record) { e.inferred = rt }
+
 // Paired label and value
+//
+// The value of a lazy label must be a function with no arguments (a thunk), which is type-checked but not applied;
+// the type of the label is the return type of the function.
 type LabelValue struct {
 	Label string
 	Value Expr
+	Lazy  bool
 }
 
 // Get the inferred (or assigned) type of e.
@@ -319,12 +666,46 @@ type RecordRestrict struct {
 // "RecordRestrict"
 func (e *RecordRestrict) ExprName() string { return "RecordRestrict" }
 
-// Get the inferred (or assigned) type of e.
-func (e *RecordRestrict) Type() types.Type { return types.RealType(e.inferred) }
+// Get the inferred (or assigned) type of e. The type is nil (rather than a nil pointer) if no type has been assigned.
+func (e *RecordRestrict) Type() types.Type {
+	if e.inferred == nil {
+		return nil
+	}
+	return e.inferred
+}
 
 // Assign a type to e. Type assignments should occur indirectly, during inference.
 func (e *RecordRestrict) SetType(rt *types.Record) { e.inferred = rt }
 
+// Merging records: `{...a, ...b}`
+//
+// Labels of the merged records must be distinct, unless labels of the right record overwrite labels of the left record.
+// Both of the merged records must be closed.
+//
+// If Defaults is set, the left record supplies default values for labels which are not provided by the right record.
+// Labels of the right record override labels of the left record, and the type of each overridden label is unified
+// with the type of its default value.
+type RecordMerge struct {
+	Left     Expr
+	Right    Expr
+	Defaults bool
+	inferred *types.Record
+}
+
+// "RecordMerge"
+func (e *RecordMerge) ExprName() string { return "RecordMerge" }
+
+// Get the inferred (or assigned) type of e. The type is nil (rather than a nil pointer) if no type has been assigned.
+func (e *RecordMerge) Type() types.Type {
+	if e.inferred == nil {
+		return nil
+	}
+	return e.inferred
+}
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *RecordMerge) SetType(rt *types.Record) { e.inferred = rt }
+
 // Empty record: `{}`
 type RecordEmpty struct {
 	inferred *types.Record
@@ -333,12 +714,49 @@ type RecordEmpty struct {
 // "RecordEmpty"
 func (e *RecordEmpty) ExprName() string { return "RecordEmpty" }
 
-// Get the inferred (or assigned) type of e.
-func (e *RecordEmpty) Type() types.Type { return types.RealType(e.inferred) }
+// Get the inferred (or assigned) type of e. The type is nil (rather than a nil pointer) if no type has been assigned.
+func (e *RecordEmpty) Type() types.Type {
+	if e.inferred == nil {
+		return nil
+	}
+	return e.inferred
+}
 
 // Assign a type to e. Type assignments should occur indirectly, during inference.
 func (e *RecordEmpty) SetType(rt *types.Record) { e.inferred = rt }
 
+// Fixed-size array literal: `[a, b, c]`
+//
+// The literal is inferred as `array['a, N]`, where each element has type 'a and N is the number of elements.
+type SizedArrayLit struct {
+	Elems    []Expr
+	inferred types.Type
+}
+
+// "SizedArrayLit"
+func (e *SizedArrayLit) ExprName() string { return "SizedArrayLit" }
+
+// Get the inferred (or assigned) type of e.
+func (e *SizedArrayLit) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *SizedArrayLit) SetType(t types.Type) { e.inferred = t }
+
+// Tuple literal: `(a, b, c)`
+type TupleLit struct {
+	Elems    []Expr
+	inferred types.Type
+}
+
+// "TupleLit"
+func (e *TupleLit) ExprName() string { return "TupleLit" }
+
+// Get the inferred (or assigned) type of e.
+func (e *TupleLit) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *TupleLit) SetType(t types.Type) { e.inferred = t }
+
 // Tagged (ad-hoc) variant: `:X a`
 type Variant struct {
 	Label string
@@ -351,6 +769,25 @@ func (e *Variant) ExprName() string { return "Variant" }
 // Get the inferred (or assigned) type of e.
 func (e *Variant) Type() types.Type { return e.Value.Type() }
 
+// Tagged (ad-hoc) variant with multiple payloads: `:X(a, b)`
+//
+// The payload of the variant is a tuple of the values. Matching the variant binds the tuple, which may be
+// destructured by a tuple-destructuring match (see MatchTuple).
+type VariantN struct {
+	Label    string
+	Values   []Expr
+	inferred types.Type
+}
+
+// "VariantN"
+func (e *VariantN) ExprName() string { return "VariantN" }
+
+// Get the inferred (or assigned) type of e.
+func (e *VariantN) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *VariantN) SetType(t types.Type) { e.inferred = t }
+
 // Variant-matching switch:
 //
 //  match e {
@@ -364,6 +801,7 @@ type Match struct {
 	Cases    []MatchCase
 	Default  *MatchCase
 	inferred types.Type
+	residual types.Type
 }
 
 // "Match"
@@ -375,10 +813,40 @@ func (e *Match) Type() types.Type { return types.RealType(e.inferred) }
 // Assign a type to e. Type assignments should occur indirectly, during inference.
 func (e *Match) SetType(t types.Type) { e.inferred = t }
 
+// Get the labels handled by the cases of e, along with the inferred (or assigned) residual row-type of the matched
+// variant. The residual row contains the labels which are deferred to the default case; when the matched variant
+// is closed or e has no default case, the residual row will be empty.
+func (e *Match) Residual() (handled []string, tail types.Type) {
+	handled = make([]string, 0, len(e.Cases))
+	for i, c := range e.Cases {
+		// Cases with nested patterns may share a label:
+		if i > 0 && c.Nested != nil && containsLabel(handled, c.Label) {
+			continue
+		}
+		handled = append(handled, c.Label)
+	}
+	return handled, types.RealType(e.residual)
+}
+
+// Assign a residual row-type to e. Type assignments should occur indirectly, during inference.
+func (e *Match) SetResidual(t types.Type) { e.residual = t }
+
+func containsLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
 // Case expression within Match: `:X a -> expr1`
+//
+// If Nested is not nil, the case matches a nested variant pattern: `:X (:Y a) -> expr1`, and Var is ignored.
 type MatchCase struct {
 	Label   string
 	Var     string
+	Nested  *VariantPattern
 	Value   Expr
 	varType types.Type
 }
@@ -392,7 +860,156 @@ func (e *MatchCase) VariantType() types.Type { return types.RealType(e.varType)
 // Assign a variant-type to e. Type assignments should occur indirectly, during inference.
 func (e *MatchCase) SetVariantType(t types.Type) { e.varType = t }
 
+// Get the name of the variable bound by e, within its nested pattern if one exists.
+func (e *MatchCase) BoundVar() string {
+	if e.Nested != nil {
+		return e.Nested.Var
+	}
+	return e.Var
+}
+
+// Nested variant pattern within MatchCase: `(:Y a)`
+type VariantPattern struct {
+	Label   string
+	Var     string
+	varType types.Type
+}
+
+// Get the inferred (or assigned) variant-type of the payload bound by p.
+func (p *VariantPattern) VariantType() types.Type { return types.RealType(p.varType) }
+
+// Assign a variant-type to p. Type assignments should occur indirectly, during inference.
+func (p *VariantPattern) SetVariantType(t types.Type) { p.varType = t }
+
+// Tuple-destructuring match: `match e { ((a, b), c) -> expr }`
+type MatchTuple struct {
+	Value    Expr
+	Pattern  TuplePattern
+	Body     Expr
+	inferred types.Type
+}
+
+// "MatchTuple"
+func (e *MatchTuple) ExprName() string { return "MatchTuple" }
+
+// Get the inferred (or assigned) type of e.
+func (e *MatchTuple) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *MatchTuple) SetType(t types.Type) { e.inferred = t }
+
+// Positional pattern within MatchTuple: `(a, (b, c))`
+//
+// A pattern without elements binds the matched value to Var; otherwise, each element is matched
+// against the corresponding element of a tuple.
+type TuplePattern struct {
+	Var   string
+	Elems []TuplePattern
+}
+
+// Check if p is a (nested) tuple pattern, rather than a variable.
+func (p *TuplePattern) IsTuple() bool { return p.Elems != nil }
+
+// Get the names of all variables bound by p, in positional order.
+func (p *TuplePattern) Vars() []string {
+	if !p.IsTuple() {
+		return []string{p.Var}
+	}
+	var vars []string
+	for i := range p.Elems {
+		vars = append(vars, p.Elems[i].Vars()...)
+	}
+	return vars
+}
+
+// Record-destructuring match: `match e { {a, b = c | rest} -> expr }`
+type MatchRecord struct {
+	Value    Expr
+	Pattern  RecordPattern
+	Body     Expr
+	inferred types.Type
+}
+
+// "MatchRecord"
+func (e *MatchRecord) ExprName() string { return "MatchRecord" }
+
+// Get the inferred (or assigned) type of e.
+func (e *MatchRecord) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *MatchRecord) SetType(t types.Type) { e.inferred = t }
+
+// Eliminating an empty variant: `absurd e`
+//
+// The value must be a closed variant with no labels, which can not be constructed; the result may be of any type.
+// Absurd expressions are useful within unreachable match cases, e.g. the default case of a match which handles every
+// label of the matched variant.
+type Absurd struct {
+	Value    Expr
+	inferred types.Type
+}
+
+// "Absurd"
+func (e *Absurd) ExprName() string { return "Absurd" }
+
+// Get the inferred (or assigned) type of e.
+func (e *Absurd) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *Absurd) SetType(t types.Type) { e.inferred = t }
+
+// Comparison: `a < b`
+//
+// Both operands must have the same type, which is constrained by the comparison type-class of the inference context
+// (if configured). The result is a bool, or the configured comparison result type. The operator is not interpreted
+// during inference.
+type Compare struct {
+	Op       string
+	Left     Expr
+	Right    Expr
+	inferred types.Type
+}
+
+// "Compare"
+func (e *Compare) ExprName() string { return "Compare" }
+
+// Get the inferred (or assigned) type of e.
+func (e *Compare) Type() types.Type { return types.RealType(e.inferred) }
+
+// Assign a type to e. Type assignments should occur indirectly, during inference.
+func (e *Compare) SetType(t types.Type) { e.inferred = t }
+
+// Labeled pattern within MatchRecord: `{a, b = c | rest}`
+//
+// Each field binds the value of its label to Var. If Rest is not empty, the record without the matched labels is
+// bound to Rest; otherwise, the remaining labels are ignored.
+type RecordPattern struct {
+	Fields []FieldPattern
+	Rest   string
+}
+
+// Paired label and variable within a record pattern
+type FieldPattern struct {
+	Label string
+	Var   string
+}
+
+// Get the names of all variables bound by p, with the rest variable last.
+func (p *RecordPattern) Vars() []string {
+	vars := make([]string, 0, len(p.Fields)+1)
+	for _, field := range p.Fields {
+		vars = append(vars, field.Var)
+	}
+	if p.Rest != "" {
+		vars = append(vars, p.Rest)
+	}
+	return vars
+}
+
 // Pipeline: `pipe $ = xs |> fmap($, fn (x) -> to_y(x)) |> fmap($, fn (y) -> to_z(y))`
+//
+// Each step may reference the result of the previous step through the placeholder. A step may fan out to multiple
+// transformations by collecting their results into a record: `pipe $ = x |> {a = f($), b = g($)}`
 type Pipe struct {
 	Source   Expr
 	As       string
@@ -26,6 +26,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/wdamron/poly/types"
 )
 
 func ExprString(e Expr) string {
@@ -98,6 +100,18 @@ func exprString(sb *strings.Builder, simple bool, e Expr) {
 			sb.WriteByte(')')
 		}
 
+	case *Fix:
+		if simple {
+			sb.WriteByte('(')
+		}
+		sb.WriteString("fix ")
+		if e.Func != nil {
+			exprString(sb, true, e.Func)
+		}
+		if simple {
+			sb.WriteByte(')')
+		}
+
 	case *ControlFlow:
 		if simple {
 			sb.WriteByte('(')
@@ -156,14 +170,118 @@ func exprString(sb *strings.Builder, simple bool, e Expr) {
 			sb.WriteByte(')')
 		}
 
+	case *Where:
+		if simple {
+			sb.WriteByte('(')
+		}
+		exprString(sb, true, e.Body)
+		sb.WriteString(" where ")
+		for i, v := range e.Vars {
+			if i > 0 {
+				sb.WriteString(" and ")
+			}
+			bindingString(sb, v.Var, v.Value)
+		}
+		if simple {
+			sb.WriteByte(')')
+		}
+
+	case *Definition:
+		bindingString(sb, e.Name, e.Value)
+
 	case *RecordEmpty:
 		sb.WriteString("{}")
 
+	case *Hole:
+		sb.WriteByte('?')
+		sb.WriteString(e.Name)
+
 	case *RecordSelect:
 		exprString(sb, true, e.Record)
 		sb.WriteByte('.')
 		sb.WriteString(e.Label)
 
+	case *Try:
+		if simple {
+			sb.WriteByte('(')
+		}
+		sb.WriteString("try ")
+		exprString(sb, true, e.Expr)
+		if simple {
+			sb.WriteByte(')')
+		}
+
+	case *Signature:
+		sb.WriteByte('(')
+		exprString(sb, false, e.Value)
+		sb.WriteString(" : ")
+		if e.Partial {
+			sb.WriteString("partial ")
+		}
+		sb.WriteString(types.TypeString(e.Sig))
+		sb.WriteByte(')')
+
+	case *EqualityConstraint:
+		if simple {
+			sb.WriteByte('(')
+		}
+		sb.WriteByte('(')
+		sb.WriteString(types.TypeString(e.Left))
+		sb.WriteString(" ~ ")
+		sb.WriteString(types.TypeString(e.Right))
+		sb.WriteString(") => ")
+		exprString(sb, false, e.Body)
+		if simple {
+			sb.WriteByte(')')
+		}
+
+	case *TypeAbstraction:
+		if simple {
+			sb.WriteByte('(')
+		}
+		sb.WriteString("forall ")
+		sb.WriteString(strings.Join(e.Names, " "))
+		sb.WriteString(". ")
+		exprString(sb, false, e.Body)
+		if simple {
+			sb.WriteByte(')')
+		}
+
+	case *FieldPath:
+		exprString(sb, true, e.Record)
+		for _, label := range e.Path {
+			sb.WriteByte('.')
+			sb.WriteString(label)
+		}
+
+	case *WithInstance:
+		if simple {
+			sb.WriteByte('(')
+		}
+		sb.WriteString("with-instance ")
+		if e.Class != nil {
+			sb.WriteString(e.Class.Name)
+		}
+		sb.WriteByte(' ')
+		sb.WriteString(types.TypeString(e.Param))
+		sb.WriteString(" {")
+		for i, name := range e.MethodNames() {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			bindingString(sb, name, e.Methods[name])
+		}
+		sb.WriteString("} in ")
+		exprString(sb, false, e.Body)
+		if simple {
+			sb.WriteByte(')')
+		}
+
+	case *OptionChain:
+		exprString(sb, true, e.Expr)
+		sb.WriteString("?.")
+		sb.WriteString(e.Label)
+
 	case *RecordRestrict:
 		sb.WriteByte('{')
 		exprString(sb, false, e.Record)
@@ -171,6 +289,33 @@ func exprString(sb *strings.Builder, simple bool, e Expr) {
 		sb.WriteString(e.Label)
 		sb.WriteByte('}')
 
+	case *SizedArrayLit:
+		sb.WriteByte('[')
+		for i, elem := range e.Elems {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			exprString(sb, false, elem)
+		}
+		sb.WriteByte(']')
+
+	case *TupleLit:
+		sb.WriteByte('(')
+		for i, elem := range e.Elems {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			exprString(sb, false, elem)
+		}
+		sb.WriteByte(')')
+
+	case *RecordMerge:
+		sb.WriteString("{...")
+		exprString(sb, false, e.Left)
+		sb.WriteString(", ...")
+		exprString(sb, false, e.Right)
+		sb.WriteByte('}')
+
 	case *RecordExtend:
 		sb.WriteByte('{')
 		labels := make([]LabelValue, len(e.Labels))
@@ -182,7 +327,7 @@ func exprString(sb *strings.Builder, simple bool, e Expr) {
 			if i > 0 {
 				sb.WriteString(", ")
 			}
-			bindingString(sb, label.Label, label.Value)
+			labelString(sb, label)
 		}
 		switch e.Record.(type) {
 		case *RecordEmpty:
@@ -193,6 +338,18 @@ func exprString(sb *strings.Builder, simple bool, e Expr) {
 		}
 		sb.WriteByte('}')
 
+	case *RecordUpdate:
+		sb.WriteByte('{')
+		exprString(sb, false, e.Record)
+		sb.WriteString(" | ")
+		for i, label := range e.Labels {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			labelString(sb, label)
+		}
+		sb.WriteByte('}')
+
 	case *Variant:
 		if simple {
 			sb.WriteByte('(')
@@ -205,6 +362,18 @@ func exprString(sb *strings.Builder, simple bool, e Expr) {
 			sb.WriteByte(')')
 		}
 
+	case *VariantN:
+		sb.WriteByte(':')
+		sb.WriteString(e.Label)
+		sb.WriteByte('(')
+		for i, value := range e.Values {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			exprString(sb, false, value)
+		}
+		sb.WriteByte(')')
+
 	case *Match:
 		sb.WriteString("match ")
 		exprString(sb, false, e.Value)
@@ -215,8 +384,16 @@ func exprString(sb *strings.Builder, simple bool, e Expr) {
 			}
 			sb.WriteString(" :")
 			sb.WriteString(c.Label)
-			sb.WriteByte(' ')
-			sb.WriteString(c.Var)
+			if c.Nested != nil {
+				sb.WriteString(" (:")
+				sb.WriteString(c.Nested.Label)
+				sb.WriteByte(' ')
+				sb.WriteString(c.Nested.Var)
+				sb.WriteByte(')')
+			} else {
+				sb.WriteByte(' ')
+				sb.WriteString(c.Var)
+			}
 			sb.WriteString(" -> ")
 			exprString(sb, false, c.Value)
 		}
@@ -227,9 +404,94 @@ func exprString(sb *strings.Builder, simple bool, e Expr) {
 			exprString(sb, false, e.Default.Value)
 		}
 		sb.WriteString(" }")
+
+	case *MatchTuple:
+		sb.WriteString("match ")
+		exprString(sb, false, e.Value)
+		sb.WriteString(" { ")
+		tuplePattern(sb, e.Pattern)
+		sb.WriteString(" -> ")
+		exprString(sb, false, e.Body)
+		sb.WriteString(" }")
+
+	case *MatchRecord:
+		sb.WriteString("match ")
+		exprString(sb, false, e.Value)
+		sb.WriteString(" { ")
+		recordPattern(sb, e.Pattern)
+		sb.WriteString(" -> ")
+		exprString(sb, false, e.Body)
+		sb.WriteString(" }")
+
+	case *Absurd:
+		if simple {
+			sb.WriteByte('(')
+		}
+		sb.WriteString("absurd ")
+		exprString(sb, true, e.Value)
+		if simple {
+			sb.WriteByte(')')
+		}
+
+	case *Compare:
+		if simple {
+			sb.WriteByte('(')
+		}
+		exprString(sb, true, e.Left)
+		sb.WriteByte(' ')
+		sb.WriteString(e.Op)
+		sb.WriteByte(' ')
+		exprString(sb, true, e.Right)
+		if simple {
+			sb.WriteByte(')')
+		}
 	}
 }
 
+func recordPattern(sb *strings.Builder, p RecordPattern) {
+	sb.WriteByte('{')
+	for i, field := range p.Fields {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(field.Label)
+		if field.Var != field.Label {
+			sb.WriteString(" = ")
+			sb.WriteString(field.Var)
+		}
+	}
+	if p.Rest != "" {
+		if len(p.Fields) > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString("| ")
+		sb.WriteString(p.Rest)
+	}
+	sb.WriteByte('}')
+}
+
+func tuplePattern(sb *strings.Builder, p TuplePattern) {
+	if !p.IsTuple() {
+		sb.WriteString(p.Var)
+		return
+	}
+	sb.WriteByte('(')
+	for i, elem := range p.Elems {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		tuplePattern(sb, elem)
+	}
+	sb.WriteByte(')')
+}
+
+func labelString(sb *strings.Builder, label LabelValue) {
+	if label.Lazy {
+		sb.WriteString("lazy ")
+	}
+	bindingString(sb, label.Label, label.Value)
+}
+
 func bindingString(sb *strings.Builder, label string, value Expr) {
 	fn, ok := value.(*Func)
 	if !ok {
@@ -284,6 +546,13 @@ func init() {
 	}
 }
 
+// Get the label of a block within a control-flow graph: entry, return, or L<index>
+func BlockLabel(index int) string {
+	var sb strings.Builder
+	printBlockLabel(&sb, index)
+	return sb.String()
+}
+
 func printBlockLabel(sb *strings.Builder, index int) {
 	switch index {
 	case ControlFlowEntryIndex:
@@ -0,0 +1,59 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ast
+
+import (
+	"github.com/wdamron/poly/types"
+)
+
+var _ Expr = (*Definition)(nil)
+
+// ExprProvider produces a stream of top-level expressions, which may be inferred as they are produced.
+//
+// Expressions must be produced in dependency order; each expression may only refer to definitions which were
+// previously produced. Mutually-recursive definitions should be produced together within a single LetGroup,
+// which will be sorted by dependency during inference.
+type ExprProvider interface {
+	// Get the next expression in the stream, or false if the stream has ended.
+	Next() (Expr, bool)
+}
+
+// Named top-level definition: `a = 1`
+//
+// Definitions are only valid as top-level expressions produced by an ExprProvider. The inferred type of Value
+// will be assigned to Name within the type-environment for subsequent expressions.
+type Definition struct {
+	Name  string
+	Value Expr
+}
+
+// "Definition"
+func (e *Definition) ExprName() string { return "Definition" }
+
+// Get the inferred (or assigned) type of the defined value.
+func (e *Definition) Type() types.Type {
+	if e.Value == nil {
+		return nil
+	}
+	return e.Value.Type()
+}
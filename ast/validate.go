@@ -0,0 +1,257 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ast
+
+import (
+	"errors"
+)
+
+// Validate the structure of e and its sub-expressions before inference. Validate reports the first violation of
+// the following invariants:
+//
+//	Pipe:        the source must be set and the sequence must not be empty
+//	Match:       at least one case or a default case must be present
+//	Func:        argument names must be unique
+//	LetGroup:    at least one binding must be present, and binding names must be unique
+//	Where:       at least one binding must be present, and binding names must be unique
+//	ControlFlow: all blocks must be reachable from the entry block, and must reach the return block
+//
+// Missing (nil) sub-expressions are skipped; they are reported during inference.
+func Validate(e Expr) error {
+	switch e := e.(type) {
+	case *Pipe:
+		if e.Source == nil {
+			return errors.New("Pipe expression is missing Source")
+		}
+		if len(e.Sequence) == 0 {
+			return errors.New("Pipe expression has an empty sequence")
+		}
+		if err := Validate(e.Source); err != nil {
+			return err
+		}
+		return validateAll(e.Sequence)
+
+	case *Match:
+		if len(e.Cases) == 0 && e.Default == nil {
+			return errors.New("Match expression has no cases")
+		}
+		if err := Validate(e.Value); err != nil {
+			return err
+		}
+		for _, c := range e.Cases {
+			if err := Validate(c.Value); err != nil {
+				return err
+			}
+		}
+		if e.Default != nil {
+			return Validate(e.Default.Value)
+		}
+		return nil
+
+	case *Func:
+		for i, name := range e.ArgNames {
+			for _, prev := range e.ArgNames[:i] {
+				if name == prev {
+					return errors.New("Function has duplicate arguments named " + name)
+				}
+			}
+		}
+		return Validate(e.Body)
+
+	case *LetGroup:
+		if err := validateBindings("Let-group", e.Vars); err != nil {
+			return err
+		}
+		return Validate(e.Body)
+
+	case *Where:
+		if err := validateBindings("Where", e.Vars); err != nil {
+			return err
+		}
+		return Validate(e.Body)
+
+	case *ControlFlow:
+		if err := e.validateReachability(); err != nil {
+			return err
+		}
+		if err := validateAll(e.Entry.Sequence); err != nil {
+			return err
+		}
+		for _, b := range e.Blocks {
+			if err := validateAll(b.Sequence); err != nil {
+				return err
+			}
+		}
+		return validateAll(e.Return.Sequence)
+
+	case *Deref:
+		return Validate(e.Ref)
+	case *DerefAssign:
+		if err := Validate(e.Ref); err != nil {
+			return err
+		}
+		return Validate(e.Value)
+	case *Call:
+		if err := Validate(e.Func); err != nil {
+			return err
+		}
+		return validateAll(e.Args)
+	case *Fix:
+		if e.Func == nil {
+			return nil
+		}
+		return Validate(e.Func)
+	case *Let:
+		if err := Validate(e.Value); err != nil {
+			return err
+		}
+		return Validate(e.Body)
+	case *Definition:
+		return Validate(e.Value)
+	case *RecordSelect:
+		return Validate(e.Record)
+	case *FieldPath:
+		return Validate(e.Record)
+	case *OptionChain:
+		return Validate(e.Expr)
+	case *Try:
+		return Validate(e.Expr)
+	case *Signature:
+		return Validate(e.Value)
+	case *EqualityConstraint:
+		return Validate(e.Body)
+	case *TypeAbstraction:
+		return Validate(e.Body)
+	case *WithInstance:
+		for _, name := range e.MethodNames() {
+			if err := Validate(e.Methods[name]); err != nil {
+				return err
+			}
+		}
+		return Validate(e.Body)
+	case *RecordUpdate:
+		if err := Validate(e.Record); err != nil {
+			return err
+		}
+		for _, label := range e.Labels {
+			if err := Validate(label.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *RecordExtend:
+		for _, label := range e.Labels {
+			if err := Validate(label.Value); err != nil {
+				return err
+			}
+		}
+		if e.Record == nil {
+			return nil
+		}
+		return Validate(e.Record)
+	case *RecordRestrict:
+		return Validate(e.Record)
+	case *RecordMerge:
+		if err := Validate(e.Left); err != nil {
+			return err
+		}
+		return Validate(e.Right)
+	case *SizedArrayLit:
+		return validateAll(e.Elems)
+	case *TupleLit:
+		return validateAll(e.Elems)
+	case *Variant:
+		return Validate(e.Value)
+	case *VariantN:
+		return validateAll(e.Values)
+	case *MatchTuple:
+		if err := Validate(e.Value); err != nil {
+			return err
+		}
+		return Validate(e.Body)
+	case *MatchRecord:
+		if err := Validate(e.Value); err != nil {
+			return err
+		}
+		return Validate(e.Body)
+	case *Absurd:
+		return Validate(e.Value)
+	case *Compare:
+		if err := Validate(e.Left); err != nil {
+			return err
+		}
+		return Validate(e.Right)
+	}
+	return nil
+}
+
+func validateAll(exprs []Expr) error {
+	for _, e := range exprs {
+		if err := Validate(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateBindings(kind string, bindings []LetBinding) error {
+	if len(bindings) == 0 {
+		return errors.New(kind + " expression has no bindings")
+	}
+	for i, b := range bindings {
+		for _, prev := range bindings[:i] {
+			if b.Var == prev.Var {
+				return errors.New(kind + " expression has duplicate bindings for " + b.Var)
+			}
+		}
+	}
+	for _, b := range bindings {
+		if err := Validate(b.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ensure all blocks within e are reachable from the entry block, then ensure all blocks reach the return block.
+func (e *ControlFlow) validateReachability() error {
+	reached := make([]bool, len(e.Blocks))
+	stack := []int{ControlFlowEntryIndex}
+	for len(stack) != 0 {
+		from := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, j := range e.Jumps {
+			if j.From == from && j.To >= 0 && j.To < len(reached) && !reached[j.To] {
+				reached[j.To] = true
+				stack = append(stack, j.To)
+			}
+		}
+	}
+	for i, ok := range reached {
+		if !ok {
+			return errors.New("Control flow block " + BlockLabel(i) + " is not reachable from the entry block")
+		}
+	}
+	_, err := e.Validate(false)
+	return err
+}
@@ -24,7 +24,7 @@ package ast
 
 func WalkExpr(e Expr, f func(Expr)) {
 	switch e := e.(type) {
-	case *Var, *Literal, *RecordEmpty:
+	case *Var, *Hole, *Literal, *RecordEmpty:
 		f(e)
 
 	case *Call:
@@ -37,6 +37,12 @@ func WalkExpr(e Expr, f func(Expr)) {
 		f(e)
 		WalkExpr(e.Body, f)
 
+	case *Fix:
+		f(e)
+		if e.Func != nil {
+			WalkExpr(e.Func, f)
+		}
+
 	case *Pipe:
 		f(e.Source)
 		for _, step := range e.Sequence {
@@ -55,10 +61,48 @@ func WalkExpr(e Expr, f func(Expr)) {
 		}
 		WalkExpr(e.Body, f)
 
+	case *Where:
+		f(e)
+		WalkExpr(e.Body, f)
+		for _, v := range e.Vars {
+			WalkExpr(v.Value, f)
+		}
+
 	case *RecordSelect:
 		f(e)
 		WalkExpr(e.Record, f)
 
+	case *FieldPath:
+		f(e)
+		WalkExpr(e.Record, f)
+
+	case *OptionChain:
+		f(e)
+		WalkExpr(e.Expr, f)
+
+	case *Try:
+		f(e)
+		WalkExpr(e.Expr, f)
+
+	case *Signature:
+		f(e)
+		WalkExpr(e.Value, f)
+
+	case *EqualityConstraint:
+		f(e)
+		WalkExpr(e.Body, f)
+
+	case *TypeAbstraction:
+		f(e)
+		WalkExpr(e.Body, f)
+
+	case *WithInstance:
+		f(e)
+		for _, name := range e.MethodNames() {
+			WalkExpr(e.Methods[name], f)
+		}
+		WalkExpr(e.Body, f)
+
 	case *RecordExtend:
 		f(e)
 		for _, v := range e.Labels {
@@ -66,14 +110,48 @@ func WalkExpr(e Expr, f func(Expr)) {
 		}
 		WalkExpr(e.Record, f)
 
+	case *RecordUpdate:
+		f(e)
+		WalkExpr(e.Record, f)
+		for _, v := range e.Labels {
+			WalkExpr(v.Value, f)
+		}
+
 	case *RecordRestrict:
 		f(e)
 		WalkExpr(e.Record, f)
 
+	case *Definition:
+		f(e)
+		WalkExpr(e.Value, f)
+
+	case *RecordMerge:
+		f(e)
+		WalkExpr(e.Left, f)
+		WalkExpr(e.Right, f)
+
+	case *SizedArrayLit:
+		f(e)
+		for _, elem := range e.Elems {
+			WalkExpr(elem, f)
+		}
+
+	case *TupleLit:
+		f(e)
+		for _, elem := range e.Elems {
+			WalkExpr(elem, f)
+		}
+
 	case *Variant:
 		f(e)
 		WalkExpr(e.Value, f)
 
+	case *VariantN:
+		f(e)
+		for _, value := range e.Values {
+			WalkExpr(value, f)
+		}
+
 	case *Match:
 		f(e)
 		for _, v := range e.Cases {
@@ -83,6 +161,25 @@ func WalkExpr(e Expr, f func(Expr)) {
 			WalkExpr(e.Default.Value, f)
 		}
 
+	case *MatchTuple:
+		f(e)
+		WalkExpr(e.Value, f)
+		WalkExpr(e.Body, f)
+
+	case *MatchRecord:
+		f(e)
+		WalkExpr(e.Value, f)
+		WalkExpr(e.Body, f)
+
+	case *Absurd:
+		f(e)
+		WalkExpr(e.Value, f)
+
+	case *Compare:
+		f(e)
+		WalkExpr(e.Left, f)
+		WalkExpr(e.Right, f)
+
 	case nil:
 
 	default:
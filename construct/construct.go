@@ -23,7 +23,12 @@
 package construct
 
 import (
+	"errors"
+	"sort"
+	"strconv"
+
 	"github.com/wdamron/poly/ast"
+	"github.com/wdamron/poly/internal/typeutil"
 	"github.com/wdamron/poly/types"
 )
 
@@ -37,11 +42,36 @@ func TVar(id, level uint) *types.Var {
 	return types.NewVar(id, level)
 }
 
+// Create a generalized type with named type-parameters: `forall a b. (a -> b) -> list[a] -> list[b]`
+//
+// A distinct generic type-variable is allocated for each name and passed to body, which should build the type. Type-variables
+// are numbered from 0 in the order of names, so they should not be mixed with generic type-variables created
+// elsewhere within the same type.
+func Forall(names []string, body func(vars map[string]*types.Var) types.Type) types.Type {
+	vars := make(map[string]*types.Var, len(names))
+	for _, name := range names {
+		if _, ok := vars[name]; !ok {
+			vars[name] = types.NewGenericVar(uint(len(vars)))
+		}
+	}
+	return typeutil.GeneralizeOpts(types.TopLevel, body(vars), true, false)
+}
+
 // Type constant: `int`, `bool`, etc
 func TConst(name string) *types.Const {
 	return &types.Const{Name: name}
 }
 
+// Reference to a type-variable bound by an enclosing type-abstraction (see TypeAbstraction): `a`
+func TScoped(name string) *types.Const {
+	return &types.Const{Name: name, Scoped: true}
+}
+
+// Abstract type constant, which may be unified by a user-defined unifier: `cell`
+func TAbstract(name string) *types.Const {
+	return &types.Const{Name: name, Abstract: true}
+}
+
 // Size constant: `array[int, 8]`
 func TSize(size int) types.Size {
 	return types.Size(size)
@@ -52,6 +82,57 @@ func TRecursiveLink(rec *types.Recursive, name string) *types.RecursiveLink {
 	return &types.RecursiveLink{Recursive: rec, Index: rec.Indexes[name]}
 }
 
+// RecRef references the types within a recursive type-group while the group is being bound.
+type RecRef struct {
+	Recursive *types.Recursive
+	err       *error
+}
+
+// Get the type-parameters of the recursive type-group.
+func (r RecRef) Params() []*types.Var { return r.Recursive.Params }
+
+// Recursive link to a named type within the recursive type-group.
+func (r RecRef) Link(name string) *types.RecursiveLink {
+	index, ok := r.Recursive.Indexes[name]
+	if !ok && r.err != nil && *r.err == nil {
+		*r.err = errors.New("Recursive type " + name + " is not defined")
+	}
+	return &types.RecursiveLink{Recursive: r.Recursive, Index: index}
+}
+
+// Create a recursive type or group of mutually-recursive types from named definitions.
+//
+// Each definition should return an aliased type, which may reference itself or other definitions through
+// links created by the RecRef. Names and indexes are assigned in sorted order by name. An error will be
+// returned if any definition links to an undefined name.
+func Recursive(params []*types.Var, defs map[string]func(self RecRef) *types.App) (*types.Recursive, error) {
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	indexes := make(map[string]int, len(names))
+	for i, name := range names {
+		indexes[name] = i
+	}
+	var err error
+	rec := typeutil.NewRecursive(params, func(instance *types.Recursive) {
+		self := RecRef{Recursive: instance}
+		// Undefined names are reported while binding the initial instance:
+		if instance.Indexes == nil {
+			instance.Names, instance.Indexes = names, indexes
+			self.err = &err
+		}
+		for _, name := range names {
+			instance.Types = append(instance.Types, defs[name](self))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
 // Type application: `list[int]`
 func TApp(constructor types.Type, params ...types.Type) *types.App {
 	return &types.App{Const: constructor, Params: params}
@@ -85,6 +166,11 @@ func TArrow3(arg1, arg2, arg3 types.Type, ret types.Type) *types.Arrow {
 	return &types.Arrow{Args: []types.Type{arg1, arg2, arg3}, Return: ret}
 }
 
+// Tuple type: `(int, bool)`
+func TTuple(elems ...types.Type) *types.Tuple {
+	return &types.Tuple{Elems: elems}
+}
+
 // Type-class method type: `('a, int) -> 'a`
 func TMethod(typeClass *types.TypeClass, name string) *types.Method {
 	return &types.Method{TypeClass: typeClass, Name: name}
@@ -105,6 +191,15 @@ func TVariant(row types.Type) *types.Variant {
 	return &types.Variant{Row: row}
 }
 
+// Closed enum variant-type, where each label carries the unit type: `[a, b, ...]`
+func TEnum(labels ...string) *types.Variant {
+	m := make(map[string]types.Type, len(labels))
+	for _, label := range labels {
+		m[label] = types.UnitPointer
+	}
+	return TVariant(TRowExtend(nil, TypeMap(m)))
+}
+
 // Row extension: `<a : _ , b : _ | ...>`
 func TRowExtend(row types.Type, labels types.TypeMap) *types.RowExtend {
 	if row == nil {
@@ -129,11 +224,94 @@ func Literal(syntax string, usingVars []string, constructType func(env types.Typ
 	return &ast.Literal{Syntax: syntax, Construct: constructType}
 }
 
+// Names of the type constants constructed for built-in literals
+type Builtins struct {
+	Int    string
+	String string
+	Bool   string
+}
+
+// Names of the type constants constructed for IntLit, StringLit, and BoolLit
+var defaultBuiltins = Builtins{Int: "int", String: "string", Bool: "bool"}
+
+// Integer literal: `1`
+func IntLit(value int) *ast.Literal { return defaultBuiltins.IntLit(value) }
+
+// String literal: `"a"`
+func StringLit(value string) *ast.Literal { return defaultBuiltins.StringLit(value) }
+
+// Boolean literal: `true`
+func BoolLit(value bool) *ast.Literal { return defaultBuiltins.BoolLit(value) }
+
+// Integer literal with the type constant named by b.Int: `1`
+func (b Builtins) IntLit(value int) *ast.Literal {
+	return constLiteral(strconv.Itoa(value), b.Int)
+}
+
+// String literal with the type constant named by b.String: `"a"`
+func (b Builtins) StringLit(value string) *ast.Literal {
+	return constLiteral(strconv.Quote(value), b.String)
+}
+
+// Boolean literal with the type constant named by b.Bool: `true`
+func (b Builtins) BoolLit(value bool) *ast.Literal {
+	return constLiteral(strconv.FormatBool(value), b.Bool)
+}
+
+// Unit literal: `()`
+func UnitLit() *ast.Literal {
+	return &ast.Literal{Syntax: "()", Construct: func(env types.TypeEnv, level uint, using []types.Type) (types.Type, error) {
+		return types.UnitPointer, nil
+	}}
+}
+
+func constLiteral(syntax, name string) *ast.Literal {
+	t := &types.Const{Name: name}
+	return &ast.Literal{Syntax: syntax, Construct: func(env types.TypeEnv, level uint, using []types.Type) (types.Type, error) {
+		return t, nil
+	}}
+}
+
+// Value of an enum variant-type (see TEnum): `:a`
+//
+// Inference fails if the label is not a member of the enum type.
+func EnumValue(enumType types.Type, label string) *ast.Literal {
+	return &ast.Literal{Syntax: ":" + label, Construct: func(env types.TypeEnv, level uint, using []types.Type) (types.Type, error) {
+		if !hasVariantLabel(enumType, label) {
+			return nil, errors.New("Label " + label + " is not a member of enum " + types.TypeString(enumType))
+		}
+		return enumType, nil
+	}}
+}
+
+func hasVariantLabel(t types.Type, label string) bool {
+	variant, ok := types.RealType(t).(*types.Variant)
+	if !ok {
+		return false
+	}
+	row := variant.Row
+	for {
+		ext, ok := types.RealType(row).(*types.RowExtend)
+		if !ok {
+			return false
+		}
+		if _, ok := ext.Labels.Get(label); ok {
+			return true
+		}
+		row = ext.Row
+	}
+}
+
 // Variable
 func Var(name string) *ast.Var {
 	return &ast.Var{Name: name}
 }
 
+// Placeholder for an unknown expression: `?name`
+func Hole(name string) *ast.Hole {
+	return &ast.Hole{Name: name}
+}
+
 // Dereference: `*x`
 func Deref(ref ast.Expr) *ast.Deref {
 	return &ast.Deref{Ref: ref}
@@ -169,13 +347,23 @@ func Func3(arg1, arg2, arg3 string, body ast.Expr) *ast.Func {
 	return &ast.Func{ArgNames: []string{arg1, arg2, arg3}, Body: body}
 }
 
+// Recursive anonymous function: `fix (fn (self) -> fn (x) -> self(x))`
+func Fix(f *ast.Func) *ast.Fix {
+	return &ast.Fix{Func: f}
+}
+
 // Control flow graph
 func ControlFlow(name string, locals ...string) *ast.ControlFlow {
 	return ast.NewControlFlow(name, locals...)
 }
 
 // Pipeline: `pipe $ = xs |> fmap($, fn (x) -> to_y(x)) |> fmap($, fn (y) -> to_z(y))`
+//
+// The first expression in the sequence is the source. The source will be missing if the sequence is empty.
 func Pipe(as string, sequence ...ast.Expr) *ast.Pipe {
+	if len(sequence) == 0 {
+		return &ast.Pipe{As: as}
+	}
 	return &ast.Pipe{Source: sequence[0], As: as, Sequence: sequence[1:]}
 }
 
@@ -189,6 +377,11 @@ func LetGroup(vars []ast.LetBinding, body ast.Expr) *ast.LetGroup {
 	return &ast.LetGroup{Vars: vars, Body: body}
 }
 
+// Grouped post-bindings: `e where a = 1 and b = 2`
+func Where(body ast.Expr, vars ...ast.LetBinding) *ast.Where {
+	return &ast.Where{Body: body, Vars: vars}
+}
+
 // Paired identifier and value
 func LetBinding(varName string, value ast.Expr) ast.LetBinding {
 	return ast.LetBinding{Var: varName, Value: value}
@@ -199,11 +392,84 @@ func RecordSelect(record ast.Expr, label string) *ast.RecordSelect {
 	return &ast.RecordSelect{Record: record, Label: label}
 }
 
+// Selecting value of nested labels: `r.a.b.c`
+func FieldPath(record ast.Expr, path ...string) *ast.FieldPath {
+	return &ast.FieldPath{Record: record, Path: path}
+}
+
+// Unwrapping a result, propagating errors: `try e`
+func Try(expr ast.Expr) *ast.Try {
+	return &ast.Try{Expr: expr}
+}
+
+// Explicit type signature: `(e : T)`
+func Signature(value ast.Expr, t types.Type) *ast.Signature {
+	return &ast.Signature{Value: value, Sig: t}
+}
+
+// Partial type signature: `(e : partial T)`
+func PartialSignature(value ast.Expr, t types.Type) *ast.Signature {
+	return &ast.Signature{Value: value, Sig: t, Partial: true}
+}
+
+// Type equality: `(L ~ R) => e`
+func WithEquality(left, right types.Type, body ast.Expr) *ast.EqualityConstraint {
+	return &ast.EqualityConstraint{Left: left, Right: right, Body: body}
+}
+
+// Scoped type-variables: `forall a b. e`
+func TypeAbstraction(names []string, body ast.Expr) *ast.TypeAbstraction {
+	return &ast.TypeAbstraction{Names: names, Body: body}
+}
+
+// Local type-class instance: `with-instance C T {m = e} in body`
+func WithInstance(class *types.TypeClass, param types.Type, methods map[string]ast.Expr, body ast.Expr) *ast.WithInstance {
+	return &ast.WithInstance{Class: class, Param: param, Methods: methods, Body: body}
+}
+
+// Selecting value of label within an optional record: `r?.a`
+func OptionChain(expr ast.Expr, label string) *ast.OptionChain {
+	return &ast.OptionChain{Expr: expr, Label: label}
+}
+
 // Deleting label: `{r - a}`
 func RecordRestrict(record ast.Expr, label string) *ast.RecordRestrict {
 	return &ast.RecordRestrict{Record: record, Label: label}
 }
 
+// Named top-level definition: `a = 1`
+func Definition(name string, value ast.Expr) *ast.Definition {
+	return &ast.Definition{Name: name, Value: value}
+}
+
+// Fixed-size array literal: `[a, b, c]`
+func SizedArrayLit(elems ...ast.Expr) *ast.SizedArrayLit {
+	return &ast.SizedArrayLit{Elems: elems}
+}
+
+// Tuple literal: `(a, b, c)`
+func TupleLit(elems ...ast.Expr) *ast.TupleLit {
+	return &ast.TupleLit{Elems: elems}
+}
+
+// Merging records: `{...a, ...b}`
+func RecordMerge(left, right ast.Expr) *ast.RecordMerge {
+	return &ast.RecordMerge{Left: left, Right: right}
+}
+
+// Merging a record of default values with a record of overrides: `{...defaults, ...overrides}`
+//
+// Each overridden label must have the same type as its default value.
+func RecordDefaults(defaults, overrides ast.Expr) *ast.RecordMerge {
+	return &ast.RecordMerge{Left: defaults, Right: overrides, Defaults: true}
+}
+
+// Fan-out step within a pipeline, which collects the results of multiple transformations of the placeholder
+// into a record: `{a = f($), b = g($)}`
+func PipeFanOut(labels ...ast.LabelValue) *ast.RecordExtend {
+	return RecordExtend(nil, labels...)
+}
+
 // Extending record: `{a = 1, b = 2 | r}`
 func RecordExtend(record ast.Expr, labels ...ast.LabelValue) *ast.RecordExtend {
 	if record == nil {
@@ -212,11 +478,22 @@ func RecordExtend(record ast.Expr, labels ...ast.LabelValue) *ast.RecordExtend {
 	return &ast.RecordExtend{Record: record, Labels: labels}
 }
 
+// Updating labels: `{r | a = 1, b = 2}`
+func RecordUpdate(record ast.Expr, labels ...ast.LabelValue) *ast.RecordUpdate {
+	return &ast.RecordUpdate{Record: record, Labels: labels}
+}
+
 // Paired label and value
 func LabelValue(label string, value ast.Expr) ast.LabelValue {
 	return ast.LabelValue{Label: label, Value: value}
 }
 
+// Paired label and thunk (a function with no arguments), where the label has the return type of the thunk:
+// `{lazy a() = e}`
+func LazyLabelValue(label string, thunk *ast.Func) ast.LabelValue {
+	return ast.LabelValue{Label: label, Value: thunk, Lazy: true}
+}
+
 // Empty record: `{}`
 func RecordEmpty() *ast.RecordEmpty {
 	return &ast.RecordEmpty{}
@@ -227,6 +504,16 @@ func Variant(label string, value ast.Expr) *ast.Variant {
 	return &ast.Variant{Label: label, Value: value}
 }
 
+// Tagged (ad-hoc) variant with multiple payloads: `:X(a, b)`
+func VariantN(label string, values ...ast.Expr) *ast.VariantN {
+	return &ast.VariantN{Label: label, Values: values}
+}
+
+// Tagged (ad-hoc) variant with a unit payload: `:X ()`
+func UnitVariant(label string) *ast.Variant {
+	return &ast.Variant{Label: label, Value: UnitLit()}
+}
+
 // Pattern-matching case expression over tagged (ad-hoc) variant-types:
 //
 //  match e {
@@ -243,3 +530,53 @@ func Match(value ast.Expr, cases []ast.MatchCase, defaultCase *ast.MatchCase) *a
 func MatchCase(label string, varName string, value ast.Expr) ast.MatchCase {
 	return ast.MatchCase{Label: label, Var: varName, Value: value}
 }
+
+// Case expression within Match, with a nested variant pattern: `:X (:Y a) -> expr1`
+func NestedMatchCase(label string, nestedLabel string, varName string, value ast.Expr) ast.MatchCase {
+	return ast.MatchCase{Label: label, Nested: &ast.VariantPattern{Label: nestedLabel, Var: varName}, Value: value}
+}
+
+// Tuple-destructuring match: `match e { ((a, b), c) -> expr }`
+func MatchTuple(value ast.Expr, pattern ast.TuplePattern, body ast.Expr) *ast.MatchTuple {
+	return &ast.MatchTuple{Value: value, Pattern: pattern, Body: body}
+}
+
+// Variable within a tuple pattern: `a`
+func PatternVar(varName string) ast.TuplePattern {
+	return ast.TuplePattern{Var: varName}
+}
+
+// Tuple pattern: `(a, b)`
+func TuplePattern(elems ...ast.TuplePattern) ast.TuplePattern {
+	if elems == nil {
+		elems = []ast.TuplePattern{}
+	}
+	return ast.TuplePattern{Elems: elems}
+}
+
+// Record-destructuring match: `match e { {a, b = c | rest} -> expr }`
+func MatchRecord(value ast.Expr, pattern ast.RecordPattern, body ast.Expr) *ast.MatchRecord {
+	return &ast.MatchRecord{Value: value, Pattern: pattern, Body: body}
+}
+
+// Eliminating an empty variant: `absurd e`
+func Absurd(value ast.Expr) *ast.Absurd {
+	return &ast.Absurd{Value: value}
+}
+
+// Comparison: `a < b`
+func Compare(op string, left, right ast.Expr) *ast.Compare {
+	return &ast.Compare{Op: op, Left: left, Right: right}
+}
+
+// Record pattern: `{a, b = c | rest}`
+//
+// If rest is empty, the remaining labels are ignored.
+func RecordPattern(rest string, fields ...ast.FieldPattern) ast.RecordPattern {
+	return ast.RecordPattern{Fields: fields, Rest: rest}
+}
+
+// Field within a record pattern: `b = c`
+func FieldPattern(label string, varName string) ast.FieldPattern {
+	return ast.FieldPattern{Label: label, Var: varName}
+}
@@ -42,7 +42,11 @@ func GeneralizeRefs(t types.Type) types.Type {
 	return typeutil.GeneralizeOpts(types.TopLevel, t, true, false)
 }
 
-// Generalize all unbound type-variables in t, excluding type-variables within mutable reference-types.
+// Generalize all unbound type-variables in t with a binding-level greater than level, including type-variables within
+// mutable reference-types. This is consistent with generalization of let-bindings during inference.
+//
+// Type-variables are converted to generic (quantified) type-variables in place, so t and the returned type share
+// structure. Generic types should be instantiated (see TypeEnv.Instantiate) before unification.
 func GeneralizeAtLevel(level uint, t types.Type) types.Type {
 	return typeutil.GeneralizeOpts(level, t, true, false)
 }
@@ -24,13 +24,20 @@ package poly
 
 import (
 	"errors"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/wdamron/poly/ast"
 	"github.com/wdamron/poly/internal/astutil"
+	"github.com/wdamron/poly/internal/typeutil"
 	"github.com/wdamron/poly/types"
 )
 
 func (ti *InferenceContext) infer(env *TypeEnv, level uint, e ast.Expr) (ret types.Type, err error) {
+	if ti.cacheTypes {
+		return ti.inferCached(env, level, e)
+	}
 	current := env.common.CurrentExpr
 	env.common.CurrentExpr = e
 	ret, err = ti.inferCurrentExpr(env, level)
@@ -38,7 +45,77 @@ func (ti *InferenceContext) infer(env *TypeEnv, level uint, e ast.Expr) (ret typ
 	return
 }
 
+// Cached types of sub-expressions are reused without traversal. Effects of the skipped traversal on let-group
+// numbering are replayed. Types are recorded during annotation, and are cached after inference succeeds if they do not
+// contain type-variables and the sub-expression does not reference variables bound by enclosing expressions.
+func (ti *InferenceContext) inferCached(env *TypeEnv, level uint, e ast.Expr) (types.Type, error) {
+	if cached, ok := ti.typeCache[e]; ok {
+		ti.letGroupCount += cached.groups
+		return cached.t, nil
+	}
+	switch e := e.(type) {
+	case *ast.Hole, *ast.Try:
+		// Holes are reported and try expressions constrain the enclosing function, so they are never skipped:
+		ti.uncached++
+	case *ast.Literal:
+		// Variables bound within literals are not captured, but they are logged so that enclosing sub-expressions which
+		// depend on their bindings are not cached:
+		for _, name := range e.Using {
+			if _, scope := env.scopeLookup(name); scope != nil && scope != ast.PredeclaredScope {
+				ti.captureLog = append(ti.captureLog, capturedVar{name, scope.Expr})
+			}
+		}
+	}
+	groups, uncached, captures := ti.letGroupCount, ti.uncached, len(ti.captureLog)
+	current := env.common.CurrentExpr
+	env.common.CurrentExpr = e
+	t, err := ti.inferCurrentExpr(env, level)
+	env.common.CurrentExpr = current
+	if err == nil && ti.annotate && ti.uncached == uncached && !ti.referencesEnclosingScope(env, captures) {
+		ti.cachePending = append(ti.cachePending, pendingType{e, t, ti.letGroupCount - groups})
+	}
+	return t, err
+}
+
+// Check if any variable referenced since the capture log had length start is bound by an expression which encloses
+// the current expression. Skipping such a sub-expression would also skip the constraints it places on the variable.
+func (ti *InferenceContext) referencesEnclosingScope(env *TypeEnv, start int) bool {
+	stack := env.common.ScopeStack
+	for _, c := range ti.captureLog[start:] {
+		for i := range stack {
+			if stack[i].Expr == c.scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Move pending types without type-variables into the type cache, after inference succeeds.
+func (ti *InferenceContext) commitCache() {
+	for _, p := range ti.cachePending {
+		if !typeutil.IsGround(p.t) {
+			continue
+		}
+		ti.typeCache[p.expr] = cachedType{types.RealType(p.t), p.groups}
+	}
+}
+
 func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret types.Type, err error) {
+	// Report missing (nil) sub-expressions and degenerate (empty) expressions before inferring the current expression:
+	if field := missingSubExpr(env.common.CurrentExpr); field != "" {
+		kind := env.common.CurrentExpr.ExprName()
+		if _, isLiteral := env.common.CurrentExpr.(*ast.Literal); isLiteral {
+			kind = "Literal"
+		}
+		ti.invalid, ti.err = env.common.CurrentExpr, errors.New(kind+" expression is missing "+field)
+		return nil, ti.err
+	}
+	if empty := emptyExpr(env.common.CurrentExpr); empty != "" {
+		kind := env.common.CurrentExpr.ExprName()
+		ti.invalid, ti.err = env.common.CurrentExpr, errors.New(kind+" expression has "+empty)
+		return nil, ti.err
+	}
 	switch e := env.common.CurrentExpr.(type) {
 	case *ast.Literal:
 		var using []types.Type
@@ -48,24 +125,28 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 			for i, name := range e.Using {
 				vt := env.Lookup(name)
 				if vt == nil {
-					return nil, errors.New("Variable " + name + " is not defined")
+					ti.invalid, ti.err = e, errors.New("Variable "+name+" is not defined")
+					return nil, ti.err
 				}
 				using[i] = vt
 			}
 		}
 		// Construct and instantiate the literal with the bound variable types:
-		t, err := e.Construct(env, level, using)
+		scheme, err := e.Construct(env, level, using)
 		if err != nil {
 			ti.invalid, ti.err = e, err
-			return t, err
+			return scheme, err
 		}
-		t = env.common.Instantiate(level, t)
+		t := env.common.Instantiate(level, scheme)
 		if ti.annotate {
 			e.SetType(t)
+			e.SetScheme(scheme)
 		}
 		return t, nil
 
 	case *ast.Var:
+		// Type-class methods are declared as identifiers within the type-environment, so local bindings (which are
+		// assigned within the innermost environment while in scope) shadow methods with the same name:
 		var t types.Type
 		var scope *ast.Scope
 		if ti.annotate {
@@ -77,10 +158,15 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 			ti.invalid, ti.err = e, errors.New("Variable "+e.Name+" is not defined")
 			return nil, ti.err
 		}
-		t = env.common.Instantiate(level, t)
+		if ti.recordInsts {
+			t, ti.lastInst = env.common.InstantiateWithSubst(level, t)
+		} else {
+			t = env.common.Instantiate(level, t)
+		}
 		if ti.annotate {
 			e.SetType(t)
 			e.SetScope(scope)
+			ti.recordCaptures(env, e.Name, scope)
 		}
 		return t, nil
 
@@ -138,15 +224,38 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 			}
 			return t, nil
 		}
+		// Uses of the placeholder are checked by the analysis:
+		if ti.strictPipe {
+			if err := ti.analyze(); err != nil {
+				return nil, err
+			}
+		}
+		if err := ti.checkWeakGeneralization(level, e.As, t, e); err != nil {
+			return nil, err
+		}
 		stashed := env.common.Stash(env, e.As)
 		env.common.EnterScope(e)
 		env.common.PushVarScope(e.As)
-		for _, step := range e.Sequence {
+		last := len(e.Sequence) - 1
+		for i, step := range e.Sequence {
+			if ti.levelHook != nil {
+				ti.levelHook(e.ExprName(), int(level+1), t)
+			}
 			// Reassign the placeholder:
 			env.Assign(e.As, GeneralizeAtLevel(level, t))
-			t, err = ti.infer(env, level, step)
+			// The final step is inferred as the body; each preceding step is inferred as a let-bound value:
+			if i == last {
+				t, err = ti.infer(env, level, step)
+				break
+			}
+			if t, err = ti.infer(env, level+1, step); err != nil {
+				break
+			}
+			if err = ti.checkWeakGeneralization(level, e.As, t, e); err != nil {
+				break
+			}
 		}
-		if ti.annotate && err != nil {
+		if ti.annotate && err == nil {
 			e.SetType(t)
 		}
 		// Restore the parent scope:
@@ -184,13 +293,54 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 				ti.invalid, ti.err = e, err
 				goto RestoreScope
 			}
+			if ti.levelHook != nil {
+				ti.levelHook(e.ExprName(), int(level+1), varType)
+			}
 			GeneralizeAtLevel(level, varType)
+		case *ast.Signature:
+			// Recursive references to functions are instantiated from the signature, allowing polymorphic recursion:
+			isFunc := ast.IsFunc(binding)
+			if isFunc {
+				stashed = env.common.Stash(env, e.Var)
+				env.Assign(e.Var, ti.signatureType(binding))
+			}
+			t, err := ti.infer(env, level+1, binding)
+			if err != nil {
+				if isFunc {
+					goto RestoreScope
+				}
+				env.common.LeaveScope()
+				return nil, err
+			}
+			if ti.levelHook != nil {
+				ti.levelHook(e.ExprName(), int(level+1), t)
+			}
+			if binding.Partial {
+				if err := ti.checkWeakGeneralization(level, e.Var, t, e); err != nil {
+					env.common.LeaveScope()
+					return nil, err
+				}
+				stashed = env.common.Stash(env, e.Var)
+				env.Assign(e.Var, GeneralizeAtLevel(level, t))
+				break
+			}
+			if !isFunc {
+				stashed = env.common.Stash(env, e.Var)
+			}
+			env.Assign(e.Var, ti.signatureType(binding))
 		default:
 			t, err := ti.infer(env, level+1, binding)
 			if err != nil {
 				env.common.LeaveScope()
 				return nil, err
 			}
+			if ti.levelHook != nil {
+				ti.levelHook(e.ExprName(), int(level+1), t)
+			}
+			if err := ti.checkWeakGeneralization(level, e.Var, t, e); err != nil {
+				env.common.LeaveScope()
+				return nil, err
+			}
 			// Begin a new scope:
 			stashed = env.common.Stash(env, e.Var)
 			env.Assign(e.Var, GeneralizeAtLevel(level, t))
@@ -205,11 +355,53 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 		env.common.LeaveScope()
 		return t, ti.err
 
+	case *ast.Fix:
+		// fix : ('a -> 'a) -> 'a
+		//
+		// Inline equivalent to applying fix to e.Func, where the argument of e.Func is bound to the function returned by e.Func:
+		if len(e.Func.ArgNames) != 1 {
+			err := errors.New("Fix expression requires a function with a single argument")
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		if _, isFunc := e.Func.Body.(*ast.Func); !isFunc {
+			err := errors.New("Fix expression requires a function which returns a function")
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		t, err := ti.infer(env, level, e.Func)
+		if err != nil {
+			return nil, err
+		}
+		ft := types.RealType(t).(*types.Arrow)
+		if err := env.common.Unify(ft.Args[0], ft.Return); err != nil {
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		t = types.RealType(ft.Return)
+		if ti.annotate {
+			e.SetType(t)
+		}
+		return t, nil
+
 	case *ast.LetGroup:
 		// Grouped let-bindings are sorted into strongly-connected components, then type-checked in dependency order:
 		env.common.EnterScope(e)
-		t, err := ti.inferLetGroup(env, level, e)
+		t, sccs, err := ti.inferLetGroup(env, level, e, e.Vars, e.Body)
+		env.common.LeaveScope()
+		if err == nil && ti.annotate {
+			e.SetStronglyConnectedComponents(sccs)
+		}
+		return t, err
+
+	case *ast.Where:
+		// Post-bindings are inferred identically to grouped let-bindings:
+		env.common.EnterScope(e)
+		t, sccs, err := ti.inferLetGroup(env, level, e, e.Vars, e.Body)
 		env.common.LeaveScope()
+		if err == nil && ti.annotate {
+			e.SetStronglyConnectedComponents(sccs)
+		}
 		return t, err
 
 	case *ast.Func:
@@ -217,6 +409,9 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 		stashed := 0
 		vars := env.common.VarTracker.NewList(level, len(e.ArgNames))
 		tv, tail := vars.Head(), vars.Tail()
+		if ti.annotate {
+			e.SetCaptures(nil)
+		}
 		// Begin a new scope:
 		env.common.EnterScope(e)
 		for i, name := range e.ArgNames {
@@ -226,7 +421,11 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 			env.common.PushVarScope(name)
 			tv, tail = tail.Head(), tail.Tail()
 		}
+		// Errors propagated by try expressions within the body are tracked for the innermost function:
+		ti.tryErrs = append(ti.tryErrs, tryFrame{level: level})
 		ret, err := ti.infer(env, level, e.Body)
+		errType := ti.tryErrs[len(ti.tryErrs)-1].errType
+		ti.tryErrs = ti.tryErrs[:len(ti.tryErrs)-1]
 		for _, name := range e.ArgNames {
 			env.Remove(name)
 			env.common.PopVarScope(name)
@@ -234,6 +433,13 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 		// Restore the parent scope:
 		env.common.LeaveScope()
 		env.common.Unstash(env, stashed)
+		if err == nil && errType != nil {
+			if err = env.common.Unify(resultType(env.common.VarTracker.New(level), errType), ret); err != nil {
+				err = errors.New("Function containing try expressions must return a variant with labels ok and err, found " +
+					types.TypeString(ret))
+				ti.invalid, ti.err = e, err
+			}
+		}
 		t := &types.Arrow{Args: args, Return: ret}
 		if ti.annotate {
 			e.SetType(t)
@@ -271,6 +477,20 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 		}
 		return ret, nil
 
+	case *ast.Hole:
+		tv := env.common.VarTracker.New(level)
+		if ti.holes == nil {
+			ti.holes = make(map[*ast.Hole]TypedHole)
+		}
+		// Record the identifiers in scope, which may be used to fill the hole:
+		scope := make(map[string]types.Type)
+		env.collectBindings(scope)
+		ti.holes[e] = TypedHole{Type: tv, Env: scope}
+		if ti.annotate {
+			e.SetType(tv)
+		}
+		return tv, nil
+
 	case *ast.RecordEmpty:
 		rt := &types.Record{Row: types.RowEmptyPointer}
 		if ti.annotate {
@@ -282,50 +502,368 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 		// label, rest := fresh(), fresh()
 		// unify({ <label>: label | rest }, record)
 		// -> label
-		label, _, err := ti.splitRecord(env, level, e.Record, e.Label)
+		label, _, err := ti.splitRecord(env, level, e.Record, e.Label, ti.selectMode == RecordSelectStrict)
 		if err != nil {
-			ti.invalid, ti.err = e, err
 			return nil, err
 		}
 		return label, nil
 
+	case *ast.FieldPath:
+		// Inline equivalent to nested record selections:
+		t, err := ti.infer(env, level, e.Record)
+		if err != nil {
+			return nil, err
+		}
+		for i, label := range e.Path {
+			if t, err = ti.selectField(env, level, t, label); err != nil {
+				err = errors.New("Failed to select " + strings.Join(e.Path[:i+1], ".") + ": " + err.Error())
+				ti.invalid, ti.err = e, err
+				return nil, err
+			}
+		}
+		t = types.RealType(t)
+		if ti.annotate {
+			e.SetType(t)
+		}
+		return t, nil
+
+	case *ast.Try:
+		// Inline equivalent to matching the result, returning early from the enclosing function in the err case:
+		//
+		// match result { :ok a -> a | :err e -> return (:err e) }
+		if len(ti.tryErrs) == 0 {
+			err := errors.New("Try expression must be within a function")
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		t, err := ti.infer(env, level, e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		// The error type is shared by all try expressions within the enclosing function, at the function's level:
+		frame := &ti.tryErrs[len(ti.tryErrs)-1]
+		if frame.errType == nil {
+			frame.errType = env.common.VarTracker.New(frame.level)
+		}
+		okType := env.common.VarTracker.New(level)
+		if err := env.common.Unify(resultType(okType, frame.errType), t); err != nil {
+			err = errors.New("Try expression requires a variant with labels ok and err, found " + types.TypeString(t))
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		result := types.RealType(okType)
+		if ti.annotate {
+			e.SetType(result)
+		}
+		return result, nil
+
+	case *ast.EqualityConstraint:
+		// Generic type-variables shared between the equated types are instantiated together:
+		pair := GeneralizeRefs(&types.Arrow{Args: []types.Type{types.Substitute(e.Left, ti.equalities)}, Return: types.Substitute(e.Right, ti.equalities)})
+		inst, subst := env.common.InstantiateWithSubst(level, pair)
+		arrow := inst.(*types.Arrow)
+		if err := env.common.Unify(arrow.Args[0], arrow.Return); err != nil {
+			err = errors.New("Type equality " + types.TypeString(e.Left) + " ~ " + types.TypeString(e.Right) + " does not hold: " + err.Error())
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		// Signatures within the body are checked with the equated generic type-variables substituted:
+		equalities := ti.equalities
+		ti.equalities = equateGenericVars(equalities, subst)
+		t, err := ti.infer(env, level, e.Body)
+		ti.equalities = equalities
+		return t, err
+
+	case *ast.TypeAbstraction:
+		// The body is inferred at a nested level, so rigid type-variables cannot be unified with type-variables from
+		// the enclosing scope without being detected:
+		vars := make([]*types.Var, len(e.Names))
+		scopedVars := ti.scopedVars
+		ti.scopedVars = make(map[string]types.Type, len(scopedVars)+len(e.Names))
+		for name, tv := range scopedVars {
+			ti.scopedVars[name] = tv
+		}
+		for i, name := range e.Names {
+			vars[i] = env.common.VarTracker.New(level + 1)
+			ti.scopedVars[name] = vars[i]
+		}
+		t, err := ti.infer(env, level+1, e.Body)
+		ti.scopedVars = scopedVars
+		if err != nil {
+			return nil, err
+		}
+		if err := ti.checkScopedVars(level, e, vars); err != nil {
+			return nil, err
+		}
+		// Levels of type-variables within the inferred type are adjusted to the current level:
+		retType := env.common.VarTracker.New(level)
+		if err := env.common.Unify(retType, t); err != nil {
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		return retType, nil
+
+	case *ast.WithInstance:
+		inst, err := ti.declareLocalInstance(env, level, e)
+		if err != nil {
+			return nil, err
+		}
+		// The instance is only available while the body is inferred:
+		t, err := ti.infer(env, level, e.Body)
+		e.Class.RemoveInstance(inst)
+		return t, err
+
+	case *ast.Signature:
+		// The value is inferred at a nested level, so type-variables of the signature cannot escape:
+		t, err := ti.infer(env, level+1, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := ti.unifySignature(env, level, e, t)
+		if err != nil {
+			return nil, err
+		}
+		if e.Partial {
+			// Type-variables of a partial signature are flexible, so the inferred type is retained. Levels of
+			// type-variables within the inferred type are adjusted to the current level:
+			retType := env.common.VarTracker.New(level)
+			if err := env.common.Unify(retType, t); err != nil {
+				ti.invalid, ti.err = e, err
+				return nil, err
+			}
+			if ti.annotate {
+				e.SetType(retType)
+			}
+			return retType, nil
+		}
+		if err := ti.checkSignature(level, sig); err != nil {
+			return nil, err
+		}
+		t = env.common.Instantiate(level, ti.signatureType(e))
+		if ti.annotate {
+			e.SetType(t)
+		}
+		return t, nil
+
+	case *ast.OptionChain:
+		// Inline equivalent to inferring a match on the optional record:
+		//
+		// match option { :some r -> :some r.label | :none n -> :none n }
+		t, err := ti.infer(env, level, e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		some, none := env.common.VarTracker.New(level), env.common.VarTracker.New(level)
+		option := &types.Variant{Row: &types.RowExtend{Row: types.RowEmptyPointer,
+			Labels: types.NewFlatTypeMap(map[string]types.Type{"some": some, "none": none})}}
+		if err := env.common.Unify(option, t); err != nil {
+			err = errors.New("Option chain requires a variant with labels some and none, found " + types.TypeString(t))
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		labelType, rowType := env.common.VarTracker.New(level), env.common.VarTracker.New(level)
+		record := &types.Record{Row: &types.RowExtend{Row: rowType, Labels: types.SingletonTypeMap(e.Label, labelType)}}
+		if err := env.common.Unify(record, some); err != nil {
+			err = errors.New("Option chain requires a record with label " + e.Label + " within the some case, found " +
+				types.TypeString(some))
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		result := &types.Variant{Row: &types.RowExtend{Row: types.RowEmptyPointer,
+			Labels: types.NewFlatTypeMap(map[string]types.Type{"some": labelType, "none": none})}}
+		if ti.annotate {
+			e.SetType(result)
+		}
+		return result, nil
+
 	case *ast.RecordRestrict:
 		// label, rest := fresh(), fresh()
 		// unify({ <label>: label | rest }, record)
 		// -> rest
-		_, rest, err := ti.splitRecord(env, level, e.Record, e.Label)
+		_, rest, err := ti.splitRecord(env, level, e.Record, e.Label, false)
 		if err != nil {
-			ti.invalid, ti.err = e, err
 			return nil, err
 		}
 		return rest, nil
 
 	case *ast.RecordExtend:
 		mb := types.NewTypeMapBuilder()
-		for _, label := range e.Labels {
-			t, err := ti.infer(env, level, label.Value)
+		for i, label := range e.Labels {
+			t, err := ti.inferLabelValue(env, level, e, label)
 			if err != nil {
 				return nil, err
 			}
+			// Duplicate labels are rejected, unless the last duplicate label is kept (and extensions are not distinct):
+			if !ti.keepLastLabel || ti.distinctExt {
+				for _, prev := range e.Labels[:i] {
+					if prev.Label == label.Label {
+						err := errors.New("Record extension contains duplicate label " + label.Label)
+						ti.invalid, ti.err = e, err
+						return nil, err
+					}
+				}
+			}
 			mb.Set(label.Label, types.SingletonTypeList(t))
 		}
 		rowType := env.common.VarTracker.New(level)
-		recordType, err := ti.infer(env, level, e.Record)
-		if err != nil {
-			return nil, err
+		// A missing record is equivalent to an empty record:
+		var recordType types.Type = &types.Record{Row: types.RowEmptyPointer}
+		if e.Record != nil {
+			t, err := ti.infer(env, level, e.Record)
+			if err != nil {
+				return nil, err
+			}
+			recordType = t
 		}
 		if err := env.common.Unify(&types.Record{Row: rowType}, recordType); err != nil {
 			ti.invalid, ti.err = e, err
 			return nil, err
 		}
+		if ti.distinctExt {
+			if err := checkDistinctLabels(e, rowType); err != nil {
+				ti.invalid, ti.err = e, err
+				return nil, err
+			}
+		}
 		ext := &types.RowExtend{Row: rowType, Labels: mb.Build()}
 		labels, rest, err := types.FlattenRowType(ext)
 		if err != nil {
 			ti.invalid, ti.err = e, err
 			return nil, err
 		}
+		if err := env.common.CheckRowWidth(labels.Len()); err != nil {
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
 		ext.Labels, ext.Row = labels, rest
 		rt := &types.Record{Row: ext}
+		if ti.annotate {
+			e.SetType(rt)
+			e.SetFieldOrder(fieldOrder(e.Labels))
+		}
+		return rt, nil
+
+	case *ast.RecordUpdate:
+		// Each update is equivalent to restricting then extending the record, where the label must be present:
+		//
+		// {r | a = v} -> {a = v | {r - a}}
+		t, err := ti.infer(env, level, e.Record)
+		if err != nil {
+			return nil, err
+		}
+		for _, label := range e.Labels {
+			rowType := env.common.VarTracker.New(level)
+			record := &types.Record{Row: &types.RowExtend{Row: rowType, Labels: types.SingletonTypeMap(label.Label, env.common.VarTracker.New(level))}}
+			if err := env.common.Unify(record, t); err != nil {
+				err = errors.New("Record update requires label " + label.Label + ": " + err.Error())
+				ti.invalid, ti.err = e, err
+				return nil, err
+			}
+			valueType, err := ti.inferLabelValue(env, level, e, label)
+			if err != nil {
+				return nil, err
+			}
+			t = &types.Record{Row: &types.RowExtend{Row: rowType, Labels: types.SingletonTypeMap(label.Label, valueType)}}
+		}
+		rt, ok := types.RealType(t).(*types.Record)
+		if !ok {
+			// An update without labels only requires a record:
+			rt = &types.Record{Row: env.common.VarTracker.New(level)}
+			if err := env.common.Unify(rt, t); err != nil {
+				ti.invalid, ti.err = e, err
+				return nil, err
+			}
+		}
+		if ti.annotate {
+			e.SetType(rt)
+		}
+		return rt, nil
+
+	case *ast.SizedArrayLit:
+		// Each element must have the same type; the size of the array is the number of elements:
+		elemType := types.Type(env.common.VarTracker.New(level))
+		for _, elem := range e.Elems {
+			t, err := ti.infer(env, level, elem)
+			if err != nil {
+				return nil, err
+			}
+			if err := env.common.Unify(elemType, t); err != nil {
+				ti.invalid, ti.err = e, err
+				return nil, err
+			}
+		}
+		t := &types.App{Const: arrayConst, Params: []types.Type{types.RealType(elemType), types.Size(len(e.Elems))}}
+		if ti.annotate {
+			e.SetType(t)
+		}
+		return t, nil
+
+	case *ast.TupleLit:
+		elems := make([]types.Type, len(e.Elems))
+		for i, elem := range e.Elems {
+			t, err := ti.infer(env, level, elem)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = t
+		}
+		t := &types.Tuple{Elems: elems}
+		if ti.annotate {
+			e.SetType(t)
+		}
+		return t, nil
+
+	case *ast.RecordMerge:
+		// The labels of both records are combined within a single extension of the empty row. Both records must be
+		// closed, since labels which are later unified into the row of an open record could not be checked for overlap:
+		leftLabels, leftRest, err := ti.inferRecordRow(env, level, e, e.Left)
+		if err != nil {
+			return nil, err
+		}
+		rightLabels, rightRest, err := ti.inferRecordRow(env, level, e, e.Right)
+		if err != nil {
+			return nil, err
+		}
+		_, leftClosed := leftRest.(*types.RowEmpty)
+		_, rightClosed := rightRest.(*types.RowEmpty)
+		if !leftClosed || !rightClosed {
+			err := errors.New("Record merge requires closed records")
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		rest := leftRest
+		mb := leftLabels.Builder()
+		var mergeErr error
+		rightLabels.Range(func(label string, ts types.TypeList) bool {
+			defaults, ok := leftLabels.Get(label)
+			switch {
+			case ok && e.Defaults:
+				// Overrides must have the same type as the default value:
+				if err := env.common.Unify(defaults.Get(0), ts.Get(0)); err != nil {
+					mergeErr = errors.New("Override for label " + label + " does not match the type of its default value: " + err.Error())
+					return false
+				}
+			case ok && !ti.rightBiased:
+				// Labels of the right record overwrite labels of the left record, if right-biased merging is enabled:
+				mergeErr = errors.New("Record merge contains overlapping label " + label)
+				return false
+			}
+			mb.Set(label, ts)
+			return true
+		})
+		if mergeErr != nil {
+			ti.invalid, ti.err = e, mergeErr
+			return nil, mergeErr
+		}
+		labels := mb.Build()
+		if err := env.common.CheckRowWidth(labels.Len()); err != nil {
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		rt := &types.Record{Row: rest}
+		if labels.Len() != 0 {
+			rt.Row = &types.RowExtend{Row: rest, Labels: labels}
+		}
 		if ti.annotate {
 			e.SetType(rt)
 		}
@@ -346,8 +884,25 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 		vt := &types.Variant{Row: &types.RowExtend{Row: rowType, Labels: labels}}
 		return vt, nil
 
-	case *ast.Match:
-		// Inline equivalent to inferring a record-select on a record constructed from the cases,
+	case *ast.VariantN:
+		// The payload is a tuple of the values:
+		elems := make([]types.Type, len(e.Values))
+		for i, value := range e.Values {
+			t, err := ti.infer(env, level, value)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = t
+		}
+		labels := types.SingletonTypeMap(e.Label, &types.Tuple{Elems: elems})
+		vt := &types.Variant{Row: &types.RowExtend{Row: env.common.VarTracker.New(level), Labels: labels}}
+		if ti.annotate {
+			e.SetType(vt)
+		}
+		return vt, nil
+
+	case *ast.Match:
+		// Inline equivalent to inferring a record-select on a record constructed from the cases,
 		// where each case is represented as a labeled function from the case's variant-type to the
 		// shared return type for the match expression:
 		//
@@ -382,7 +937,7 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 			return nil, err
 		}
 		env.common.EnterScope(e)
-		casesRow, err := ti.inferCases(env, level, retType, rowType, e, e.Cases)
+		casesRow, retType, err := ti.inferCases(env, level, retType, rowType, e, e.Cases)
 		env.common.LeaveScope()
 		if err != nil {
 			return nil, err
@@ -391,6 +946,164 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 			ti.invalid, ti.err = e, err
 			return nil, err
 		}
+		// The default case is dead if the matched variant is closed and all of its labels are matched by the explicit cases:
+		if _, dead := types.RealType(rowType).(*types.RowEmpty); dead && e.Default != nil && ti.noDeadDefault {
+			err := errors.New("Default case is unreachable; all variant labels are matched")
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		if ti.annotate {
+			e.SetType(retType)
+			e.SetResidual(rowType)
+		}
+		return retType, nil
+
+	case *ast.MatchTuple:
+		// Inline equivalent to unifying the matched value with a (nested) tuple of fresh type-variables,
+		// then inferring the body with each variable in the pattern bound to its element type:
+		matchType, err := ti.infer(env, level, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		vars := e.Pattern.Vars()
+		for i, name := range vars {
+			for _, existing := range vars[:i] {
+				if existing == name {
+					ti.invalid, ti.err = e, errors.New("Found duplicate bindings for "+name+" within tuple pattern")
+					return nil, ti.err
+				}
+			}
+		}
+		patternType, bound := tuplePatternType(env, level, e.Pattern, make([]types.Type, 0, len(vars)))
+		if err := env.common.Unify(patternType, matchType); err != nil {
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		// Begin a new scope:
+		stashed := 0
+		env.common.EnterScope(e)
+		for i, name := range vars {
+			stashed += env.common.Stash(env, name)
+			env.Assign(name, bound[i])
+			env.common.PushVarScope(name)
+		}
+		t, err := ti.infer(env, level, e.Body)
+		for _, name := range vars {
+			env.Remove(name)
+			env.common.PopVarScope(name)
+		}
+		// Restore the parent scope:
+		env.common.Unstash(env, stashed)
+		env.common.LeaveScope()
+		if err != nil {
+			return nil, err
+		}
+		if ti.annotate {
+			e.SetType(t)
+		}
+		return t, nil
+
+	case *ast.MatchRecord:
+		// Inline equivalent to unifying the matched value with a record of fresh type-variables for each label,
+		// extending a fresh row, then inferring the body with each variable in the pattern bound to its label type
+		// and the rest variable bound to a record of the remaining row:
+		matchType, err := ti.infer(env, level, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		vars := e.Pattern.Vars()
+		for i, name := range vars {
+			for _, existing := range vars[:i] {
+				if existing == name {
+					ti.invalid, ti.err = e, errors.New("Found duplicate bindings for "+name+" within record pattern")
+					return nil, ti.err
+				}
+			}
+		}
+		fields := e.Pattern.Fields
+		labels := make(map[string]types.Type, len(fields))
+		bound := make([]types.Type, len(vars))
+		for i, field := range fields {
+			if _, exists := labels[field.Label]; exists {
+				ti.invalid, ti.err = e, errors.New("Found duplicate label "+field.Label+" within record pattern")
+				return nil, ti.err
+			}
+			bound[i] = env.common.VarTracker.New(level)
+			labels[field.Label] = bound[i]
+		}
+		restRow := env.common.VarTracker.New(level)
+		if e.Pattern.Rest != "" {
+			bound[len(fields)] = &types.Record{Row: restRow}
+		}
+		var patternType types.Type = &types.Record{Row: restRow}
+		if len(fields) != 0 {
+			patternType = &types.Record{Row: &types.RowExtend{Row: restRow, Labels: types.NewFlatTypeMap(labels)}}
+		}
+		if err := env.common.Unify(patternType, matchType); err != nil {
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		// Begin a new scope:
+		stashed := 0
+		env.common.EnterScope(e)
+		for i, name := range vars {
+			stashed += env.common.Stash(env, name)
+			env.Assign(name, bound[i])
+			env.common.PushVarScope(name)
+		}
+		t, err := ti.infer(env, level, e.Body)
+		for _, name := range vars {
+			env.Remove(name)
+			env.common.PopVarScope(name)
+		}
+		// Restore the parent scope:
+		env.common.Unstash(env, stashed)
+		env.common.LeaveScope()
+		if err != nil {
+			return nil, err
+		}
+		if ti.annotate {
+			e.SetType(t)
+		}
+		return t, nil
+
+	case *ast.Absurd:
+		// The value is unified with a closed variant with no labels; the result is a fresh type-variable:
+		t, err := ti.infer(env, level, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		if err := env.common.Unify(t, &types.Variant{Row: types.RowEmptyPointer}); err != nil {
+			err = errors.New("Absurd expression requires an empty closed variant, found " + types.TypeString(t))
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		retType := env.common.VarTracker.New(level)
+		if ti.annotate {
+			e.SetType(retType)
+		}
+		return retType, nil
+
+	case *ast.Compare:
+		// Both operands are unified with a shared type-variable, constrained by the comparison type-class:
+		operandType := env.common.VarTracker.New(level)
+		if ti.compareClass != nil {
+			operandType.AddConstraint(types.InstanceConstraint{TypeClass: ti.compareClass})
+		}
+		for _, operand := range [2]ast.Expr{e.Left, e.Right} {
+			t, err := ti.infer(env, level, operand)
+			if err != nil {
+				return nil, err
+			}
+			if err := env.common.Unify(operandType, t); err != nil {
+				ti.invalid, ti.err = e, err
+				return nil, err
+			}
+		}
+		var retType types.Type = ti.compareType
+		if retType == nil {
+			retType = &types.Const{Name: "bool"}
+		}
 		if ti.annotate {
 			e.SetType(retType)
 		}
@@ -408,10 +1121,321 @@ func (ti *InferenceContext) inferCurrentExpr(env *TypeEnv, level uint) (ret type
 	return nil, ti.err
 }
 
+// Record a variable as captured by each function which encloses the variable, up to the scope where the
+// variable is bound. Predeclared (top-level) variables are not captured.
+func (ti *InferenceContext) recordCaptures(env *TypeEnv, name string, scope *ast.Scope) {
+	if scope == nil || scope == ast.PredeclaredScope {
+		return
+	}
+	ti.captureVar(env, name, scope.Expr)
+}
+
+func (ti *InferenceContext) captureVar(env *TypeEnv, name string, scope ast.Expr) {
+	if ti.cacheTypes {
+		ti.captureLog = append(ti.captureLog, capturedVar{name, scope})
+	}
+	stack := env.common.ScopeStack
+	for i := len(stack) - 1; i >= 0 && stack[i].Expr != scope; i-- {
+		fn, ok := stack[i].Expr.(*ast.Func)
+		if !ok {
+			continue
+		}
+		captures, captured := fn.Captures(), false
+		for _, existing := range captures {
+			if existing == name {
+				captured = true
+				break
+			}
+		}
+		if !captured {
+			fn.SetCaptures(append(captures, name))
+		}
+	}
+}
+
+// Describe the empty part of a degenerate expression, or return an empty string if e is not degenerate. Functions
+// without arguments, pipes without steps, and record extensions without labels are not degenerate.
+func emptyExpr(e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.LetGroup:
+		if len(e.Vars) == 0 {
+			return "no bindings"
+		}
+	case *ast.Where:
+		if len(e.Vars) == 0 {
+			return "no bindings"
+		}
+	case *ast.Match:
+		if len(e.Cases) == 0 && e.Default == nil {
+			return "no cases"
+		}
+	case *ast.MatchTuple:
+		if hasEmptyTuplePattern(e.Pattern) {
+			return "an empty tuple pattern"
+		}
+	case *ast.ControlFlow:
+		if len(e.Return.Sequence) == 0 {
+			return "an empty return block"
+		}
+	}
+	return ""
+}
+
+func hasEmptyTuplePattern(p ast.TuplePattern) bool {
+	if !p.IsTuple() {
+		return false
+	}
+	if len(p.Elems) == 0 {
+		return true
+	}
+	for _, elem := range p.Elems {
+		if hasEmptyTuplePattern(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the first missing (nil) sub-expression which is required by e. The name of the missing field will be
+// returned, or an empty string if all required sub-expressions are present.
+func missingSubExpr(e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.Literal:
+		if e.Construct == nil {
+			return "Construct"
+		}
+	case *ast.Deref:
+		if e.Ref == nil {
+			return "Ref"
+		}
+	case *ast.DerefAssign:
+		if e.Ref == nil {
+			return "Ref"
+		}
+		if e.Value == nil {
+			return "Value"
+		}
+	case *ast.ControlFlow:
+		for i, sub := range e.Entry.Sequence {
+			if sub == nil {
+				return "Entry.Sequence[" + strconv.Itoa(i) + "]"
+			}
+		}
+		for i, sub := range e.Return.Sequence {
+			if sub == nil {
+				return "Return.Sequence[" + strconv.Itoa(i) + "]"
+			}
+		}
+		for i, block := range e.Blocks {
+			for j, sub := range block.Sequence {
+				if sub == nil {
+					return "Blocks[" + strconv.Itoa(i) + "].Sequence[" + strconv.Itoa(j) + "]"
+				}
+			}
+		}
+	case *ast.Pipe:
+		if e.Source == nil {
+			return "Source"
+		}
+		for i, step := range e.Sequence {
+			if step == nil {
+				return "Sequence[" + strconv.Itoa(i) + "]"
+			}
+		}
+	case *ast.Call:
+		if e.Func == nil {
+			return "Func"
+		}
+		for i, arg := range e.Args {
+			if arg == nil {
+				return "Args[" + strconv.Itoa(i) + "]"
+			}
+		}
+	case *ast.Func:
+		if e.Body == nil {
+			return "Body"
+		}
+	case *ast.Let:
+		if e.Value == nil {
+			return "Value"
+		}
+		if e.Body == nil {
+			return "Body"
+		}
+	case *ast.LetGroup:
+		return missingBinding(e.Vars, e.Body)
+	case *ast.Where:
+		return missingBinding(e.Vars, e.Body)
+	case *ast.RecordSelect:
+		if e.Record == nil {
+			return "Record"
+		}
+	case *ast.RecordRestrict:
+		if e.Record == nil {
+			return "Record"
+		}
+	case *ast.FieldPath:
+		if e.Record == nil {
+			return "Record"
+		}
+	case *ast.OptionChain:
+		if e.Expr == nil {
+			return "Expr"
+		}
+	case *ast.Try:
+		if e.Expr == nil {
+			return "Expr"
+		}
+	case *ast.Signature:
+		if e.Value == nil {
+			return "Value"
+		}
+	case *ast.EqualityConstraint:
+		if e.Body == nil {
+			return "Body"
+		}
+	case *ast.TypeAbstraction:
+		if e.Body == nil {
+			return "Body"
+		}
+	case *ast.WithInstance:
+		for _, name := range e.MethodNames() {
+			if e.Methods[name] == nil {
+				return "Methods[" + name + "]"
+			}
+		}
+		if e.Body == nil {
+			return "Body"
+		}
+	case *ast.SizedArrayLit:
+		for i, elem := range e.Elems {
+			if elem == nil {
+				return "Elems[" + strconv.Itoa(i) + "]"
+			}
+		}
+	case *ast.TupleLit:
+		for i, elem := range e.Elems {
+			if elem == nil {
+				return "Elems[" + strconv.Itoa(i) + "]"
+			}
+		}
+	case *ast.RecordMerge:
+		if e.Left == nil {
+			return "Left"
+		}
+		if e.Right == nil {
+			return "Right"
+		}
+	case *ast.RecordExtend:
+		for _, label := range e.Labels {
+			if label.Value == nil {
+				return "Labels[" + label.Label + "]"
+			}
+		}
+	case *ast.RecordUpdate:
+		if e.Record == nil {
+			return "Record"
+		}
+		for _, label := range e.Labels {
+			if label.Value == nil {
+				return "Labels[" + label.Label + "]"
+			}
+		}
+	case *ast.Variant:
+		if e.Value == nil {
+			return "Value"
+		}
+	case *ast.VariantN:
+		for i, value := range e.Values {
+			if value == nil {
+				return "Values[" + strconv.Itoa(i) + "]"
+			}
+		}
+	case *ast.Match:
+		if e.Value == nil {
+			return "Value"
+		}
+		for _, c := range e.Cases {
+			if c.Value == nil {
+				return "Cases[" + c.Label + "]"
+			}
+		}
+		if e.Default != nil && e.Default.Value == nil {
+			return "Default"
+		}
+	case *ast.Fix:
+		if e.Func == nil {
+			return "Func"
+		}
+	case *ast.MatchTuple:
+		if e.Value == nil {
+			return "Value"
+		}
+		if e.Body == nil {
+			return "Body"
+		}
+	case *ast.MatchRecord:
+		if e.Value == nil {
+			return "Value"
+		}
+		if e.Body == nil {
+			return "Body"
+		}
+	case *ast.Absurd:
+		if e.Value == nil {
+			return "Value"
+		}
+	case *ast.Compare:
+		if e.Left == nil {
+			return "Left"
+		}
+		if e.Right == nil {
+			return "Right"
+		}
+	}
+	return ""
+}
+
+func missingBinding(vars []ast.LetBinding, body ast.Expr) string {
+	for _, v := range vars {
+		if v.Value == nil {
+			return "Vars[" + v.Var + "]"
+		}
+	}
+	if body == nil {
+		return "Body"
+	}
+	return ""
+}
+
+// row := fresh()
+// unify({ | row }, record)
+// -> flatten(row)
+//
+// The merge expression is marked as invalid if the record does not match.
+func (ti *InferenceContext) inferRecordRow(env *TypeEnv, level uint, merge *ast.RecordMerge, recordExpr ast.Expr) (labels types.TypeMap, rest types.Type, err error) {
+	rowType := env.common.VarTracker.New(level)
+	recordType, err := ti.infer(env, level, recordExpr)
+	if err != nil {
+		return labels, nil, err
+	}
+	if err = env.common.Unify(&types.Record{Row: rowType}, recordType); err == nil {
+		labels, rest, err = types.FlattenRowType(rowType)
+	}
+	if err != nil {
+		ti.invalid, ti.err = merge, err
+		return labels, nil, err
+	}
+	return labels, types.RealType(rest), nil
+}
+
 // label, rest := fresh(), fresh()
 // unify({ <label>: label | rest }, record)
 // -> (label, rest)
-func (ti *InferenceContext) splitRecord(env *TypeEnv, level uint, recordExpr ast.Expr, label string) (labelType types.Type, restType types.Type, err error) {
+//
+// If strict is set, the label must already be present within the record if the record's type is known.
+// The current expression is marked as invalid if the record does not match.
+func (ti *InferenceContext) splitRecord(env *TypeEnv, level uint, recordExpr ast.Expr, label string, strict bool) (labelType types.Type, restType types.Type, err error) {
 	rowType := env.common.VarTracker.New(level)
 	labelType = env.common.VarTracker.New(level)
 	labels := types.SingletonTypeMap(label, labelType)
@@ -421,19 +1445,201 @@ func (ti *InferenceContext) splitRecord(env *TypeEnv, level uint, recordExpr ast
 	if err != nil {
 		return nil, nil, err
 	}
+	if record, ok := types.RealType(recordType).(*types.Record); ok && strict {
+		labels, _, err := types.FlattenRowType(record.Row)
+		if err == nil {
+			if _, ok := labels.Get(label); !ok {
+				err = errors.New("Record does not contain label " + label)
+			}
+		}
+		if err != nil {
+			ti.invalid, ti.err = env.common.CurrentExpr, err
+			return nil, nil, err
+		}
+	}
 	if err = env.common.Unify(paramType, recordType); err != nil {
+		ti.invalid, ti.err = env.common.CurrentExpr, err
 		return nil, nil, err
 	}
 	restType = &types.Record{Row: rowType}
 	return
 }
 
+// Infer the methods of a local type-class instance, then add the instance to its type-class. Each method is inferred
+// as a let-bound value, and must unify with the method of the type-class (or a super-class) for the instance type.
+func (ti *InferenceContext) declareLocalInstance(env *TypeEnv, level uint, e *ast.WithInstance) (*types.Instance, error) {
+	tc := e.Class
+	var err error
+	switch e.Param.(type) {
+	case *types.Const, *types.App, *types.Record, *types.Variant:
+	default:
+		err = errors.New("Type-class instance must be a type constant, type application, record type, or variant type")
+	}
+	if tc == nil {
+		err = errors.New("Local instance requires a type-class")
+	}
+	if err != nil {
+		ti.invalid, ti.err = e, err
+		return nil, err
+	}
+	param := GeneralizeRefs(e.Param)
+	// prevent overlapping instances:
+	var conflict *types.Instance
+	tc.FindInstanceFromRoots(func(inst *types.Instance) bool {
+		if !env.common.CanUnify(env.common.Instantiate(level, param), env.common.Instantiate(level, inst.Param)) {
+			return false
+		}
+		if inst.TypeClass.HasSuperClass(tc) || tc.HasSuperClass(inst.TypeClass) {
+			return false
+		}
+		conflict = inst
+		return true
+	})
+	if conflict != nil {
+		err = errors.New("Found overlapping instance for type-class " + tc.Name + " at " + conflict.TypeClass.Name + " instance " + types.TypeString(conflict.Param))
+		ti.invalid, ti.err = e, err
+		return nil, err
+	}
+	// Methods of the type-class and its super-classes, each paired with the type-parameter of its type-class:
+	defs := make(map[string]*types.Arrow)
+	var collect func(c *types.TypeClass)
+	collect = func(c *types.TypeClass) {
+		for name, def := range c.Methods {
+			if _, ok := defs[name]; !ok {
+				defs[name] = GeneralizeRefs(&types.Arrow{Args: []types.Type{c.Param}, Return: def}).(*types.Arrow)
+			}
+		}
+		for _, super := range c.Super {
+			collect(super)
+		}
+	}
+	collect(tc)
+	for _, name := range e.MethodNames() {
+		if _, ok := defs[name]; !ok {
+			err = errors.New("Type-class " + tc.Name + " does not declare method " + name)
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	impls := make(types.MethodSet, len(defs))
+	for _, name := range names {
+		value, ok := e.Methods[name]
+		if !ok {
+			err = methodErr(tc, e.Param, name)
+			ti.invalid, ti.err = e, err
+			return nil, err
+		}
+		t, err := ti.infer(env, level+1, value)
+		if err != nil {
+			return nil, err
+		}
+		// Instantiate the method with the instance type as the type-parameter, without the type-class constraint:
+		pair := env.common.Instantiate(level+1, defs[name]).(*types.Arrow)
+		if tv, ok := pair.Args[0].(*types.Var); ok {
+			tv.SetConstraints(nil)
+		}
+		err = env.common.Unify(pair.Args[0], env.common.Instantiate(level+1, param))
+		if err == nil {
+			err = env.common.Unify(pair.Return, t)
+		}
+		arrow, ok := types.RealType(t).(*types.Arrow)
+		if err != nil || !ok {
+			err = methodErr(tc, e.Param, name)
+			ti.invalid, ti.err = value, err
+			return nil, err
+		}
+		impls[name] = GeneralizeAtLevel(level, arrow).(*types.Arrow)
+	}
+	return tc.AddInstance(param, impls, nil), nil
+}
+
+// Select the type of label within the record-type t. In strict mode, the label must be present within the known labels of t.
+func (ti *InferenceContext) selectField(env *TypeEnv, level uint, t types.Type, label string) (types.Type, error) {
+	if record, ok := types.RealType(t).(*types.Record); ok && ti.selectMode == RecordSelectStrict {
+		labels, _, err := types.FlattenRowType(record.Row)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := labels.Get(label); !ok {
+			return nil, errors.New("Record does not contain label " + label)
+		}
+	}
+	labelType := env.common.VarTracker.New(level)
+	record := &types.Record{Row: &types.RowExtend{Row: env.common.VarTracker.New(level), Labels: types.SingletonTypeMap(label, labelType)}}
+	if err := env.common.Unify(record, t); err != nil {
+		return nil, err
+	}
+	return labelType, nil
+}
+
+// Infer the type of a labeled value within a record extension or update. The type of a lazy label is the return type
+// of its thunk.
+func (ti *InferenceContext) inferLabelValue(env *TypeEnv, level uint, e ast.Expr, label ast.LabelValue) (types.Type, error) {
+	if !label.Lazy {
+		return ti.infer(env, level, label.Value)
+	}
+	if fn, ok := label.Value.(*ast.Func); !ok || len(fn.ArgNames) != 0 {
+		err := errors.New("Lazy label " + label.Label + " requires a function with no arguments")
+		ti.invalid, ti.err = e, err
+		return nil, err
+	}
+	t, err := ti.infer(env, level, label.Value)
+	if err != nil {
+		return nil, err
+	}
+	return types.RealType(t).(*types.Arrow).Return, nil
+}
+
+// Get the distinct labels of a record extension, in order of first appearance.
+func fieldOrder(labels []ast.LabelValue) []string {
+	order := make([]string, 0, len(labels))
+	for i, label := range labels {
+		repeated := false
+		for _, prev := range labels[:i] {
+			if prev.Label == label.Label {
+				repeated = true
+				break
+			}
+		}
+		if !repeated {
+			order = append(order, label.Label)
+		}
+	}
+	return order
+}
+
+// Ensure the labels of a record extension are not already present in the known labels of the extended row.
+func checkDistinctLabels(e *ast.RecordExtend, row types.Type) error {
+	existing, _, err := types.FlattenRowType(row)
+	if err != nil {
+		return err
+	}
+	for _, label := range e.Labels {
+		if _, ok := existing.Get(label.Label); ok {
+			return errors.New("Record already contains label " + label.Label)
+		}
+	}
+	return nil
+}
+
 // If t is an unbound type-variable, instantiate a function with unbound type-variables for its arguments and return value;
 // otherwise, ensure t has the correct argument count.
+//
+// If tupled calls are enabled, a function with a single tuple argument may be matched against multiple arguments.
 func (ti *InferenceContext) matchFuncType(env *TypeEnv, argc int, t types.Type) (*types.Arrow, error) {
 	switch t := t.(type) {
 	case *types.Arrow:
 		if len(t.Args) != argc {
+			if ti.tupleCalls && len(t.Args) == 1 {
+				if tuple, ok := types.RealType(t.Args[0]).(*types.Tuple); ok && len(tuple.Elems) == argc {
+					return &types.Arrow{Args: tuple.Elems, Return: t.Return, Method: t.Method, Source: t.Source, Flags: t.Flags}, nil
+				}
+			}
 			return t, errors.New("Unexpected number of arguments for applied function")
 		}
 		return t, nil
@@ -461,6 +1667,20 @@ func (ti *InferenceContext) matchFuncType(env *TypeEnv, argc int, t types.Type)
 	return nil, errors.New("Unexpected type " + t.TypeName() + " for applied function")
 }
 
+// Create a (nested) tuple type with fresh type-variables for each variable within a tuple pattern.
+// The type-variables are appended to bound in positional order.
+func tuplePatternType(env *TypeEnv, level uint, p ast.TuplePattern, bound []types.Type) (types.Type, []types.Type) {
+	if !p.IsTuple() {
+		tv := env.common.VarTracker.New(level)
+		return tv, append(bound, tv)
+	}
+	elems := make([]types.Type, len(p.Elems))
+	for i, elem := range p.Elems {
+		elems[i], bound = tuplePatternType(env, level, elem, bound)
+	}
+	return &types.Tuple{Elems: elems}, bound
+}
+
 // https://github.com/tomprimozic/type-systems/blob/master/extensible_rows2/infer.ml#L287
 //
 // infer_cases env level return_ty rest_row_ty cases = match cases with
@@ -470,79 +1690,376 @@ func (ti *InferenceContext) matchFuncType(env *TypeEnv, argc int, t types.Type)
 // 			unify return_ty (infer (Env.extend env var_name variant_ty) level expr) ;
 // 			let other_cases_row = infer_cases env level return_ty rest_row_ty other_cases in
 // 			TRowExtend(LabelMap.singleton label [variant_ty], other_cases_row)
-func (ti *InferenceContext) inferCases(env *TypeEnv, level uint, retType, rowType types.Type, e *ast.Match, cases []ast.MatchCase) (types.Type, error) {
+func (ti *InferenceContext) inferCases(env *TypeEnv, level uint, retType, rowType types.Type, e *ast.Match, cases []ast.MatchCase) (types.Type, types.Type, error) {
+	// Cases with nested patterns share a closed variant-type for the payload of their outer label:
+	var nested map[string]*types.Variant
+	for i := range cases {
+		if cases[i].Nested != nil {
+			if nested == nil {
+				nested = make(map[string]*types.Variant)
+			}
+			nested[cases[i].Label] = &types.Variant{Row: types.RowEmptyPointer}
+		}
+	}
+	for i := range cases {
+		if _, ok := nested[cases[i].Label]; ok && cases[i].Nested == nil {
+			err := errors.New("Match cases for label " + cases[i].Label + " mix nested and unnested patterns")
+			ti.invalid, ti.err = e, err
+			return nil, nil, err
+		}
+	}
 	// Each case extends an existing record formed from all subsequent cases.
 	// Visit cases in reverse order, accumulating labels and value types into the record as row-extensions.
 	extensions := make([]types.RowExtend, len(cases))
 	vars := env.common.VarTracker.NewList(level, len(cases))
-	tv, tail := vars.Head(), vars.Tail()
+	tv, tail, consumed := vars.Head(), vars.Tail(), 0
 	for i := len(cases) - 1; i >= 0; i-- {
-		c := cases[i]
+		c := &cases[i]
+		name := c.BoundVar()
 		// Infer the return expression for the case with the variable-name temporarily bound in the environment:
 		variantType := tv
 		// Begin a new scope:
-		stashed := env.common.Stash(env, c.Var)
-		env.Assign(c.Var, variantType)
-		env.common.PushVarScope(c.Var)
-		c.SetVariantType(variantType)
+		stashed := env.common.Stash(env, name)
+		env.Assign(name, variantType)
+		env.common.PushVarScope(name)
+		if c.Nested != nil {
+			c.Nested.SetVariantType(variantType)
+		} else {
+			c.SetVariantType(variantType)
+		}
 		t, err := ti.infer(env, level, c.Value)
-		env.Remove(c.Var)
-		env.common.PopVarScope(c.Var)
+		env.Remove(name)
+		env.common.PopVarScope(name)
 		// Restore the parent scope:
 		env.common.Unstash(env, stashed)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		// Ensure all cases have matching return types:
-		if err := env.common.Unify(retType, t); err != nil {
-			return nil, err
+		if retType, err = ti.joinBranches(env, retType, t); err != nil {
+			ti.invalid, ti.err = c.Value, err
+			return nil, nil, err
+		}
+		tv, tail, consumed = tail.Head(), tail.Tail(), consumed+1
+		if c.Nested != nil {
+			// Extend the payload of the outer label, which is added to the accumulated record only once:
+			payload := nested[c.Label]
+			first := payload.Row == types.RowEmptyPointer
+			payload.Row = &types.RowExtend{Row: payload.Row, Labels: types.SingletonTypeMap(c.Nested.Label, variantType)}
+			if !first {
+				continue
+			}
+			c.SetVariantType(payload)
+			extensions[i].Row, extensions[i].Labels = rowType, types.SingletonTypeMap(c.Label, payload)
+			rowType = &extensions[i]
+			continue
 		}
 		// Extend the accumulated record:
 		extensions[i].Row, extensions[i].Labels = rowType, types.SingletonTypeMap(c.Label, variantType)
 		rowType = &extensions[i]
-		tv, tail = tail.Head(), tail.Tail()
 	}
+	ti.checkVarsConsumed("inferCases", vars, consumed)
 	// Return the accumulated record which maps each variant label to its associated type(s):
-	return rowType, nil
+	return rowType, retType, nil
 }
 
-// Grouped let-bindings are sorted into strongly-connected components, then type-checked in dependency order.
-func (ti *InferenceContext) inferLetGroup(env *TypeEnv, level uint, e *ast.LetGroup) (ret types.Type, err error) {
-	if !ti.analyzed {
-		if ti.analysis == nil {
-			ti.analysis = new(astutil.Analysis)
-			ti.analysis.Init()
+// Panic if the number of type-variables consumed from vars does not match the number allocated. Checks are only
+// performed when debugging is enabled.
+func (ti *InferenceContext) checkVarsConsumed(site string, vars typeutil.VarList, consumed int) {
+	if !ti.debug || consumed == vars.Len() {
+		return
+	}
+	panic("poly: " + site + " consumed " + strconv.Itoa(consumed) + " of " + strconv.Itoa(vars.Len()) + " allocated type-variables")
+}
+
+// Combine the return type of a branch with the return type of previous branches. If the branch mode is
+// RecordBranchIntersect and both types are closed records, a closed record of the shared labels is returned.
+// Otherwise, the types are unified.
+func (ti *InferenceContext) joinBranches(env *TypeEnv, retType, t types.Type) (types.Type, error) {
+	if ti.branchMode == RecordBranchIntersect {
+		if a, b := closedRecordLabels(retType), closedRecordLabels(t); a != nil && b != nil {
+			mb := types.NewTypeMapBuilder()
+			var err error
+			a.Range(func(label string, ts types.TypeList) bool {
+				other, ok := b.Get(label)
+				if !ok || other.Len() != ts.Len() {
+					return true
+				}
+				ts.Range(func(i int, t types.Type) bool {
+					err = env.common.Unify(t, other.Get(i))
+					return err == nil
+				})
+				mb.Set(label, ts)
+				return err == nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			shared := mb.Build()
+			if shared.Len() == 0 {
+				return &types.Record{Row: types.RowEmptyPointer}, nil
+			}
+			return &types.Record{Row: &types.RowExtend{Row: types.RowEmptyPointer, Labels: shared}}, nil
 		}
-		if err := ti.analysis.Analyze(ti.rootExpr); err != nil {
-			ti.invalid, ti.err, ti.analysis.Invalid = ti.analysis.Invalid, err, nil
-			return nil, err
+	}
+	if err := env.common.Unify(retType, t); err != nil {
+		return nil, err
+	}
+	return retType, nil
+}
+
+// Type constant for fixed-size arrays: `array['a, N]`
+var arrayConst = &types.Const{Name: "array"}
+
+// Type of a sub-expression within the type cache. The number of let-groups within the sub-expression is replayed
+// when the cached type is reused.
+type cachedType struct {
+	t      types.Type
+	groups int
+}
+
+// Type of a sub-expression recorded during annotation, which will be cached if inference succeeds.
+type pendingType struct {
+	expr   ast.Expr
+	t      types.Type
+	groups int
+}
+
+// Variable referenced within a sub-expression, with the expression where the variable is bound.
+type capturedVar struct {
+	name  string
+	scope ast.Expr
+}
+
+// Try expressions within a function share an error type, created at the function's level.
+type tryFrame struct {
+	errType types.Type
+	level   uint
+}
+
+// Create a closed result-type: `[ok : 'a, err : 'e]`
+func resultType(ok, err types.Type) *types.Variant {
+	return &types.Variant{Row: &types.RowExtend{Row: types.RowEmptyPointer,
+		Labels: types.NewFlatTypeMap(map[string]types.Type{"ok": ok, "err": err})}}
+}
+
+// Get the generalized type of an explicit signature, substituting generic type-variables which are equated by
+// enclosing type equalities and scoped type constants which are bound by enclosing type-abstractions.
+func (ti *InferenceContext) signatureType(e *ast.Signature) types.Type {
+	return types.SubstituteScoped(GeneralizeRefs(types.Substitute(e.Sig, ti.equalities)), ti.scopedVars)
+}
+
+// Ensure all scoped type constants within the signature of e are bound by enclosing type-abstractions.
+func (ti *InferenceContext) checkScopedNames(e *ast.Signature) error {
+	for _, name := range types.ScopedConstNames(e.Sig) {
+		if _, ok := ti.scopedVars[name]; !ok {
+			err := errors.New("Type-variable " + name + " within signature " + types.TypeString(e.Sig) + " is not in scope")
+			ti.invalid, ti.err = e, err
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that the rigid type-variables bound by a type-abstraction remain distinct, unbound, unconstrained, and local
+// to the abstraction.
+func (ti *InferenceContext) checkScopedVars(level uint, e *ast.TypeAbstraction, vars []*types.Var) error {
+	seen := make(map[*types.Var]bool, len(vars))
+	for i, v := range vars {
+		tv, ok := types.RealType(v).(*types.Var)
+		if !ok || !tv.IsUnboundVar() || seen[tv] || tv.LevelNum() <= level || len(tv.Constraints()) != 0 {
+			err := errors.New("Scoped type-variable " + e.Names[i] + " is not rigid within its scope, found " + types.TypeString(v))
+			ti.invalid, ti.err = e, err
+			return err
 		}
-		ti.analyzed = true
+		seen[tv] = true
+	}
+	return nil
+}
+
+// Extend the substitution for enclosing type equalities with the generic type-variables of a type equality, given
+// the instance of each generic type-variable after the equated types were unified. Generic type-variables whose
+// instances were linked together are replaced by the generic type-variable with the least id.
+func equateGenericVars(equalities map[uint]types.Type, inst map[uint]*types.Var) map[uint]types.Type {
+	ids := make([]uint, 0, len(inst))
+	for id := range inst {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	generic := make(map[uint]types.Type, len(ids))
+	for _, id := range ids {
+		if tv, ok := types.RealType(inst[id]).(*types.Var); ok && tv.IsUnboundVar() {
+			if _, ok := generic[tv.Id()]; !ok {
+				gv := types.NewGenericVar(id)
+				gv.SetConstraints(tv.Constraints())
+				generic[tv.Id()] = gv
+			}
+		}
+	}
+	next := make(map[uint]types.Type, len(equalities)+len(ids))
+	for id, t := range equalities {
+		next[id] = t
+	}
+	for _, id := range ids {
+		t := types.Substitute(inst[id], generic)
+		if gv, ok := t.(*types.Var); ok && gv.Id() == id {
+			continue
+		}
+		next[id] = t
+	}
+	return next
+}
+
+// Instantiated explicit signature, which is checked after unification with the inferred type of its value.
+type signatureInst struct {
+	expr        *ast.Signature
+	inferred    types.Type
+	vars        []*types.Var // rigid type-variables, sorted by the ids of generic type-variables within the signature
+	constraints []int        // number of declared constraints for each rigid type-variable
+}
+
+// Unify the inferred type of a value with an instance of its explicit signature.
+func (ti *InferenceContext) unifySignature(env *TypeEnv, level uint, e *ast.Signature, t types.Type) (signatureInst, error) {
+	if err := ti.checkScopedNames(e); err != nil {
+		return signatureInst{}, err
+	}
+	inst, subst := env.common.InstantiateWithSubst(level+1, ti.signatureType(e))
+	ids := make([]uint, 0, len(subst))
+	for id := range subst {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	sig := signatureInst{expr: e, inferred: t, vars: make([]*types.Var, len(ids)), constraints: make([]int, len(ids))}
+	for i, id := range ids {
+		sig.vars[i], sig.constraints[i] = subst[id], len(subst[id].Constraints())
+	}
+	if err := env.common.Unify(inst, t); err != nil {
+		err = errors.New("Signature " + types.TypeString(e.Sig) + " does not match the inferred type " + types.TypeString(t) + ": " + err.Error())
+		ti.invalid, ti.err = e, err
+		return sig, err
+	}
+	if ti.annotate {
+		e.SetType(inst)
+	}
+	return sig, nil
+}
+
+// Check that the rigid type-variables of an instantiated signature remain distinct, unbound, unconstrained beyond
+// their declared constraints, and local to the binding level; otherwise the signature is more general than the
+// inferred type of its value.
+func (ti *InferenceContext) checkSignature(level uint, sig signatureInst) error {
+	seen := make(map[*types.Var]bool, len(sig.vars))
+	for i, v := range sig.vars {
+		tv, ok := types.RealType(v).(*types.Var)
+		if !ok || !tv.IsUnboundVar() || seen[tv] || tv.LevelNum() <= level || len(tv.Constraints()) > sig.constraints[i] {
+			err := errors.New("Signature " + types.TypeString(sig.expr.Sig) + " is more general than the inferred type " + types.TypeString(sig.inferred))
+			ti.invalid, ti.err = sig.expr, err
+			return err
+		}
+		seen[tv] = true
+	}
+	return nil
+}
+
+// Get the labels of a closed record, or nil if t is not a closed record.
+func closedRecordLabels(t types.Type) *types.TypeMap {
+	record, ok := types.RealType(t).(*types.Record)
+	if !ok {
+		return nil
+	}
+	labels, rest, err := types.FlattenRowType(record.Row)
+	if err != nil {
+		return nil
+	}
+	if _, closed := types.RealType(rest).(*types.RowEmpty); !closed {
+		return nil
+	}
+	return &labels
+}
+
+// Analyze the root expression, if it has not been analyzed since the context was reset.
+func (ti *InferenceContext) analyze() error {
+	if ti.analyzed {
+		return nil
+	}
+	if ti.analysis == nil {
+		ti.analysis = new(astutil.Analysis)
+		ti.analysis.Init()
 	}
-	for _, v := range e.Vars {
+	ti.analysis.TrackUnused, ti.analysis.StrictPipes = ti.warnUnused, ti.strictPipe
+	if ti.timing {
+		ti.timer.Enter(typeutil.PhaseAnalysis)
+	}
+	// The analysis must be reset before the next inference, even if it fails:
+	err := ti.analysis.Analyze(ti.rootExpr)
+	if ti.timing {
+		ti.timer.Leave()
+	}
+	ti.analyzed = true
+	if err != nil {
+		ti.invalid, ti.err, ti.analysis.Invalid = ti.analysis.Invalid, err, nil
+		return err
+	}
+	return nil
+}
+
+// Grouped let-bindings are sorted into strongly-connected components, then type-checked in dependency order.
+//
+// If annotation is enabled, the strongly connected components are returned in dependency order.
+func (ti *InferenceContext) inferLetGroup(env *TypeEnv, level uint, e ast.Expr, bindings []ast.LetBinding, body ast.Expr) (ret types.Type, sccBindings [][]ast.LetBinding, err error) {
+	if err := ti.analyze(); err != nil {
+		return nil, nil, err
+	}
+	for _, v := range bindings {
 		env.common.PushVarScope(v.Var)
 	}
 	stashed, sccs := 0, ti.analysis.SCC[ti.letGroupCount]
 	ti.letGroupCount++
+	var schemes map[string]types.Type
+	if ti.annotate {
+		schemes = make(map[string]types.Type, len(bindings))
+	}
 	// Grouped let-bindings are sorted into strongly-connected components, then type-checked in dependency order:
 	for _, scc := range sccs {
 		// Add fresh type-variables for bindings:
 		vars := env.common.VarTracker.NewList(level+1, len(scc))
-		tv, tail := vars.Head(), vars.Tail()
+		tv, tail, consumed := vars.Head(), vars.Tail(), 0
 		// Begin a new scope:
 		for _, bindNum := range scc {
-			v := e.Vars[bindNum]
+			v := bindings[bindNum]
 			stashed += env.common.Stash(env, v.Var)
-			env.Assign(v.Var, tv)
-			tv, tail = tail.Head(), tail.Tail()
+			// Recursive references to functions with signatures are instantiated from the signature:
+			if sig, ok := v.Value.(*ast.Signature); ok && ast.IsFunc(sig) {
+				env.Assign(v.Var, ti.signatureType(sig))
+			} else {
+				env.Assign(v.Var, tv)
+			}
+			tv, tail, consumed = tail.Head(), tail.Tail(), consumed+1
 		}
+		ti.checkVarsConsumed("inferLetGroup", vars, consumed)
 		// Infer types:
-		tv, tail = vars.Head(), vars.Tail()
+		var sigs []signatureInst
+		tv, tail, consumed = vars.Head(), vars.Tail(), 0
 		for _, bindNum := range scc {
-			v := e.Vars[bindNum]
+			v := bindings[bindNum]
+			// Signatures are checked after the component has been inferred, since later bindings may constrain
+			// the type-variables of earlier signatures:
+			if sig, ok := v.Value.(*ast.Signature); ok && ast.IsFunc(sig) {
+				t, err := ti.infer(env, level+1, sig.Value)
+				if err != nil {
+					return nil, nil, ti.cycleError(scc, v, err)
+				}
+				inst, err := ti.unifySignature(env, level, sig, t)
+				if err != nil {
+					return nil, nil, ti.cycleError(scc, v, err)
+				}
+				sigs = append(sigs, inst)
+				tv, tail, consumed = tail.Head(), tail.Tail(), consumed+1
+				continue
+			}
 			var isFunc bool
 			// To prevent self-references within non-function types, stash/remove the type-variable:
-			if _, isFunc = v.Value.(*ast.Func); !isFunc {
+			if isFunc = ast.IsFunc(v.Value); !isFunc {
 				exists := false
 				for i := 0; i < stashed; i++ {
 					existing := env.common.EnvStash[len(env.common.EnvStash)-(1+i)]
@@ -558,46 +2075,92 @@ func (ti *InferenceContext) inferLetGroup(env *TypeEnv, level uint, e *ast.LetGr
 			}
 			t, err := ti.infer(env, level+1, v.Value)
 			if err != nil {
-				return nil, err
+				return nil, nil, ti.cycleError(scc, v, err)
 			}
 			if err := env.common.Unify(tv, t); err != nil {
-				ti.invalid, ti.err = e, err
-				return nil, err
+				ti.invalid = v.Value
+				return nil, nil, ti.cycleError(scc, v, err)
 			}
 			// Restore the previously stashed/removed type-variable:
 			if !isFunc {
 				env.Assign(v.Var, tv)
 			}
-			tv, tail = tail.Head(), tail.Tail()
+			tv, tail, consumed = tail.Head(), tail.Tail(), consumed+1
+		}
+		ti.checkVarsConsumed("inferLetGroup", vars, consumed)
+		for _, sig := range sigs {
+			if err := ti.checkSignature(level, sig); err != nil {
+				return nil, nil, err
+			}
 		}
 		// Generalize types:
 		tv, tail = vars.Head(), vars.Tail()
 		for _, bindNum := range scc {
-			v := e.Vars[bindNum]
-			env.Assign(v.Var, GeneralizeAtLevel(level, tv))
+			v := bindings[bindNum]
+			if ti.levelHook != nil {
+				ti.levelHook(e.ExprName(), int(level+1), tv)
+			}
+			var scheme types.Type
+			if sig, ok := v.Value.(*ast.Signature); ok && ast.IsFunc(sig) {
+				scheme = ti.signatureType(sig)
+			} else {
+				if !ast.IsFunc(v.Value) {
+					if err := ti.checkWeakGeneralization(level, v.Var, tv, v.Value); err != nil {
+						return nil, nil, err
+					}
+				}
+				scheme = GeneralizeAtLevel(level, tv)
+			}
+			env.Assign(v.Var, scheme)
+			if schemes != nil {
+				schemes[v.Var] = scheme
+			}
 			tv, tail = tail.Head(), tail.Tail()
 		}
 	}
 
-	t, err := ti.infer(env, level, e.Body)
+	t, err := ti.infer(env, level, body)
 	// Restore the parent scope:
-	for _, v := range e.Vars {
+	for _, v := range bindings {
 		env.Remove(v.Var)
 		env.common.PopVarScope(v.Var)
 	}
 	env.common.Unstash(env, stashed)
 	if err == nil && ti.annotate {
-		sccBindings := make([][]ast.LetBinding, len(sccs))
+		sccBindings = make([][]ast.LetBinding, len(sccs))
 		for i, scc := range sccs {
 			cycle := make([]ast.LetBinding, len(scc))
 			for j, binding := range scc {
-				cycle[j] = e.Vars[binding]
+				cycle[j] = bindings[binding]
 			}
 			sccBindings[i] = cycle
 		}
-		e.SetStronglyConnectedComponents(sccBindings)
+		if group, ok := e.(*ast.LetGroup); ok {
+			group.SetSchemes(schemes)
+		}
 	}
-	return t, err
+	return t, sccBindings, err
+}
+
+// If generalization of weak type-variables is disallowed, check that t does not contain weak type-variables which
+// would be generalized at level.
+func (ti *InferenceContext) checkWeakGeneralization(level uint, name string, t types.Type, e ast.Expr) error {
+	if !ti.noWeakGen || typeutil.FindGeneralizableWeakVar(level, t) == nil {
+		return nil
+	}
+	err := errors.New("Weakly-polymorphic binding " + name + " may not be generalized")
+	ti.invalid, ti.err = e, err
+	return err
+}
+
+// Errors within mutually recursive bindings name the binding which failed to type-check, since the failure may
+// only be detected after the binding has been used by other bindings within the cycle.
+func (ti *InferenceContext) cycleError(scc []int, v ast.LetBinding, err error) error {
+	if len(scc) > 1 {
+		err = errors.New("Mutually recursive binding " + v.Var + " within let-group failed to type-check: " + err.Error())
+	}
+	ti.err = err
+	return err
 }
 
 // Loops are detected through SCC analysis and inferred as recursive functions. Blocks are inferred in dependency order.
@@ -606,7 +2169,7 @@ func (ti *InferenceContext) inferControlFlow(env *TypeEnv, level uint, e *ast.Co
 	stashed := 0
 	refs := make([]*types.App, len(e.Locals))
 	vars := env.common.VarTracker.NewList(level, len(e.Locals))
-	tv, tail := vars.Head(), vars.Tail()
+	tv, tail, consumed := vars.Head(), vars.Tail(), 0
 	for i, name := range e.Locals {
 		stashed += env.common.Stash(env, name)
 		tv.SetWeak()
@@ -614,8 +2177,9 @@ func (ti *InferenceContext) inferControlFlow(env *TypeEnv, level uint, e *ast.Co
 		env.Assign(name, ref)
 		env.common.PushVarScope(name)
 		refs[i] = ref
-		tv, tail = tail.Head(), tail.Tail()
+		tv, tail, consumed = tail.Head(), tail.Tail(), consumed+1
 	}
+	ti.checkVarsConsumed("inferControlFlow", vars, consumed)
 	// Loops are detected through SCC analysis and inferred as recursive functions. Ensure all blocks and
 	// cycles in the strongly connected components for e reach the return block, directly or transitively:
 	sccs, err := e.Validate(ti.annotate)
@@ -624,6 +2188,24 @@ func (ti *InferenceContext) inferControlFlow(env *TypeEnv, level uint, e *ast.Co
 		return nil, err
 	}
 	var tmpRefs []*types.App
+	// All return points must have matching result types:
+	retBlock := ast.ControlFlowReturnIndex
+	joinReturn := func(block ast.Block, t types.Type) error {
+		if ti.annotate {
+			e.SetReturnPointType(block.Index, t)
+		}
+		if ret == nil {
+			ret, retBlock = t, block.Index
+			return nil
+		}
+		if err := env.common.Unify(ret, t); err != nil {
+			err = errors.New("Mismatched result types for return points " + ast.BlockLabel(retBlock) + " and " +
+				ast.BlockLabel(block.Index) + ": " + err.Error())
+			ti.invalid, ti.err = e, err
+			return err
+		}
+		return nil
+	}
 	// Blocks will be inferred in dependency order:
 	for _, cycle := range sccs {
 		// A component with a single block which doesn't jump to itself is not a cycle or part of a cycle:
@@ -634,11 +2216,10 @@ func (ti *InferenceContext) inferControlFlow(env *TypeEnv, level uint, e *ast.Co
 				if err != nil {
 					return nil, err
 				}
-				// The last expression within the return block determines the return type:
-				if block.IsReturn() && i == len(block.Sequence)-1 {
-					ret = t
-					if ti.annotate {
-						e.SetType(t)
+				// The last expression within each return point determines the return type:
+				if i == len(block.Sequence)-1 && e.IsReturnPoint(block) {
+					if err := joinReturn(block, t); err != nil {
+						return nil, err
 					}
 				}
 			}
@@ -652,20 +2233,27 @@ func (ti *InferenceContext) inferControlFlow(env *TypeEnv, level uint, e *ast.Co
 			tmpRefs = make([]*types.App, len(e.Locals))
 		}
 		vars := env.common.VarTracker.NewList(level, len(e.Locals))
-		tv, tail := vars.Head(), vars.Tail()
+		tv, tail, consumed := vars.Head(), vars.Tail(), 0
 		for i, name := range e.Locals {
 			tv.SetWeak()
 			ref := types.NewRef(tv)
 			env.Assign(name, ref)
 			tmpRefs[i] = ref
-			tv, tail = tail.Head(), tail.Tail()
+			tv, tail, consumed = tail.Head(), tail.Tail(), consumed+1
 		}
+		ti.checkVarsConsumed("inferControlFlow", vars, consumed)
 		for _, block := range cycle {
 			// The entry and return blocks are handled above (as non-cycles).
-			for _, sub := range block.Sequence {
-				if _, err := ti.infer(env, level, sub); err != nil {
+			for i, sub := range block.Sequence {
+				t, err := ti.infer(env, level, sub)
+				if err != nil {
 					return nil, err
 				}
+				if i == len(block.Sequence)-1 && e.IsReturnPoint(block) {
+					if err := joinReturn(block, t); err != nil {
+						return nil, err
+					}
+				}
 			}
 		}
 		// Check consistent usage of locals across loop iterations:
@@ -691,5 +2279,8 @@ func (ti *InferenceContext) inferControlFlow(env *TypeEnv, level uint, e *ast.Co
 		ti.invalid, ti.err = e, errors.New("Control flow must reach the return block and return a value")
 		return nil, ti.err
 	}
+	if ti.annotate {
+		e.SetType(ret)
+	}
 	return ret, nil
 }
@@ -23,6 +23,7 @@
 package poly_test
 
 import (
+	"strconv"
 	"testing"
 
 	. "github.com/wdamron/poly"
@@ -185,3 +186,74 @@ func BenchmarkInstanceLookups(t *testing.B) { // ~15000 ns/op
 		}
 	}
 }
+
+func preludeTypes(size int) map[string]types.Type {
+	prelude := make(map[string]types.Type, size)
+	for i := 0; i < size; i++ {
+		prelude["builtin"+strconv.Itoa(i)] = TArrow1(TConst("int"), TConst("int"))
+	}
+	return prelude
+}
+
+func BenchmarkAssignPrelude(b *testing.B) { // ~140000 ns/op
+	prelude := preludeTypes(1000)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		env := NewTypeEnv(nil)
+		for name, t := range prelude {
+			env.Assign(name, t)
+		}
+		if len(env.Types) != len(prelude) {
+			b.Fatalf("expected %d types, found %d", len(prelude), len(env.Types))
+		}
+	}
+}
+
+func BenchmarkAssignAllPrelude(b *testing.B) { // ~70000 ns/op
+	prelude := preludeTypes(1000)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		env := NewTypeEnv(nil)
+		env.AssignAll(prelude)
+		if len(env.Types) != len(prelude) {
+			b.Fatalf("expected %d types, found %d", len(prelude), len(env.Types))
+		}
+	}
+}
+
+func benchmarkUnification(b *testing.B, occursCheck bool) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+	ctx.SetOccursCheck(occursCheck)
+
+	// Each application of id unifies a fresh type-variable with a deeply nested type:
+	var big types.Type = TConst("int")
+	for i := 0; i < 6; i++ {
+		big = TRecordFlat(map[string]types.Type{"a": big, "b": TArrow1(big, TConst("bool"))})
+	}
+	A := env.NewGenericVar()
+	env.Declare("id", TArrow1(A, A))
+	env.Declare("big", big)
+
+	steps := make([]ast.Expr, 65)
+	steps[0] = Var("big")
+	for i := 1; i < len(steps); i++ {
+		steps[i] = Call(Var("id"), Var("$"))
+	}
+	expr := Pipe("$", steps...)
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		ty, err := ctx.Infer(expr, env)
+		if err != nil || ty == nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnificationOccursCheck(b *testing.B) { benchmarkUnification(b, true) } // ~5250000 ns/op
+
+func BenchmarkUnificationNoOccursCheck(b *testing.B) { benchmarkUnification(b, false) } // ~5500000 ns/op
@@ -24,9 +24,12 @@ package poly
 
 import (
 	"errors"
+	"strconv"
+	"time"
 
 	"github.com/wdamron/poly/ast"
 	"github.com/wdamron/poly/internal/astutil"
+	"github.com/wdamron/poly/internal/typeutil"
 	"github.com/wdamron/poly/types"
 )
 
@@ -38,15 +41,96 @@ type InferenceContext struct {
 	canDeferMatch bool
 	analyzed      bool
 	needsReset    bool
+	selectMode    RecordSelectMode
+	branchMode    RecordBranchMode
+	tupleCalls    bool
+	distinctExt   bool
+	keepLastLabel bool
+	rightBiased   bool
+	warnUnused    bool
+	strictPipe    bool
+	noDeadDefault bool
+	recordInsts   bool
+	timing        bool
+	stripWeak     bool
+	noWeakGen     bool
+	noOccurs      bool
+	cacheTypes    bool
+	debug         bool
+	maxRowWidth   int
+	maxInstDepth  int
+	levelHook     func(op string, level int, t types.Type)
+	resolver      func(class *types.TypeClass, t types.Type) (methodImpls map[string]types.Type, ok bool)
+	abstractUnify func(a, b *types.App) (handled bool, err error)
+	onResolved    func(c types.InstanceConstraint, instance types.Type)
+	compareClass  *types.TypeClass
+	compareType   types.Type
 
 	rootExpr      ast.Expr
+	result        types.Type
 	analysis      *astutil.Analysis
 	letGroupCount int
+	lastInst      map[uint]*types.Var
+	holes         map[*ast.Hole]TypedHole
+	tryErrs       []tryFrame
+	timer         typeutil.PhaseTimer
+	typeCache     map[ast.Expr]cachedType
+	cachePending  []pendingType
+	captureLog    []capturedVar
+	uncached      int
+	equalities    map[uint]types.Type
+	scopedVars    map[string]types.Type
 
-	err     error
-	invalid ast.Expr
+	err      error
+	invalid  ast.Expr
+	warnings []Warning
 }
 
+// Warning describes a suspicious (but well-typed) expression found during inference.
+type Warning struct {
+	Message string
+	Name    string   // name of the unused variable
+	Expr    ast.Expr // expression which binds the unused variable
+}
+
+// TypedHole describes a hole found during inference.
+type TypedHole struct {
+	Type types.Type            // inferred type of the hole
+	Env  map[string]types.Type // types of the identifiers in scope at the hole
+}
+
+// Timings contains the wall-clock time spent within each phase of inference. Time spent within a phase which
+// begins while another phase is running (e.g. instantiation during unification) is attributed only to the
+// inner phase.
+type Timings struct {
+	Analysis      time.Duration // analysis of let-groups and unused bindings
+	Unification   time.Duration
+	Instantiation time.Duration
+}
+
+// RecordSelectMode determines how selection of labels which are missing from a record is inferred.
+type RecordSelectMode uint8
+
+const (
+	// Selecting a label which is missing from an open record extends the record's row with the label.
+	// Selection is treated as evidence that the label exists. This is the default mode.
+	RecordSelectInferring RecordSelectMode = iota
+	// Selecting a label which is missing from an open or closed record fails. Records with
+	// unknown (type-variable) types are still inferred as open records containing the label.
+	RecordSelectStrict
+)
+
+// RecordBranchMode determines how records returned from the branches of a match expression are combined.
+type RecordBranchMode uint8
+
+const (
+	// Records returned from each branch must have matching types. This is the default mode.
+	RecordBranchStrict RecordBranchMode = iota
+	// Closed records returned from each branch are combined into a closed record containing the labels which are
+	// shared by all branches. Labels which are missing from any branch are dropped from the combined record.
+	RecordBranchIntersect
+)
+
 // Create a new type-inference context. A context may be reused for inference.
 func NewContext() *InferenceContext { return &InferenceContext{} }
 
@@ -55,7 +139,14 @@ func (ti *InferenceContext) reset() {
 		ti.analysis.Reset()
 		ti.analyzed = false
 	}
-	ti.rootExpr, ti.err, ti.invalid, ti.letGroupCount, ti.needsReset = nil, nil, nil, 0, false
+	ti.rootExpr, ti.result, ti.err, ti.invalid, ti.letGroupCount, ti.needsReset = nil, nil, nil, nil, 0, false
+	ti.warnings, ti.lastInst, ti.tryErrs = ti.warnings[:0], nil, ti.tryErrs[:0]
+	ti.cachePending, ti.captureLog, ti.uncached, ti.equalities = ti.cachePending[:0], ti.captureLog[:0], 0, nil
+	ti.scopedVars = nil
+	for hole := range ti.holes {
+		delete(ti.holes, hole)
+	}
+	ti.timer.Reset()
 }
 
 // Reset the state of the context. The context will be reset automatically before inference.
@@ -73,6 +164,239 @@ func (ti *InferenceContext) Reset() {
 // By default, deferred instance-matching is disabled.
 func (ti *InferenceContext) EnableDeferredInstanceMatching(enabled bool) { ti.canDeferMatch = enabled }
 
+// Set the mode for inferring selection of labels which are missing from a record. Selecting a missing
+// label from a closed record fails in all modes.
+//
+// By default, the mode is RecordSelectInferring.
+func (ti *InferenceContext) SetRecordSelectMode(mode RecordSelectMode) { ti.selectMode = mode }
+
+// Record the substitution built when the type of each variable is instantiated during inference. The most recent
+// substitution is available through LastInstantiation.
+//
+// By default, substitutions are not recorded.
+func (ti *InferenceContext) SetRecordInstantiations(enabled bool) { ti.recordInsts = enabled }
+
+// Get the substitution built by the most recent instantiation of a variable's type during inference, which maps
+// the id of each generic type-variable within the variable's type to the fresh type-variable which replaced it.
+// Nil will be returned if no variables have been instantiated since the context was reset, or if recording of
+// instantiations is disabled.
+func (ti *InferenceContext) LastInstantiation() map[uint]*types.Var { return ti.lastInst }
+
+// Set the mode for combining records returned from the branches of match expressions.
+//
+// By default, the mode is RecordBranchStrict.
+func (ti *InferenceContext) SetRecordBranchMode(mode RecordBranchMode) { ti.branchMode = mode }
+
+// Tupled calls allow a function with a single tuple argument to be applied to multiple arguments,
+// where each argument is unified with the corresponding element of the tuple. Functions may still
+// be applied directly to a single tuple.
+//
+// By default, tupled calls are disabled.
+func (ti *InferenceContext) SetTupleCalls(enabled bool) { ti.tupleCalls = enabled }
+
+// Labels which are repeated within a single record extension are rejected by default. If the last duplicate
+// label is kept, the types of previous duplicate labels within the extension are discarded.
+//
+// Duplicate labels within an extension are always rejected if record extensions are distinct.
+func (ti *InferenceContext) SetRecordExtendKeepLast(enabled bool) { ti.keepLastLabel = enabled }
+
+// Distinct record extensions reject labels which are already present in the extended record, or which are
+// repeated within the extension. Labels of open records which are not yet known are not rejected.
+//
+// By default, record extensions are not distinct: extending a record with an existing label shadows the existing
+// label, and selecting the label returns the type of the outermost (most recently added) label. The shadowed label
+// becomes visible again when the outermost label is removed by restriction.
+func (ti *InferenceContext) SetRecordExtendDistinct(enabled bool) { ti.distinctExt = enabled }
+
+// Labels which are present in both records of a merge expression are rejected by default. If merging is right-biased,
+// labels of the right record overwrite labels of the left record.
+func (ti *InferenceContext) SetRecordMergeRightBiased(enabled bool) { ti.rightBiased = enabled }
+
+// Reject default cases of match expressions which cannot be reached, where the matched variant is closed
+// and each of its labels is matched by an explicit case. Variants which are closed after the match expression
+// is inferred are not checked.
+//
+// By default, unreachable default cases are allowed.
+func (ti *InferenceContext) SetRejectDeadDefault(enabled bool) { ti.noDeadDefault = enabled }
+
+// Preserve weakness of type-variables when instantiating types during inference. If disabled, weak type-variables
+// are instantiated as fresh non-weak type-variables, which may be generalized.
+//
+// Disabling preservation is unsound for types of mutable values: a reference instantiated with a non-weak
+// type-variable may be generalized, then used at incompatible types. Preservation should only be disabled when
+// weak type-variables are not used to restrict generalization of mutable values.
+//
+// By default, weak type-variables are preserved.
+func (ti *InferenceContext) SetPreserveWeakVars(enabled bool) { ti.stripWeak = !enabled }
+
+// Fail inference when a let-binding (or pipe placeholder) would generalize a weak type-variable, rather than
+// generalizing it. Weak type-variables are introduced for the contents of mutable references, so generalizing them
+// may allow a reference to be used at incompatible types. Bindings of functions are generalized as usual, since
+// references created within a function are not shared between calls.
+//
+// By default, weak type-variables may be generalized.
+func (ti *InferenceContext) SetErrorOnWeakGeneralization(enabled bool) { ti.noWeakGen = enabled }
+
+// Cache the types of sub-expressions during annotation, keyed by the identity of each expression, and reuse cached
+// types without re-inferring the sub-expressions during later inferences with the context. Only types without
+// type-variables are cached; sub-expressions containing holes or try expressions, or referencing variables bound by
+// an enclosing function, let-binding, or match-case, are not cached, since their constraints must be replayed for
+// each inference. Since copies are annotated by Annotate, the cache is only populated by AnnotateDirect.
+//
+// Reusing a cached type is only sound if the sub-expression and the type-environment are unchanged since it was
+// annotated. Each modified expression, and each expression which encloses it, must be invalidated (see Invalidate)
+// before inference.
+//
+// By default, types are not cached. Disabling the cache removes all cached types.
+func (ti *InferenceContext) SetTypeCache(enabled bool) {
+	ti.cacheTypes = enabled
+	if enabled && ti.typeCache == nil {
+		ti.typeCache = make(map[ast.Expr]cachedType)
+	} else if !enabled {
+		ti.typeCache = nil
+	}
+}
+
+// Remove the cached type of e, if any. Sub-expressions of e remain cached.
+func (ti *InferenceContext) Invalidate(e ast.Expr) { delete(ti.typeCache, e) }
+
+// Enable internal assertions during inference, which panic with a descriptive message when an invariant of the
+// inference engine is violated (e.g. when type-variables allocated for a let-group, match expression, or control-flow
+// graph are not consumed exactly). Assertions guard against regressions within the engine; they should not fail for
+// any input expression.
+//
+// By default, assertions are disabled.
+func (ti *InferenceContext) SetDebug(enabled bool) { ti.debug = enabled }
+
+// Enable or disable the occurs check during unification, which rejects implicitly recursive (cyclic) types.
+// Disabling the check is unsafe: inference may not terminate for expressions which would otherwise be rejected
+// with a recursive type error. The check should only be disabled for trusted inputs which are known to be well-typed.
+// Binding-levels of type-variables are adjusted whether or not the check is enabled.
+//
+// By default, the occurs check is enabled.
+func (ti *InferenceContext) SetOccursCheck(enabled bool) { ti.noOccurs = !enabled }
+
+// Set the maximum number of labels within a record or variant row. Inference fails when a record is extended
+// or a row is unified beyond the maximum width. The limit guards against pathological rows in untrusted input.
+//
+// By default, row width is unlimited. A maximum width less than or equal to 0 removes the limit.
+func (ti *InferenceContext) SetMaxRowWidth(n int) { ti.maxRowWidth = n }
+
+// Set the maximum depth of recursive instance resolution. Instances may constrain their type-parameters (e.g. an
+// instance of Show for list['a] may require Show 'a), so resolving an instance may resolve further instances as
+// sub-goals. Inference fails when the chain of sub-goals exceeds the maximum depth, which guards against cyclic
+// instances (e.g. through recursive types).
+//
+// By default, the maximum depth is 64. A maximum depth less than or equal to 0 restores the default.
+func (ti *InferenceContext) SetMaxInstanceDepth(n int) { ti.maxInstDepth = n }
+
+// Set a resolver for type-class instances which are declared outside of the type-environment (e.g. by a host's
+// module system). When a constrained type-variable is bound to a type during inference, the resolver is consulted
+// before the declared instances of each type-class; the resolver should return an implementation for each method
+// of the type-class. Resolved methods are checked against the methods of the type-class.
+//
+// If the resolver returns false, the declared instances will be searched.
+func (ti *InferenceContext) SetInstanceResolver(resolver func(class *types.TypeClass, t types.Type) (methodImpls map[string]types.Type, ok bool)) {
+	ti.resolver = resolver
+}
+
+// Set a callback which is invoked each time an instance constraint is resolved, when a constrained type-variable is
+// linked to a type which satisfies the constraint during inference or constraint solving (see SolveConstraints).
+// Resolutions are reported in the order they occur, which follows the order of sub-expressions; sub-goals of an
+// instance are reported before the instance. Resolutions within rolled-back unifications are not reported.
+//
+// Resolved and residual constraints together describe the dictionaries required by dictionary-passing code.
+//
+// By default, no callback is invoked.
+func (ti *InferenceContext) SetOnConstraintResolved(f func(c types.InstanceConstraint, instance types.Type)) {
+	ti.onResolved = f
+}
+
+// Set a unifier for type-applications of abstract type constants (see types.Const), such as nominal types with
+// variance. When both sides of a unification are applications of the same abstract type constant, the unifier is
+// consulted before the type-applications are unified structurally. Unify may be called within the unifier (e.g. to
+// unify invariant type-parameters).
+//
+// If the unifier returns false, the type-applications will be unified structurally.
+func (ti *InferenceContext) SetAbstractUnifier(unify func(a, b *types.App) (handled bool, err error)) {
+	ti.abstractUnify = unify
+}
+
+// Configure inference for comparisons (see ast.Compare). The shared type of both operands will be constrained by
+// class, if class is not nil; comparisons will have the type result, if result is not nil.
+//
+// By default, operands are unconstrained and comparisons have the type constant bool.
+func (ti *InferenceContext) SetComparison(class *types.TypeClass, result types.Type) {
+	ti.compareClass, ti.compareType = class, result
+}
+
+// Set a hook which observes the binding-levels of let-bound values during inference. The hook will be called
+// with the name of the binding expression (Let, LetGroup, Where, or Pipe), the incremented binding-level at
+// which the bound value was inferred, and the inferred type of the value. For pipelines, the hook is called for each
+// step with the type of the placeholder, which is generalized again before each step.
+//
+// The hook is called before the type is generalized; type-variables in the type with levels greater than or
+// equal to the given level will be generalized after the hook returns. The hook must not modify the type.
+//
+// The hook is purely observational, and may be removed by setting a nil hook.
+func (ti *InferenceContext) SetLevelHook(hook func(op string, level int, t types.Type)) {
+	ti.levelHook = hook
+}
+
+// Strict pipelines require each step of a pipeline to reference the placeholder, which binds the result of the
+// previous step (or the source). A step which ignores the placeholder breaks the flow of data through the pipeline,
+// and will be reported as an error. References within nested bindings of the same name are not counted.
+//
+// By default, pipelines are not strict.
+func (ti *InferenceContext) SetStrictPipe(enabled bool) { ti.strictPipe = enabled }
+
+// Warn about variables bound by let-bindings, let-groups, where-bindings, or function arguments which are never
+// referenced. Variables with names beginning with an underscore are not reported. Warnings are only recorded after
+// inference succeeds.
+//
+// By default, unused bindings are not reported.
+func (ti *InferenceContext) SetWarnUnusedBindings(enabled bool) { ti.warnUnused = enabled }
+
+// Record wall-clock time spent within each phase of inference, which may be retrieved with Timings after inference.
+// Timing is intended for profiling, and adds overhead to unification and instantiation.
+//
+// By default, timing is disabled.
+func (ti *InferenceContext) SetTiming(enabled bool) { ti.timing = enabled }
+
+// Get the wall-clock time spent within each phase of the most recent inference, if timing is enabled.
+func (ti *InferenceContext) Timings() Timings {
+	d := &ti.timer.Durations
+	return Timings{
+		Analysis:      d[typeutil.PhaseAnalysis],
+		Unification:   d[typeutil.PhaseUnification],
+		Instantiation: d[typeutil.PhaseInstantiation],
+	}
+}
+
+// Get the inferred type of each hole within the most recently inferred expression, along with the types of the
+// identifiers in scope at the hole. Holes which share a name are recorded separately.
+//
+// Holes are inferred as fresh type-variables; after inference, each type reflects the constraints of the
+// expressions surrounding the hole.
+//
+// Holes are keyed by expression rather than by name (as a map[string]types.Type would be), since several holes
+// may share a name, and each hole also records its surrounding environment. Tools may look up a hole's type by
+// the name of the hole through the Name field of each key.
+func (ti *InferenceContext) Holes() map[*ast.Hole]TypedHole {
+	holes := make(map[*ast.Hole]TypedHole, len(ti.holes))
+	for hole, typed := range ti.holes {
+		env := make(map[string]types.Type, len(typed.Env))
+		for name, t := range typed.Env {
+			env[name] = types.RealType(t)
+		}
+		holes[hole] = TypedHole{Type: types.RealType(typed.Type), Env: env}
+	}
+	return holes
+}
+
+// Get the warnings recorded during inference.
+func (ti *InferenceContext) Warnings() []Warning { return ti.warnings }
+
 // Get the error which caused inference to fail.
 func (ti *InferenceContext) Error() error { return ti.err }
 
@@ -86,10 +410,64 @@ func (ti *InferenceContext) InvalidExpr() ast.Expr { return ti.invalid }
 // shared environment.
 func (ti *InferenceContext) Infer(expr ast.Expr, env *TypeEnv) (types.Type, error) {
 	nocopy := true
-	_, t, err := ti.inferRoot(expr, env, nocopy)
+	_, t, err := ti.inferRoot(expr, env, types.TopLevel, nocopy)
 	return t, err
 }
 
+// Infer the type of expr within env, generalizing relative to an enclosing binding-level.
+//
+// The expression is inferred at the next level after level, and only unbound type-variables with a binding-level
+// greater than level are generalized. Type-variables within env which are bound at or below level (e.g. the types
+// of variables bound by an enclosing expression, at the enclosing expression's level) remain unbound, as they
+// would within the enclosing expression. Infer is equivalent to InferAtLevel at level 0 (types.TopLevel), where
+// all unbound type-variables are generalized.
+func (ti *InferenceContext) InferAtLevel(expr ast.Expr, env *TypeEnv, level uint) (types.Type, error) {
+	nocopy := true
+	_, t, err := ti.inferRoot(expr, env, level, nocopy)
+	return t, err
+}
+
+// Infer the type of each top-level expression produced by provider within env, as the expressions are produced.
+// The inferred types are returned in the order which the expressions were produced. The generalized type of each
+// named definition (ast.Definition) is assigned within env, and is visible to subsequent expressions.
+//
+// Expressions must be produced in dependency order. Mutually-recursive definitions should be produced together
+// within a single LetGroup expression, which is sorted by dependency during inference. If inference fails for
+// an expression, the types inferred for previous expressions will be returned along with the error.
+func (ti *InferenceContext) InferStream(env *TypeEnv, provider ast.ExprProvider) ([]types.Type, error) {
+	var inferred []types.Type
+	for {
+		expr, ok := provider.Next()
+		if !ok {
+			return inferred, nil
+		}
+		def, isDef := expr.(*ast.Definition)
+		if isDef {
+			expr = def.Value
+		}
+		t, err := ti.Infer(expr, env)
+		if err != nil {
+			return inferred, err
+		}
+		if isDef {
+			env.Assign(def.Name, t)
+		}
+		inferred = append(inferred, t)
+	}
+}
+
+// Infer the type of expr within env, and print the inferred type as a type-scheme with leading quantifiers
+// and constraints: `forall 'a. Show 'a => 'a -> string`
+//
+// A new inference context is created for each call.
+func InferString(env *TypeEnv, expr ast.Expr) (string, error) {
+	t, err := NewContext().Infer(expr, env)
+	if err != nil {
+		return "", err
+	}
+	return types.SchemeString(t), nil
+}
+
 // Infer the type of expr within env. The type-annotated copy of expr will be returned.
 //
 // A type-environment cannot be used concurrently for inference; to share a type-environment
@@ -98,7 +476,7 @@ func (ti *InferenceContext) Infer(expr ast.Expr, env *TypeEnv) (types.Type, erro
 func (ti *InferenceContext) Annotate(expr ast.Expr, env *TypeEnv) (ast.Expr, error) {
 	nocopy := false
 	ti.annotate = true
-	root, _, err := ti.inferRoot(expr, env, nocopy)
+	root, _, err := ti.inferRoot(expr, env, types.TopLevel, nocopy)
 	ti.annotate = false
 	return root, err
 }
@@ -112,12 +490,89 @@ func (ti *InferenceContext) Annotate(expr ast.Expr, env *TypeEnv) (ast.Expr, err
 func (ti *InferenceContext) AnnotateDirect(expr ast.Expr, env *TypeEnv) error {
 	nocopy := true
 	ti.annotate = true
-	_, _, err := ti.inferRoot(expr, env, nocopy)
+	_, _, err := ti.inferRoot(expr, env, types.TopLevel, nocopy)
 	ti.annotate = false
 	return err
 }
 
-func (ti *InferenceContext) inferRoot(root ast.Expr, env *TypeEnv, nocopy bool) (ast.Expr, types.Type, error) {
+// Resolve the residual type-class constraints within the most recently inferred type. Each constrained type-variable
+// is linked to the parameter of the unique instance which satisfies its constraints; the inferred type (and any
+// type-annotations which share its type-variables) will be modified.
+//
+// Solving fails if no instance satisfies the constraints of a type-variable, or if multiple instances satisfy the
+// constraints (the constraints are ambiguous). Constraints should be solved before the context is reused.
+func (ti *InferenceContext) SolveConstraints(env *TypeEnv) error {
+	if ti.result == nil {
+		return errors.New("No inferred type to solve constraints for")
+	}
+	env.common.OnResolved = ti.onResolved
+	err := env.common.SolveConstraints(ti.result)
+	env.common.Reset()
+	if err != nil {
+		return err
+	}
+	Generalize(ti.result)
+	return nil
+}
+
+// Checkpoint records the state of unification within a type-environment. Type-variables which are linked after
+// the checkpoint is created will be unlinked when the checkpoint is rolled back.
+type Checkpoint struct {
+	env *TypeEnv
+	txn typeutil.UnifyTxn
+}
+
+// Create a checkpoint for trial unification within env. Each checkpoint must be rolled back or committed, in the
+// reverse order of creation (checkpoints may be nested).
+func (ti *InferenceContext) Checkpoint(env *TypeEnv) Checkpoint {
+	return Checkpoint{env: env, txn: env.common.NewUnifyTxn()}
+}
+
+// Undo all type-variable links which were created since the checkpoint.
+func (ti *InferenceContext) Rollback(cp Checkpoint) { cp.env.common.Rollback(cp.txn) }
+
+// Keep all type-variable links which were created since the checkpoint.
+func (ti *InferenceContext) Commit(cp Checkpoint) { cp.env.common.Commit(cp.txn) }
+
+// Unify a and b within env. Generic types should be instantiated (see TypeEnv.Instantiate) before unification.
+//
+// Type-variables may be linked even if unification fails; a checkpoint should be created before unification
+// and rolled back after failure, to undo links created during the failed unification.
+func (ti *InferenceContext) Unify(env *TypeEnv, a, b types.Type) error { return env.common.Unify(a, b) }
+
+// Unify each of ts with the first type of ts within env, and return the unified type. Generic types should be
+// instantiated (see TypeEnv.Instantiate) before unification.
+//
+// Unification stops at the first type which does not unify. As with Unify, type-variables may be linked even if
+// unification fails; a checkpoint should be created before unification and rolled back after failure.
+func (ti *InferenceContext) UnifyAll(env *TypeEnv, ts []types.Type) (types.Type, error) {
+	if len(ts) == 0 {
+		return nil, errors.New("No types to unify")
+	}
+	for i := 1; i < len(ts); i++ {
+		if err := env.common.Unify(ts[0], ts[i]); err != nil {
+			return nil, errors.New("Failed to unify type " + strconv.Itoa(i) + " (" + types.TypeString(ts[i]) + "): " + err.Error())
+		}
+	}
+	return types.RealType(ts[0]), nil
+}
+
+// Check if a and b could be unified, without modifying a or b. Unification is performed against copies of a and b,
+// so type-variables within a and b are never linked, and their constraints are not modified. Generic types should
+// be instantiated (see TypeEnv.Instantiate) before checking.
+//
+// Options of the inference context which affect unification (e.g. the instance resolver and the maximum row width)
+// are applied while checking.
+func (ti *InferenceContext) CanUnify(a, b types.Type) bool {
+	var common typeutil.CommonContext
+	common.Init()
+	common.MaxRowWidth, common.InstanceResolver, common.AbstractUnifier = ti.maxRowWidth, ti.resolver, ti.abstractUnify
+	common.DeferredConstraintsEnabled, common.MaxInstanceDepth = ti.canDeferMatch, ti.maxInstDepth
+	common.SkipOccursCheck = ti.noOccurs
+	return common.CanUnifyCopies(a, b)
+}
+
+func (ti *InferenceContext) inferRoot(root ast.Expr, env *TypeEnv, level uint, nocopy bool) (ast.Expr, types.Type, error) {
 	if root == nil {
 		return nil, nil, errors.New("Empty expression")
 	}
@@ -128,7 +583,13 @@ func (ti *InferenceContext) inferRoot(root ast.Expr, env *TypeEnv, nocopy bool)
 		ti.reset()
 	}
 	ti.rootExpr, env.common.TrackScopes, env.common.DeferredConstraintsEnabled = root, ti.annotate, ti.canDeferMatch
-	t, err := ti.infer(env, types.TopLevel+1, root)
+	env.common.MaxRowWidth, env.common.InstanceResolver, env.common.MaxInstanceDepth = ti.maxRowWidth, ti.resolver, ti.maxInstDepth
+	env.common.AbstractUnifier, env.common.StripWeakVars, env.common.SkipOccursCheck = ti.abstractUnify, ti.stripWeak, ti.noOccurs
+	env.common.OnResolved = ti.onResolved
+	if ti.timing {
+		env.common.Timer = &ti.timer
+	}
+	t, err := ti.infer(env, level+1, root)
 	if err != nil {
 		goto Cleanup
 	}
@@ -136,8 +597,20 @@ func (ti *InferenceContext) inferRoot(root ast.Expr, env *TypeEnv, nocopy bool)
 		ti.invalid, ti.err = invalid, err
 		goto Cleanup
 	}
+	if ti.warnUnused {
+		if err = ti.analyze(); err != nil {
+			goto Cleanup
+		}
+		for _, unused := range ti.analysis.Unused {
+			ti.warnings = append(ti.warnings, Warning{Message: "Unused binding " + unused.Name, Name: unused.Name, Expr: unused.Expr})
+		}
+	}
 	env.common.VarTracker.FlattenLinks()
-	t = Generalize(t)
+	if ti.cacheTypes {
+		ti.commitCache()
+	}
+	t = typeutil.GeneralizeOpts(level, t, false, false)
+	ti.result = t
 Cleanup:
 	env.common.Reset()
 	ti.needsReset, ti.rootExpr = true, nil
@@ -23,6 +23,7 @@
 package poly_test
 
 import (
+	"errors"
 	"reflect"
 	"strings"
 	"testing"
@@ -64,6 +65,58 @@ func TestLiterals(t *testing.T) {
 		},
 	}
 	mustInfer(t, env, ctx, Let("vec", xvec, Var("vec")), "vec[int]")
+
+	// Generic literals are instantiated, and the constructed scheme is annotated:
+
+	A := env.NewGenericVar()
+	env.Declare("push", TArrow2(TApp(TConst("vec"), A), A, TApp(TConst("vec"), A)))
+	elemType := env.NewGenericVar()
+	empty := &ast.Literal{
+		Syntax: "[]",
+		Construct: func(env types.TypeEnv, level uint, using []types.Type) (types.Type, error) {
+			return Generalize(TApp(TConst("vec"), elemType)), nil // |- forall 'a. vec['a]
+		},
+	}
+	expr := Call(Var("push"), empty, Var("x"))
+	mustInfer(t, env, ctx, expr, "vec[int]")
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(empty.Type()) != "vec[int]" {
+		t.Fatalf("unexpected literal type: %s", types.TypeString(empty.Type()))
+	}
+	if types.SchemeString(empty.Scheme()) != "forall 'a. vec['a]" {
+		t.Fatalf("unexpected literal scheme: %s", types.SchemeString(empty.Scheme()))
+	}
+}
+
+func TestBuiltinLiterals(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	mustInfer(t, env, ctx, IntLit(1), "int")
+	mustInfer(t, env, ctx, StringLit("a"), "string")
+	mustInfer(t, env, ctx, BoolLit(true), "bool")
+
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	expr := Call(Var("add"), IntLit(1), IntLit(-2))
+	if ast.ExprString(expr) != "add(1, -2)" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "int")
+	if _, err := ctx.Infer(Call(Var("add"), IntLit(1), StringLit("2")), env); err == nil {
+		t.Fatalf("expected an error for a string argument")
+	}
+	if ast.ExprString(StringLit("a\"b")) != `"a\"b"` {
+		t.Fatalf("expr: %s", ast.ExprString(StringLit("a\"b")))
+	}
+
+	// Constant names are configurable:
+	names := Builtins{Int: "i64", String: "str", Bool: "boolean"}
+	mustInfer(t, env, ctx, names.IntLit(1), "i64")
+	mustInfer(t, env, ctx, names.StringLit("a"), "str")
+	mustInfer(t, env, ctx, names.BoolLit(false), "boolean")
+	mustInfer(t, env, ctx, IntLit(1), "int")
 }
 
 func TestSizes(t *testing.T) {
@@ -102,6 +155,137 @@ func TestSizes(t *testing.T) {
 	if _, err := ctx.Infer(Call(Var("add"), Var("zs"), Var("zs")), env); err == nil {
 		t.Fatalf("Expected size type-restriction error")
 	}
+
+	// Size mismatches are distinct from element-type mismatches:
+	a := env.NewGenericVar()
+	env.Declare("same", TArrow2(a, a, a))
+	env.Declare("bs", TApp(TConst("array"), TConst("bool"), TSize(8)))
+	env.Declare("xs2", TApp(TConst("array"), TConst("int"), TSize(8)))
+	mustInfer(t, env, ctx, Call(Var("same"), Var("xs"), Var("xs2")), "array[int, 8]")
+	for _, test := range []struct {
+		expr   ast.Expr
+		expect string
+	}{
+		{Call(Var("same"), Var("xs"), Var("ys")), "Size mismatch: failed to unify size 8 with size 16"},
+		{Call(Var("same"), Var("xs"), Var("bs")), "Failed to unify int with bool"},
+		{Call(Var("same"), Var("xs"), Var("zs")), "Failed to unify size 8 with foo"},
+		{Call(Var("same"), Var("zs"), Var("xs")), "Failed to unify size 8 with foo"},
+	} {
+		if _, err := ctx.Infer(test.expr, env); err == nil || err.Error() != test.expect {
+			t.Fatalf("expected error %q, found %v", test.expect, err)
+		}
+	}
+
+	// Size type-variables are bound to sizes:
+	expr, err := ctx.Annotate(Call(Var("add"), Var("xs"), Var("xs2")), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := types.TypeString(expr.(*ast.Call).FuncType()); s != "(array[int, 8], array[int, 8]) -> array[int, 8]" {
+		t.Fatalf("unexpected instantiated type: %s", s)
+	}
+}
+
+func TestSizedArrayLit(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType := TConst("int")
+	env.Declare("one", intType)
+	env.Declare("yes", TConst("bool"))
+	a := env.NewGenericVar()
+	env.Declare("same", TArrow2(a, a, a))
+	size := env.NewGenericSize()
+	env.Declare("get", TArrow2(TApp(TConst("array"), intType, size), TApp(TConst("index"), size), intType))
+	env.Declare("i3", TApp(TConst("index"), TSize(3)))
+
+	expr := SizedArrayLit(Var("one"), Var("one"), Var("one"))
+	if ast.ExprString(expr) != "[one, one, one]" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "array[int, 3]")
+	mustInfer(t, env, ctx, SizedArrayLit(), "array['a, 0]")
+	mustInfer(t, env, ctx, Func1("x", SizedArrayLit(Var("x"), Var("x"))), "'a -> array['a, 2]")
+
+	// Sizes of literals are unified with size type-variables:
+	mustInfer(t, env, ctx, Call(Var("get"), expr, Var("i3")), "int")
+	mustInfer(t, env, ctx, Call(Var("same"), expr, SizedArrayLit(Var("one"), Var("one"), Var("one"))), "array[int, 3]")
+	for _, test := range []struct {
+		expr   ast.Expr
+		expect string
+	}{
+		{Call(Var("same"), expr, SizedArrayLit(Var("one"), Var("one"))), "Size mismatch: failed to unify size 3 with size 2"},
+		{Call(Var("get"), SizedArrayLit(Var("one")), Var("i3")), "Size mismatch: failed to unify size 1 with size 3"},
+		{SizedArrayLit(Var("one"), Var("yes")), "Failed to unify int with bool"},
+	} {
+		if _, err := ctx.Infer(test.expr, env); err == nil || err.Error() != test.expect {
+			t.Fatalf("expected error %q, found %v", test.expect, err)
+		}
+	}
+}
+
+func TestSizeGeneralization(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType := TConst("int")
+	env.Declare("one", intType)
+	env.Declare("count", TArrow1(TApp(TConst("array"), env.NewGenericVar(), env.NewGenericSize()), intType))
+	env.Declare("add", TArrow2(intType, intType, intType))
+
+	// The length function is generalized over the element type and size of the array:
+	length := Func1("xs", Call(Var("count"), Var("xs")))
+	mustInfer(t, env, ctx, Let("length", length, Var("length")), "size 'b => array['a, 'b] -> int")
+
+	pair := SizedArrayLit(Var("one"), Var("one"))
+	triple := SizedArrayLit(Var("one"), Var("one"), Var("one"))
+	expr := Let("length", length, Call(Var("add"), Call(Var("length"), pair), Call(Var("length"), triple)))
+	mustInfer(t, env, ctx, expr, "int")
+
+	// Without generalization (e.g. for function arguments), sizes must match:
+	apply := Func1("length", Call(Var("add"), Call(Var("length"), pair), Call(Var("length"), triple)))
+	if _, err := ctx.Infer(Call(apply, length), env); err == nil || err.Error() != "Size mismatch: failed to unify size 2 with size 3" {
+		t.Fatalf("expected size mismatch, found: %v", err)
+	}
+
+	// Generalized size type-variables are instantiated as fresh size type-variables:
+	size := env.NewVar(types.TopLevel + 1)
+	size.RestrictSizeVar()
+	fn := GeneralizeAtLevel(types.TopLevel, TArrow1(TApp(TConst("array"), intType, size), intType))
+	if !size.IsGenericVar() || !size.IsSizeVar() {
+		t.Fatalf("expected a generic size type-variable, found: %s", types.TypeString(size))
+	}
+	inst := env.Instantiate(types.TopLevel+1, fn).(*types.Arrow)
+	if next := inst.Args[0].(*types.App).Params[1].(*types.Var); next == size || next.IsGenericVar() || !next.IsSizeVar() {
+		t.Fatalf("expected a fresh size type-variable, found: %s", types.TypeString(next))
+	}
+}
+
+func TestSizeInstantiation(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intarray := TApp(TConst("array"), TConst("int"), env.NewGenericSize())
+	env.Declare("xs", TApp(TConst("array"), TConst("int"), TSize(8)))
+	env.Declare("zs", TApp(TConst("array"), TConst("int"), TConst("foo")))
+	env.Declare("add", TArrow2(intarray, intarray, intarray))
+
+	// Size restrictions survive instantiation, generalization of let-bindings, and re-instantiation:
+	double := Func1("x", Call(Var("add"), Var("x"), Var("x")))
+	mustInfer(t, env, ctx, Let("double", double, Var("double")), "size 'a => array[int, 'a] -> array[int, 'a]")
+	mustInfer(t, env, ctx, Let("double", double, Call(Var("double"), Var("xs"))), "array[int, 8]")
+	if _, err := ctx.Infer(Let("double", double, Call(Var("double"), Var("zs"))), env); err == nil {
+		t.Fatalf("Expected size type-restriction error")
+	}
+
+	expr := Var("add")
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
+		t.Fatal(err)
+	}
+	arg := expr.Type().(*types.Arrow).Args[0].(*types.App)
+	if size := types.RealType(arg.Params[1]).(*types.Var); !size.IsSizeVar() || size == intarray.Params[1] {
+		t.Fatalf("expected an instantiated size type-variable, found: %s", types.TypeString(size))
+	}
 }
 
 func TestRefs(t *testing.T) {
@@ -125,6 +309,41 @@ func TestRefs(t *testing.T) {
 	}
 }
 
+func TestErrorOnWeakGeneralization(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	a := env.NewGenericVar()
+	env.Declare("new", TArrow(nil, TRef(a)))
+	env.Declare("set", TArrow2(TRef(a), a, TUnit()))
+	env.Declare("someint", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
+
+	// The reference is generalized, so it may be used at incompatible types:
+	expr := Let("r", Call(Var("new")), Let("_", Call(Var("set"), Var("r"), Var("someint")), Call(Var("set"), Var("r"), Var("somebool"))))
+	mustInfer(t, env, ctx, expr, "()")
+
+	ctx.SetErrorOnWeakGeneralization(true)
+	_, err := ctx.Infer(expr, env)
+	if err == nil || err.Error() != "Weakly-polymorphic binding r may not be generalized" {
+		t.Fatalf("expected weak generalization error, found: %v", err)
+	}
+	if ctx.InvalidExpr() == nil || ctx.InvalidExpr().ExprName() != "Let" {
+		t.Fatalf("expected the let-binding to be invalid, found: %v", ctx.InvalidExpr())
+	}
+	_, err = ctx.Infer(LetGroup([]ast.LetBinding{{"r", Call(Var("new"))}}, Var("r")), env)
+	if err == nil || err.Error() != "Weakly-polymorphic binding r may not be generalized" {
+		t.Fatalf("expected weak generalization error, found: %v", err)
+	}
+
+	// Bindings of functions which create references are allowed:
+	ty, err := ctx.Infer(Let("mk", Func(nil, Call(Var("new"))), Var("mk")), env)
+	if err != nil || !strings.HasPrefix(types.TypeString(ty), "weak '") {
+		t.Fatalf("expected a function type, found: %v (%v)", types.TypeString(ty), err)
+	}
+	mustInfer(t, env, ctx, Let("n", Var("someint"), Var("n")), "int")
+}
+
 func TestRecords(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
@@ -137,1008 +356,5319 @@ func TestRecords(t *testing.T) {
 	mustInfer(t, env, ctx, RecordRestrict(record, "a"), "{b : B}")
 }
 
-func TestAliases(t *testing.T) {
+func TestLazyLabels(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	a := env.NewGenericVar()
-	sliceHeader := TRecord(TRowExtend(types.RowEmptyPointer, TypeMap(map[string]types.Type{
-		"data": TRef(TApp(TConst("array"), a)),
-		"len":  TConst("int"),
-		"cap":  TConst("int"),
-	})))
-	slice := Generalize(TAlias(TApp(TConst("slice"), a), sliceHeader))
-
-	intSliceHeader := TRecord(TRowExtend(types.RowEmptyPointer, TypeMap(map[string]types.Type{
-		"data": TRef(TApp(TConst("array"), TConst("int"))),
-		"len":  TConst("int"),
-		"cap":  TConst("int"),
-	})))
-	intSlice := TAlias(TApp(TConst("slice"), TConst("int")), intSliceHeader)
-
-	env.Declare("append", TArrow2(slice, slice, slice))
-	env.Declare("someints", intSliceHeader)
-	env.Declare("someints2", intSlice)
-	env.Declare("someints3", TApp(TConst("slice"), TConst("int")))
+	env.Declare("one", TConst("int"))
+	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
 
-	mustInfer(t, env, ctx, Var("someints"), "{cap : int, data : ref[array[int]], len : int}")
-	mustInfer(t, env, ctx, Var("someints2"), "slice[int]")
+	// The type of a lazy label is the return type of its thunk:
+	expr := RecordExtend(nil,
+		LabelValue("port", Var("one")),
+		LazyLabelValue("name", Func(nil, Call(Var("itoa"), Var("one")))))
+	if ast.ExprString(expr) != "{lazy name() = itoa(one), port = one}" {
+		t.Fatalf("unexpected expression string: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "{name : string, port : int}")
+	if !ast.CopyExpr(expr).(*ast.RecordExtend).Labels[1].Lazy {
+		t.Fatalf("expected copied label to be lazy")
+	}
 
-	sel := Let("f", Func1("x", RecordSelect(Var("x"), "data")),
-		Call(Var("f"), Var("someints2")))
+	// Thunks may depend on bound variables:
+	expr = RecordExtend(nil, LazyLabelValue("twice", Func(nil, Call(Var("itoa"), Var("n")))))
+	mustInfer(t, env, ctx, Func1("n", expr), "int -> {twice : string}")
+	mustInfer(t, env, ctx, Func1("r", RecordUpdate(Var("r"), LazyLabelValue("x", Func(nil, Var("one"))))), "{x : 'a | 'b} -> {x : int | 'b}")
 
-	mustInfer(t, env, ctx, sel, "ref[array[int]]")
-	mustInfer(t, env, ctx, Call(Var("append"), Var("someints"), Var("someints")), "slice[int]")
-	mustInfer(t, env, ctx, Call(Var("append"), Var("someints"), Var("someints2")), "slice[int]")
-	mustInfer(t, env, ctx, Call(Var("append"), Var("someints2"), Var("someints3")), "slice[int]")
+	// Thunks must not have arguments:
+	_, err := ctx.Infer(RecordExtend(nil, LazyLabelValue("x", Func1("y", Var("y")))), env)
+	if err == nil || err.Error() != "Lazy label x requires a function with no arguments" {
+		t.Fatalf("expected lazy label error, found: %v", err)
+	}
+	_, err = ctx.Infer(RecordExtend(nil, ast.LabelValue{Label: "x", Value: Var("one"), Lazy: true}), env)
+	if err == nil || err.Error() != "Lazy label x requires a function with no arguments" {
+		t.Fatalf("expected lazy label error, found: %v", err)
+	}
 }
 
-func TestVariableScopeAnnotations(t *testing.T) {
+func TestRecordFieldOrder(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	expr := Func2("x", "y",
-		LetGroup([]ast.LetBinding{
-			{"a", Var("x")},
-			{"b", Var("y")},
-		},
-			Let("z", Var("a"),
-				Let("z2", Var("b"),
-					Let("z2", Var("b"),
-						Var("z2"))))))
+	env.Declare("one", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
 
+	expr := RecordExtend(nil,
+		LabelValue("z", Var("one")),
+		LabelValue("a", Var("somebool")),
+		LabelValue("m", Var("one")))
 	if err := ctx.AnnotateDirect(expr, env); err != nil {
 		t.Fatal(err)
 	}
+	if types.TypeString(expr.Type()) != "{a : bool, m : int, z : int}" {
+		t.Fatalf("unexpected canonical type: %s", types.TypeString(expr.Type()))
+	}
+	if order := expr.FieldOrder(); !reflect.DeepEqual(order, []string{"z", "a", "m"}) {
+		t.Fatalf("unexpected field order: %v", order)
+	}
 
-	var seen []string
-	ast.WalkExpr(expr, func(e ast.Expr) {
-		if v, ok := e.(*ast.Var); ok {
-			if v.Scope() == nil {
-				t.Fatalf("nil scope annotation for %s", v.Name)
-			}
-			seen = append(seen, v.Name)
-			switch v.Name {
-			case "x", "y":
-				if _, ok := v.Scope().Expr.(*ast.Func); !ok {
-					t.Fatalf("wrong scope annotation for %s, found %s", v.Name, v.Scope().Expr.ExprName())
-				}
-
-			case "a", "b":
-				if _, ok := v.Scope().Expr.(*ast.LetGroup); !ok {
-					t.Fatalf("wrong scope annotation for %s, found %s", v.Name, v.Scope().Expr.ExprName())
-				}
-
-			case "z2":
-				if _, ok := v.Scope().Expr.(*ast.Let); !ok {
-					t.Fatalf("wrong scope annotation for %s, found %s", v.Name, v.Scope().Expr.ExprName())
-				}
-				if v.Scope().Parent == nil {
-					t.Logf("nil parent annotation for %s", v.Name)
-				}
-				if _, ok := v.Scope().Parent.Parent.Parent.Expr.(*ast.LetGroup); !ok {
-					t.Fatalf("wrong parent annotation for z2, found %s", v.Scope().Parent.Expr.ExprName())
-				}
-				if _, ok := v.Scope().Parent.Parent.Parent.Parent.Expr.(*ast.Func); !ok {
-					t.Fatalf("wrong scope annotation for top parent of z2, found %s", v.Scope().Expr.ExprName())
-				}
-			}
-		}
-	})
-
-	for i, name := range []string{"x", "y", "a", "b", "b", "z2"} {
-		if seen[i] != name {
-			t.Fatalf("not all variables were visited/checked: %#+v", seen)
-		}
+	// The field order is retained by copies, and labels of the extended record are not included:
+	annotated, err := ctx.Annotate(RecordExtend(expr, LabelValue("b", Var("one"))), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := annotated.(*ast.RecordExtend)
+	if !reflect.DeepEqual(outer.FieldOrder(), []string{"b"}) || !reflect.DeepEqual(outer.Record.(*ast.RecordExtend).FieldOrder(), []string{"z", "a", "m"}) {
+		t.Fatalf("unexpected field order: %v, %v", outer.FieldOrder(), outer.Record.(*ast.RecordExtend).FieldOrder())
 	}
 
-	env.Declare("x", TConst("int"))
-	varExpr := Var("x")
-	if err := ctx.AnnotateDirect(varExpr, env); err != nil {
+	// Repeated labels are ordered by their first appearance:
+	ctx.SetRecordExtendKeepLast(true)
+	expr = RecordExtend(nil, LabelValue("y", Var("one")), LabelValue("x", Var("one")), LabelValue("y", Var("somebool")))
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
 		t.Fatal(err)
 	}
-	if varExpr.Scope() != ast.PredeclaredScope {
-		t.Fatalf("expected predeclared scope")
+	if order := expr.FieldOrder(); !reflect.DeepEqual(order, []string{"y", "x"}) {
+		t.Fatalf("unexpected field order: %v", order)
 	}
 }
 
-func TestPipes(t *testing.T) {
+func TestRecordExtendDuplicateLabels(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	env.Declare("x", TConst("int"))
-	env.Declare("id", TArrow1(TConst("int"), TConst("int")))
-	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
-	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
+	env.Declare("a", TConst("A"))
+	env.Declare("b", TConst("B"))
 
-	expr := Pipe("$", Var("x"),
-		Call(Var("itoa"), Var("$")))
+	// {a = a, a = b | r}
+	expr := Func1("r", RecordExtend(Var("r"), LabelValue("a", Var("a")), LabelValue("a", Var("b"))))
+	_, err := ctx.Infer(expr, env)
+	if err == nil || err.Error() != "Record extension contains duplicate label a" {
+		t.Fatalf("expected duplicate label error, found: %v", err)
+	}
+	if ctx.InvalidExpr() != expr.Body {
+		t.Fatalf("expected the record extension to be invalid")
+	}
 
-	mustInfer(t, env, ctx, expr, "string")
+	ctx.SetRecordExtendKeepLast(true)
+	defer ctx.SetRecordExtendKeepLast(false)
+	mustInfer(t, env, ctx, expr, "{'a} -> {a : B | 'a}")
 
-	expr = Pipe("$", Var("x"),
-		Call(Var("id"), Var("$")),
-		Call(Var("itoa"), Var("$")))
+	ctx.SetRecordExtendDistinct(true)
+	defer ctx.SetRecordExtendDistinct(false)
+	if _, err = ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected duplicate label error for distinct record extensions")
+	}
+}
 
-	mustInfer(t, env, ctx, expr, "string")
+func TestRecordExtendShadowing(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	expr = Pipe("$", Var("x"),
-		Call(Var("id"), Var("$")),
-		Call(Var("add"), Var("$"), Var("$")),
-		Call(Var("itoa"), Var("$")))
+	env.Declare("a", TConst("A"))
+	env.Declare("b", TConst("B"))
 
-	if ast.ExprString(expr) != "pipe $ = x |> id($) |> add($, $) |> itoa($)" {
-		t.Fatalf("expr: %s", ast.ExprString(expr))
+	inner := RecordExtend(nil, LabelValue("x", Var("a")))
+	outer := RecordExtend(inner, LabelValue("x", Var("b")))
+
+	// By default, extending a record with an existing label shadows the existing label:
+	mustInfer(t, env, ctx, outer, "{x : A, x : B}")
+	mustInfer(t, env, ctx, RecordSelect(outer, "x"), "B")
+	mustInfer(t, env, ctx, RecordRestrict(outer, "x"), "{x : A}")
+	mustInfer(t, env, ctx, RecordSelect(RecordRestrict(outer, "x"), "x"), "A")
+	mustInfer(t, env, ctx, Func1("r", RecordSelect(RecordExtend(Var("r"), LabelValue("x", Var("b"))), "x")), "{'a} -> B")
+
+	ctx.SetRecordExtendDistinct(true)
+	defer ctx.SetRecordExtendDistinct(false)
+
+	mustInfer(t, env, ctx, RecordExtend(inner, LabelValue("y", Var("b"))), "{x : A, y : B}")
+	mustInfer(t, env, ctx, Func1("r", RecordExtend(Var("r"), LabelValue("x", Var("b")))), "{'a} -> {x : B | 'a}")
+
+	cases := []struct {
+		expr ast.Expr
+		err  string
+	}{
+		{outer, "Record already contains label x"},
+		{Let("r", inner, RecordExtend(Var("r"), LabelValue("x", Var("a")))), "Record already contains label x"},
+		{RecordExtend(nil, LabelValue("x", Var("a")), LabelValue("x", Var("b"))), "Record extension contains duplicate label x"},
+	}
+	for _, c := range cases {
+		_, err := ctx.Infer(c.expr, env)
+		if err == nil || err.Error() != c.err {
+			t.Fatalf("expected error %q, found: %v", c.err, err)
+		}
 	}
-	mustInfer(t, env, ctx, expr, "string")
 }
 
-func TestControlFlow(t *testing.T) {
+func TestUnifyOpenRows(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	env.Declare("n", TConst("int"))
-	env.Declare("b", TConst("bool"))
-	env.Declare("zero", TConst("int"))
-	env.Declare("dec", TArrow1(TConst("int"), TConst("int")))
-	env.Declare("cmp", TArrow2(TConst("int"), TConst("int"), TConst("bool")))
-
-	cfg := ControlFlow("strange_loop", "local_x")
+	env.Declare("someint", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
+	A := env.NewGenericVar()
+	env.Declare("same", TArrow2(A, A, A))
 
-	cfg.SetEntry(
-		DerefAssign(Var("local_x"), Call(Var("dec"), Var("n"))),
-		Call(Var("cmp"), Deref(Var("local_x")), Var("zero")))
+	// Each open row is extended with the labels missing from it, sharing a fresh tail:
+	r := RecordExtend(Var("r"), LabelValue("a", Var("someint")))
+	s := RecordExtend(Var("s"), LabelValue("b", Var("somebool")))
+	mustInfer(t, env, ctx, Func2("r", "s", Call(Var("same"), r, s)), "({b : bool | 'a}, {a : int | 'a}) -> {a : int, b : bool | 'a}")
+}
 
-	cfg.SetReturn(Deref(Var("local_x")))
+func TestRecordMerge(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	L0 := cfg.AddBlock(
-		DerefAssign(Var("local_x"), Call(Var("dec"), Deref(Var("local_x")))),
-		Call(Var("cmp"), Deref(Var("local_x")), Var("zero")))
+	env.Declare("someint", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
+	env.Declare("useb", TArrow1(TRecordFlat(map[string]types.Type{"b": TConst("int")}), TConst("int")))
 
-	L1 := cfg.AddBlock(
-		DerefAssign(Var("local_x"), Call(Var("dec"), Deref(Var("local_x")))),
-		Call(Var("cmp"), Deref(Var("local_x")), Var("zero")))
+	left := RecordExtend(nil, LabelValue("a", Var("someint")), LabelValue("b", Var("somebool")))
+	right := RecordExtend(nil, LabelValue("c", Var("somebool")))
+	overlapping := RecordExtend(nil, LabelValue("b", Var("someint")), LabelValue("c", Var("somebool")))
 
-	cfg.AddJump(cfg.Entry, cfg.Return)
-	cfg.AddJump(cfg.Entry, L0)
-	cfg.AddJump(L0, L1)
-	cfg.AddJump(L1, L0)
-	cfg.AddJump(L1, cfg.Return)
+	if ast.ExprString(RecordMerge(left, right)) != "{...{a = someint, b = somebool}, ...{c = somebool}}" {
+		t.Fatalf("expr: %s", ast.ExprString(RecordMerge(left, right)))
+	}
 
-	mustInfer(t, env, ctx, cfg, "int")
+	// disjoint merges:
+	mustInfer(t, env, ctx, RecordMerge(left, right), "{a : int, b : bool, c : bool}")
+	mustInfer(t, env, ctx, RecordMerge(left, RecordEmpty()), "{a : int, b : bool}")
+	mustInfer(t, env, ctx, RecordMerge(RecordEmpty(), RecordEmpty()), "{}")
+	mustInfer(t, env, ctx, RecordSelect(RecordMerge(left, right), "c"), "bool")
+
+	// open records are rejected, since labels later unified into an open row could overlap:
+	openMerges := []ast.Expr{
+		Func1("r", RecordMerge(Var("r"), right)),
+		Func1("r", RecordMerge(left, Var("r"))),
+		Func1("r", RecordMerge(left, RecordExtend(Var("r"), LabelValue("c", Var("someint"))))),
+		Func2("r", "s", RecordMerge(Var("r"), Var("s"))),
+		// b would overlap after r is unified with {b : int}:
+		Func1("r", Let("merged", RecordMerge(left, Var("r")), Call(Var("useb"), Var("r")))),
+	}
+	for _, expr := range openMerges {
+		if _, err := ctx.Infer(expr, env); err == nil || err.Error() != "Record merge requires closed records" {
+			t.Fatalf("expected open record merge error for %s, found: %v", ast.ExprString(expr), err)
+		}
+	}
+	if _, err := ctx.Infer(RecordMerge(left, Var("someint")), env); err == nil {
+		t.Fatalf("expected non-record merge error")
+	}
 
-	expect := "strange_loop(local_x) {" +
-		"entry : {*local_x = dec(n); cmp(*local_x, zero)}, " +
-		"return : *local_x, " +
-		"L0 : {*local_x = dec(*local_x); cmp(*local_x, zero)}, " +
-		"L1 : {*local_x = dec(*local_x); cmp(*local_x, zero)}" +
-		"} in {entry -> [return, L0], L0 -> [L1], L1 -> [return, L0]}"
-
-	if ast.ExprString(cfg) != expect {
-		t.Fatalf("expr: %s", ast.ExprString(cfg))
+	// overlapping labels:
+	merge := RecordMerge(left, overlapping)
+	if _, err := ctx.Infer(merge, env); err == nil || err.Error() != "Record merge contains overlapping label b" {
+		t.Fatalf("expected overlapping label error, found: %v", err)
+	}
+	if ctx.InvalidExpr() != merge {
+		t.Fatalf("expected the merge expression to be invalid")
 	}
 
-	// Error detection for loops (inferred as recursive functions):
+	ctx.SetRecordMergeRightBiased(true)
+	defer ctx.SetRecordMergeRightBiased(false)
 
-	cfg = ControlFlow("invalid_loop", "local_n", "local_b", "local_row")
+	mustInfer(t, env, ctx, merge, "{a : int, b : int, c : bool}")
+	mustInfer(t, env, ctx, RecordMerge(overlapping, left), "{a : int, b : bool, c : bool}")
+	mustInfer(t, env, ctx, RecordRestrict(merge, "b"), "{a : int, c : bool}")
 
-	cfg.SetEntry(
-		DerefAssign(Var("local_n"), Var("n")),
-		DerefAssign(Var("local_b"), Var("b")),
-		DerefAssign(Var("local_row"), RecordExtend(RecordEmpty(),
-			LabelValue("n", Var("n")),
-			LabelValue("b", Var("b")))),
-		Call(Var("cmp"), Deref(Var("local_n")), Var("zero")))
+	// open right records are rejected, since left labels would otherwise be placed over the right record's row:
+	if _, err := ctx.Infer(Func1("r", RecordMerge(left, Var("r"))), env); err == nil || err.Error() != "Record merge requires closed records" {
+		t.Fatalf("expected open record merge error, found: %v", err)
+	}
+}
 
-	cfg.SetReturn(Deref(Var("local_row")))
+func TestRecordDefaults(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	// Record extension within loops is not supported (leads to a recursive type error):
+	env.Declare("someint", TConst("int"))
+	env.Declare("somestring", TConst("string"))
+	env.Declare("somebool", TConst("bool"))
 
-	L0 = cfg.AddBlock(
-		DerefAssign(Var("local_row"), RecordExtend(Deref(Var("local_row")),
-			LabelValue("n", Deref(Var("local_n"))),
-			LabelValue("b", Deref(Var("local_b"))))),
-		DerefAssign(Var("local_n"), Call(Var("dec"), Deref(Var("local_n")))),
-		Call(Var("cmp"), Deref(Var("local_n")), Var("zero")))
+	defaults := RecordExtend(nil,
+		LabelValue("host", Var("somestring")),
+		LabelValue("port", Var("someint")),
+		LabelValue("verbose", Var("somebool")))
 
-	L1 = cfg.AddBlock(
-		DerefAssign(Var("local_row"), RecordExtend(Deref(Var("local_row")),
-			LabelValue("n", Deref(Var("local_n"))),
-			LabelValue("b", Deref(Var("local_b"))))),
-		DerefAssign(Var("local_n"), Call(Var("dec"), Deref(Var("local_n")))),
-		Call(Var("cmp"), Deref(Var("local_n")), Var("zero")))
+	// Labels which are not overridden take their default values:
+	mustInfer(t, env, ctx, RecordDefaults(defaults, RecordExtend(nil, LabelValue("port", Var("someint")))),
+		"{host : string, port : int, verbose : bool}")
+	mustInfer(t, env, ctx, RecordDefaults(defaults, RecordEmpty()), "{host : string, port : int, verbose : bool}")
 
-	cfg.AddJump(cfg.Entry, cfg.Return)
-	cfg.AddJump(cfg.Entry, L0)
-	cfg.AddJump(L0, L1)
-	cfg.AddJump(L1, L0)
-	cfg.AddJump(L1, cfg.Return)
+	// The types of overrides are unified with the types of their default values:
+	expr := Func1("port", RecordDefaults(defaults, RecordExtend(nil, LabelValue("port", Var("port")))))
+	mustInfer(t, env, ctx, expr, "int -> {host : string, port : int, verbose : bool}")
 
-	if _, err := ctx.Infer(cfg, env); err == nil {
-		t.Fatalf("expected recursive type error")
+	// Open overrides are rejected, since overridden labels could not be unified with their default values:
+	expr = Func1("overrides", RecordDefaults(defaults, Var("overrides")))
+	if _, err := ctx.Infer(expr, env); err == nil || err.Error() != "Record merge requires closed records" {
+		t.Fatalf("expected open record merge error, found: %v", err)
+	}
+
+	// Overrides with incompatible types are rejected:
+	merge := RecordDefaults(defaults, RecordExtend(nil, LabelValue("port", Var("somestring"))))
+	_, err := ctx.Infer(merge, env)
+	if err == nil || !strings.HasPrefix(err.Error(), "Override for label port does not match the type of its default value") {
+		t.Fatalf("expected override type error, found: %v", err)
+	}
+	if ctx.InvalidExpr() != merge {
+		t.Fatalf("expected the merge expression to be invalid")
 	}
 }
 
-func TestRecursiveTypes(t *testing.T) {
+func TestRecordUpdate(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	params := []*types.Var{env.NewGenericVar()}
-	list := env.NewSimpleRecursive(params, func(rec *types.Recursive, self *types.RecursiveLink) {
-		a := rec.Params[0]
-		rec.AddType("list", TAlias(TApp(TConst("list"), a),
-			TRecordFlat(map[string]types.Type{"head": a, "tail": self})))
-	})
+	env.Declare("one", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
+	env.Declare("a", TRecordFlat(map[string]types.Type{"x": TConst("bool"), "y": TConst("string")}))
+	env.Declare("b", TRecordFlat(map[string]types.Type{"x": TConst("int"), "z": TConst("float"), "w": TConst("char")}))
 
-	env.Declare("someintlist", list.WithParams(env, TConst("int")).GetType("list"))
+	setX := Func1("r", RecordUpdate(Var("r"), LabelValue("x", Var("one"))))
+	mustInfer(t, env, ctx, setX, "{x : 'a | 'b} -> {x : int | 'b}")
+	if s := ast.ExprString(setX); s != "fn (r) -> {r | x = one}" {
+		t.Fatalf("expr: %s", s)
+	}
 
-	var expr ast.Expr = RecordSelect(RecordSelect(RecordSelect(Var("someintlist"), "tail"), "tail"), "tail")
-	mustInfer(t, env, ctx, expr, "list[int]")
+	// The row tail is generalized, so the update applies to any record containing the label:
+	expr := Let("setX", setX, RecordExtend(nil,
+		LabelValue("a", Call(Var("setX"), Var("a"))),
+		LabelValue("b", Call(Var("setX"), Var("b")))))
+	mustInfer(t, env, ctx, expr, "{a : {x : int, y : string}, b : {w : char, x : int, z : float}}")
 
-	expr = RecordSelect(RecordSelect(RecordSelect(Var("someintlist"), "tail"), "tail"), "head")
-	mustInfer(t, env, ctx, expr, "int")
+	// Multiple labels are updated in order:
+	mustInfer(t, env, ctx, RecordUpdate(Var("b"), LabelValue("x", Var("somebool")), LabelValue("z", Var("one"))), "{w : char, x : bool, z : int}")
+	mustInfer(t, env, ctx, Func1("r", RecordUpdate(Var("r"))), "{'a} -> {'a}")
 
-	a, b := env.NewGenericVar(), env.NewGenericVar()
-	listA, listB := list.WithParams(env, a).GetType("list"), list.WithParams(env, b).GetType("list")
-	env.Declare("list_map", TArrow2(listA, TArrow1(a, b), listB))
-	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
-	env.Declare("atoi", TArrow1(TConst("string"), TConst("int")))
+	// The updated label must be present:
+	_, err := ctx.Infer(RecordUpdate(Var("a"), LabelValue("z", Var("one"))), env)
+	if err == nil || !strings.HasPrefix(err.Error(), "Record update requires label z") {
+		t.Fatalf("expected missing-label error, found: %v", err)
+	}
+}
 
-	expr = RecordSelect(RecordSelect(Call(Var("list_map"), Var("someintlist"), Var("itoa")), "tail"), "tail")
-	mustInfer(t, env, ctx, expr, "list[string]")
+func TestRowPolymorphicSelect(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	expr = RecordSelect(RecordSelect(Call(Var("list_map"), Var("someintlist"), Var("itoa")), "tail"), "head")
-	mustInfer(t, env, ctx, expr, "string")
+	env.Declare("a", TConst("A"))
+	env.Declare("b", TConst("B"))
 
-	expr = Pipe("$", Var("someintlist"),
-		Call(Var("list_map"), Var("$"), Var("itoa")),
-		RecordSelect(Var("$"), "tail"),
-		Call(Var("list_map"), Var("$"), Var("atoi")),
-		RecordSelect(Var("$"), "tail"),
-		Call(Var("list_map"), Var("$"), Var("itoa")),
-		RecordSelect(Var("$"), "head"))
+	getX := Func1("r", RecordSelect(Var("r"), "x"))
+	mustInfer(t, env, ctx, getX, "{x : 'a | 'b} -> 'a")
+	mustInfer(t, env, ctx, Let("get_x", getX, Var("get_x")), "{x : 'a | 'b} -> 'a")
+
+	// The row tail must be generalized at the let-binding, so get_x applies to any record containing x:
+	expr := Let("get_x", getX,
+		RecordExtend(nil,
+			LabelValue("ab", Call(Var("get_x"), RecordExtend(nil, LabelValue("x", Var("a")), LabelValue("y", Var("b"))))),
+			LabelValue("b", Call(Var("get_x"), RecordExtend(nil, LabelValue("x", Var("b"))))),
+			LabelValue("ba", Call(Var("get_x"), RecordExtend(nil, LabelValue("x", Var("b")), LabelValue("z", Var("a")), LabelValue("w", RecordEmpty()))))))
+	mustInfer(t, env, ctx, expr, "{ab : A, b : B, ba : B}")
+
+	// The row tail must not be generalized within the function body:
+	expr = Let("f", Func1("r", RecordExtend(nil,
+		LabelValue("x", RecordSelect(Var("r"), "x")),
+		LabelValue("r", RecordRestrict(Var("r"), "x")))),
+		Var("f"))
+	mustInfer(t, env, ctx, expr, "{x : 'a | 'b} -> {r : {'b}, x : 'a}")
 
-	mustInfer(t, env, ctx, expr, "string")
+	if _, err := ctx.Infer(Call(getX, RecordExtend(nil, LabelValue("y", Var("a")))), env); err == nil {
+		t.Fatalf("expected missing-label error")
+	}
 }
 
-func TestMutuallyRecursiveTypes(t *testing.T) {
+func TestOpenRecordArguments(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	cycle := env.NewRecursive(nil, func(rec *types.Recursive) {
-		int2bool := TApp(TConst("cycle"), TConst("int"), TConst("bool"))
-		bool2int := TApp(TConst("cycle"), TConst("bool"), TConst("int"))
-		rec.AddType("int2bool", int2bool)
-		rec.AddType("bool2int", bool2int)
-		int2bool.Underlying = TRecordFlat(map[string]types.Type{
-			"v": TConst("int"), "link": TRecursiveLink(rec, "bool2int"),
-		})
-		bool2int.Underlying = TRecordFlat(map[string]types.Type{
-			"v": TConst("bool"), "link": TRecursiveLink(rec, "int2bool"),
-		})
-	})
+	env.Declare("someint", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
+	a, r := env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("with_y", TArrow1( // {x : 'a | 'r} -> {x : 'a, y : 'a | 'r}
+		TRecord(TRowExtend(r, TypeMap(map[string]types.Type{"x": a}))),
+		TRecord(TRowExtend(r, TypeMap(map[string]types.Type{"x": a, "y": a})))))
+
+	narrow := RecordExtend(nil, LabelValue("x", Var("someint")))
+	wide := RecordExtend(nil, LabelValue("x", Var("someint")), LabelValue("z", Var("somebool")))
+	wider := RecordExtend(nil, LabelValue("w", Var("someint")), LabelValue("x", Var("somebool")), LabelValue("z", Var("someint")))
+
+	// Extra labels of wider records pass through the row variable:
+	mustInfer(t, env, ctx, Call(Var("with_y"), narrow), "{x : int, y : int}")
+	mustInfer(t, env, ctx, Call(Var("with_y"), wide), "{x : int, y : int, z : bool}")
+	mustInfer(t, env, ctx, RecordExtend(nil,
+		LabelValue("a", Call(Var("with_y"), wide)),
+		LabelValue("b", Call(Var("with_y"), wider))),
+		"{a : {x : int, y : int, z : bool}, b : {w : int, x : bool, y : bool, z : int}}")
+
+	// The row variable of a let-bound function is generalized, so the function may be applied to different records:
+	f := Func1("r", RecordExtend(Var("r"), LabelValue("y", RecordSelect(Var("r"), "x"))))
+	mustInfer(t, env, ctx, f, "{x : 'a | 'b} -> {x : 'a, y : 'a | 'b}")
+	mustInfer(t, env, ctx, Let("f", f, RecordExtend(nil,
+		LabelValue("a", Call(Var("f"), wide)),
+		LabelValue("b", Call(Var("f"), wider)),
+		LabelValue("c", Call(Var("f"), narrow)))),
+		"{a : {x : int, y : int, z : bool}, b : {w : int, x : bool, y : bool, z : int}, c : {x : int, y : int}}")
+
+	// Missing labels are rejected:
+	if _, err := ctx.Infer(Call(Var("with_y"), RecordExtend(nil, LabelValue("z", Var("someint")))), env); err == nil {
+		t.Fatalf("expected missing label error")
+	}
+}
 
-	int2bool := cycle.GetType("int2bool")
-	env.Declare("someint2bool", int2bool)
+func TestOptionChain(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	var expr ast.Expr = Var("someint2bool")
-	mustInfer(t, env, ctx, expr, "cycle[int, bool]")
+	option := func(t types.Type) types.Type {
+		return TVariant(TRowExtend(nil, TypeMap(map[string]types.Type{"some": t, "none": TRecordFlat(nil)})))
+	}
+	address := TRecordFlat(map[string]types.Type{"city": TConst("string")})
+	user := TRecordFlat(map[string]types.Type{"name": TConst("string"), "address": address, "phone": option(TConst("string"))})
+	env.Declare("user", option(user))
+	env.Declare("someint", TConst("int"))
+	env.Declare("variant", TVariant(TRowExtend(nil, TypeMap(map[string]types.Type{"some": user, "other": TConst("int")}))))
 
-	expr = Let("f", Func1("x", RecordSelect(Var("x"), "link")),
-		Call(Var("f"), Var("someint2bool")))
+	expr := OptionChain(OptionChain(Var("user"), "address"), "city")
+	if ast.ExprString(expr) != "user?.address?.city" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, OptionChain(Var("user"), "name"), "[none : {}, some : string]")
+	mustInfer(t, env, ctx, OptionChain(Var("user"), "phone"), "[none : {}, some : [none : {}, some : string]]")
+	mustInfer(t, env, ctx, expr, "[none : {}, some : string]")
+	mustInfer(t, env, ctx, Func1("o", OptionChain(Var("o"), "x")), "[none : 'a, some : {x : 'b | 'c}] -> [none : 'a, some : 'b]")
+
+	// Chained selections require the selected value to be a record:
+	mustInfer(t, env, ctx, Func1("o", OptionChain(OptionChain(Var("o"), "x"), "y")),
+		"[none : 'a, some : {x : {y : 'b | 'c} | 'd}] -> [none : 'a, some : 'b]")
+	if _, err := ctx.Infer(OptionChain(OptionChain(Var("user"), "name"), "city"), env); err == nil ||
+		err.Error() != "Option chain requires a record with label city within the some case, found string" {
+		t.Fatalf("expected non-record error, found: %v", err)
+	}
 
-	mustInfer(t, env, ctx, expr, "cycle[bool, int]")
+	for _, c := range []struct {
+		expr   ast.Expr
+		expect string
+	}{
+		{OptionChain(Var("someint"), "x"), "Option chain requires a variant with labels some and none, found int"},
+		{OptionChain(Var("variant"), "name"), "Option chain requires a variant with labels some and none"},
+		{OptionChain(Var("user"), "email"), "Option chain requires a record with label email within the some case"},
+	} {
+		_, err := ctx.Infer(c.expr, env)
+		if err == nil || !strings.HasPrefix(err.Error(), c.expect) {
+			t.Fatalf("expected error for %s, found: %v", ast.ExprString(c.expr), err)
+		}
+		if ctx.InvalidExpr() != c.expr {
+			t.Fatalf("expected %s to be invalid", ast.ExprString(c.expr))
+		}
+	}
+}
 
-	expr = Let("f", Func1("x", RecordSelect(Var("x"), "v")),
-		Call(Var("f"), Var("someint2bool")))
+func TestRecordSelectModes(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	mustInfer(t, env, ctx, expr, "int")
+	env.Declare("a", TConst("A"))
+	env.Declare("open", TRecord(TRowExtend(env.NewGenericVar(), TypeMap(map[string]types.Type{"a": TConst("A")}))))
+	env.Declare("closed", TRecordFlat(map[string]types.Type{"a": TConst("A")}))
 
-	expr = Let("link", RecordSelect(Var("someint2bool"), "link"),
-		RecordSelect(Var("link"), "link"))
+	// Inferring mode (default):
 
-	mustInfer(t, env, ctx, expr, "cycle[int, bool]")
+	mustInfer(t, env, ctx, RecordSelect(Var("open"), "a"), "A")
+	mustInfer(t, env, ctx, RecordSelect(Var("open"), "b"), "'a")
+	mustInfer(t, env, ctx, RecordSelect(Var("closed"), "a"), "A")
+	if _, err := ctx.Infer(RecordSelect(Var("closed"), "b"), env); err == nil {
+		t.Fatalf("expected missing-label error for closed record")
+	}
 
-	expr = Pipe("$", Var("someint2bool"),
-		RecordSelect(Var("$"), "link"),
-		RecordSelect(Var("$"), "link"),
-		RecordSelect(Var("$"), "link"),
-		RecordSelect(Var("$"), "v"))
+	// Strict mode:
 
-	mustInfer(t, env, ctx, expr, "bool")
+	ctx.SetRecordSelectMode(RecordSelectStrict)
+	mustInfer(t, env, ctx, RecordSelect(Var("open"), "a"), "A")
+	mustInfer(t, env, ctx, RecordSelect(Var("closed"), "a"), "A")
+	mustInfer(t, env, ctx, Func1("r", RecordSelect(Var("r"), "x")), "{x : 'a | 'b} -> 'a")
+	if _, err := ctx.Infer(RecordSelect(Var("open"), "b"), env); err == nil || err.Error() != "Record does not contain label b" {
+		t.Fatalf("expected missing-label error for open record, found %v", err)
+	}
+	if _, err := ctx.Infer(RecordSelect(Var("closed"), "b"), env); err == nil {
+		t.Fatalf("expected missing-label error for closed record")
+	}
 }
 
-func TestGenericMutuallyRecursiveTypes(t *testing.T) {
+func TestFieldPath(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	params := []*types.Var{env.NewGenericVar(), env.NewGenericVar()}
-	cycle := env.NewRecursive(params, func(rec *types.Recursive) {
-		a, b := rec.Params[0], rec.Params[1]
-		a2b := TApp(TConst("cycle"), a, b)
-		b2a := TApp(TConst("cycle"), b, a)
-		rec.AddType("a2b", a2b)
-		rec.AddType("b2a", b2a)
-		a2b.Underlying = TRecordFlat(map[string]types.Type{
-			"v": a, "link": TRecursiveLink(rec, "b2a"),
-		})
-		b2a.Underlying = TRecordFlat(map[string]types.Type{
-			"v": b, "link": TRecursiveLink(rec, "a2b"),
-		})
-	})
-
-	intboolcycle := cycle.WithParams(env, TConst("int"), TConst("bool"))
-	env.Declare("someint2bool", intboolcycle.GetType("a2b"))
+	inner := TRecordFlat(map[string]types.Type{"c": TConst("C")})
+	middle := TRecordFlat(map[string]types.Type{"b": inner})
+	env.Declare("r", TRecordFlat(map[string]types.Type{"a": middle}))
 
-	expr := Pipe("$", Var("someint2bool"),
-		RecordSelect(Var("$"), "link"),
-		RecordSelect(Var("$"), "link"),
-		RecordSelect(Var("$"), "link"))
+	path := FieldPath(Var("r"), "a", "b", "c")
+	mustInfer(t, env, ctx, path, "C")
+	if err := ctx.AnnotateDirect(path, env); err != nil {
+		t.Fatal(err)
+	}
+	if path.Type() == nil || types.TypeString(path.Type()) != "C" {
+		t.Fatalf("expected the final field type to be annotated, found %s", types.TypeString(path.Type()))
+	}
+	mustInfer(t, env, ctx, FieldPath(Var("r"), "a", "b"), "{c : C}")
+	mustInfer(t, env, ctx, FieldPath(Var("r")), "{a : {b : {c : C}}}")
+	mustInfer(t, env, ctx, Func1("x", FieldPath(Var("x"), "a", "b")), "{a : {b : 'a | 'b} | 'c} -> 'a")
+	if s := ast.ExprString(path); s != "r.a.b.c" {
+		t.Fatalf("expr: %s", s)
+	}
 
-	mustInfer(t, env, ctx, expr, "cycle[bool, int]")
+	// A missing label mid-path reports the path up to the failure:
+	_, err := ctx.Infer(FieldPath(Var("r"), "a", "x", "c"), env)
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed to select a.x: ") {
+		t.Fatalf("expected missing-label error for a.x, found: %v", err)
+	}
+	ctx.SetRecordSelectMode(RecordSelectStrict)
+	_, err = ctx.Infer(FieldPath(Var("r"), "a", "b", "x"), env)
+	if err == nil || err.Error() != "Failed to select a.b.x: Record does not contain label x" {
+		t.Fatalf("expected missing-label error for a.b.x, found: %v", err)
+	}
+	mustInfer(t, env, ctx, path, "C")
 }
 
-func TestRecursiveLet(t *testing.T) {
+func TestForall(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
-	A := env.NewGenericVar()
-	env.Declare("if", TArrow3(TConst("bool"), A, A, A))
-	env.Declare("somebool", TConst("bool"))
+	list := TConst("list")
+	mapType := Forall([]string{"a", "b"}, func(vars map[string]*types.Var) types.Type {
+		a, b := vars["a"], vars["b"]
+		return TArrow1(TArrow1(a, b), TArrow1(TApp(list, a), TApp(list, b)))
+	})
+	if types.TypeString(mapType) != "('a -> 'b) -> list['a] -> list['b]" {
+		t.Fatalf("type: %s", types.TypeString(mapType))
+	}
+	if !mapType.IsGeneric() {
+		t.Fatalf("expected a generalized type")
+	}
 
-	var expr ast.Expr
-	expr =
-		Func1("x",
-			Let("f",
-				Func1("x",
-					Call(
-						Var("if"),
-						Var("somebool"),
-						Var("x"),
-						Call(Var("f"), Call(Var("add"), Var("x"), Var("x"))),
-					),
-				),
-				Call(Var("f"), Var("x")),
-			))
+	env.Declare("map", mapType)
+	env.Declare("show", TArrow1(TConst("int"), TConst("string")))
+	env.Declare("ints", TApp(list, TConst("int")))
+	mustInfer(t, env, ctx, Call(Call(Var("map"), Var("show")), Var("ints")), "list[string]")
+	mustInfer(t, env, ctx, Var("map"), "('a -> 'b) -> list['a] -> list['b]")
+}
 
-	if ast.ExprString(expr) != "fn (x) -> let f(x) = if(somebool, x, f(add(x, x))) in f(x)" {
-		t.Fatalf("expr: %s", ast.ExprString(expr))
-	}
-	mustInfer(t, env, ctx, expr, "int -> int")
+func TestAliases(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	// Record extension within recursive functions is not supported:
+	a := env.NewGenericVar()
+	sliceHeader := TRecord(TRowExtend(types.RowEmptyPointer, TypeMap(map[string]types.Type{
+		"data": TRef(TApp(TConst("array"), a)),
+		"len":  TConst("int"),
+		"cap":  TConst("int"),
+	})))
+	slice := Generalize(TAlias(TApp(TConst("slice"), a), sliceHeader))
 
-	env.Declare("someint", TConst("int"))
+	intSliceHeader := TRecord(TRowExtend(types.RowEmptyPointer, TypeMap(map[string]types.Type{
+		"data": TRef(TApp(TConst("array"), TConst("int"))),
+		"len":  TConst("int"),
+		"cap":  TConst("int"),
+	})))
+	intSlice := TAlias(TApp(TConst("slice"), TConst("int")), intSliceHeader)
 
-	expr =
-		Let("f", Func1("x", RecordExtend(Call(Var("f"), Var("x")), LabelValue("i", Var("someint")))),
-			Var("f"))
+	env.Declare("append", TArrow2(slice, slice, slice))
+	env.Declare("someints", intSliceHeader)
+	env.Declare("someints2", intSlice)
+	env.Declare("someints3", TApp(TConst("slice"), TConst("int")))
 
-	if _, err := ctx.Infer(expr, env); err == nil {
-		t.Fatalf("expected recursive type error")
-	}
+	mustInfer(t, env, ctx, Var("someints"), "{cap : int, data : ref[array[int]], len : int}")
+	mustInfer(t, env, ctx, Var("someints2"), "slice[int]")
+
+	sel := Let("f", Func1("x", RecordSelect(Var("x"), "data")),
+		Call(Var("f"), Var("someints2")))
+
+	mustInfer(t, env, ctx, sel, "ref[array[int]]")
+	mustInfer(t, env, ctx, Call(Var("append"), Var("someints"), Var("someints")), "slice[int]")
+	mustInfer(t, env, ctx, Call(Var("append"), Var("someints"), Var("someints2")), "slice[int]")
+	mustInfer(t, env, ctx, Call(Var("append"), Var("someints2"), Var("someints3")), "slice[int]")
 }
 
-func TestFixedPoint(t *testing.T) {
+func TestAbstractUnifier(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	// fix :: ('a -> 'a) -> 'a
-	// fix = fn (f) -> f(fix(f))
+	intType, boolType := TConst("int"), TConst("bool")
+	cell, box := TAbstract("cell"), TAbstract("box")
 	a := env.NewGenericVar()
-	env.Declare("fix", TArrow1(TArrow1(a, a), a))
+	env.Declare("new_cell", TArrow1(a, TApp(cell, a)))
+	b := env.NewGenericVar()
+	env.Declare("same_cell", TArrow2(TApp(cell, b), TApp(cell, b), TApp(cell, b)))
+	c := env.NewGenericVar()
+	env.Declare("same_box", TArrow2(TApp(box, c), TApp(box, c), TApp(box, c)))
+	env.Declare("intcell", TApp(cell, intType))
+	env.Declare("boolcell", TApp(cell, boolType))
+	env.Declare("intbox", TApp(box, intType))
+	env.Declare("boolbox", TApp(box, boolType))
+	env.Declare("someint", intType)
 
-	a = env.NewGenericVar()
-	env.Declare("merge", TArrow2(a, a, a))
+	calls := 0
+	ctx.SetAbstractUnifier(func(a, b *types.App) (bool, error) {
+		calls++
+		if types.RealType(a.Const).(*types.Const).Name != "cell" {
+			return false, nil
+		}
+		// Cells are invariant in their type-parameter:
+		if err := ctx.Unify(env, a.Params[0], b.Params[0]); err != nil {
+			return true, errors.New("Abstract type cell is invariant in its type-parameter")
+		}
+		return true, nil
+	})
+	defer ctx.SetAbstractUnifier(nil)
 
-	// fix(fn (f) -> fn (x) -> merge(x, f(x)))
-	expr := Call(Var("fix"), Func1("f", Func1("x", Call(Var("merge"), Var("x"), Call(Var("f"), Var("x"))))))
+	mustInfer(t, env, ctx, Call(Var("same_cell"), Var("intcell"), Call(Var("new_cell"), Var("someint"))), "cell[int]")
+	if calls == 0 {
+		t.Fatalf("expected the abstract unifier to be called")
+	}
+	_, err := ctx.Infer(Call(Var("same_cell"), Var("intcell"), Var("boolcell")), env)
+	if err == nil || err.Error() != "Abstract type cell is invariant in its type-parameter" {
+		t.Fatalf("expected invariance error, found: %v", err)
+	}
 
-	mustInfer(t, env, ctx, expr, "'a -> 'a")
+	// Unhandled abstract types are unified structurally:
+	calls = 0
+	mustInfer(t, env, ctx, Call(Var("same_box"), Var("intbox"), Var("intbox")), "box[int]")
+	if _, err = ctx.Infer(Call(Var("same_box"), Var("intbox"), Var("boolbox")), env); err == nil || err.Error() != "Failed to unify int with bool" {
+		t.Fatalf("expected structural unification error, found: %v", err)
+	}
+	if calls == 0 {
+		t.Fatalf("expected the abstract unifier to be called")
+	}
+	// Applications of different abstract type constants are not passed to the unifier:
+	calls = 0
+	if _, err = ctx.Infer(Call(Var("same_box"), Var("intbox"), Var("intcell")), env); err == nil || calls != 1 {
+		t.Fatalf("expected mismatched abstract types to fail without the unifier, found: %v (%d calls)", err, calls)
+	}
+}
 
-	a = env.NewGenericVar()
-	env.Declare("if", TArrow3(TConst("bool"), a, a, a))
+func TestPhantomAliases(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	// The type-parameter of tagged does not appear within the underlying type:
+	repr := func() types.Type { return TRecordFlat(map[string]types.Type{"value": TConst("int")}) }
+	tagged := Generalize(TAlias(TApp(TConst("tagged"), env.NewGenericVar()), repr()))
+
+	env.Declare("tag_int", TAlias(TApp(TConst("tagged"), TConst("int")), repr()))
+	env.Declare("tag_bool", TAlias(TApp(TConst("tagged"), TConst("bool")), repr()))
+	env.Declare("untag", TArrow1(tagged, TConst("int")))
+	a := env.NewGenericVar()
+	env.Declare("same", TArrow2(a, a, TConst("bool")))
+
+	mustInfer(t, env, ctx, Call(Var("untag"), Var("tag_int")), "int")
+	mustInfer(t, env, ctx, Call(Var("untag"), Var("tag_bool")), "int")
+	mustInfer(t, env, ctx, Call(Var("same"), Var("tag_int"), Var("tag_int")), "bool")
+	mustInfer(t, env, ctx, Func1("x", Call(Var("same"), Var("x"), Var("tag_int"))), "tagged[int] -> bool")
+
+	for _, expr := range []ast.Expr{
+		Call(Var("same"), Var("tag_int"), Var("tag_bool")),
+		Call(Var("same"), Var("tag_bool"), Var("tag_int")),
+		Let("f", Func1("x", Call(Var("same"), Var("x"), Var("tag_int"))), Call(Var("f"), Var("tag_bool"))),
+	} {
+		_, err := ctx.Infer(expr, env)
+		if err == nil {
+			t.Fatalf("expected phantom type-parameters to differ for %s", ast.ExprString(expr))
+		}
+		if !strings.Contains(err.Error(), "Failed to unify") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestVariableScopeAnnotations(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	expr := Func2("x", "y",
+		LetGroup([]ast.LetBinding{
+			{"a", Var("x")},
+			{"b", Var("y")},
+		},
+			Let("z", Var("a"),
+				Let("z2", Var("b"),
+					Let("z2", Var("b"),
+						Var("z2"))))))
+
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	ast.WalkExpr(expr, func(e ast.Expr) {
+		if v, ok := e.(*ast.Var); ok {
+			if v.Scope() == nil {
+				t.Fatalf("nil scope annotation for %s", v.Name)
+			}
+			seen = append(seen, v.Name)
+			switch v.Name {
+			case "x", "y":
+				if _, ok := v.Scope().Expr.(*ast.Func); !ok {
+					t.Fatalf("wrong scope annotation for %s, found %s", v.Name, v.Scope().Expr.ExprName())
+				}
+
+			case "a", "b":
+				if _, ok := v.Scope().Expr.(*ast.LetGroup); !ok {
+					t.Fatalf("wrong scope annotation for %s, found %s", v.Name, v.Scope().Expr.ExprName())
+				}
+
+			case "z2":
+				if _, ok := v.Scope().Expr.(*ast.Let); !ok {
+					t.Fatalf("wrong scope annotation for %s, found %s", v.Name, v.Scope().Expr.ExprName())
+				}
+				if v.Scope().Parent == nil {
+					t.Logf("nil parent annotation for %s", v.Name)
+				}
+				if _, ok := v.Scope().Parent.Parent.Parent.Expr.(*ast.LetGroup); !ok {
+					t.Fatalf("wrong parent annotation for z2, found %s", v.Scope().Parent.Expr.ExprName())
+				}
+				if _, ok := v.Scope().Parent.Parent.Parent.Parent.Expr.(*ast.Func); !ok {
+					t.Fatalf("wrong scope annotation for top parent of z2, found %s", v.Scope().Expr.ExprName())
+				}
+			}
+		}
+	})
+
+	for i, name := range []string{"x", "y", "a", "b", "b", "z2"} {
+		if seen[i] != name {
+			t.Fatalf("not all variables were visited/checked: %#+v", seen)
+		}
+	}
+
+	env.Declare("x", TConst("int"))
+	varExpr := Var("x")
+	if err := ctx.AnnotateDirect(varExpr, env); err != nil {
+		t.Fatal(err)
+	}
+	if varExpr.Scope() != ast.PredeclaredScope {
+		t.Fatalf("expected predeclared scope")
+	}
+}
+
+func TestClosureCaptures(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+
+	inner := Func1("z", Call(Var("add"), Call(Var("add"), Var("x"), Var("y")), Var("z")))
+	middle := Func1("y", Let("w", Var("x"), inner))
+	outer := Func1("x", middle)
+
+	if err := ctx.AnnotateDirect(outer, env); err != nil {
+		t.Fatal(err)
+	}
+	if len(outer.Captures()) != 0 {
+		t.Fatalf("unexpected captures for outer function: %#+v", outer.Captures())
+	}
+	if !reflect.DeepEqual([]string{"x"}, middle.Captures()) {
+		t.Fatalf("unexpected captures for middle function: %#+v", middle.Captures())
+	}
+	if !reflect.DeepEqual([]string{"x", "y"}, inner.Captures()) {
+		t.Fatalf("unexpected captures for inner function: %#+v", inner.Captures())
+	}
+}
+
+func TestPipes(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("x", TConst("int"))
+	env.Declare("id", TArrow1(TConst("int"), TConst("int")))
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
+
+	expr := Pipe("$", Var("x"),
+		Call(Var("itoa"), Var("$")))
+
+	mustInfer(t, env, ctx, expr, "string")
+
+	expr = Pipe("$", Var("x"),
+		Call(Var("id"), Var("$")),
+		Call(Var("itoa"), Var("$")))
+
+	mustInfer(t, env, ctx, expr, "string")
+
+	expr = Pipe("$", Var("x"),
+		Call(Var("id"), Var("$")),
+		Call(Var("add"), Var("$"), Var("$")),
+		Call(Var("itoa"), Var("$")))
+
+	if ast.ExprString(expr) != "pipe $ = x |> id($) |> add($, $) |> itoa($)" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "string")
+}
+
+func TestStrictPipes(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("x", TConst("int"))
+	env.Declare("y", TConst("int"))
+	env.Declare("id", TArrow1(TConst("int"), TConst("int")))
+	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
+
+	// The second step drops the placeholder:
+	dropped := Pipe("$", Var("x"),
+		Call(Var("id"), Var("$")),
+		Call(Var("id"), Var("y")),
+		Call(Var("itoa"), Var("$")))
+	mustInfer(t, env, ctx, dropped, "string")
+
+	ctx.SetStrictPipe(true)
+	_, err := ctx.Infer(dropped, env)
+	if err == nil || err.Error() != "Step 1 of pipeline does not use the placeholder $" {
+		t.Fatalf("expected strict pipeline error, found: %v", err)
+	}
+	if ctx.InvalidExpr() != dropped.Sequence[1] {
+		t.Fatalf("expected the dropped step to be invalid, found: %s", ast.ExprString(ctx.InvalidExpr()))
+	}
+
+	// A reference within a nested binding of the same name does not use the placeholder:
+	shadowed := Pipe("$", Var("x"),
+		Call(Var("itoa"), Let("$", Var("y"), Var("$"))))
+	if _, err = ctx.Infer(shadowed, env); err == nil {
+		t.Fatalf("expected strict pipeline error for a shadowed placeholder")
+	}
+	nested := Pipe("$", Var("x"),
+		Pipe("$", Call(Var("id"), Var("$")), Call(Var("itoa"), Var("$"))))
+	mustInfer(t, env, ctx, nested, "string")
+	mustInfer(t, env, ctx, Pipe("$", Var("x"), Call(Var("id"), Var("$")), Call(Var("itoa"), Var("$"))), "string")
+}
+
+func TestPipeFanOut(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("x", TConst("int"))
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
+	A := env.NewGenericVar()
+	env.Declare("some", TArrow1(A, TApp(TConst("option"), A)))
+
+	expr := Pipe("$", Var("x"),
+		PipeFanOut(LabelValue("n", Call(Var("add"), Var("$"), Var("$"))), LabelValue("s", Call(Var("itoa"), Var("$")))))
+	if ast.ExprString(expr) != "pipe $ = x |> {n = add($, $), s = itoa($)}" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "{n : int, s : string}")
+
+	// Fan-out results may feed later steps:
+	expr = Pipe("$", Var("x"),
+		PipeFanOut(LabelValue("n", Var("$")), LabelValue("s", Call(Var("itoa"), Var("$")))),
+		PipeFanOut(LabelValue("n", Call(Var("some"), RecordSelect(Var("$"), "n"))), LabelValue("s", Call(Var("some"), RecordSelect(Var("$"), "s")))))
+	mustInfer(t, env, ctx, expr, "{n : option[int], s : option[string]}")
+}
+
+func TestDesugarPipe(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("x", TConst("int"))
+	env.Declare("id", TArrow1(TConst("int"), TConst("int")))
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
+	A := env.NewGenericVar()
+	env.Declare("some", TArrow1(A, TApp(TConst("option"), A)))
+	B := env.NewGenericVar()
+	env.Declare("poly_id", TArrow1(B, B))
+	env.Declare("t", TConst("bool"))
+
+	pipes := []ast.Expr{
+		Pipe("$", Var("x")),
+		Pipe("$", Var("x"), Call(Var("itoa"), Var("$"))),
+		Pipe("$", Var("x"),
+			Call(Var("id"), Var("$")),
+			Call(Var("add"), Var("$"), Var("$")),
+			Call(Var("itoa"), Var("$"))),
+		Pipe("$", Var("x"),
+			PipeFanOut(LabelValue("n", Var("$")), LabelValue("s", Call(Var("itoa"), Var("$")))),
+			PipeFanOut(LabelValue("n", Call(Var("some"), RecordSelect(Var("$"), "n"))), LabelValue("s", Call(Var("some"), RecordSelect(Var("$"), "s"))))),
+		Func1("y", Pipe("$", Var("y"),
+			Call(Var("some"), Var("$")),
+			Pipe("_", Var("$"), Call(Var("some"), Var("_"))))),
+		Pipe("$", Var("x"),
+			Func1("y", Call(Var("add"), Var("$"), Var("y"))),
+			Call(Var("$"), Var("x"))),
+		// Polymorphic steps are generalized:
+		Pipe("$", Var("x"),
+			Func1("y", Var("y")),
+			RecordExtend(nil, LabelValue("a", Call(Var("$"), Var("x"))), LabelValue("b", Call(Var("$"), Var("t"))))),
+		Pipe("$", Var("x"),
+			Call(Var("poly_id"), Var("poly_id")),
+			RecordExtend(nil, LabelValue("a", Call(Var("$"), Var("x"))), LabelValue("b", Call(Var("$"), Var("t"))))),
+	}
+	for _, expr := range pipes {
+		original := ast.ExprString(expr)
+		desugared := ast.DesugarPipe(expr)
+		if ast.ExprString(expr) != original {
+			t.Fatalf("expected the original expression to be unmodified: %s", ast.ExprString(expr))
+		}
+		ast.WalkExpr(desugared, func(e ast.Expr) {
+			if _, ok := e.(*ast.Pipe); ok {
+				t.Fatalf("unexpected pipe within desugared expression: %s", ast.ExprString(desugared))
+			}
+		})
+		pipeType, err := ctx.Infer(expr, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		letType, err := ctx.Infer(desugared, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if types.TypeString(pipeType) != types.TypeString(letType) {
+			t.Fatalf("expected %s, found %s for %s", types.TypeString(pipeType), types.TypeString(letType), ast.ExprString(desugared))
+		}
+	}
+
+	mustInfer(t, env, ctx, pipes[6], "{a : int, b : bool}")
+	mustInfer(t, env, ctx, pipes[7], "{a : int, b : bool}")
+
+	desugared := ast.DesugarPipe(pipes[2])
+	if ast.ExprString(desugared) != "let $ = x in let $ = id($) in let $ = add($, $) in itoa($)" {
+		t.Fatalf("unexpected desugared expression: %s", ast.ExprString(desugared))
+	}
+	// Function steps are bound without self-reference:
+	desugared = ast.DesugarPipe(pipes[5])
+	if ast.ExprString(desugared) != "let $ = x in let $1(y) = add($, y) in let $ = $1 in $(x)" {
+		t.Fatalf("unexpected desugared expression: %s", ast.ExprString(desugared))
+	}
+}
+
+func TestTupleCalls(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("n", TConst("int"))
+	env.Declare("b", TConst("bool"))
+	env.Declare("pair", TTuple(TConst("int"), TConst("bool")))
+	env.Declare("f", TArrow1(TTuple(TConst("int"), TConst("bool")), TConst("string")))
+	A := env.NewGenericVar()
+	env.Declare("fst", TArrow1(TTuple(A, env.NewGenericVar()), A))
+
+	mustInfer(t, env, ctx, Var("f"), "((int, bool)) -> string")
+
+	// Direct application to a single tuple:
+
+	mustInfer(t, env, ctx, Call(Var("f"), Var("pair")), "string")
+	if _, err := ctx.Infer(Call(Var("f"), Var("n"), Var("b")), env); err == nil {
+		t.Fatalf("expected arity error without tupled calls")
+	}
+
+	// Tupled application to multiple arguments:
+
+	ctx.SetTupleCalls(true)
+	mustInfer(t, env, ctx, Call(Var("f"), Var("n"), Var("b")), "string")
+	mustInfer(t, env, ctx, Call(Var("f"), Var("pair")), "string")
+	mustInfer(t, env, ctx, Call(Var("fst"), Var("b"), Var("n")), "bool")
+	if _, err := ctx.Infer(Call(Var("f"), Var("b"), Var("n")), env); err == nil {
+		t.Fatalf("expected type error for mismatched tuple elements")
+	}
+	if _, err := ctx.Infer(Call(Var("f"), Var("n"), Var("b"), Var("n")), env); err == nil {
+		t.Fatalf("expected arity error for mismatched tuple length")
+	}
+}
+
+func TestMaxRowWidth(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+	ctx.SetMaxRowWidth(4)
+
+	labels := make([]ast.LabelValue, 5)
+	for i := range labels {
+		labels[i] = LabelValue(string(byte('a'+i)), RecordEmpty())
+	}
+
+	// {a = {}, b = {}, c = {}, d = {}}
+	mustInfer(t, env, ctx, RecordExtend(nil, labels[:4]...), "{a : {}, b : {}, c : {}, d : {}}")
+
+	// {a = {}, b = {}, c = {}, d = {}, e = {}}
+	_, err := ctx.Infer(RecordExtend(nil, labels...), env)
+	if err == nil || err.Error() != "Row width 5 exceeds the maximum row width 4" {
+		t.Fatalf("expected row width error, found: %v", err)
+	}
+
+	// {e = {} | {a = {}, b = {}, c = {}, d = {}}}
+	_, err = ctx.Infer(RecordExtend(RecordExtend(nil, labels[:4]...), labels[4]), env)
+	if err == nil || err.Error() != "Row width 5 exceeds the maximum row width 4" {
+		t.Fatalf("expected row width error, found: %v", err)
+	}
+
+	// fn (r) -> let x = r.a in let y = r.b in let z = r.c in let w = r.d in r.e
+	var body ast.Expr = RecordSelect(Var("r"), "e")
+	for i := 3; i >= 0; i-- {
+		name := string(byte('a' + i))
+		body = Let("_"+name, RecordSelect(Var("r"), name), body)
+	}
+	_, err = ctx.Infer(Func1("r", body), env)
+	if err == nil || err.Error() != "Row width 5 exceeds the maximum row width 4" {
+		t.Fatalf("expected row width error, found: %v", err)
+	}
+
+	ctx.SetMaxRowWidth(0)
+	mustInfer(t, env, ctx, RecordExtend(nil, labels...), "{a : {}, b : {}, c : {}, d : {}, e : {}}")
+	mustInfer(t, env, ctx, Func1("r", body), "{a : 'a, b : 'b, c : 'c, d : 'd, e : 'e | 'f} -> 'e")
+}
+
+func TestUnusedBindings(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("someint", TConst("int"))
+
+	unusedNames := func() []string {
+		var names []string
+		for _, w := range ctx.Warnings() {
+			names = append(names, w.Name)
+		}
+		return names
+	}
+
+	// let x = someint in let y = x in let _z = someint in someint
+	letExpr := Let("x", Var("someint"), Let("y", Var("x"), Let("_z", Var("someint"), Var("someint"))))
+	mustInfer(t, env, ctx, letExpr, "int")
+	if len(ctx.Warnings()) != 0 {
+		t.Fatalf("unexpected warnings: %#+v", ctx.Warnings())
+	}
+
+	ctx.SetWarnUnusedBindings(true)
+	defer ctx.SetWarnUnusedBindings(false)
+
+	mustInfer(t, env, ctx, letExpr, "int")
+	if names := unusedNames(); !reflect.DeepEqual(names, []string{"y"}) {
+		t.Fatalf("unexpected unused bindings: %v", names)
+	}
+	if w := ctx.Warnings()[0]; w.Message != "Unused binding y" || w.Expr != letExpr.Body {
+		t.Fatalf("unexpected warning: %#+v", w)
+	}
+
+	// fn (a, b, _) -> let a = someint in a
+	fnExpr := Func3("a", "b", "_", Let("a", Var("someint"), Var("a")))
+	mustInfer(t, env, ctx, fnExpr, "('a, 'b, 'c) -> int")
+	if names := unusedNames(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Fatalf("unexpected unused bindings: %v", names)
+	}
+	for _, w := range ctx.Warnings() {
+		if w.Expr != fnExpr {
+			t.Fatalf("expected unused arguments to be bound by the function: %#+v", w)
+		}
+	}
+
+	// let f = fn (x) -> x and g = fn (x) -> f(x) in f
+	groupExpr := LetGroup([]ast.LetBinding{
+		{"f", Func1("x", Var("x"))},
+		{"g", Func1("x", Call(Var("f"), Var("x")))},
+	}, Var("f"))
+	mustInfer(t, env, ctx, groupExpr, "'a -> 'a")
+	if names := unusedNames(); !reflect.DeepEqual(names, []string{"g"}) {
+		t.Fatalf("unexpected unused bindings: %v", names)
+	}
+
+	// self-references do not count as uses of recursive bindings:
+	// let f = fn (x) -> f(x) in someint
+	recExpr := Let("f", Func1("x", Call(Var("f"), Var("x"))), Var("someint"))
+	mustInfer(t, env, ctx, recExpr, "int")
+	if names := unusedNames(); !reflect.DeepEqual(names, []string{"f"}) {
+		t.Fatalf("unexpected unused bindings: %v", names)
+	}
+	// let f = fn (x) -> f(x) and g = fn (x) -> g(f(x)) in someint
+	recGroupExpr := LetGroup([]ast.LetBinding{
+		{"f", Func1("x", Call(Var("f"), Var("x")))},
+		{"g", Func1("x", Call(Var("g"), Call(Var("f"), Var("x"))))},
+	}, Var("someint"))
+	mustInfer(t, env, ctx, recGroupExpr, "int")
+	if names := unusedNames(); !reflect.DeepEqual(names, []string{"g"}) {
+		t.Fatalf("unexpected unused bindings: %v", names)
+	}
+
+	// match-case variables are not reported, but they shadow outer bindings:
+	matchExpr := Let("i", Var("someint"), Match(Variant("a", Var("someint")), []ast.MatchCase{MatchCase("a", "i", Var("i"))}, nil))
+	mustInfer(t, env, ctx, matchExpr, "int")
+	if names := unusedNames(); !reflect.DeepEqual(names, []string{"i"}) {
+		t.Fatalf("unexpected unused bindings: %v", names)
+	}
+}
+
+func TestRecordInstantiations(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	a, b, c := env.NewGenericVar(), env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("pair", TArrow2(a, b, TRecordFlat(map[string]types.Type{"a": a, "b": b})))
+	env.Declare("id", TArrow1(c, c))
+	env.Declare("apply_int", TArrow1(TArrow1(TConst("int"), TConst("int")), TConst("int")))
+
+	mustInfer(t, env, ctx, Var("pair"), "('a, 'b) -> {a : 'a, b : 'b}")
+	if ctx.LastInstantiation() != nil {
+		t.Fatalf("expected instantiations not to be recorded")
+	}
+
+	ctx.SetRecordInstantiations(true)
+	defer ctx.SetRecordInstantiations(false)
+
+	ty, err := ctx.Infer(Var("pair"), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subst := ctx.LastInstantiation()
+	if len(subst) != 2 || subst[a.Id()] == nil || subst[b.Id()] == nil {
+		t.Fatalf("unexpected substitution: %v", subst)
+	}
+	arrow := ty.(*types.Arrow)
+	if types.RealType(arrow.Args[0]) != subst[a.Id()] || types.RealType(arrow.Args[1]) != subst[b.Id()] {
+		t.Fatalf("expected substituted type-variables within the instantiated type")
+	}
+
+	// The substitution for the most recently instantiated variable is recorded:
+	mustInfer(t, env, ctx, Call(Var("apply_int"), Var("id")), "int")
+	subst = ctx.LastInstantiation()
+	if len(subst) != 1 || types.TypeString(subst[c.Id()]) != "int" {
+		t.Fatalf("unexpected substitution: %v", subst)
+	}
+
+	// Non-generic types are not substituted:
+	mustInfer(t, env, ctx, Var("apply_int"), "(int -> int) -> int")
+	if subst = ctx.LastInstantiation(); subst == nil || len(subst) != 0 {
+		t.Fatalf("expected an empty substitution, found: %v", subst)
+	}
+}
+
+func TestLevelHook(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	type levelEvent struct {
+		op      string
+		level   int
+		generic bool
+	}
+	var events []levelEvent
+	ctx.SetLevelHook(func(op string, level int, t types.Type) {
+		events = append(events, levelEvent{op, level, t.IsGeneric()})
+	})
+
+	// let x = (let y = fn (z) -> z in y) in x
+	expr := Let("x", Let("y", Func1("z", Var("z")), Var("y")), Var("x"))
+	mustInfer(t, env, ctx, expr, "'a -> 'a")
+	expect := []levelEvent{{"Let", 3, false}, {"Let", 2, false}}
+	if !reflect.DeepEqual(expect, events) {
+		t.Fatalf("unexpected level events: %#+v", events)
+	}
+
+	events = nil
+	expr2 := LetGroup([]ast.LetBinding{{"f", Func1("x", Pipe("$", Var("x"), Var("$")))}}, Var("f"))
+	mustInfer(t, env, ctx, expr2, "'a -> 'a")
+	expect = []levelEvent{{"Pipe", 3, false}, {"LetGroup", 2, false}}
+	if !reflect.DeepEqual(expect, events) {
+		t.Fatalf("unexpected level events: %#+v", events)
+	}
+
+	// The placeholder is generalized before each step:
+	events = nil
+	env.Declare("someint", TConst("int"))
+	expr3 := Pipe("$", Func1("z", Var("z")), Var("$"), Call(Var("$"), Var("someint")))
+	mustInfer(t, env, ctx, expr3, "int")
+	expect = []levelEvent{{"Pipe", 2, false}, {"Pipe", 2, false}}
+	if !reflect.DeepEqual(expect, events) {
+		t.Fatalf("unexpected level events: %#+v", events)
+	}
+
+	events = nil
+	ctx.SetLevelHook(nil)
+	mustInfer(t, env, ctx, expr, "'a -> 'a")
+	if len(events) != 0 {
+		t.Fatalf("unexpected level events after removing hook: %#+v", events)
+	}
+}
+
+func TestControlFlow(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("n", TConst("int"))
+	env.Declare("b", TConst("bool"))
+	env.Declare("zero", TConst("int"))
+	env.Declare("dec", TArrow1(TConst("int"), TConst("int")))
+	env.Declare("cmp", TArrow2(TConst("int"), TConst("int"), TConst("bool")))
+
+	cfg := ControlFlow("strange_loop", "local_x")
+
+	cfg.SetEntry(
+		DerefAssign(Var("local_x"), Call(Var("dec"), Var("n"))),
+		Call(Var("cmp"), Deref(Var("local_x")), Var("zero")))
+
+	cfg.SetReturn(Deref(Var("local_x")))
+
+	L0 := cfg.AddBlock(
+		DerefAssign(Var("local_x"), Call(Var("dec"), Deref(Var("local_x")))),
+		Call(Var("cmp"), Deref(Var("local_x")), Var("zero")))
+
+	L1 := cfg.AddBlock(
+		DerefAssign(Var("local_x"), Call(Var("dec"), Deref(Var("local_x")))),
+		Call(Var("cmp"), Deref(Var("local_x")), Var("zero")))
+
+	cfg.AddJump(cfg.Entry, cfg.Return)
+	cfg.AddJump(cfg.Entry, L0)
+	cfg.AddJump(L0, L1)
+	cfg.AddJump(L1, L0)
+	cfg.AddJump(L1, cfg.Return)
+
+	mustInfer(t, env, ctx, cfg, "int")
+
+	expect := "strange_loop(local_x) {" +
+		"entry : {*local_x = dec(n); cmp(*local_x, zero)}, " +
+		"return : *local_x, " +
+		"L0 : {*local_x = dec(*local_x); cmp(*local_x, zero)}, " +
+		"L1 : {*local_x = dec(*local_x); cmp(*local_x, zero)}" +
+		"} in {entry -> [return, L0], L0 -> [L1], L1 -> [return, L0]}"
+
+	if ast.ExprString(cfg) != expect {
+		t.Fatalf("expr: %s", ast.ExprString(cfg))
+	}
+
+	// Error detection for loops (inferred as recursive functions):
+
+	cfg = ControlFlow("invalid_loop", "local_n", "local_b", "local_row")
+
+	cfg.SetEntry(
+		DerefAssign(Var("local_n"), Var("n")),
+		DerefAssign(Var("local_b"), Var("b")),
+		DerefAssign(Var("local_row"), RecordExtend(RecordEmpty(),
+			LabelValue("n", Var("n")),
+			LabelValue("b", Var("b")))),
+		Call(Var("cmp"), Deref(Var("local_n")), Var("zero")))
+
+	cfg.SetReturn(Deref(Var("local_row")))
+
+	// Record extension within loops is not supported (leads to a recursive type error):
+
+	L0 = cfg.AddBlock(
+		DerefAssign(Var("local_row"), RecordExtend(Deref(Var("local_row")),
+			LabelValue("n", Deref(Var("local_n"))),
+			LabelValue("b", Deref(Var("local_b"))))),
+		DerefAssign(Var("local_n"), Call(Var("dec"), Deref(Var("local_n")))),
+		Call(Var("cmp"), Deref(Var("local_n")), Var("zero")))
+
+	L1 = cfg.AddBlock(
+		DerefAssign(Var("local_row"), RecordExtend(Deref(Var("local_row")),
+			LabelValue("n", Deref(Var("local_n"))),
+			LabelValue("b", Deref(Var("local_b"))))),
+		DerefAssign(Var("local_n"), Call(Var("dec"), Deref(Var("local_n")))),
+		Call(Var("cmp"), Deref(Var("local_n")), Var("zero")))
+
+	cfg.AddJump(cfg.Entry, cfg.Return)
+	cfg.AddJump(cfg.Entry, L0)
+	cfg.AddJump(L0, L1)
+	cfg.AddJump(L1, L0)
+	cfg.AddJump(L1, cfg.Return)
+
+	if _, err := ctx.Infer(cfg, env); err == nil {
+		t.Fatalf("expected recursive type error")
+	}
+}
+
+func TestControlFlowReturnPoints(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("n", TConst("int"))
+	env.Declare("b", TConst("bool"))
+	env.Declare("zero", TConst("int"))
+	env.Declare("dec", TArrow1(TConst("int"), TConst("int")))
+	env.Declare("cmp", TArrow2(TConst("int"), TConst("int"), TConst("bool")))
+
+	newCfg := func(early ast.Expr) (*ast.ControlFlow, ast.Block) {
+		cfg := ControlFlow("early_return", "local_x")
+		cfg.SetEntry(
+			DerefAssign(Var("local_x"), Var("n")),
+			Call(Var("cmp"), Deref(Var("local_x")), Var("zero")))
+		cfg.SetReturn(Deref(Var("local_x")))
+		L0 := cfg.AddBlock(
+			DerefAssign(Var("local_x"), Call(Var("dec"), Deref(Var("local_x")))),
+			Call(Var("cmp"), Deref(Var("local_x")), Var("zero")))
+		// The early return exits from within the loop:
+		L1 := cfg.AddReturnBlock(early)
+		cfg.AddJump(cfg.Entry, L0)
+		cfg.AddJump(L0, L0)
+		cfg.AddJump(L0, L1)
+		cfg.AddJump(L0, cfg.Return)
+		return cfg, L1
+	}
+
+	// compatible return points:
+	cfg, L1 := newCfg(Var("zero"))
+	if !cfg.IsReturnPoint(L1) || !cfg.IsReturnPoint(cfg.Return) || cfg.IsReturnPoint(cfg.Entry) {
+		t.Fatalf("unexpected return points: %v", cfg.Returns)
+	}
+	mustInfer(t, env, ctx, cfg, "int")
+	annotated, err := ctx.Annotate(cfg, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acfg := annotated.(*ast.ControlFlow)
+	if types.TypeString(acfg.Type()) != "int" ||
+		types.TypeString(acfg.ReturnPointType(L1.Index)) != "int" ||
+		types.TypeString(acfg.ReturnPointType(ast.ControlFlowReturnIndex)) != "int" {
+		t.Fatalf("unexpected return point annotations")
+	}
+
+	// incompatible return points:
+	cfg, _ = newCfg(Var("b"))
+	_, err = ctx.Infer(cfg, env)
+	if err == nil || !strings.HasPrefix(err.Error(), "Mismatched result types for return points L1 and return") {
+		t.Fatalf("expected mismatched return points, found: %v", err)
+	}
+	if ctx.InvalidExpr() != cfg {
+		t.Fatalf("expected the control flow expression to be invalid")
+	}
+}
+
+func TestControlFlowTupleReturns(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("n", TConst("int"))
+	env.Declare("zero", TConst("int"))
+	env.Declare("inc", TArrow1(TConst("int"), TConst("int")))
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	env.Declare("cmp", TArrow2(TConst("int"), TConst("int"), TConst("bool")))
+
+	newCfg := func(early ast.Expr) (*ast.ControlFlow, *ast.TupleLit) {
+		cfg := ControlFlow("sum_loop", "sum", "count")
+		cfg.SetEntry(
+			DerefAssign(Var("sum"), Var("zero")),
+			DerefAssign(Var("count"), Var("zero")),
+			Call(Var("cmp"), Deref(Var("count")), Var("n")))
+		result := TupleLit(Deref(Var("sum")), Deref(Var("count")))
+		cfg.SetReturn(result)
+		L0 := cfg.AddBlock(
+			DerefAssign(Var("sum"), Call(Var("add"), Deref(Var("sum")), Deref(Var("count")))),
+			DerefAssign(Var("count"), Call(Var("inc"), Deref(Var("count")))),
+			Call(Var("cmp"), Deref(Var("count")), Var("n")))
+		cfg.AddJump(cfg.Entry, L0)
+		cfg.AddJump(cfg.Entry, cfg.Return)
+		cfg.AddJump(L0, L0)
+		cfg.AddJump(L0, cfg.Return)
+		if early != nil {
+			L1 := cfg.AddReturnBlock(early)
+			cfg.AddJump(L0, L1)
+		}
+		return cfg, result
+	}
+
+	cfg, result := newCfg(nil)
+	if ast.ExprString(result) != "(*sum, *count)" {
+		t.Fatalf("expr: %s", ast.ExprString(result))
+	}
+	mustInfer(t, env, ctx, cfg, "(int, int)")
+	if err := ctx.AnnotateDirect(cfg, env); err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(cfg.ReturnPointType(ast.ControlFlowReturnIndex)) != "(int, int)" {
+		t.Fatalf("unexpected return point type: %s", types.TypeString(cfg.ReturnPointType(ast.ControlFlowReturnIndex)))
+	}
+	for _, elem := range result.Elems {
+		if types.TypeString(elem.Type()) != "int" {
+			t.Fatalf("unexpected element type: %s", types.TypeString(elem.Type()))
+		}
+	}
+
+	// Return points with tuples of the same arity are unified:
+	cfg, _ = newCfg(TupleLit(Var("zero"), Deref(Var("count"))))
+	mustInfer(t, env, ctx, cfg, "(int, int)")
+
+	// Return points with tuples of differing arity are mismatched:
+	cfg, _ = newCfg(TupleLit(Deref(Var("sum"))))
+	_, err := ctx.Infer(cfg, env)
+	if err == nil || !strings.HasPrefix(err.Error(), "Mismatched result types for return points") || !strings.Contains(err.Error(), "arity") {
+		t.Fatalf("expected mismatched tuple arity, found: %v", err)
+	}
+}
+
+func TestControlFlowNonProductiveLoops(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("n", TConst("int"))
+	env.Declare("dec", TArrow1(TConst("int"), TConst("int")))
+
+	// L0 and L1 loop forever, without any path to the return block:
+
+	cfg := ControlFlow("infinite_loop", "local_x")
+	cfg.SetEntry(DerefAssign(Var("local_x"), Var("n")))
+	cfg.SetReturn(Deref(Var("local_x")))
+	L0 := cfg.AddBlock(DerefAssign(Var("local_x"), Call(Var("dec"), Deref(Var("local_x")))))
+	L1 := cfg.AddBlock(DerefAssign(Var("local_x"), Call(Var("dec"), Deref(Var("local_x")))))
+	cfg.AddJump(cfg.Entry, cfg.Return)
+	cfg.AddJump(cfg.Entry, L0)
+	cfg.AddJump(L0, L1)
+	cfg.AddJump(L1, L0)
+
+	_, err := ctx.Infer(cfg, env)
+	if err == nil {
+		t.Fatalf("expected non-productive loop error")
+	}
+	if err.Error() != "Control flow contains blocks which do not reach the return block: L0, L1" &&
+		err.Error() != "Control flow contains blocks which do not reach the return block: L1, L0" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The entry block only reaches a self-loop:
+
+	cfg = ControlFlow("stuck_entry", "local_x")
+	cfg.SetEntry(DerefAssign(Var("local_x"), Var("n")))
+	cfg.SetReturn(Deref(Var("local_x")))
+	L0 = cfg.AddBlock(DerefAssign(Var("local_x"), Call(Var("dec"), Deref(Var("local_x")))))
+	cfg.AddJump(cfg.Entry, L0)
+	cfg.AddJump(L0, L0)
+
+	if _, err = ctx.Infer(cfg, env); err == nil || !strings.Contains(err.Error(), "entry") || !strings.Contains(err.Error(), "L0") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRecursiveTypes(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	params := []*types.Var{env.NewGenericVar()}
+	list := env.NewSimpleRecursive(params, func(rec *types.Recursive, self *types.RecursiveLink) {
+		a := rec.Params[0]
+		rec.AddType("list", TAlias(TApp(TConst("list"), a),
+			TRecordFlat(map[string]types.Type{"head": a, "tail": self})))
+	})
+
+	env.Declare("someintlist", list.WithParams(env, TConst("int")).GetType("list"))
+
+	var expr ast.Expr = RecordSelect(RecordSelect(RecordSelect(Var("someintlist"), "tail"), "tail"), "tail")
+	mustInfer(t, env, ctx, expr, "list[int]")
+
+	expr = RecordSelect(RecordSelect(RecordSelect(Var("someintlist"), "tail"), "tail"), "head")
+	mustInfer(t, env, ctx, expr, "int")
+
+	a, b := env.NewGenericVar(), env.NewGenericVar()
+	listA, listB := list.WithParams(env, a).GetType("list"), list.WithParams(env, b).GetType("list")
+	env.Declare("list_map", TArrow2(listA, TArrow1(a, b), listB))
+	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
+	env.Declare("atoi", TArrow1(TConst("string"), TConst("int")))
+
+	expr = RecordSelect(RecordSelect(Call(Var("list_map"), Var("someintlist"), Var("itoa")), "tail"), "tail")
+	mustInfer(t, env, ctx, expr, "list[string]")
+
+	expr = RecordSelect(RecordSelect(Call(Var("list_map"), Var("someintlist"), Var("itoa")), "tail"), "head")
+	mustInfer(t, env, ctx, expr, "string")
+
+	expr = Pipe("$", Var("someintlist"),
+		Call(Var("list_map"), Var("$"), Var("itoa")),
+		RecordSelect(Var("$"), "tail"),
+		Call(Var("list_map"), Var("$"), Var("atoi")),
+		RecordSelect(Var("$"), "tail"),
+		Call(Var("list_map"), Var("$"), Var("itoa")),
+		RecordSelect(Var("$"), "head"))
+
+	mustInfer(t, env, ctx, expr, "string")
+}
+
+func TestRecursiveTypeBuilder(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	list, err := Recursive([]*types.Var{env.NewGenericVar()}, map[string]func(RecRef) *types.App{
+		"list": func(self RecRef) *types.App {
+			a := self.Params()[0]
+			return TAlias(TApp(TConst("list"), a), TRecordFlat(map[string]types.Type{"head": a, "tail": self.Link("list")}))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.Declare("someintlist", list.WithParams(env, TConst("int")).GetType("list"))
+	mustInfer(t, env, ctx, RecordSelect(RecordSelect(Var("someintlist"), "tail"), "tail"), "list[int]")
+	mustInfer(t, env, ctx, RecordSelect(RecordSelect(Var("someintlist"), "tail"), "head"), "int")
+
+	a, b := env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("list_map", TArrow2(list.WithParams(env, a).GetType("list"), TArrow1(a, b), list.WithParams(env, b).GetType("list")))
+	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
+	var expr ast.Expr = RecordSelect(RecordSelect(Call(Var("list_map"), Var("someintlist"), Var("itoa")), "tail"), "head")
+	mustInfer(t, env, ctx, expr, "string")
+
+	tree, err := Recursive(nil, map[string]func(RecRef) *types.App{
+		"even": func(self RecRef) *types.App {
+			return TAlias(TApp(TConst("even")), TRecordFlat(map[string]types.Type{"children": TApp(TConst("vec"), self.Link("odd"))}))
+		},
+		"odd": func(self RecRef) *types.App {
+			return TAlias(TApp(TConst("odd")), TRecordFlat(map[string]types.Type{"children": TApp(TConst("vec"), self.Link("even"))}))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("someeven", tree.GetType("even"))
+	a = env.NewGenericVar()
+	env.Declare("first", TArrow1(TApp(TConst("vec"), a), a))
+	expr = Call(Var("first"), RecordSelect(Call(Var("first"), RecordSelect(Var("someeven"), "children")), "children"))
+	mustInfer(t, env, ctx, expr, "even")
+
+	_, err = Recursive(nil, map[string]func(RecRef) *types.App{
+		"bad": func(self RecRef) *types.App {
+			return TAlias(TApp(TConst("bad")), TRecordFlat(map[string]types.Type{"link": self.Link("missing")}))
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected undefined recursive type error")
+	}
+
+	// The builder generalizes consistently with TypeEnv.NewRecursive, and does not modify the parameters:
+	param := env.NewVar(types.TopLevel + 1)
+	param.SetLink(env.NewVar(types.TopLevel + 1))
+	params := []*types.Var{param}
+	built, declared := env.NewVar(types.TopLevel+1), env.NewVar(types.TopLevel+1)
+	_, err = Recursive(params, map[string]func(RecRef) *types.App{
+		"cells": func(self RecRef) *types.App {
+			a := self.Params()[0]
+			return TAlias(TApp(TConst("cells"), a), TRecordFlat(map[string]types.Type{"head": TRef(built), "tail": self.Link("cells")}))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params[0] != param {
+		t.Fatalf("expected the parameters to be unmodified")
+	}
+	env.NewSimpleRecursive([]*types.Var{env.NewVar(types.TopLevel + 1)}, func(rec *types.Recursive, self *types.RecursiveLink) {
+		a := rec.Params[0]
+		rec.Types = append(rec.Types, TAlias(TApp(TConst("cells"), a), TRecordFlat(map[string]types.Type{"head": TRef(declared), "tail": self})))
+	})
+	if built.IsGenericVar() != declared.IsGenericVar() || built.IsWeakVar() != declared.IsWeakVar() {
+		t.Fatalf("expected type-variables within references to be generalized consistently")
+	}
+}
+
+func TestMutuallyRecursiveTypes(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	cycle := env.NewRecursive(nil, func(rec *types.Recursive) {
+		int2bool := TApp(TConst("cycle"), TConst("int"), TConst("bool"))
+		bool2int := TApp(TConst("cycle"), TConst("bool"), TConst("int"))
+		rec.AddType("int2bool", int2bool)
+		rec.AddType("bool2int", bool2int)
+		int2bool.Underlying = TRecordFlat(map[string]types.Type{
+			"v": TConst("int"), "link": TRecursiveLink(rec, "bool2int"),
+		})
+		bool2int.Underlying = TRecordFlat(map[string]types.Type{
+			"v": TConst("bool"), "link": TRecursiveLink(rec, "int2bool"),
+		})
+	})
+
+	int2bool := cycle.GetType("int2bool")
+	env.Declare("someint2bool", int2bool)
+
+	var expr ast.Expr = Var("someint2bool")
+	mustInfer(t, env, ctx, expr, "cycle[int, bool]")
+
+	expr = Let("f", Func1("x", RecordSelect(Var("x"), "link")),
+		Call(Var("f"), Var("someint2bool")))
+
+	mustInfer(t, env, ctx, expr, "cycle[bool, int]")
+
+	expr = Let("f", Func1("x", RecordSelect(Var("x"), "v")),
+		Call(Var("f"), Var("someint2bool")))
+
+	mustInfer(t, env, ctx, expr, "int")
+
+	expr = Let("link", RecordSelect(Var("someint2bool"), "link"),
+		RecordSelect(Var("link"), "link"))
+
+	mustInfer(t, env, ctx, expr, "cycle[int, bool]")
+
+	expr = Pipe("$", Var("someint2bool"),
+		RecordSelect(Var("$"), "link"),
+		RecordSelect(Var("$"), "link"),
+		RecordSelect(Var("$"), "link"),
+		RecordSelect(Var("$"), "v"))
+
+	mustInfer(t, env, ctx, expr, "bool")
+}
+
+func TestGenericMutuallyRecursiveTypes(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	params := []*types.Var{env.NewGenericVar(), env.NewGenericVar()}
+	cycle := env.NewRecursive(params, func(rec *types.Recursive) {
+		a, b := rec.Params[0], rec.Params[1]
+		a2b := TApp(TConst("cycle"), a, b)
+		b2a := TApp(TConst("cycle"), b, a)
+		rec.AddType("a2b", a2b)
+		rec.AddType("b2a", b2a)
+		a2b.Underlying = TRecordFlat(map[string]types.Type{
+			"v": a, "link": TRecursiveLink(rec, "b2a"),
+		})
+		b2a.Underlying = TRecordFlat(map[string]types.Type{
+			"v": b, "link": TRecursiveLink(rec, "a2b"),
+		})
+	})
+
+	intboolcycle := cycle.WithParams(env, TConst("int"), TConst("bool"))
+	env.Declare("someint2bool", intboolcycle.GetType("a2b"))
+
+	expr := Pipe("$", Var("someint2bool"),
+		RecordSelect(Var("$"), "link"),
+		RecordSelect(Var("$"), "link"),
+		RecordSelect(Var("$"), "link"))
+
+	mustInfer(t, env, ctx, expr, "cycle[bool, int]")
+}
+
+func TestRecursiveLet(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	A := env.NewGenericVar()
+	env.Declare("if", TArrow3(TConst("bool"), A, A, A))
+	env.Declare("somebool", TConst("bool"))
+
+	var expr ast.Expr
+	expr =
+		Func1("x",
+			Let("f",
+				Func1("x",
+					Call(
+						Var("if"),
+						Var("somebool"),
+						Var("x"),
+						Call(Var("f"), Call(Var("add"), Var("x"), Var("x"))),
+					),
+				),
+				Call(Var("f"), Var("x")),
+			))
+
+	if ast.ExprString(expr) != "fn (x) -> let f(x) = if(somebool, x, f(add(x, x))) in f(x)" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "int -> int")
+
+	// Record extension within recursive functions is not supported:
+
+	env.Declare("someint", TConst("int"))
+
+	expr =
+		Let("f", Func1("x", RecordExtend(Call(Var("f"), Var("x")), LabelValue("i", Var("someint")))),
+			Var("f"))
+
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected recursive type error")
+	}
+}
+
+func TestPartialSignatures(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, stringType := TConst("int"), TConst("string")
+	env.Declare("someint", intType)
+	env.Declare("somestring", stringType)
+
+	wide := RecordExtend(nil, LabelValue("x", Var("someint")), LabelValue("y", Var("somestring")))
+	open := TRecord(TRowExtend(env.NewGenericVar(), TypeMap(map[string]types.Type{"x": intType})))
+	closed := TRecordFlat(map[string]types.Type{"x": intType})
+
+	// The tail of an open row absorbs the other labels of the value:
+	sig := PartialSignature(wide, open)
+	mustInfer(t, env, ctx, sig, "{x : int, y : string}")
+	if ast.ExprString(sig) != "({x = someint, y = somestring} : partial {x : int | 'a})" {
+		t.Fatalf("unexpected expression string: %s", ast.ExprString(sig))
+	}
+	mustInfer(t, env, ctx, Let("r", PartialSignature(wide, open), RecordSelect(Var("r"), "y")), "string")
+	mustInfer(t, env, ctx, Func1("r", RecordSelect(PartialSignature(Var("r"), open), "y")), "{x : int, y : 'a | 'b} -> 'a")
+
+	// The specified labels must match:
+	_, err := ctx.Infer(PartialSignature(wide, TRecord(TRowExtend(env.NewGenericVar(), TypeMap(map[string]types.Type{"x": stringType})))), env)
+	if err == nil || !strings.Contains(err.Error(), "does not match the inferred type") {
+		t.Fatalf("expected signature mismatch, found: %v", err)
+	}
+	// A closed row requires an exact match:
+	mustInfer(t, env, ctx, PartialSignature(RecordExtend(nil, LabelValue("x", Var("someint"))), closed), "{x : int}")
+	_, err = ctx.Infer(PartialSignature(wide, closed), env)
+	if err == nil || !strings.Contains(err.Error(), "does not match the inferred type") {
+		t.Fatalf("expected signature mismatch, found: %v", err)
+	}
+	// Within a (rigid) signature, the tail is more general than the remaining labels of the value:
+	_, err = ctx.Infer(Signature(wide, open), env)
+	if err == nil || !strings.Contains(err.Error(), "more general") {
+		t.Fatalf("expected signature error, found: %v", err)
+	}
+}
+
+func TestScopedTypeVariables(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("one", TConst("int"))
+	a := TScoped("a")
+
+	// Both annotations refer to the same type-variable:
+	expr := TypeAbstraction([]string{"a"}, Func2("x", "y", TupleLit(Signature(Var("x"), a), Signature(Var("y"), a))))
+	if ast.ExprString(expr) != "forall a. fn (x, y) -> ((x : a), (y : a))" {
+		t.Fatalf("unexpected expression string: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "('a, 'a) -> ('a, 'a)")
+	mustInfer(t, env, ctx, TypeAbstraction([]string{"a"}, Func1("x", Let("y", Signature(Var("x"), a), Signature(Func1("z", Var("y")), TArrow1(a, a))))), "'a -> 'a -> 'a")
+
+	// Distinct names are bound to distinct type-variables, and nested abstractions may shadow names:
+	b := TScoped("b")
+	mustInfer(t, env, ctx, TypeAbstraction([]string{"a", "b"}, Func2("x", "y", TupleLit(Signature(Var("x"), a), Signature(Var("y"), b)))), "('a, 'b) -> ('a, 'b)")
+	_, err := ctx.Infer(TypeAbstraction([]string{"a", "b"}, Func1("x", TupleLit(Signature(Var("x"), a), Signature(Var("x"), b)))), env)
+	if err == nil || !strings.Contains(err.Error(), "is not rigid within its scope") {
+		t.Fatalf("expected rigid type-variable error, found: %v", err)
+	}
+	shadowed := TypeAbstraction([]string{"a"}, Func1("x", TupleLit(Signature(Var("x"), a), TypeAbstraction([]string{"a"}, Func1("y", Signature(Var("y"), a))))))
+	mustInfer(t, env, ctx, shadowed, "'a -> ('a, 'b -> 'b)")
+
+	// Scoped type-variables are rigid:
+	_, err = ctx.Infer(TypeAbstraction([]string{"a"}, Signature(Var("one"), a)), env)
+	if err == nil || err.Error() != "Scoped type-variable a is not rigid within its scope, found int" {
+		t.Fatalf("expected rigid type-variable error, found: %v", err)
+	}
+	_, err = ctx.Infer(Func1("x", TypeAbstraction([]string{"a"}, Signature(Var("x"), a))), env)
+	if err == nil || !strings.Contains(err.Error(), "is not rigid within its scope") {
+		t.Fatalf("expected rigid type-variable error, found: %v", err)
+	}
+
+	// References to unbound names are rejected:
+	_, err = ctx.Infer(TypeAbstraction([]string{"a"}, Func1("x", Signature(Var("x"), TArrow1(a, b)))), env)
+	if err == nil || err.Error() != "Type-variable b within signature a -> b is not in scope" {
+		t.Fatalf("expected scope error, found: %v", err)
+	}
+	_, err = ctx.Infer(Func1("x", Signature(Var("x"), a)), env)
+	if err == nil || err.Error() != "Type-variable a within signature a is not in scope" {
+		t.Fatalf("expected scope error, found: %v", err)
+	}
+}
+
+func TestTypeEquality(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	a, b := env.NewGenericVar(), env.NewGenericVar()
+
+	// The identity function is not as general as the signature 'a -> 'b:
+	sig := Signature(Func1("x", Var("x")), TArrow1(a, b))
+	if _, err := ctx.Infer(sig, env); err == nil || !strings.Contains(err.Error(), "more general") {
+		t.Fatalf("expected signature error, found: %v", err)
+	}
+	// Within the equality 'a ~ 'b, the signature is checked as 'a -> 'a:
+	mustInfer(t, env, ctx, WithEquality(a, b, sig), "'a -> 'a")
+	mustInfer(t, env, ctx, WithEquality(b, TConst("int"), Signature(Func1("x", Var("x")), TArrow1(b, b))), "int -> int")
+	mustInfer(t, env, ctx, WithEquality(TArrow1(a, b), TArrow1(TConst("int"), a), Signature(Func1("x", Var("x")), TArrow1(a, b))), "int -> int")
+
+	// A failing equality is reported before the body is checked:
+	expr := WithEquality(TConst("int"), TConst("bool"), Var("missing"))
+	if ast.ExprString(expr) != "(int ~ bool) => missing" {
+		t.Fatalf("unexpected expression string: %s", ast.ExprString(expr))
+	}
+	if _, err := ctx.Infer(expr, env); err == nil || !strings.HasPrefix(err.Error(), "Type equality int ~ bool does not hold") {
+		t.Fatalf("expected equality error, found: %v", err)
+	}
+
+	// Unbound type-variables are linked by the equality:
+	x := env.NewVar(types.TopLevel)
+	env.DeclareInvariant("x", x)
+	mustInfer(t, env, ctx, WithEquality(x, TConst("bool"), Var("x")), "bool")
+}
+
+func TestPolymorphicRecursion(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType := TConst("int")
+	nested, list := TConst("nested"), TConst("list")
+	A := env.NewGenericVar()
+	// uncons : nested['a] -> [cons : {head : 'a, tail : nested[list['a]]}, nil : {}]
+	cons := TRecordFlat(map[string]types.Type{"head": A, "tail": TApp(nested, TApp(list, A))})
+	env.Declare("uncons", TArrow1(TApp(nested, A), TVariant(TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"cons": cons, "nil": TRecordFlat(nil)})))))
+	env.Declare("add", TArrow2(intType, intType, intType))
+	env.Declare("one", intType)
+	env.Declare("zero", intType)
+	env.Declare("ints", TApp(nested, intType))
+	env.Declare("strs", TApp(nested, TConst("string")))
+
+	length := Func1("n", Match(Call(Var("uncons"), Var("n")), []ast.MatchCase{
+		MatchCase("cons", "c", Call(Var("add"), Var("one"), Call(Var("length"), RecordSelect(Var("c"), "tail")))),
+		MatchCase("nil", "_", Var("zero")),
+	}, nil))
+
+	// Recursive calls at a different type cannot be inferred without a signature:
+	if _, err := ctx.Infer(Let("length", length, Var("length")), env); err == nil {
+		t.Fatalf("expected an error for polymorphic recursion without a signature")
+	}
+
+	// Recursive calls are instantiated from the signature:
+	S := env.NewGenericVar()
+	sig := Signature(length, TArrow1(TApp(nested, S), intType))
+	expr := Let("length", sig, Var("length"))
+	if ast.ExprString(expr) != "let length = (fn (n) -> match uncons(n) { :cons c -> add(one, length(c.tail)) | :nil _ -> zero } : nested['a] -> int) in length" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "nested['a] -> int")
+	mustInfer(t, env, ctx, Let("length", sig, Call(Var("add"), Call(Var("length"), Var("ints")), Call(Var("length"), Var("strs")))), "int")
+	mustInfer(t, env, ctx, LetGroup([]ast.LetBinding{{"length", sig}}, Var("length")), "nested['a] -> int")
+
+	// Signatures may not be more general than the inferred type:
+	_, err := ctx.Infer(Let("length", Signature(length, TArrow1(S, intType)), Var("length")), env)
+	if err == nil || !strings.HasPrefix(err.Error(), "Signature 'a -> int is more general than the inferred type") {
+		t.Fatalf("expected signature error, found: %v", err)
+	}
+	_, err = ctx.Infer(Signature(Func1("x", Call(Var("add"), Var("x"), Var("x"))), TArrow1(S, S)), env)
+	if err == nil || !strings.HasPrefix(err.Error(), "Signature 'a -> 'a is more general than the inferred type") {
+		t.Fatalf("expected signature error, found: %v", err)
+	}
+	mustInfer(t, env, ctx, Signature(Func1("x", Var("x")), TArrow1(S, S)), "'a -> 'a")
+	mustInfer(t, env, ctx, Signature(Func1("x", Var("x")), TArrow1(intType, intType)), "int -> int")
+}
+
+func TestFixedPoint(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	// fix :: ('a -> 'a) -> 'a
+	// fix = fn (f) -> f(fix(f))
+	a := env.NewGenericVar()
+	env.Declare("fix", TArrow1(TArrow1(a, a), a))
+
+	a = env.NewGenericVar()
+	env.Declare("merge", TArrow2(a, a, a))
+
+	// fix(fn (f) -> fn (x) -> merge(x, f(x)))
+	expr := Call(Var("fix"), Func1("f", Func1("x", Call(Var("merge"), Var("x"), Call(Var("f"), Var("x"))))))
+
+	mustInfer(t, env, ctx, expr, "'a -> 'a")
+
+	a = env.NewGenericVar()
+	env.Declare("if", TArrow3(TConst("bool"), a, a, a))
 	env.Declare("sub", TArrow2(TConst("int"), TConst("int"), TConst("int")))
 	env.Declare("mul", TArrow2(TConst("int"), TConst("int"), TConst("int")))
 	env.Declare("less", TArrow2(TConst("int"), TConst("int"), TConst("bool")))
 	env.Declare("1", TConst("int"))
 
-	// fix(fn (fact) -> fn (n) -> if(less(n, 1), 1, mul(n, fact(sub(n, 1)))))
-	expr =
-		Call(Var("fix"), Func1("fact", Func1("n",
-			Call(Var("if"), Call(Var("less"), Var("n"), Var("1")),
-				Var("1"),
-				Call(Var("mul"), Var("n"), Call(Var("fact"), Call(Var("sub"), Var("n"), Var("1"))))))))
+	// fix(fn (fact) -> fn (n) -> if(less(n, 1), 1, mul(n, fact(sub(n, 1)))))
+	expr =
+		Call(Var("fix"), Func1("fact", Func1("n",
+			Call(Var("if"), Call(Var("less"), Var("n"), Var("1")),
+				Var("1"),
+				Call(Var("mul"), Var("n"), Call(Var("fact"), Call(Var("sub"), Var("n"), Var("1"))))))))
+
+	mustInfer(t, env, ctx, expr, "int -> int")
+
+	// Record extension within recursive functions is not supported:
+	// fix(fn (f) -> fn (x) -> {i = 1 | f(x)})
+	expr = Call(Var("fix"), Func1("f", Func1("x", RecordExtend(Call(Var("f"), Var("x")), LabelValue("i", Var("1"))))))
+
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected recursive type error")
+	}
+}
+
+func TestMutuallyRecursiveLet(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	A := env.NewGenericVar()
+	env.Declare("if", TArrow3(TConst("bool"), A, A, A))
+	env.Declare("somebool", TConst("bool"))
+
+	somebool, add, f, g, h, id, x := Var("somebool"), Var("add"), Var("f"), Var("g"), Var("h"), Var("id"), Var("x")
+
+	expr := LetGroup(
+		[]ast.LetBinding{
+			{"id", Func1("x", x)},
+			{"f", Func1("x", Call(Var("if"), Call(id, somebool), Call(id, x), Call(g, Call(add, x, x))))},
+			{"g", Func1("x", Call(Var("if"), somebool, x, Call(id, Call(f, x))))},
+		},
+		Let("h", Func1("x", Call(id, Call(f, x))),
+			RecordExtend(nil,
+				LabelValue("f", f),
+				LabelValue("g", g),
+				LabelValue("h", h),
+				LabelValue("id", id))))
+
+	expect := "" +
+		"let id(x) = x" +
+		" and f(x) = if(id(somebool), id(x), g(add(x, x)))" +
+		" and g(x) = if(somebool, x, id(f(x)))" +
+		" in" +
+		" let h(x) = id(f(x))" +
+		" in {f = f, g = g, h = h, id = id}"
+
+	if ast.ExprString(expr) != expect {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "{f : int -> int, g : int -> int, h : int -> int, id : 'a -> 'a}")
+
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
+		t.Fatal(err)
+	}
+	sccs := expr.StronglyConnectedComponents()
+	sccNames := make([][]string, len(sccs))
+	for i, scc := range sccs {
+		sccNames[i] = make([]string, len(scc))
+		for j, binding := range scc {
+			sccNames[i][j] = binding.Var
+		}
+	}
+	if !reflect.DeepEqual([][]string{{"id"}, {"g", "f"}}, sccNames) {
+		t.Fatalf("invalid strongly connected components, found %#+v", sccNames)
+	}
+}
+
+func TestMutuallyRecursiveLetErrors(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	env.Declare("one", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
+
+	gValue := Func1("y", Call(Var("add"), Call(Var("f"), Var("y")), Var("somebool")))
+	expr := LetGroup(
+		[]ast.LetBinding{
+			{"f", Func1("x", Call(Var("add"), Call(Var("g"), Var("x")), Var("one")))},
+			{"g", gValue},
+		},
+		Var("f"))
+
+	_, err := ctx.Infer(expr, env)
+	if err == nil || !strings.HasPrefix(err.Error(), "Mutually recursive binding g within let-group failed to type-check: ") {
+		t.Fatalf("expected an error naming binding g, found: %v", err)
+	}
+	if ctx.Error() != err {
+		t.Fatalf("expected the context error to match the returned error")
+	}
+	invalid := ctx.InvalidExpr()
+	if invalid == nil || ast.ExprString(invalid) != ast.ExprString(gValue.Body) {
+		t.Fatalf("expected the invalid expression within binding g, found: %v", invalid)
+	}
+
+	// The invalid expression is the binding's value when the binding's type conflicts with its uses:
+	fValue := Func1("y", Let("z", Call(Var("g"), Var("y")), Var("somebool")))
+	expr = LetGroup(
+		[]ast.LetBinding{
+			{"f", fValue},
+			{"g", Func1("x", Call(Var("add"), Call(Var("f"), Var("x")), Var("one")))},
+		},
+		Var("f"))
+	_, err = ctx.Infer(expr, env)
+	if err == nil || err.Error() != "Mutually recursive binding f within let-group failed to type-check: Failed to unify int with bool" {
+		t.Fatalf("expected an error naming binding f, found: %v", err)
+	}
+	if ctx.InvalidExpr() != fValue {
+		t.Fatalf("expected the invalid expression to be the value of binding f, found: %v", ctx.InvalidExpr())
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	inner := LetGroup(
+		[]ast.LetBinding{
+			{"even", Func1("n", Call(Var("odd"), Var("n")))},
+			{"odd", Func1("n", Call(Var("even"), Var("n")))},
+			{"id", Func1("x", Var("x"))},
+		},
+		Var("even"))
+	outer := LetGroup(
+		[]ast.LetBinding{
+			{"a", Call(Var("b"))},
+			{"b", Func(nil, Var("c"))},
+			{"c", inner},
+		},
+		Var("a"))
+
+	a, err := Analyze(outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Groups()) != 2 || a.Groups()[0] != outer || a.Groups()[1] != inner {
+		t.Fatalf("unexpected groups: %v", a.Groups())
+	}
+	names := func(sccs [][]ast.LetBinding) [][]string {
+		sccNames := make([][]string, len(sccs))
+		for i, scc := range sccs {
+			sccNames[i] = make([]string, len(scc))
+			for j, binding := range scc {
+				sccNames[i][j] = binding.Var
+			}
+		}
+		return sccNames
+	}
+	if sccs := names(a.StronglyConnectedComponents(0)); !reflect.DeepEqual([][]string{{"c"}, {"b"}, {"a"}}, sccs) {
+		t.Fatalf("invalid strongly connected components for the outer group, found %#+v", sccs)
+	}
+	if sccs := names(a.StronglyConnectedComponents(1)); !reflect.DeepEqual([][]string{{"id"}, {"odd", "even"}}, sccs) {
+		t.Fatalf("invalid strongly connected components for the inner group, found %#+v", sccs)
+	}
+	if a.InvalidExpr() != nil {
+		t.Fatalf("unexpected invalid expression")
+	}
+
+	// Recursive bindings must be functions:
+	invalid := LetGroup([]ast.LetBinding{{"x", Var("y")}, {"y", Var("x")}}, Var("x"))
+	a, err = Analyze(invalid)
+	if err == nil || a.InvalidExpr() == nil {
+		t.Fatalf("expected analysis to fail for recursive values")
+	}
+}
+
+func TestWhereBindings(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("dec", TArrow1(TConst("int"), TConst("int")))
+	env.Declare("iszero", TArrow1(TConst("int"), TConst("bool")))
+	A := env.NewGenericVar()
+	env.Declare("if", TArrow3(TConst("bool"), A, A, A))
+	env.Declare("n", TConst("int"))
+
+	even, odd, x := Var("even"), Var("odd"), Var("x")
+
+	expr := Where(
+		RecordExtend(nil,
+			LabelValue("even", Call(even, Var("n"))),
+			LabelValue("odd", Call(odd, Var("n")))),
+		LetBinding("even", Func1("x", Call(Var("if"), Call(Var("iszero"), x), Var("t"), Call(odd, Call(Var("dec"), x))))),
+		LetBinding("odd", Func1("x", Call(Var("if"), Call(Var("iszero"), x), Var("f"), Call(even, Call(Var("dec"), x))))),
+		LetBinding("t", Call(Var("iszero"), Var("n"))),
+		LetBinding("f", Call(Var("iszero"), Call(Var("dec"), Var("n")))))
+
+	expect := "" +
+		"{even = even(n), odd = odd(n)}" +
+		" where even(x) = if(iszero(x), t, odd(dec(x)))" +
+		" and odd(x) = if(iszero(x), f, even(dec(x)))" +
+		" and t = iszero(n)" +
+		" and f = iszero(dec(n))"
+
+	if ast.ExprString(expr) != expect {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	if expr.ExprName() != "Where" {
+		t.Fatalf("unexpected expression name: %s", expr.ExprName())
+	}
+	mustInfer(t, env, ctx, expr, "{even : bool, odd : bool}")
+
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
+		t.Fatal(err)
+	}
+	sccs := expr.StronglyConnectedComponents()
+	if len(sccs) != 3 || len(sccs[2]) != 2 {
+		t.Fatalf("invalid strongly connected components, found %d", len(sccs))
+	}
+}
+
+func TestRecursiveValueBindings(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	env.Declare("one", TConst("int"))
+
+	// let x = add(x, one) in x
+	self := Call(Var("add"), Var("x"), Var("one"))
+	expr := LetGroup([]ast.LetBinding{{"x", self}}, Var("x"))
+	_, err := ctx.Infer(expr, env)
+	if err == nil {
+		t.Fatalf("expected recursive value error")
+	}
+	if err.Error() != "Recursive binding x within let-group is not a function" {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if ctx.InvalidExpr() != self {
+		t.Fatalf("unexpected invalid expression: %s", ast.ExprString(ctx.InvalidExpr()))
+	}
+
+	// let a = b and b = add(a, one) in a
+	expr = LetGroup([]ast.LetBinding{
+		{"a", Var("b")},
+		{"b", Call(Var("add"), Var("a"), Var("one"))},
+	}, Var("a"))
+	if _, err = ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected mutually recursive value error")
+	}
+	if !strings.HasPrefix(err.Error(), "Mutually recursive binding") {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// let f() = v and v = f() in v
+	expr = LetGroup([]ast.LetBinding{
+		{"f", Func(nil, Var("v"))},
+		{"v", Call(Var("f"))},
+	}, Var("v"))
+	if _, err = ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected mutually recursive value error")
+	}
+	if err.Error() != "Mutually recursive binding v within let-group is not a function" {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// let x = one in (let x = add(x, one) in x): the inner x refers to the shadowed binding
+	shadowed := Let("x", Var("one"), LetGroup([]ast.LetBinding{{"x", self}}, Var("x")))
+	mustInfer(t, env, ctx, shadowed, "int")
+
+	// Non-recursive values may depend on recursive functions:
+	expr = LetGroup([]ast.LetBinding{
+		{"f", Func1("x", Call(Var("f"), Var("x")))},
+		{"v", Call(Var("f"), Var("one"))},
+	}, Var("v"))
+	mustInfer(t, env, ctx, expr, "'a")
+}
+
+func TestVariantMatch(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	a := env.NewGenericVar()
+	env.Declare("if", TArrow3(TConst("bool"), a, a, a))
+	env.Declare("somebool", TConst("bool"))
+	env.Declare("someint", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
+
+	ifExpr := Call(Var("if"), Var("somebool"), Variant("i", Var("someint")), Variant("b", Var("somebool")))
+	mustInfer(t, env, ctx, ifExpr, "[b : bool, i : int | 'a]")
+
+	matchExpr := Match(ifExpr, // [i : int, b : bool | 'a]
+		[]ast.MatchCase{
+			{Label: "i", Var: "i", Value: Call(Var("add"), Var("i"), Var("i"))},
+			{Label: "b", Var: "b", Value: Call(Var("if"), Var("b"), Var("someint"), Var("someint"))},
+		},
+		// default case:
+		nil)
+
+	mustInfer(t, env, ctx, matchExpr, "int")
+
+	matchExpr = Match(ifExpr, // [i : int, b : bool | 'a]
+		[]ast.MatchCase{
+			{Label: "i", Var: "i", Value: Call(Var("add"), Var("i"), Var("i"))},
+			// does not match variant type for the match argument (bool != int):
+			{Label: "b", Var: "b", Value: Call(Var("add"), Var("b"), Var("b"))},
+		},
+		// default case:
+		nil)
+
+	if _, err := ctx.Infer(matchExpr, env); err == nil {
+		t.Fatalf("expected error due to invalid variant argument for match")
+	}
+
+	expr := Let("f", Func1("x", Match(Var("x"),
+		[]ast.MatchCase{
+			{Label: "a", Var: "i", Value: Call(Var("f"), Variant("b", Var("i")))},
+			{Label: "b", Var: "i", Value: Call(Var("f"), Variant("c", Var("i")))},
+			{Label: "c", Var: "i", Value: Call(Var("add"), Var("i"), Var("someint"))},
+		},
+		// default case:
+		&ast.MatchCase{Var: "_", Value: Var("someint")})),
+		// let-in:
+		Var("f"))
+
+	if ast.ExprString(expr) != "let f(x) = match x { :a i -> f(:b i) | :b i -> f(:c i) | :c i -> add(i, someint) | _ -> someint } in f" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "[a : int, b : int, c : int | 'a] -> int")
+
+	fnExpr := Func2("x", "y",
+		Match(
+			Var("x"),
+			[]ast.MatchCase{
+				{Label: "a", Var: "i", Value: Call(Var("add"), Var("i"), Var("i"))},
+				{Label: "b", Var: "i", Value: Call(Var("add"), Var("i"), Var("i"))},
+				{Label: "c", Var: "_", Value: Var("y")},
+			},
+			nil,
+		))
+
+	if ast.ExprString(fnExpr) != "fn (x, y) -> match x { :a i -> add(i, i) | :b i -> add(i, i) | :c _ -> y }" {
+		t.Fatalf("expr: %s", ast.ExprString(fnExpr))
+	}
+	mustInfer(t, env, ctx, fnExpr, "([a : int, b : int, c : 'a], int) -> int")
+
+	// Call:
+
+	callExpr := Call(fnExpr, Variant("c", Var("somebool")), Var("someint"))
+
+	if ast.ExprString(callExpr) != "(fn (x, y) -> match x { :a i -> add(i, i) | :b i -> add(i, i) | :c _ -> y })(:c somebool, someint)" {
+		t.Fatalf("expr: %s", ast.ExprString(callExpr))
+	}
+	mustInfer(t, env, ctx, callExpr, "int")
+}
+
+func TestRecordBranchIntersection(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("someint", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
+
+	cases := []ast.MatchCase{
+		MatchCase("a", "i", RecordExtend(nil, LabelValue("x", Var("i")), LabelValue("y", Var("somebool")))),
+		MatchCase("b", "i", RecordExtend(nil, LabelValue("x", Var("i")), LabelValue("z", Var("someint")))),
+	}
+	partial := Func1("v", Match(Var("v"), cases, nil))
+	withDefault := Func1("v", Match(Var("v"), cases,
+		&ast.MatchCase{Var: "_", Value: RecordExtend(nil, LabelValue("x", Var("someint")), LabelValue("y", Var("somebool")))}))
+	disjoint := Func1("v", Match(Var("v"), []ast.MatchCase{
+		MatchCase("a", "i", RecordExtend(nil, LabelValue("x", Var("i")))),
+		MatchCase("b", "i", RecordExtend(nil, LabelValue("y", Var("i")))),
+	}, nil))
+	mismatched := Func1("v", Match(Var("v"), []ast.MatchCase{
+		MatchCase("a", "i", RecordExtend(nil, LabelValue("x", Var("someint")))),
+		MatchCase("b", "i", RecordExtend(nil, LabelValue("x", Var("somebool")))),
+	}, nil))
+
+	// Records with different labels fail to unify by default:
+	for _, expr := range []ast.Expr{partial, withDefault, disjoint, mismatched} {
+		if _, err := ctx.Infer(expr, env); err == nil {
+			t.Fatalf("expected branch mismatch for %s", ast.ExprString(expr))
+		}
+	}
+
+	ctx.SetRecordBranchMode(RecordBranchIntersect)
+	defer ctx.SetRecordBranchMode(RecordBranchStrict)
+
+	mustInfer(t, env, ctx, partial, "[a : 'a, b : 'a] -> {x : 'a}")
+	mustInfer(t, env, ctx, withDefault, "[a : int, b : int | 'a] -> {x : int}")
+	mustInfer(t, env, ctx, disjoint, "[a : 'a, b : 'b] -> {}")
+	mustInfer(t, env, ctx, RecordSelect(Call(partial, Variant("a", Var("someint"))), "x"), "int")
+	if _, err := ctx.Infer(RecordSelect(Call(partial, Variant("a", Var("someint"))), "y"), env); err == nil {
+		t.Fatalf("expected dropped label to be missing")
+	}
+	// Shared labels must have matching types:
+	if _, err := ctx.Infer(mismatched, env); err == nil {
+		t.Fatalf("expected mismatched shared label for %s", ast.ExprString(mismatched))
+	}
+}
+
+func TestMixedVariantPayloads(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	option := TVariant(TRowExtend(nil, TypeMap(map[string]types.Type{"none": TUnit(), "some": TConst("int")})))
+	env.Declare("someint", TConst("int"))
+	env.Declare("opt", option)
+
+	none := UnitVariant("none")
+	if ast.ExprString(none) != ":none ()" {
+		t.Fatalf("expr: %s", ast.ExprString(none))
+	}
+	mustInfer(t, env, ctx, none, "[none : () | 'a]")
+	mustInfer(t, env, ctx, Variant("some", Var("someint")), "[some : int | 'a]")
+
+	// Matching binds the unit payload of none and the int payload of some:
+	retag := func(value ast.Expr) *ast.Match {
+		return Match(value, []ast.MatchCase{
+			MatchCase("none", "u", Variant("empty", Var("u"))),
+			MatchCase("some", "i", Variant("full", Var("i"))),
+		}, nil)
+	}
+	mustInfer(t, env, ctx, retag(Var("opt")), "[empty : (), full : int | 'a]")
+	mustInfer(t, env, ctx, Func1("x", retag(Var("x"))), "[none : 'a, some : 'b] -> [empty : 'a, full : 'b | 'c]")
+	mustInfer(t, env, ctx, retag(none), "[empty : (), full : 'a | 'b]")
+	mustInfer(t, env, ctx, retag(Variant("some", Var("someint"))), "[empty : 'a, full : int | 'b]")
+
+	match := retag(Var("opt"))
+	if err := ctx.AnnotateDirect(match, env); err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(match.Cases[0].VariantType()) != "()" || types.TypeString(match.Cases[1].VariantType()) != "int" {
+		t.Fatalf("unexpected payload types: %s, %s", types.TypeString(match.Cases[0].VariantType()), types.TypeString(match.Cases[1].VariantType()))
+	}
+
+	// Both kinds of payloads compose within the branches of a single match:
+	pick := Func1("flag", Match(Var("flag"), []ast.MatchCase{
+		MatchCase("no", "_", none),
+		MatchCase("yes", "_", Variant("some", Var("someint"))),
+	}, nil))
+	mustInfer(t, env, ctx, pick, "[no : 'a, yes : 'b] -> [none : (), some : int | 'c]")
+	mustInfer(t, env, ctx, Func1("flag", retag(Call(pick, Var("flag")))), "[no : 'a, yes : 'b] -> [empty : (), full : int | 'c]")
+}
+
+func TestEnums(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	color := TEnum("red", "green", "blue")
+	if types.TypeString(color) != "[blue : (), green : (), red : ()]" {
+		t.Fatalf("unexpected enum type: %s", types.TypeString(color))
+	}
+	env.Declare("color", TArrow1(color, TConst("string")))
+
+	mustInfer(t, env, ctx, EnumValue(color, "red"), "[blue : (), green : (), red : ()]")
+	mustInfer(t, env, ctx, Call(Var("color"), EnumValue(color, "green")), "string")
+
+	// Labels must be members of the enum:
+	if _, err := ctx.Infer(EnumValue(color, "purple"), env); err == nil || !strings.HasPrefix(err.Error(), "Label purple is not a member of enum") {
+		t.Fatalf("expected enum membership error, found: %v", err)
+	}
+
+	// Matches over enums must handle every label:
+	cases := []ast.MatchCase{MatchCase("red", "_", IntLit(0)), MatchCase("green", "_", IntLit(1)), MatchCase("blue", "_", IntLit(2))}
+	mustInfer(t, env, ctx, Match(EnumValue(color, "blue"), cases, nil), "int")
+	if _, err := ctx.Infer(Match(EnumValue(color, "blue"), cases[:2], nil), env); err == nil {
+		t.Fatalf("expected missing case error")
+	}
+	mustInfer(t, env, ctx, Match(EnumValue(color, "blue"), cases[:2], &ast.MatchCase{Var: "_", Value: IntLit(2)}), "int")
+}
+
+func TestDeadMatchDefault(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("someint", TConst("int"))
+	env.Declare("closed", TVariant(TRowExtend(nil, TypeMap(map[string]types.Type{"a": TConst("int"), "b": TConst("int")}))))
+
+	cases := []ast.MatchCase{
+		MatchCase("a", "i", Var("i")),
+		MatchCase("b", "i", Var("i")),
+	}
+	defaultCase := &ast.MatchCase{Var: "_", Value: Var("someint")}
+
+	// The default case is unreachable, since both labels of the closed variant are matched:
+	dead := Match(Var("closed"), cases, defaultCase)
+	mustInfer(t, env, ctx, dead, "int")
+
+	ctx.SetRejectDeadDefault(true)
+	defer ctx.SetRejectDeadDefault(false)
+
+	if _, err := ctx.Infer(dead, env); err == nil || !strings.Contains(err.Error(), "Default case is unreachable") {
+		t.Fatalf("expected unreachable default error, found: %v", err)
+	}
+	if ctx.InvalidExpr() != dead {
+		t.Fatalf("expected the match expression to be invalid")
+	}
+
+	mustInfer(t, env, ctx, Match(Var("closed"), cases[:1], defaultCase), "int")
+	mustInfer(t, env, ctx, Match(Var("closed"), cases, nil), "int")
+	mustInfer(t, env, ctx, Func1("x", Match(Var("x"), cases, defaultCase)), "[a : int, b : int | 'a] -> int")
+}
+
+func TestMatchResidualRows(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("someint", TConst("int"))
+
+	// The default case of the outer match receives the residual variant, which is matched by the inner match:
+	inner := Match(Var("rest"), []ast.MatchCase{MatchCase("b", "i", Var("i"))}, &ast.MatchCase{Var: "_", Value: Var("someint")})
+	outer := Match(Var("x"), []ast.MatchCase{MatchCase("a", "i", Var("i"))}, &ast.MatchCase{Var: "rest", Value: inner})
+	expr := Func1("x", outer)
+
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(expr.Type()) != "[a : int, b : int | 'a] -> int" {
+		t.Fatalf("unexpected type: %s", types.TypeString(expr.Type()))
+	}
+
+	handled, tail := outer.Residual()
+	if len(handled) != 1 || handled[0] != "a" {
+		t.Fatalf("unexpected handled labels: %v", handled)
+	}
+	if types.TypeString(TVariant(tail)) != "[b : int | 'a]" {
+		t.Fatalf("unexpected residual row: %s", types.TypeString(TVariant(tail)))
+	}
+	handled, tail = inner.Residual()
+	if len(handled) != 1 || handled[0] != "b" {
+		t.Fatalf("unexpected handled labels: %v", handled)
+	}
+	if _, ok := tail.(*types.Var); !ok {
+		t.Fatalf("expected an open residual row, found: %s", types.TypeString(TVariant(tail)))
+	}
+
+	// The residual row remains open, so it may be passed to a function which matches other labels:
+	env.Declare("match_b", TArrow1(TVariant(TRowExtend(env.NewGenericVar(), TypeMap(map[string]types.Type{"b": TConst("int")}))), TConst("int")))
+	expr = Func1("x", Match(Var("x"), []ast.MatchCase{MatchCase("a", "i", Var("i"))}, &ast.MatchCase{Var: "rest", Value: Call(Var("match_b"), Var("rest"))}))
+	mustInfer(t, env, ctx, expr, "[a : int, b : int | 'a] -> int")
+
+	// Without a default case, the residual row is empty:
+	closed := Match(Var("x"), []ast.MatchCase{MatchCase("a", "i", Var("i"))}, nil)
+	if err := ctx.AnnotateDirect(Func1("x", closed), env); err != nil {
+		t.Fatal(err)
+	}
+	if _, tail = closed.Residual(); types.TypeString(TVariant(tail)) != "[]" {
+		t.Fatalf("unexpected residual row: %s", types.TypeString(TVariant(tail)))
+	}
+}
+
+func TestComposedPartialMatches(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	// Each match handles one label, re-tags its payload, and passes the residual variant through:
+	first := Match(Var("x"), []ast.MatchCase{MatchCase("a", "i", Variant("c", Var("i")))}, &ast.MatchCase{Var: "rest", Value: Var("rest")})
+	second := Match(Var("$"), []ast.MatchCase{MatchCase("b", "i", Variant("d", Var("i")))}, &ast.MatchCase{Var: "rest", Value: Var("rest")})
+	expr := Func1("x", Pipe("$", first, second))
+	// The result row remains open, and the residual labels flow through both matches:
+	mustInfer(t, env, ctx, expr, "[a : 'a, b : 'b, c : 'a, d : 'b | 'c] -> [c : 'a, d : 'b | 'c]")
+
+	env.Declare("someint", TConst("int"))
+	mustInfer(t, env, ctx, Call(expr, Variant("a", Var("someint"))), "[c : int, d : 'a | 'b]")
+	mustInfer(t, env, ctx, Call(expr, Variant("e", Var("someint"))), "[c : 'a, d : 'b, e : int | 'c]")
+
+	// The composed result may be matched by a further partial match:
+	third := Match(Var("$"), []ast.MatchCase{MatchCase("c", "i", Var("i"))}, &ast.MatchCase{Var: "_", Value: Var("someint")})
+	expr = Func1("x", Pipe("$", first, second, third))
+	mustInfer(t, env, ctx, expr, "[a : int, b : 'a, c : int, d : 'a | 'b] -> int")
+}
+
+func TestNestedMatch(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, strType := TConst("int"), TConst("string")
+	env.Declare("zero", intType)
+	option := TVariant(TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"some": intType, "none": TRecord(TRowEmpty())})))
+	env.Declare("result", TVariant(TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"ok": option, "err": strType}))))
+	env.Declare("flat", TVariant(TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"ok": intType, "err": strType}))))
+
+	cases := []ast.MatchCase{
+		NestedMatchCase("ok", "some", "x", Var("x")),
+		NestedMatchCase("ok", "none", "_", Var("zero")),
+		MatchCase("err", "e", Var("zero")),
+	}
+	match := Match(Var("result"), cases, nil)
+	if ast.ExprString(match) != "match result { :ok (:some x) -> x | :ok (:none _) -> zero | :err e -> zero }" {
+		t.Fatalf("expr: %s", ast.ExprString(match))
+	}
+	mustInfer(t, env, ctx, match, "int")
+	mustInfer(t, env, ctx, Func1("r", Match(Var("r"), cases, nil)), "[err : 'a, ok : [none : 'b, some : int]] -> int")
+
+	annotated := Match(Var("result"), cases, nil)
+	if err := ctx.AnnotateDirect(annotated, env); err != nil {
+		t.Fatal(err)
+	}
+	if handled, _ := annotated.Residual(); len(handled) != 2 || handled[0] != "ok" || handled[1] != "err" {
+		t.Fatalf("unexpected handled labels: %v", handled)
+	}
+	if types.TypeString(annotated.Cases[0].Nested.VariantType()) != "int" {
+		t.Fatalf("unexpected nested variant type: %s", types.TypeString(annotated.Cases[0].Nested.VariantType()))
+	}
+
+	// The payload of a nested pattern must be a variant:
+	if _, err := ctx.Infer(Match(Var("flat"), cases, nil), env); err == nil {
+		t.Fatalf("expected an error for a non-variant payload")
+	}
+	// The nested variant is closed over the labels of the nested patterns:
+	partial := []ast.MatchCase{NestedMatchCase("ok", "some", "x", Var("x")), MatchCase("err", "e", Var("zero"))}
+	if _, err := ctx.Infer(Match(Var("result"), partial, nil), env); err == nil {
+		t.Fatalf("expected an error for an unmatched nested label")
+	}
+	// Nested and unnested patterns may not share a label:
+	mixed := []ast.MatchCase{NestedMatchCase("ok", "some", "x", Var("x")), MatchCase("ok", "o", Var("zero"))}
+	_, err := ctx.Infer(Match(Var("result"), mixed, nil), env)
+	if err == nil || err.Error() != "Match cases for label ok mix nested and unnested patterns" {
+		t.Fatalf("expected mixed pattern error, found: %v", err)
+	}
+}
+
+func TestAbsurd(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("someint", TConst("int"))
+
+	// The residual variant of a match which handles its sole label is empty, so the default case is unreachable:
+	absurd := Absurd(Var("rest"))
+	expr := Func1("x", Match(Var("x"), []ast.MatchCase{MatchCase("a", "i", Var("i"))}, &ast.MatchCase{Var: "rest", Value: absurd}))
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(expr.Type()) != "[a : 'a] -> 'a" {
+		t.Fatalf("unexpected type: %s", types.TypeString(expr.Type()))
+	}
+	if ast.ExprString(absurd) != "absurd rest" {
+		t.Fatalf("unexpected expression string: %s", ast.ExprString(absurd))
+	}
+
+	// The result may be of any type:
+	mustInfer(t, env, ctx, Func1("x", Absurd(Var("x"))), "[] -> 'a")
+
+	// Non-empty variants can not be eliminated:
+	_, err := ctx.Infer(Absurd(Variant("a", Var("someint"))), env)
+	if err == nil || !strings.Contains(err.Error(), "Absurd expression requires an empty closed variant") {
+		t.Fatalf("expected absurd error, found: %v", err)
+	}
+	_, err = ctx.Infer(Func1("x", Match(Var("x"), []ast.MatchCase{MatchCase("a", "i", Var("i"))}, &ast.MatchCase{Var: "rest", Value: Absurd(Variant("b", Var("rest")))})), env)
+	if err == nil || !strings.Contains(err.Error(), "Absurd expression requires an empty closed variant") {
+		t.Fatalf("expected absurd error, found: %v", err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, stringType, boolType := TConst("int"), TConst("string"), TConst("bool")
+	env.Declare("someint", intType)
+	env.Declare("otherint", intType)
+	env.Declare("somestring", stringType)
+
+	mustInfer(t, env, ctx, Compare("<", Var("someint"), Var("otherint")), "bool")
+	mustInfer(t, env, ctx, Func2("x", "y", Compare("==", Var("x"), Var("y"))), "('a, 'a) -> bool")
+	if ast.ExprString(Compare("<", Var("someint"), Var("otherint"))) != "someint < otherint" {
+		t.Fatalf("unexpected expression string: %s", ast.ExprString(Compare("<", Var("someint"), Var("otherint"))))
+	}
+	if _, err := ctx.Infer(Compare("<", Var("someint"), Var("somestring")), env); err == nil {
+		t.Fatalf("expected mismatched operands error")
+	}
+
+	// Operands are constrained by the configured comparison type-class:
+	Ord, err := env.DeclareTypeClass("Ord", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"compare": TArrow2(param, param, intType),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("compare_int", TArrow2(intType, intType, intType))
+	if _, err := env.DeclareInstance(Ord, intType, map[string]string{"compare": "compare_int"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx.SetComparison(Ord, boolType)
+
+	mustInfer(t, env, ctx, Compare("<", Var("someint"), Var("otherint")), "bool")
+	mustInfer(t, env, ctx, Func2("x", "y", Compare("<", Var("x"), Var("y"))), "Ord 'a => ('a, 'a) -> bool")
+	if _, err := ctx.Infer(Compare("<", Var("someint"), Var("somestring")), env); err == nil {
+		t.Fatalf("expected mismatched operands error")
+	}
+	if _, err := ctx.Infer(Compare("<", Var("somestring"), Var("somestring")), env); err == nil {
+		t.Fatalf("expected missing instance error")
+	}
+}
+
+func TestTupleMatch(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("nested", TTuple(TTuple(TConst("A"), TConst("B")), TConst("C")))
+	env.Declare("pair", TTuple(TConst("A"), TConst("B")))
+
+	expr := MatchTuple(Var("nested"),
+		TuplePattern(TuplePattern(PatternVar("a"), PatternVar("b")), PatternVar("c")),
+		RecordExtend(nil, LabelValue("a", Var("a")), LabelValue("b", Var("b")), LabelValue("c", Var("c"))))
+	if ast.ExprString(expr) != "match nested { ((a, b), c) -> {a = a, b = b, c = c} }" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "{a : A, b : B, c : C}")
+
+	// Variables may bind nested tuples:
+	expr = MatchTuple(Var("nested"), TuplePattern(PatternVar("ab"), PatternVar("c")), Var("ab"))
+	mustInfer(t, env, ctx, expr, "(A, B)")
+
+	// Tuple patterns infer the type of the matched value:
+	swap := Func1("p", MatchTuple(Var("p"), TuplePattern(PatternVar("x"), PatternVar("y")),
+		Call(Var("mkpair"), Var("y"), Var("x"))))
+	X, Y := env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("mkpair", TArrow2(X, Y, TTuple(X, Y)))
+	mustInfer(t, env, ctx, swap, "(('a, 'b)) -> ('b, 'a)")
+	mustInfer(t, env, ctx, Call(swap, Var("pair")), "(B, A)")
+
+	// Arity mismatch:
+	expr = MatchTuple(Var("pair"), TuplePattern(PatternVar("a"), PatternVar("b"), PatternVar("c")), Var("a"))
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected tuple arity error")
+	}
+	expr = MatchTuple(Var("nested"), TuplePattern(TuplePattern(PatternVar("a")), PatternVar("c")), Var("a"))
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected nested tuple arity error")
+	}
+
+	// Duplicate bindings:
+	expr = MatchTuple(Var("pair"), TuplePattern(PatternVar("a"), PatternVar("a")), Var("a"))
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected duplicate binding error")
+	}
+}
+
+func TestVariantPayloads(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("one", TConst("int"))
+	env.Declare("half", TConst("float"))
+	env.Declare("mkpair", TArrow2(TConst("int"), TConst("float"), TConst("pair")))
+
+	point := VariantN("point", Var("one"), Var("half"))
+	if ast.ExprString(point) != ":point(one, half)" {
+		t.Fatalf("expr: %s", ast.ExprString(point))
+	}
+	mustInfer(t, env, ctx, point, "[point : (int, float) | 'a]")
+	mustInfer(t, env, ctx, Func2("x", "y", VariantN("point", Var("x"), Var("y"))), "('a, 'b) -> [point : ('a, 'b) | 'c]")
+
+	// Matching binds the tuple payload:
+	expr := Match(point, []ast.MatchCase{MatchCase("point", "p", Var("p"))}, nil)
+	mustInfer(t, env, ctx, expr, "(int, float)")
+
+	// The tuple payload may be destructured with a tuple pattern:
+	expr = Match(point, []ast.MatchCase{
+		MatchCase("point", "p", MatchTuple(Var("p"), TuplePattern(PatternVar("x"), PatternVar("y")), Call(Var("mkpair"), Var("x"), Var("y")))),
+	}, nil)
+	mustInfer(t, env, ctx, expr, "pair")
+	expr = Match(point, []ast.MatchCase{
+		MatchCase("point", "p", MatchTuple(Var("p"), TuplePattern(PatternVar("y"), PatternVar("x")), Call(Var("mkpair"), Var("x"), Var("y")))),
+	}, nil)
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected mismatched payload error")
+	}
+
+	// Variants with different payload arities are distinct labels within a match:
+	shape := Func1("s", Match(Var("s"), []ast.MatchCase{
+		MatchCase("point", "p", MatchTuple(Var("p"), TuplePattern(PatternVar("x"), PatternVar("y")), Call(Var("mkpair"), Var("x"), Var("y")))),
+		MatchCase("origin", "o", Call(Var("mkpair"), Var("one"), Var("half"))),
+	}, nil))
+	mustInfer(t, env, ctx, shape, "[origin : 'a, point : (int, float)] -> pair")
+	mustInfer(t, env, ctx, Call(shape, point), "pair")
+}
+
+func TestRecordMatch(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("point", TRecordFlat(map[string]types.Type{"x": TConst("int"), "y": TConst("int"), "label": TConst("string"), "visible": TConst("bool")}))
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+
+	// The rest variable is bound to the record without the matched labels:
+	expr := MatchRecord(Var("point"), RecordPattern("rest", FieldPattern("x", "x"), FieldPattern("y", "b")),
+		RecordExtend(nil, LabelValue("sum", Call(Var("add"), Var("x"), Var("b"))), LabelValue("rest", Var("rest"))))
+	if ast.ExprString(expr) != "match point { {x, y = b | rest} -> {rest = rest, sum = add(x, b)} }" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "{rest : {label : string, visible : bool}, sum : int}")
+	mustInfer(t, env, ctx, MatchRecord(Var("point"), RecordPattern("rest", FieldPattern("x", "x"), FieldPattern("y", "y")),
+		RecordSelect(Var("rest"), "label")), "string")
+
+	// Record patterns infer the type of the matched value:
+	sum := Func1("p", MatchRecord(Var("p"), RecordPattern("rest", FieldPattern("x", "x"), FieldPattern("y", "y")),
+		RecordExtend(Var("rest"), LabelValue("sum", Call(Var("add"), Var("x"), Var("y"))))))
+	mustInfer(t, env, ctx, sum, "{x : int, y : int | 'a} -> {sum : int | 'a}")
+	mustInfer(t, env, ctx, Call(sum, Var("point")), "{label : string, sum : int, visible : bool}")
+
+	// Without a rest variable, the remaining labels are ignored:
+	getX := Func1("p", MatchRecord(Var("p"), RecordPattern("", FieldPattern("x", "x")), Var("x")))
+	mustInfer(t, env, ctx, getX, "{x : 'a | 'b} -> 'a")
+
+	// Missing labels:
+	expr = MatchRecord(Var("point"), RecordPattern("rest", FieldPattern("z", "z")), Var("z"))
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected missing label error")
+	}
+
+	// Duplicate labels and bindings:
+	expr = MatchRecord(Var("point"), RecordPattern("", FieldPattern("x", "a"), FieldPattern("x", "b")), Var("a"))
+	if _, err := ctx.Infer(expr, env); err == nil || err.Error() != "Found duplicate label x within record pattern" {
+		t.Fatalf("expected duplicate label error, found: %v", err)
+	}
+	expr = MatchRecord(Var("point"), RecordPattern("x", FieldPattern("x", "x")), Var("x"))
+	if _, err := ctx.Infer(expr, env); err == nil || err.Error() != "Found duplicate bindings for x within record pattern" {
+		t.Fatalf("expected duplicate binding error, found: %v", err)
+	}
+}
+
+func TestSafeStacks(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	// Use scoped labels within records to model a type-safe (polymorphic) stack
+	// with static underflow checking:
+
+	rest, a := env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("push", TArrow2( // ({'rest}, 'a) -> {top : 'a | 'rest}
+		TRecord(rest), a,
+		TRecord(TRowExtend(rest, TypeMap(map[string]types.Type{"top": a})))))
+
+	rest, a = env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("peek", TArrow1( // {top : 'a | 'rest} -> 'a
+		TRecord(TRowExtend(rest, TypeMap(map[string]types.Type{"top": a}))),
+		a))
+
+	rest, a = env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("pop", TArrow1( // {top : 'a | 'rest} -> 'rest
+		TRecord(TRowExtend(rest, TypeMap(map[string]types.Type{"top": a}))),
+		TRecord(rest)))
+
+	env.Declare("i", TConst("int"))
+	env.Declare("b", TConst("bool"))
+
+	// push(i), push(b), peek, pop, pop -> b
+	expr := Let("stack", RecordEmpty(),
+		Let("stack", Call(Var("push"), Var("stack"), Var("i")), // i
+			Let("stack", Call(Var("push"), Var("stack"), Var("b")), // i b
+				Let("top", Call(Var("peek"), Var("stack")), // i b
+					Let("stack", Call(Var("pop"), Var("stack")), // i,
+						Let("stack", Call(Var("pop"), Var("stack")), // empty
+							Var("top")))))))
+
+	mustInfer(t, env, ctx, expr, "bool")
+
+	// push(i), push(b), pop, peek, pop -> i
+	expr = Let("stack", RecordEmpty(),
+		Let("stack", Call(Var("push"), Var("stack"), Var("i")), // i
+			Let("stack", Call(Var("push"), Var("stack"), Var("b")), // i b
+				Let("stack", Call(Var("pop"), Var("stack")), // i
+					Let("top", Call(Var("peek"), Var("stack")), // i
+						Let("stack", Call(Var("pop"), Var("stack")), // empty
+							Var("top")))))))
+
+	mustInfer(t, env, ctx, expr, "int")
+
+	// push(i), push(b), pop, pop, pop -> underflow
+	expr = Let("stack", RecordEmpty(),
+		Let("stack", Call(Var("push"), Var("stack"), Var("i")), // i
+			Let("stack", Call(Var("push"), Var("stack"), Var("b")), // i b
+				Let("stack", Call(Var("pop"), Var("stack")), // i
+					Let("stack", Call(Var("pop"), Var("stack")), // empty
+						Let("stack", Call(Var("pop"), Var("stack")), // underflow
+							Var("stack")))))))
+
+	_, err := ctx.Infer(expr, env)
+	if err == nil {
+		t.Fatalf("expected stack underflow error")
+	}
+}
+
+func TestHigherKindedTypes(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	// class Functor 'f where
+	//   fmap :: (('a -> 'b), 'f['a]) -> 'f['b]
+	Functor, err := env.DeclareTypeClass("Functor", func(f *types.Var) types.MethodSet {
+		f.SetWeak()
+		f.RestrictConstVar()
+		a, b := env.NewGenericVar(), env.NewGenericVar()
+		return types.MethodSet{
+			"fmap": TArrow2(TArrow1(a, b), TApp(f, a), TApp(f, b)),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// class (Functor 'f) => Applicative 'f where
+	//   pure  :: 'a -> 'f['a]
+	//   (<*>) :: ('f[('a -> 'b)], 'f['a]) -> 'f['b]
+	Applicative, err := env.DeclareTypeClass("Applicative", func(f *types.Var) types.MethodSet {
+		f.SetWeak()
+		f.RestrictConstVar()
+		a, b := env.NewGenericVar(), env.NewGenericVar()
+		return types.MethodSet{
+			"pure":  TArrow1(a, TApp(f, a)),
+			"(<*>)": TArrow2(TApp(f, TArrow1(a, b)), TApp(f, a), TApp(f, b)),
+		}
+	}, Functor) // extends/subsumes Functor
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// class (Applicative 'm) => Monad 'm where
+	//   (>>=) :: ('m['a], (a -> 'm['b])) -> 'm['b]
+	Monad, err := env.DeclareTypeClass("Monad", func(m *types.Var) types.MethodSet {
+		m.SetWeak()
+		m.RestrictConstVar()
+		a, b := env.NewGenericVar(), env.NewGenericVar()
+		return types.MethodSet{
+			"(>>=)": TArrow2(TApp(m, a), TArrow1(a, TApp(m, b)), TApp(m, b)),
+		}
+	}, Applicative) // extends/subsumes Applicative
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fmap       :: (('a -> 'b),     'f['a]) ->     'f['b]
+	// option_map :: (('a -> 'b), Option['a]) -> Option['b]
+	//
+	// pure :: 'a ->     'f['a]
+	// some :: 'a -> Option['a]
+	//
+	// (<*>)     ::     ('f[('a -> 'b)],     'f['a]) ->     'f['b]
+	// option_ap :: (Option[('a -> 'b)], Option['a]) -> Option['b]
+	//
+	// (>>=)       ::     ('m['a], (a ->     'm['b])) ->     'm['b]
+	// option_bind :: (Option['a], (a -> Option['b])) -> Option['b]
+	//
+	// instance Monad Option where
+	//   fmap  = option_map
+	//   pure  = some
+	//   (<*>) = option_ap
+	//   (>>=) = option_bind
+	a, b, option := env.NewGenericVar(), env.NewGenericVar(), TConst("Option")
+	env.Declare("option_map", TArrow2(TArrow1(a, b), TApp(option, a), TApp(option, b)))
+	a = env.NewGenericVar()
+	env.Declare("some", TArrow1(a, TApp(option, a)))
+	a, b = env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("option_ap", TArrow2(TApp(option, TArrow1(a, b)), TApp(option, a), TApp(option, b)))
+	a, b = env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("option_bind", TArrow2(TApp(option, a), TArrow1(a, TApp(option, b)), TApp(option, b)))
+	optionMethods := map[string]string{"fmap": "option_map", "pure": "some", "(<*>)": "option_ap", "(>>=)": "option_bind"}
+	// Declaring instances for Functor and Applicative is not strictly necessary, but should not cause errors
+	// due to overlapping instances:
+	if _, err := env.DeclareInstance(Functor, option, optionMethods); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.DeclareInstance(Applicative, option, optionMethods); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.DeclareInstance(Monad, option, optionMethods); err != nil {
+		t.Fatal(err)
+	}
+
+	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
+	env.Declare("atoi", TArrow1(TConst("string"), TConst("int")))
+	env.Declare("someintoption", TApp(option, TConst("int")))
+
+	var expr ast.Expr = Call(Var("fmap"), Var("itoa"), Var("someintoption"))
+	mustInfer(t, env, ctx, expr, "Option[string]")
+
+	expr = Call(Var("(>>=)"), Var("someintoption"), Func1("i", Call(Var("pure"), Call(Var("itoa"), Var("i")))))
+	if ast.ExprString(expr) != "(>>=)(someintoption, fn (i) -> pure(itoa(i)))" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "Option[string]")
+
+	expr = Func1("x", Pipe("$", Var("x"),
+		Call(Var("(>>=)"), Var("$"), Func1("i", Call(Var("pure"), Call(Var("itoa"), Var("i"))))),
+		Call(Var("(>>=)"), Var("$"), Func1("s", Call(Var("pure"), Call(Var("atoi"), Var("s"))))),
+		Call(Var("(>>=)"), Var("$"), Func1("i", Call(Var("some"), Var("i"))))))
+
+	mustInfer(t, env, ctx, expr, "Option[int] -> Option[int]")
+
+	// fmap    :: (('a -> 'b),  'f['a]) ->  'f['b]
+	// ref_map :: (('a -> 'b), ref['a]) -> ref['b]
+	//
+	// instance Functor ref where
+	//   fmap = ref_map
+	a, b = env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("ref_map", TArrow2(TArrow1(a, b), TRef(a), TRef(b)))
+	if _, err := env.DeclareInstance(Functor, types.RefType, map[string]string{"fmap": "ref_map"}); err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("someintref", TRef(TConst("int")))
+	expr = Call(Var("fmap"), Var("itoa"), Var("someintref"))
+	mustInfer(t, env, ctx, expr, "ref[string]")
+
+	// detect invalid instances
+
+	// fmap    :: (('a -> 'b), 'f['a]) -> 'f['b]
+	// bad_map :: (('a -> 'b),  A['a]) ->  B['b]
+	//                          ^----------^
+	//
+	// instance Functor A where
+	//   fmap = bad_map
+	a, b = env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("bad_map", TArrow2(TArrow1(a, b), TApp(TConst("A"), a), TApp(TConst("B"), b)))
+	if _, err = env.DeclareInstance(Functor, TConst("A"), map[string]string{"fmap": "bad_map"}); err == nil {
+		t.Fatalf("expected invalid-instance error")
+	}
+
+	// bad applicative (Vec is not declared as a Functor instance)
+	a = env.NewGenericVar()
+	env.Declare("new_vec", TArrow1(a, TApp(TConst("Vec"), a)))
+	a, b = env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("vec_ap", TArrow2(TApp(TConst("Vec"), TArrow1(a, b)), TApp(TConst("Vec"), a), TApp(TConst("Vec"), b)))
+	if _, err := env.DeclareInstance(Applicative, TConst("Vec"), map[string]string{"pure": "new_vec", "(<*>)": "vec_ap"}); err == nil {
+		t.Fatalf("expected invalid-instance error")
+	}
+}
+
+func TestShadowedMethods(t *testing.T) {
+	parent := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	Functor, err := parent.DeclareTypeClass("Functor", func(f *types.Var) types.MethodSet {
+		f.RestrictConstVar()
+		a, b := parent.NewGenericVar(), parent.NewGenericVar()
+		return types.MethodSet{
+			"map": TArrow2(TArrow1(a, b), TApp(f, a), TApp(f, b)),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := parent.NewGenericVar(), parent.NewGenericVar()
+	parent.Declare("option_map", TArrow2(TArrow1(a, b), TApp(TConst("option"), a), TApp(TConst("option"), b)))
+	if _, err := parent.DeclareInstance(Functor, TConst("option"), map[string]string{"map": "option_map"}); err != nil {
+		t.Fatal(err)
+	}
+	parent.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	parent.Declare("someint", TConst("int"))
+
+	for _, env := range []*TypeEnv{parent, NewTypeEnv(parent)} {
+		mustInfer(t, env, ctx, Var("map"), "(const 'c, Functor 'c) => ('a -> 'b, 'c['a]) -> 'c['b]")
+
+		// let map = fn (x) -> add(x, x) in map(someint)
+		expr := Let("map", Func1("x", Call(Var("add"), Var("x"), Var("x"))), Call(Var("map"), Var("someint")))
+		mustInfer(t, env, ctx, expr, "int")
+		if err := ctx.AnnotateDirect(expr, env); err != nil {
+			t.Fatal(err)
+		}
+		if scope := expr.Body.(*ast.Call).Func.(*ast.Var).Scope(); scope == nil || scope.Expr != expr {
+			t.Fatalf("expected map to be bound by the let-expression")
+		}
+
+		// fn (map) -> map(someint)
+		mustInfer(t, env, ctx, Func1("map", Call(Var("map"), Var("someint"))), "(int -> 'a) -> 'a")
+
+		// The method is visible again outside of the let-expression:
+		mustInfer(t, env, ctx, Var("map"), "(const 'c, Functor 'c) => ('a -> 'b, 'c['a]) -> 'c['b]")
+	}
+}
+
+func TestUnionTypeClasses(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	ABC, err := env.DeclareUnionTypeClass("ABC", nil, map[string]types.Type{
+		"A": TConst("A"),
+		"B": TConst("B"),
+		"C": TConst("C"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	abc := env.NewQualifiedVar(types.InstanceConstraint{ABC})
+	env.Declare("fabc", TArrow1(abc, abc))
+	env.Declare("somea", TConst("A"))
+	env.Declare("someint", TConst("int"))
+
+	call := Call(Var("fabc"), Var("somea"))
+	mustInfer(t, env, ctx, call, "A")
+
+	// (built-in) cast to a tagged variant:
+	mustInfer(t, env, ctx, Var("ABC"), "ABC 'a => 'a -> [A : A, B : B, C : C]")
+
+	call = Call(Var("ABC"), Var("somea"))
+	mustInfer(t, env, ctx, call, "[A : A, B : B, C : C]")
+
+	match := Match(Call(Var("ABC"), Var("somea")),
+		[]ast.MatchCase{
+			{Label: "A", Var: "a", Value: Var("someint")},
+			{Label: "B", Var: "b", Value: Var("someint")},
+			{Label: "C", Var: "c", Value: Var("someint")},
+		},
+		// no default case:
+		nil)
+
+	mustInfer(t, env, ctx, match, "int")
+}
+
+func TestDeferredInstanceMatching(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	objA := TRecordFlat(map[string]types.Type{"x": TConst("A")})
+	objB := TRecordFlat(map[string]types.Type{"x": TConst("B")})
+
+	HasX, err := env.DeclareUnionTypeClass("HasX", nil, map[string]types.Type{
+		"A": objA,
+		"B": objB,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.Declare("objA", objA)
+	env.Declare("objB", objB)
+	env.Declare("a_id", TArrow1(TConst("A"), TConst("A")))
+
+	hasX := env.NewQualifiedVar(types.InstanceConstraint{HasX})
+	env.Declare("obj_id", TArrow1(hasX, hasX))
+
+	mustInfer(t, env, ctx, Var("obj_id"), "HasX 'a => 'a -> 'a")
+	mustInfer(t, env, ctx, Var("objA"), "{x : A}")
+	mustInfer(t, env, ctx, Call(Var("obj_id"), Var("objA")), "{x : A}")
+
+	// fn (x) -> let _ = obj_id({x = x}) in a_id(x)
+	expr := Func1("x",
+		Let("_", Call(Var("obj_id"), RecordExtend(RecordEmpty(), LabelValue("x", Var("x")))),
+			Call(Var("a_id"), Var("x"))))
+
+	if _, err = ctx.Infer(expr, env); err == nil {
+		t.Fatalf("unexpected match for type-class with missing context")
+	}
+	if !strings.Contains(err.Error(), "Instance cannot be determined") {
+		t.Fatalf("expected context error, found: %s", err.Error())
+	}
+	if ctx.InvalidExpr() == nil {
+		t.Fatalf("expected invalid expression to be retained")
+	}
+	if ast.ExprString(ctx.InvalidExpr()) != "obj_id({x = x})" {
+		t.Fatalf("invalid expr: %s", ast.ExprString(ctx.InvalidExpr()))
+	}
+
+	ctx.EnableDeferredInstanceMatching(true)
+	if _, err = ctx.Infer(expr, env); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSolveConstraints(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	ABC, err := env.DeclareUnionTypeClass("ABC", nil, map[string]types.Type{
+		"A": TConst("A"),
+		"B": TConst("B"),
+		"C": TConst("C"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CD, err := env.DeclareUnionTypeClass("CD", nil, map[string]types.Type{
+		"C": TConst("C"),
+		"D": TConst("D"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	DE, err := env.DeclareUnionTypeClass("DE", nil, map[string]types.Type{
+		"D": TConst("D"),
+		"E": TConst("E"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	abc := env.NewQualifiedVar(types.InstanceConstraint{ABC})
+	env.Declare("fabc", TArrow1(abc, abc))
+	cd := env.NewQualifiedVar(types.InstanceConstraint{CD})
+	env.Declare("fcd", TArrow1(cd, cd))
+	de := env.NewQualifiedVar(types.InstanceConstraint{DE})
+	env.Declare("fde", TArrow1(de, de))
+
+	if err = ctx.SolveConstraints(env); err == nil {
+		t.Fatalf("expected error before inference")
+	}
+
+	// resolved: only C is an instance of both ABC and CD
+	expr := Func1("x", Call(Var("fcd"), Call(Var("fabc"), Var("x"))))
+	mustInfer(t, env, ctx, expr, "(ABC 'a, CD 'a) => 'a -> 'a")
+	ty, _ := ctx.Infer(expr, env)
+	if err = ctx.SolveConstraints(env); err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(ty) != "C -> C" {
+		t.Fatalf("unexpected solved type: %s", types.TypeString(ty))
+	}
+
+	// ambiguous: A, B, and C are instances of ABC
+	mustInfer(t, env, ctx, Var("fabc"), "ABC 'a => 'a -> 'a")
+	if err = ctx.SolveConstraints(env); err == nil || !strings.Contains(err.Error(), "Ambiguous instances") {
+		t.Fatalf("expected ambiguous constraint error, found: %v", err)
+	}
+
+	// unsatisfiable: no type is an instance of both ABC and DE
+	expr = Func1("x", Call(Var("fde"), Call(Var("fabc"), Var("x"))))
+	mustInfer(t, env, ctx, expr, "(ABC 'a, DE 'a) => 'a -> 'a")
+	err = ctx.SolveConstraints(env)
+	var unifyErr *types.UnifyError
+	if !errors.As(err, &unifyErr) || unifyErr.Kind != types.ConstraintFailure || unifyErr.TypeClass != ABC {
+		t.Fatalf("expected unsatisfiable constraint error, found: %v", err)
+	}
+}
+
+func TestInstanceResolver(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType, stringType := TConst("int"), TConst("bool"), TConst("string")
+
+	Show, err := env.DeclareTypeClass("Show", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"show": TArrow1(param, stringType),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("show_int", TArrow1(intType, stringType))
+	if _, err := env.DeclareInstance(Show, intType, map[string]string{"show": "show_int"}); err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("someint", intType)
+	env.Declare("somebool", boolType)
+
+	mustInfer(t, env, ctx, Call(Var("show"), Var("someint")), "string")
+	if _, err = ctx.Infer(Call(Var("show"), Var("somebool")), env); err == nil {
+		t.Fatalf("expected missing instance error")
+	}
+
+	var resolved []string
+	ctx.SetInstanceResolver(func(class *types.TypeClass, t types.Type) (map[string]types.Type, bool) {
+		if class != Show || types.TypeString(t) != "bool" {
+			return nil, false
+		}
+		resolved = append(resolved, class.Name+" "+types.TypeString(t))
+		return map[string]types.Type{"show": TArrow1(boolType, stringType)}, true
+	})
+	mustInfer(t, env, ctx, Call(Var("show"), Var("someint")), "string")
+	mustInfer(t, env, ctx, Call(Var("show"), Var("somebool")), "string")
+	if len(resolved) != 1 || resolved[0] != "Show bool" {
+		t.Fatalf("unexpected resolved instances: %v", resolved)
+	}
+
+	// resolved methods must implement the type-class:
+	ctx.SetInstanceResolver(func(class *types.TypeClass, t types.Type) (map[string]types.Type, bool) {
+		return map[string]types.Type{"show": TArrow1(boolType, intType)}, true
+	})
+	if _, err = ctx.Infer(Call(Var("show"), Var("somebool")), env); err == nil {
+		t.Fatalf("expected invalid resolved method error")
+	}
+	ctx.SetInstanceResolver(func(class *types.TypeClass, t types.Type) (map[string]types.Type, bool) {
+		return map[string]types.Type{}, true
+	})
+	if _, err = ctx.Infer(Call(Var("show"), Var("somebool")), env); err == nil {
+		t.Fatalf("expected missing resolved method error")
+	}
+}
+
+func TestConstraintResolved(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType, stringType := TConst("int"), TConst("bool"), TConst("string")
+
+	Show, err := env.DeclareTypeClass("Show", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"show": TArrow1(param, stringType),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	showListType := TApp(TConst("list"), env.NewQualifiedVar(types.InstanceConstraint{Show}))
+	env.Declare("show_int", TArrow1(intType, stringType))
+	env.Declare("show_bool", TArrow1(boolType, stringType))
+	env.Declare("show_list", TArrow1(showListType, stringType))
+	for param, impl := range map[types.Type]string{intType: "show_int", boolType: "show_bool", showListType: "show_list"} {
+		if _, err := env.DeclareInstance(Show, param, map[string]string{"show": impl}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.Declare("someint", intType)
+	env.Declare("somebool", boolType)
+	env.Declare("someintlist", TApp(TConst("list"), intType))
+
+	var resolved []string
+	ctx.SetOnConstraintResolved(func(c types.InstanceConstraint, instance types.Type) {
+		resolved = append(resolved, c.TypeClass.Name+" "+types.TypeString(instance))
+	})
+
+	// Resolutions are reported in source order:
+	expr := RecordExtend(nil,
+		LabelValue("a", Call(Var("show"), Var("someint"))),
+		LabelValue("b", Call(Var("show"), Var("somebool"))))
+	mustInfer(t, env, ctx, expr, "{a : string, b : string}")
+	if !reflect.DeepEqual(resolved, []string{"Show int", "Show bool"}) {
+		t.Fatalf("unexpected resolutions: %v", resolved)
+	}
+
+	// Sub-goals are reported before the instance:
+	resolved = nil
+	mustInfer(t, env, ctx, Call(Var("show"), Var("someintlist")), "string")
+	if !reflect.DeepEqual(resolved, []string{"Show int", "Show list[int]"}) {
+		t.Fatalf("unexpected resolutions: %v", resolved)
+	}
+
+	// Residual constraints are not resolved until they are solved:
+	resolved = nil
+	mustInfer(t, env, ctx, Func1("x", Call(Var("show"), Var("x"))), "Show 'a => 'a -> string")
+	if len(resolved) != 0 {
+		t.Fatalf("unexpected resolutions: %v", resolved)
+	}
+	mustInfer(t, env, ctx, Let("f", Func1("x", Call(Var("show"), Var("x"))), Call(Var("f"), Var("somebool"))), "string")
+	if !reflect.DeepEqual(resolved, []string{"Show bool"}) {
+		t.Fatalf("unexpected resolutions: %v", resolved)
+	}
+
+	// Constraints resolved by the solver are reported:
+	Small, err := env.DeclareUnionTypeClass("Small", nil, map[string]types.Type{"I": intType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := env.NewQualifiedVar(types.InstanceConstraint{Small})
+	env.Declare("fsmall", TArrow1(small, small))
+	resolved = nil
+	mustInfer(t, env, ctx, Var("fsmall"), "Small 'a => 'a -> 'a")
+	if err = ctx.SolveConstraints(env); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resolved, []string{"Small int"}) {
+		t.Fatalf("unexpected resolutions: %v", resolved)
+	}
+}
+
+func TestRecursiveInstances(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType, stringType := TConst("int"), TConst("bool"), TConst("string")
+
+	Show, err := env.DeclareTypeClass("Show", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"show": TArrow1(param, stringType),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Show list['a] requires Show 'a:
+	showListType := TApp(TConst("list"), env.NewQualifiedVar(types.InstanceConstraint{Show}))
+	env.Declare("show_int", TArrow1(intType, stringType))
+	env.Declare("show_list", TArrow1(showListType, stringType))
+	if _, err := env.DeclareInstance(Show, intType, map[string]string{"show": "show_int"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.DeclareInstance(Show, showListType, map[string]string{"show": "show_list"}); err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("someintlists", TApp(TConst("list"), TApp(TConst("list"), intType)))
+	env.Declare("someboollists", TApp(TConst("list"), TApp(TConst("list"), boolType)))
+
+	// Show list[list[int]] resolves the sub-goals Show list[int] and Show int:
+	mustInfer(t, env, ctx, Call(Var("show"), Var("someintlists")), "string")
+	if _, err = ctx.Infer(Call(Var("show"), Var("someboollists")), env); err == nil {
+		t.Fatalf("expected unsatisfiable sub-goal error")
+	}
+
+	// The depth of sub-goals is limited:
+	ctx.SetMaxInstanceDepth(2)
+	if _, err = ctx.Infer(Call(Var("show"), Var("someintlists")), env); err == nil || !strings.Contains(err.Error(), "exceeded the maximum depth 2") {
+		t.Fatalf("expected instance depth error, found: %v", err)
+	}
+	ctx.SetMaxInstanceDepth(3)
+	mustInfer(t, env, ctx, Call(Var("show"), Var("someintlists")), "string")
+	ctx.SetMaxInstanceDepth(0)
+
+	// Show box['a] requires Show 'a, and nest = box[nest] is cyclic:
+	showBoxType := TApp(TConst("box"), env.NewQualifiedVar(types.InstanceConstraint{Show}))
+	env.Declare("show_box", TArrow1(showBoxType, stringType))
+	if _, err := env.DeclareInstance(Show, showBoxType, map[string]string{"show": "show_box"}); err != nil {
+		t.Fatal(err)
+	}
+	nest := env.NewSimpleRecursive(nil, func(rec *types.Recursive, self *types.RecursiveLink) {
+		rec.AddType("nest", TApp(TConst("box"), self))
+	})
+	env.Declare("somenest", nest.GetType("nest"))
+	_, err = ctx.Infer(Call(Var("show"), Var("somenest")), env)
+	if err == nil || !strings.Contains(err.Error(), "exceeded the maximum depth") {
+		t.Fatalf("expected instance depth error, found: %v", err)
+	}
+}
+
+func TestConstrainedArguments(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType, stringType := TConst("int"), TConst("bool"), TConst("string")
+
+	Show, err := env.DeclareTypeClass("Show", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"show": TArrow1(param, stringType),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("show_int", TArrow1(intType, stringType))
+	if _, err := env.DeclareInstance(Show, intType, map[string]string{"show": "show_int"}); err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("someint", intType)
+	env.Declare("somebool", boolType)
+
+	// The constraint on the argument's type-variable is generalized onto the function's scheme:
+	showArg := Func1("x", Call(Var("show"), Var("x")))
+	mustInfer(t, env, ctx, showArg, "Show 'a => 'a -> string")
+	mustInfer(t, env, ctx, Let("f", showArg, Var("f")), "Show 'a => 'a -> string")
+	mustInfer(t, env, ctx, Let("f", showArg, Call(Var("f"), Var("someint"))), "string")
+	if _, err = ctx.Infer(Let("f", showArg, Call(Var("f"), Var("somebool"))), env); err == nil {
+		t.Fatalf("expected unsatisfied constraint error for bool")
+	}
+
+	// Constraints are propagated through nested functions and wrapped arguments:
+	showFirst := Func2("x", "y", Call(Var("show"), RecordSelect(Var("x"), "a")))
+	mustInfer(t, env, ctx, Let("f", showFirst, Var("f")), "Show 'a => ({a : 'a | 'b}, 'c) -> string")
+	curried := Func1("x", Func1("y", Call(Var("show"), Var("y"))))
+	mustInfer(t, env, ctx, Let("f", curried, Var("f")), "Show 'b => 'a -> 'b -> string")
+	mustInfer(t, env, ctx, Let("f", curried, Call(Call(Var("f"), Var("somebool")), Var("someint"))), "string")
+
+	// An explicit signature may require the constraint:
+	sigType := TArrow1(env.NewQualifiedVar(types.InstanceConstraint{Show}), stringType)
+	mustInfer(t, env, ctx, Signature(showArg, sigType), "Show 'a => 'a -> string")
+	if _, err = ctx.Infer(Signature(showArg, TArrow1(env.NewGenericVar(), stringType)), env); err == nil {
+		t.Fatalf("expected signature error for the missing constraint")
+	}
+}
+
+func TestLocalInstances(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType, stringType := TConst("int"), TConst("bool"), TConst("string")
+
+	Show, err := env.DeclareTypeClass("Show", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"show": TArrow1(param, stringType),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("show_bool", TArrow1(boolType, stringType))
+	if _, err := env.DeclareInstance(Show, boolType, map[string]string{"show": "show_bool"}); err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("someint", intType)
+	env.Declare("somebool", boolType)
+	env.Declare("somestring", stringType)
+
+	showInt := func(body ast.Expr) *ast.WithInstance {
+		return WithInstance(Show, intType, map[string]ast.Expr{"show": Func1("x", Var("somestring"))}, body)
+	}
+
+	// The instance is available within the body:
+	var expr ast.Expr = showInt(RecordExtend(nil,
+		LabelValue("a", Call(Var("show"), Var("someint"))),
+		LabelValue("b", Call(Var("show"), Var("somebool")))))
+	mustInfer(t, env, ctx, expr, "{a : string, b : string}")
+	if s := ast.ExprString(showInt(Call(Var("show"), Var("someint")))); s != "with-instance Show int {show(x) = somestring} in show(someint)" {
+		t.Fatalf("expr: %s", s)
+	}
+
+	// The instance is not available outside the body:
+	expr = RecordExtend(nil,
+		LabelValue("a", showInt(Call(Var("show"), Var("someint")))),
+		LabelValue("b", Call(Var("show"), Var("someint"))))
+	if _, err = ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected missing instance error outside of the local instance")
+	}
+	if _, err = ctx.Infer(Call(Var("show"), Var("someint")), env); err == nil {
+		t.Fatalf("expected missing instance error after inference")
+	}
+	if len(Show.Instances) != 1 {
+		t.Fatalf("expected the local instance to be removed, found %d instances", len(Show.Instances))
+	}
+
+	// Methods must implement the type-class for the instance type:
+	expr = WithInstance(Show, intType, map[string]ast.Expr{"show": Func1("x", Var("someint"))}, Var("someint"))
+	if _, err = ctx.Infer(expr, env); err == nil || err.Error() != "Type int does not implement method show of type-class Show" {
+		t.Fatalf("expected method error, found: %v", err)
+	}
+	expr = WithInstance(Show, intType, map[string]ast.Expr{}, Var("someint"))
+	if _, err = ctx.Infer(expr, env); err == nil || err.Error() != "Type int does not implement method show of type-class Show" {
+		t.Fatalf("expected missing method error, found: %v", err)
+	}
+
+	// Local instances must not overlap with declared instances:
+	expr = WithInstance(Show, boolType, map[string]ast.Expr{"show": Func1("x", Var("somestring"))}, Var("someint"))
+	if _, err = ctx.Infer(expr, env); err == nil || !strings.HasPrefix(err.Error(), "Found overlapping instance") {
+		t.Fatalf("expected overlapping instance error, found: %v", err)
+	}
+}
+
+func TestMethodInfo(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, stringType := TConst("int"), TConst("string")
+	Show, err := env.DeclareTypeClass("Show", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"show": TArrow1(param, stringType),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("show_int", TArrow1(intType, stringType))
+	if _, err := env.DeclareInstance(Show, intType, map[string]string{"show": "show_int"}); err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("someint", intType)
+
+	method, fn := Call(Var("show"), Var("someint")), Call(Var("show_int"), Var("someint"))
+	if err := ctx.AnnotateDirect(method, env); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.AnnotateDirect(fn, env); err != nil {
+		t.Fatal(err)
+	}
+	if arrow := method.FuncType(); !arrow.IsMethod() {
+		t.Fatalf("expected method call for %s", ast.ExprString(method))
+	} else if tc, name := arrow.MethodInfo(); tc != Show || name != "show" {
+		t.Fatalf("unexpected method info: %v %s", tc, name)
+	}
+	if arrow := fn.FuncType(); arrow.IsMethod() {
+		t.Fatalf("unexpected method call for %s", ast.ExprString(fn))
+	} else if tc, name := arrow.MethodInfo(); tc != nil || name != "" {
+		t.Fatalf("unexpected method info: %v %s", tc, name)
+	}
+}
+
+func TestConstraintFailures(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType := TConst("int")
+	Num, err := env.DeclareTypeClass("Num", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"+": TArrow2(param, param, param),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("int_add", TArrow2(intType, intType, intType))
+	if _, err := env.DeclareInstance(Num, intType, map[string]string{"+": "int_add"}); err != nil {
+		t.Fatal(err)
+	}
+	num := env.NewQualifiedVar(types.InstanceConstraint{Num})
+	env.Declare("double", TArrow1(num, num))
+	env.Declare("someint", intType)
+	env.Declare("somebool", TConst("bool"))
+	env.Declare("someintvec", TApp(TConst("vec"), intType))
+
+	mustInfer(t, env, ctx, Call(Var("double"), Var("someint")), "int")
+
+	for _, c := range []struct {
+		expr   ast.Expr
+		expect string
+	}{
+		{Call(Var("double"), Var("somebool")), "bool"},
+		{Call(Var("+"), Var("someintvec"), Var("someintvec")), "vec[int]"},
+	} {
+		_, err := ctx.Infer(c.expr, env)
+		unifyErr, ok := err.(*types.UnifyError)
+		if !ok {
+			t.Fatalf("expected unification error for %s, found: %v", ast.ExprString(c.expr), err)
+		}
+		if unifyErr.Kind != types.ConstraintFailure || unifyErr.TypeClass != Num || types.TypeString(unifyErr.Type) != c.expect {
+			t.Fatalf("unexpected constraint failure for %s: %#v", ast.ExprString(c.expr), unifyErr)
+		}
+		if err.Error() != c.expect+" does not satisfy constraint Num" {
+			t.Fatalf("unexpected error message: %s", err.Error())
+		}
+	}
+}
+
+func TestConstrainedRecordFields(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType := TConst("int"), TConst("bool")
+	Num, err := env.DeclareTypeClass("Num", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"+": TArrow2(param, param, param),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("int_add", TArrow2(intType, intType, intType))
+	if _, err := env.DeclareInstance(Num, intType, map[string]string{"+": "int_add"}); err != nil {
+		t.Fatal(err)
+	}
+	num := env.NewQualifiedVar(types.InstanceConstraint{Num})
+	env.Declare("origin", TArrow1(num, TRecordFlat(map[string]types.Type{"x": num, "y": num})))
+	env.Declare("someint", intType)
+	env.Declare("somebool", boolType)
+	env.Declare("pt", TRecordFlat(map[string]types.Type{"x": env.NewQualifiedVar(types.InstanceConstraint{Num})}))
+
+	// The constraint on the field is carried to the selected value:
+	mustInfer(t, env, ctx, RecordSelect(Var("pt"), "x"), "Num 'a => 'a")
+	mustInfer(t, env, ctx, Call(Var("+"), RecordSelect(Var("pt"), "x"), Var("someint")), "int")
+	point := Call(Var("origin"), Var("someint"))
+	mustInfer(t, env, ctx, RecordSelect(point, "x"), "int")
+	mustInfer(t, env, ctx, Func1("n", RecordSelect(Call(Var("origin"), Var("n")), "x")), "Num 'a => 'a -> 'a")
+	mustInfer(t, env, ctx, Func1("n", Call(Var("+"), RecordSelect(Call(Var("origin"), Var("n")), "x"), Var("n"))), "Num 'a => 'a -> 'a")
+	mustInfer(t, env, ctx, Func1("r", Call(Var("+"), RecordSelect(Var("r"), "x"), Var("someint"))), "{x : int | 'a} -> int")
+	mustInfer(t, env, ctx, Let("p", Func1("n", Call(Var("origin"), Var("n"))),
+		Call(Var("+"), RecordSelect(Call(Var("p"), Var("someint")), "x"), RecordSelect(Call(Var("p"), Var("someint")), "y"))), "int")
+
+	// Restricted records retain constrained fields:
+	mustInfer(t, env, ctx, Func1("n", RecordRestrict(Call(Var("origin"), Var("n")), "x")), "Num 'a => 'a -> {y : 'a}")
+
+	// The constraint is checked when the selected value is used:
+	expr := Let("x", RecordSelect(Call(Var("origin"), Var("n")), "x"), Call(Var("+"), Var("x"), Var("somebool")))
+	if _, err := ctx.Infer(Func1("n", expr), env); err == nil {
+		t.Fatalf("expected constraint failure for %s", ast.ExprString(expr))
+	}
+	if _, err := ctx.Infer(RecordSelect(Call(Var("origin"), Var("somebool")), "x"), env); err == nil {
+		t.Fatalf("expected constraint failure for bool field")
+	}
+}
+
+func TestConstraints(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	// type hierarchy
+
+	intType, shortType, floatType, boolType := TConst("int"), TConst("short"), TConst("float"), TConst("bool")
+	intVecType := TApp(TConst("vec"), intType)
+
+	Add, err := env.DeclareTypeClass("Add", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"+": TArrow2(param, param, param),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adderVecType := TApp(TConst("vec"), env.NewQualifiedVar(types.InstanceConstraint{Add}))
+	if types.TypeString(adderVecType) != "Add 'a => vec['a]" {
+		t.Fatalf("invalid vec string: %s", types.TypeString(adderVecType))
+	}
+
+	Int, err := env.DeclareTypeClass("Int", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{
+			"&": TArrow2(param, param, param),
+		}
+	}, Add) // implements/subsumes Add
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.Declare("int_add", TArrow2(intType, intType, intType))
+	env.Declare("int_and", TArrow2(intType, intType, intType))
+	env.Declare("short_add", TArrow2(shortType, shortType, shortType))
+	env.Declare("short_and", TArrow2(shortType, shortType, shortType))
+	env.Declare("float_add", TArrow2(floatType, floatType, floatType))
+	env.Declare("vec_add", TArrow2(adderVecType, adderVecType, adderVecType))
+	env.Declare("int_vec_add", TArrow2(intVecType, intVecType, intVecType))
+	env.Declare("bad_bool_add", TArrow2(boolType, intType, boolType))
+
+	if _, err := env.DeclareInstance(Int, intType, map[string]string{"+": "int_add", "&": "int_and"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.DeclareInstance(Int, shortType, map[string]string{"+": "short_add", "&": "short_and"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.DeclareInstance(Add, floatType, map[string]string{"+": "float_add"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.DeclareInstance(Add, adderVecType, map[string]string{"+": "vec_add"}); err != nil {
+		t.Fatal(err)
+	}
+	// detect overlapping instances:
+	if _, err := env.DeclareInstance(Add, intVecType, map[string]string{"+": "int_vec_add"}); err == nil {
+		t.Fatalf("expected instance-overlap error")
+	}
+
+	env.Declare("somebool", boolType)
+	env.Declare("someint", intType)
+	env.Declare("someshort", shortType)
+	env.Declare("somefloat", floatType)
+	env.Declare("someintvec", TApp(TConst("vec"), intType))
+	env.Declare("somefloatvec", TApp(TConst("vec"), floatType))
+	env.Declare("someboolvec", TApp(TConst("vec"), boolType))
+
+	// method-instance lookups
+
+	call := Call(Var("+"), Var("someint"), Var("someint"))
+	if err = ctx.AnnotateDirect(call, env); err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(call.Type()) != "int" {
+		t.Fatalf("expected int return, found " + types.TypeString(call.Type()))
+	}
+
+	method := call.FuncType().Method
+	if method == nil || method.Name != "+" || method.TypeClass != Add {
+		t.Fatalf("no method annotated on call or method = %#+v", call.FuncType())
+	}
+	methodInstance := env.FindMethodInstance(call.FuncType())
+	if methodInstance == nil {
+		t.Fatal("no method instance found")
+	}
+	if types.TypeString(methodInstance.Param) != "int" {
+		t.Fatalf("expected int instance, found %s", types.TypeString(methodInstance.Param))
+	}
+	if methodInstance.MethodNames["+"] != "int_add" {
+		t.Fatalf("expected int_add, found %s", methodInstance.MethodNames["+"])
+	}
+
+	// method/instance inference
+
+	var addWrapper ast.Expr = Func2("x", "y", Call(Var("+"), Var("x"), Var("y")))
+	mustInfer(t, env, ctx, addWrapper, "Add 'a => ('a, 'a) -> 'a")
+
+	var expr ast.Expr = Call(addWrapper, Var("someint"), Var("someint"))
+	mustInfer(t, env, ctx, expr, "int")
+
+	expr = Call(addWrapper, Var("someshort"), Var("someshort"))
+	mustInfer(t, env, ctx, expr, "short")
+
+	expr = Call(addWrapper, Var("somefloat"), Var("somefloat"))
+	mustInfer(t, env, ctx, expr, "float")
+
+	expr = Call(addWrapper, Var("someint"), Var("somefloat"))
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected constraint error")
+	}
+
+	expr = Call(addWrapper, Var("somebool"), Var("somebool"))
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected constraint error")
+	}
+
+	expr = Call(addWrapper, Var("someintvec"), Var("someintvec"))
+	mustInfer(t, env, ctx, expr, "vec[int]")
+
+	expr = Call(addWrapper, Var("somefloatvec"), Var("somefloatvec"))
+	mustInfer(t, env, ctx, expr, "vec[float]")
+
+	expr = Call(addWrapper, Var("someboolvec"), Var("someboolvec"))
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected constraint error")
+	}
+
+	expr = Call(Var("&"), Var("someint"), Var("someint"))
+	mustInfer(t, env, ctx, expr, "int")
+
+	expr = Call(Var("&"), Var("someshort"), Var("someshort"))
+	mustInfer(t, env, ctx, expr, "short")
+
+	expr = Call(Var("&"), Var("somebool"), Var("somebool"))
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected constraint error")
+	}
+
+	expr = Call(Var("&"), Var("someint"), Var("someshort"))
+	_, err = ctx.Infer(expr, env)
+	if _, err := ctx.Infer(expr, env); err == nil {
+		t.Fatalf("expected constraint error")
+	}
+
+	addWrapper = Func1("x", Call(Var("+"), Var("x"), Var("someint")))
+	mustInfer(t, env, ctx, addWrapper, "int -> int")
+
+	// instance validation
+
+	if _, err := env.DeclareInstance(Int, boolType, map[string]string{"&": "bool_and"}); err == nil {
+		t.Fatalf("expected missing-method error")
+	}
+	if _, err := env.DeclareInstance(Add, boolType, map[string]string{"+": "bad_bool_add"}); err == nil {
+		t.Fatalf("expected invalid-method error")
+	}
+}
+
+type exprStream []ast.Expr
+
+func (s *exprStream) Next() (ast.Expr, bool) {
+	if len(*s) == 0 {
+		return nil, false
+	}
+	next := (*s)[0]
+	*s = (*s)[1:]
+	return next, true
+}
+
+func TestCanUnify(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType := TConst("int"), TConst("bool")
+	Num, err := env.DeclareTypeClass("Num", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{"+": TArrow2(param, param, param)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Declare("int_add", TArrow2(intType, intType, intType))
+	if _, err := env.DeclareInstance(Num, intType, map[string]string{"+": "int_add"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records:
+	a, b, row := env.NewVar(1), env.NewVar(1), env.NewVar(1)
+	open := TRecord(TRowExtend(row, TypeMap(map[string]types.Type{"x": a})))
+	if !ctx.CanUnify(open, TRecordFlat(map[string]types.Type{"x": intType, "y": boolType})) {
+		t.Fatalf("expected records to unify")
+	}
+	if ctx.CanUnify(open, TRecordFlat(map[string]types.Type{"y": boolType})) {
+		t.Fatalf("expected records not to unify")
+	}
+	if !a.IsUnboundVar() || !row.IsUnboundVar() {
+		t.Fatalf("expected type-variables to remain unbound")
+	}
+
+	// Arrows, with type-variables shared between both types:
+	if !ctx.CanUnify(TArrow1(a, b), TArrow1(b, intType)) {
+		t.Fatalf("expected arrows to unify")
+	}
+	if ctx.CanUnify(TArrow2(a, a, b), TArrow2(intType, boolType, b)) {
+		t.Fatalf("expected arrows not to unify")
+	}
+	if ctx.CanUnify(TArrow1(a, intType), a) {
+		t.Fatalf("expected recursive types not to unify")
+	}
+	if !a.IsUnboundVar() || !b.IsUnboundVar() {
+		t.Fatalf("expected type-variables to remain unbound")
+	}
+
+	// Constrained type-variables:
+	num := env.Instantiate(1, env.NewQualifiedVar(types.InstanceConstraint{Num})).(*types.Var)
+	if !ctx.CanUnify(num, intType) {
+		t.Fatalf("expected constrained type-variable to unify with an instance")
+	}
+	if ctx.CanUnify(num, boolType) {
+		t.Fatalf("expected constrained type-variable not to unify with a non-instance")
+	}
+	if !ctx.CanUnify(num, a) || len(a.Constraints()) != 0 {
+		t.Fatalf("expected constraints not to propagate to the original type-variables")
+	}
+	if !num.IsUnboundVar() || len(num.Constraints()) != 1 {
+		t.Fatalf("expected constrained type-variable to remain unbound with its constraints")
+	}
+}
+
+func TestUnifyAll(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType := TConst("int"), TConst("bool")
+	a, b, c := env.NewVar(1), env.NewVar(1), env.NewVar(1)
+
+	unified, err := ctx.UnifyAll(env, []types.Type{TArrow2(a, boolType, b), TArrow2(intType, c, b), TArrow2(a, c, intType)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(unified) != "(int, bool) -> int" {
+		t.Fatalf("unexpected unified type: %s", types.TypeString(unified))
+	}
+	if types.TypeString(a) != "int" || types.TypeString(b) != "int" || types.TypeString(c) != "bool" {
+		t.Fatalf("expected type-variables to be linked")
+	}
+
+	// The first mismatch is reported:
+	d := env.NewVar(1)
+	cp := ctx.Checkpoint(env)
+	_, err = ctx.UnifyAll(env, []types.Type{TArrow1(d, intType), TArrow1(boolType, intType), TArrow1(intType, intType)})
+	if err == nil || !strings.Contains(err.Error(), "Failed to unify type 2 (int -> int)") {
+		t.Fatalf("expected unification error, found: %v", err)
+	}
+	ctx.Rollback(cp)
+	if !d.IsUnboundVar() {
+		t.Fatalf("expected type-variables to be unbound after rollback")
+	}
+
+	if _, err = ctx.UnifyAll(env, nil); err == nil {
+		t.Fatalf("expected error for empty list")
+	}
+}
+
+func TestUnifyCheckpoints(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType := TConst("int"), TConst("bool")
+	a, b := env.NewVar(1), env.NewVar(1)
+
+	// Failed trial unification, after linking a and b:
+	cp := ctx.Checkpoint(env)
+	if err := ctx.Unify(env, TArrow2(a, b, intType), TArrow2(intType, boolType, boolType)); err == nil {
+		t.Fatalf("expected unification to fail")
+	}
+	if !a.IsLinkVar() || !b.IsLinkVar() {
+		t.Fatalf("expected type-variables to be linked before rollback")
+	}
+	ctx.Rollback(cp)
+	if !a.IsUnboundVar() || !b.IsUnboundVar() {
+		t.Fatalf("expected type-variables to be unbound after rollback")
+	}
+
+	// Nested checkpoints:
+	outer := ctx.Checkpoint(env)
+	if err := ctx.Unify(env, a, intType); err != nil {
+		t.Fatal(err)
+	}
+	inner := ctx.Checkpoint(env)
+	if err := ctx.Unify(env, b, a); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Rollback(inner)
+	if types.TypeString(a) != "int" || !b.IsUnboundVar() {
+		t.Fatalf("expected only the inner unification to be rolled back")
+	}
+	ctx.Rollback(outer)
+	if !a.IsUnboundVar() {
+		t.Fatalf("expected type-variables to be unbound after rollback")
+	}
+
+	// Committed unification:
+	cp = ctx.Checkpoint(env)
+	if err := ctx.Unify(env, TArrow1(a, b), TArrow1(boolType, intType)); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Commit(cp)
+	if types.TypeString(TArrow1(a, b)) != "bool -> int" {
+		t.Fatalf("unexpected committed type: %s", types.TypeString(TArrow1(a, b)))
+	}
+}
+
+func TestInferStream(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("someint", TConst("int"))
+	env.Declare("somebool", TConst("bool"))
+
+	stream := exprStream{
+		Definition("id", Func1("x", Var("x"))),
+		Definition("pair", Func2("a", "b", RecordExtend(nil, LabelValue("a", Var("a")), LabelValue("b", Var("b"))))),
+		Call(Var("pair"), Call(Var("id"), Var("someint")), Call(Var("id"), Var("somebool"))),
+		// mutually-recursive definitions are grouped:
+		Definition("even", LetGroup([]ast.LetBinding{
+			{"even", Func1("x", Call(Var("odd"), Var("x")))},
+			{"odd", Func1("x", Call(Var("even"), Var("x")))},
+		}, Var("even"))),
+		Call(Var("even"), Var("someint")),
+	}
+	if ast.ExprString(stream[0]) != "id(x) = x" {
+		t.Fatalf("expr: %s", ast.ExprString(stream[0]))
+	}
+	inferred, err := ctx.InferStream(env, &stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"'a -> 'a", "('a, 'b) -> {a : 'a, b : 'b}", "{a : int, b : bool}", "'a -> 'b", "'a"}
+	if len(inferred) != len(expect) {
+		t.Fatalf("expected %d types, found %d", len(expect), len(inferred))
+	}
+	for i, ty := range inferred {
+		if types.TypeString(ty) != expect[i] {
+			t.Fatalf("expected %s, found %s", expect[i], types.TypeString(ty))
+		}
+	}
+	mustInfer(t, env, ctx, Var("pair"), "('a, 'b) -> {a : 'a, b : 'b}")
+
+	// Definitions must be produced in dependency order:
+	stream = exprStream{
+		Definition("first", Call(Var("second"), Var("someint"))),
+		Definition("second", Func1("x", Var("x"))),
+	}
+	inferred, err = ctx.InferStream(env, &stream)
+	if err == nil || len(inferred) != 0 {
+		t.Fatalf("expected undefined variable error")
+	}
+	if len(stream) != 1 {
+		t.Fatalf("expected inference to stop after the first error")
+	}
+}
+
+func TestFrozenEnv(t *testing.T) {
+	prelude := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	a := prelude.NewGenericVar()
+	prelude.Declare("x", TConst("int"))
+	prelude.Declare("id", TArrow1(a, a))
+	prelude.Freeze()
+	if !prelude.IsFrozen() {
+		t.Fatalf("expected a frozen environment")
+	}
+
+	snapshot := make(map[string]types.Type, len(prelude.Types))
+	printed := make(map[string]string, len(prelude.Types))
+	for name, ty := range prelude.Types {
+		snapshot[name], printed[name] = ty, types.TypeString(ty)
+	}
+
+	// Shadows x, and binds y and z:
+	expr := Let("x", Func1("y", Var("y")), Func1("z", Call(Var("id"), Call(Var("x"), Var("z")))))
+	mustInfer(t, prelude, ctx, expr, "'a -> 'a")
+	mustInfer(t, prelude, ctx, Var("x"), "int")
+
+	if len(prelude.Types) != len(snapshot) {
+		t.Fatalf("expected %d bindings, found %d", len(snapshot), len(prelude.Types))
+	}
+	for name, ty := range snapshot {
+		if prelude.Types[name] != ty || types.TypeString(prelude.Types[name]) != printed[name] {
+			t.Fatalf("expected the frozen binding %s to be unmodified", name)
+		}
+	}
+
+	// Assignments are bound within the overlay:
+	prelude.Assign("x", TConst("bool"))
+	mustInfer(t, prelude, ctx, Var("x"), "bool")
+	if prelude.Types["x"] != snapshot["x"] {
+		t.Fatalf("expected the frozen binding x to be unmodified")
+	}
+	prelude.Remove("x")
+	mustInfer(t, prelude, ctx, Var("x"), "int")
+
+	// Methods of type-classes declared after freezing are bound within the overlay:
+	Show, err := prelude.DeclareTypeClass("Show", func(param *types.Var) types.MethodSet {
+		return types.MethodSet{"show": TArrow1(param, TConst("string"))}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := prelude.Types["show"]; ok || len(prelude.Types) != len(snapshot) {
+		t.Fatalf("expected the frozen bindings to be unmodified by type-class declarations")
+	}
+	prelude.Declare("show_int", TArrow1(TConst("int"), TConst("string")))
+	if _, err := prelude.DeclareInstance(Show, TConst("int"), map[string]string{"show": "show_int"}); err != nil {
+		t.Fatal(err)
+	}
+	mustInfer(t, prelude, ctx, Call(Var("show"), Var("x")), "string")
+
+	// Unbound (non-generic) type-variables within frozen bindings are still linked by inference:
+	weak := NewTypeEnv(nil)
+	weak.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	weak.DeclareInvariant("w", weak.NewVar(1))
+	weak.Freeze()
+	w := weak.Types["w"]
+	mustInfer(t, weak, ctx, Call(Var("add"), Var("w"), Var("w")), "int")
+	if weak.Types["w"] != w {
+		t.Fatalf("expected the frozen binding w to be retained")
+	}
+	if types.TypeString(weak.Types["w"]) != "int" {
+		t.Fatalf("expected the frozen binding w to be refined, found %s", types.TypeString(weak.Types["w"]))
+	}
+}
+
+func TestRecheckBinding(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("one", TConst("int"))
+	A := env.NewGenericVar()
+	env.Declare("id", TArrow1(A, A))
+
+	inferred := 0
+	ctx.SetLevelHook(func(op string, level int, t types.Type) {
+		if op == "LetGroup" {
+			inferred++
+		}
+	})
+
+	// Each binding belongs to a separate component; b depends on a, and c is independent:
+	group := LetGroup([]ast.LetBinding{
+		LetBinding("a", Var("one")),
+		LetBinding("b", TupleLit(Var("a"), Var("one"))),
+		LetBinding("c", Func1("x", Var("x"))),
+	}, Var("b"))
+	if err := ctx.AnnotateDirect(group, env); err != nil {
+		t.Fatal(err)
+	}
+	if len(group.StronglyConnectedComponents()) != 3 || inferred != 3 {
+		t.Fatalf("expected 3 components to be inferred, found %d", inferred)
+	}
+	schemeOf := func(name string) string { return types.TypeString(group.Schemes()[name]) }
+
+	// The type-scheme of a is unchanged, so b is not rechecked:
+	group.Vars[0].Value = Call(Var("id"), Var("one"))
+	inferred = 0
+	if err := ctx.RecheckBinding(env, group, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if inferred != 1 || schemeOf("a") != "int" || schemeOf("b") != "(int, int)" {
+		t.Fatalf("unexpected recheck: %d components inferred, a : %s, b : %s", inferred, schemeOf("a"), schemeOf("b"))
+	}
+
+	// The type-scheme of a changes, so the change is propagated to b but not c:
+	group.Vars[0].Value = StringLit("a")
+	inferred = 0
+	if err := ctx.RecheckBinding(env, group, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if inferred != 2 || schemeOf("a") != "string" || schemeOf("b") != "(string, int)" || schemeOf("c") != "'a -> 'a" {
+		t.Fatalf("unexpected recheck: %d components inferred, a : %s, b : %s", inferred, schemeOf("a"), schemeOf("b"))
+	}
+
+	// Independent components are rechecked alone:
+	group.Vars[2].Value = Func1("x", Var("one"))
+	inferred = 0
+	if err := ctx.RecheckBinding(env, group, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if inferred != 1 || schemeOf("c") != "'a -> int" {
+		t.Fatalf("unexpected recheck: %d components inferred, c : %s", inferred, schemeOf("c"))
+	}
+
+	// References to bindings of later components require the group to be annotated again:
+	group.Vars[1].Value = TupleLit(Var("a"), Var("c"))
+	if err := ctx.RecheckBinding(env, group, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if schemeOf("b") != "(string, 'a -> int)" {
+		t.Fatalf("unexpected type-scheme for b: %s", schemeOf("b"))
+	}
+	group.Vars[1].Value = TupleLit(Var("a"), Var("one"))
+	if err := ctx.RecheckBinding(env, group, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors within the edited binding are reported, and the annotated type-schemes are retained:
+	group.Vars[1].Value = Call(Var("a"), Var("one"))
+	if err := ctx.RecheckBinding(env, group, "b"); err == nil {
+		t.Fatalf("expected recheck error")
+	}
+	if schemeOf("b") != "(string, int)" {
+		t.Fatalf("unexpected type-scheme for b: %s", schemeOf("b"))
+	}
+	if err := ctx.RecheckBinding(env, group, "d"); err == nil || err.Error() != "Let-group does not bind d" {
+		t.Fatalf("expected missing binding error, found: %v", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	prelude := NewTypeEnv(nil)
+	intType := TConst("int")
+	A := prelude.NewGenericVar()
+	prelude.Declare("if", TArrow3(TConst("bool"), A, A, A))
+	prelude.Declare("iszero", TArrow1(intType, TConst("bool")))
+	prelude.Declare("dec", TArrow1(intType, intType))
+	prelude.Declare("mul", TArrow2(intType, intType, intType))
+	prelude.Declare("one", intType)
+
+	session := NewSession(prelude)
+	define := func(name string, expr ast.Expr, expect string) {
+		ty, err := session.Define(name, expr)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if types.TypeString(ty) != expect {
+			t.Fatalf("%s: expected %s, found %s", name, expect, types.TypeString(ty))
+		}
+	}
+	define("id", Func1("x", Var("x")), "'a -> 'a")
+	define("compose", Func2("f", "g", Func1("x", Call(Var("f"), Call(Var("g"), Var("x"))))), "('a -> 'b, 'c -> 'a) -> 'c -> 'b")
+	define("twice", Func1("f", Call(Var("compose"), Var("f"), Var("f"))), "('a -> 'a) -> 'a -> 'a")
+	define("fact", Func1("n", Call(Var("if"), Call(Var("iszero"), Var("n")), Var("one"),
+		Call(Var("mul"), Var("n"), Call(Var("fact"), Call(Var("dec"), Var("n")))))), "int -> int")
+
+	// Definitions are retained across calls, and remain polymorphic:
+	ty, err := session.Eval(RecordExtend(nil,
+		LabelValue("a", Call(Call(Var("twice"), Var("fact")), Var("one"))),
+		LabelValue("b", Call(Var("id"), Var("iszero")))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(ty) != "{a : int, b : int -> bool}" {
+		t.Fatalf("unexpected type: %s", types.TypeString(ty))
+	}
 
-	mustInfer(t, env, ctx, expr, "int -> int")
+	// Failed definitions and evaluated expressions do not modify the session:
+	if _, err = session.Define("bad", Call(Var("fact"), Var("iszero"))); err == nil {
+		t.Fatalf("expected error for invalid definition")
+	}
+	if _, err = session.Eval(Let("local", Var("one"), Var("local"))); err != nil {
+		t.Fatal(err)
+	}
+	if session.Env.Lookup("bad") != nil || session.Env.Lookup("local") != nil || prelude.Lookup("fact") != nil {
+		t.Fatalf("expected the session to be unmodified")
+	}
 
-	// Record extension within recursive functions is not supported:
-	// fix(fn (f) -> fn (x) -> {i = 1 | f(x)})
-	expr = Call(Var("fix"), Func1("f", Func1("x", RecordExtend(Call(Var("f"), Var("x")), LabelValue("i", Var("1"))))))
+	// Definitions may be shadowed:
+	define("id", Func1("x", Call(Var("mul"), Var("x"), Var("one"))), "int -> int")
+	if _, err = session.Eval(Call(Var("id"), Var("iszero"))); err == nil {
+		t.Fatalf("expected error for shadowed definition")
+	}
+}
 
-	if _, err := ctx.Infer(expr, env); err == nil {
-		t.Fatalf("expected recursive type error")
+func TestMergeEnvs(t *testing.T) {
+	prelude := NewTypeEnv(nil)
+	ctx := NewContext()
+	prelude.Declare("someint", TConst("int"))
+	prelude.Declare("somebool", TConst("bool"))
+
+	infer := func(env *TypeEnv, name string, expr ast.Expr) {
+		ty, err := ctx.Infer(expr, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.Assign(name, ty)
+	}
+
+	text := NewTypeEnv(prelude)
+	infer(text, "id", Func1("x", Var("x")))
+	infer(text, "size", Func1("x", Var("someint")))
+
+	lists := NewTypeEnv(prelude)
+	infer(lists, "id", Func1("x", Var("x")))
+	infer(lists, "size", Func1("x", Var("somebool")))
+	infer(lists, "pair", Func2("a", "b", RecordExtend(nil, LabelValue("a", Var("a")), LabelValue("b", Var("b")))))
+	if text.Lookup("id") == lists.Lookup("id") {
+		t.Fatalf("expected id to be inferred separately within each module")
+	}
+
+	env, conflicts := MergeEnvs(text, lists)
+	if len(conflicts) != 1 || conflicts[0].Name != "size" || len(conflicts[0].Types) != 2 {
+		t.Fatalf("expected a single conflict for size, found: %v", conflicts)
+	}
+	if a, b := types.TypeString(conflicts[0].Types[0]), types.TypeString(conflicts[0].Types[1]); a != "'a -> int" || b != "'a -> bool" {
+		t.Fatalf("unexpected conflicting types: %s, %s", a, b)
+	}
+	if env.Parent != prelude {
+		t.Fatalf("expected the merged environment to inherit from the shared prelude")
+	}
+	mustInfer(t, env, ctx, Call(Var("size"), Var("somebool")), "int")
+	mustInfer(t, env, ctx, Call(Var("pair"), Call(Var("id"), Var("someint")), Var("somebool")), "{a : int, b : bool}")
+	if text.Lookup("pair") != nil || lists.Lookup("size") == env.Lookup("size") {
+		t.Fatalf("expected the merged environments to be unmodified")
 	}
 }
 
-func TestMutuallyRecursiveLet(t *testing.T) {
+func TestEnvFromSchemes(t *testing.T) {
+	base := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	base.Declare("someint", TConst("int"))
+	base.Declare("somebool", TConst("bool"))
+
+	// First batch:
+	first := map[string]ast.Expr{
+		"id":   Func1("x", Var("x")),
+		"pair": Func2("a", "b", RecordExtend(nil, LabelValue("a", Var("a")), LabelValue("b", Var("b")))),
+	}
+	schemes := make(map[string]types.Type, len(first))
+	for name, expr := range first {
+		ty, err := ctx.Infer(expr, base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schemes[name] = ty
+	}
+	env := EnvFromSchemes(base, schemes)
+	if base.Lookup("id") != nil || base.Lookup("pair") != nil {
+		t.Fatalf("expected the base environment to be unmodified")
+	}
+
+	// Second batch, referencing the first:
+	second := map[string]ast.Expr{
+		"ints":  Call(Var("pair"), Call(Var("id"), Var("someint")), Var("someint")),
+		"mixed": Call(Var("pair"), Call(Var("id"), Var("someint")), Call(Var("id"), Var("somebool"))),
+	}
+	schemes = make(map[string]types.Type, len(second))
+	for name, expr := range second {
+		ty, err := ctx.Infer(expr, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schemes[name] = ty
+	}
+	env = EnvFromSchemes(env, schemes)
+
+	mustInfer(t, env, ctx, Var("ints"), "{a : int, b : int}")
+	mustInfer(t, env, ctx, Var("mixed"), "{a : int, b : bool}")
+	mustInfer(t, env, ctx, Var("id"), "'a -> 'a")
+	if env.Parent.Lookup("ints") != nil {
+		t.Fatalf("expected the first batch environment to be unmodified")
+	}
+}
+
+func TestOccursCheckToggle(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
 	A := env.NewGenericVar()
 	env.Declare("if", TArrow3(TConst("bool"), A, A, A))
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
 	env.Declare("somebool", TConst("bool"))
 
-	somebool, add, f, g, h, id, x := Var("somebool"), Var("add"), Var("f"), Var("g"), Var("h"), Var("id"), Var("x")
-
-	expr := LetGroup(
-		[]ast.LetBinding{
-			{"id", Func1("x", x)},
-			{"f", Func1("x", Call(Var("if"), Call(id, somebool), Call(id, x), Call(g, Call(add, x, x))))},
-			{"g", Func1("x", Call(Var("if"), somebool, x, Call(id, Call(f, x))))},
-		},
-		Let("h", Func1("x", Call(id, Call(f, x))),
-			RecordExtend(nil,
-				LabelValue("f", f),
-				LabelValue("g", g),
-				LabelValue("h", h),
-				LabelValue("id", id))))
+	exprs := []ast.Expr{
+		Func1("x", Var("x")),
+		Func2("f", "g", Func1("x", Call(Var("f"), Call(Var("g"), Var("x"))))),
+		Func1("r", RecordExtend(nil, LabelValue("x", RecordSelect(Var("r"), "x")), LabelValue("r", RecordRestrict(Var("r"), "x")))),
+		Let("f", Func1("x", Call(Var("if"), Var("somebool"), Var("x"), Call(Var("f"), Call(Var("add"), Var("x"), Var("x"))))), Var("f")),
+		LetGroup([]ast.LetBinding{
+			{"id", Func1("x", Var("x"))},
+			{"f", Func1("x", Call(Var("if"), Call(Var("id"), Var("somebool")), Var("x"), Call(Var("g"), Var("x"))))},
+			{"g", Func1("x", Call(Var("if"), Var("somebool"), Var("x"), Call(Var("id"), Call(Var("f"), Var("x")))))},
+		}, RecordExtend(nil, LabelValue("f", Var("f")), LabelValue("g", Var("g")))),
+		Func1("x", Match(Var("x"), []ast.MatchCase{MatchCase("a", "i", Var("i"))}, &ast.MatchCase{Var: "rest", Value: Variant("a", Var("somebool"))})),
+	}
+	expected := make([]string, len(exprs))
+	for i, expr := range exprs {
+		ty, err := ctx.Infer(expr, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[i] = types.TypeString(ty)
+	}
 
-	expect := "" +
-		"let id(x) = x" +
-		" and f(x) = if(id(somebool), id(x), g(add(x, x)))" +
-		" and g(x) = if(somebool, x, id(f(x)))" +
-		" in" +
-		" let h(x) = id(f(x))" +
-		" in {f = f, g = g, h = h, id = id}"
+	// Well-formed expressions infer identical types without the occurs check:
+	ctx.SetOccursCheck(false)
+	for i, expr := range exprs {
+		mustInfer(t, env, ctx, expr, expected[i])
+	}
 
-	if ast.ExprString(expr) != expect {
-		t.Fatalf("expr: %s", ast.ExprString(expr))
+	// The occurs check rejects implicitly recursive types by default:
+	ctx.SetOccursCheck(true)
+	if _, err := ctx.Infer(Func1("x", Call(Var("x"), Var("x"))), env); err == nil || err.Error() != "Implicitly recursive types are not supported" {
+		t.Fatalf("expected recursive type error, found: %v", err)
 	}
-	mustInfer(t, env, ctx, expr, "{f : int -> int, g : int -> int, h : int -> int, id : 'a -> 'a}")
+}
+
+func TestDebugAssertions(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+	ctx.SetDebug(true)
+
+	env.Declare("someint", TConst("int"))
+	env.Declare("dec", TArrow1(TConst("int"), TConst("int")))
+	env.Declare("cmp", TArrow2(TConst("int"), TConst("int"), TConst("bool")))
+
+	// inferLetGroup:
+	group := LetGroup([]ast.LetBinding{
+		LetBinding("even", Func1("n", Call(Var("odd"), Var("n")))),
+		LetBinding("odd", Func1("n", Call(Var("even"), Var("n")))),
+		LetBinding("x", Var("someint")),
+	}, Var("even"))
+	mustInfer(t, env, ctx, group, "'a -> 'b")
+
+	// inferCases:
+	match := Func1("v", Match(Var("v"),
+		[]ast.MatchCase{MatchCase("a", "i", Var("i")), MatchCase("b", "_", Var("someint")), MatchCase("c", "i", Call(Var("dec"), Var("i")))},
+		nil))
+	mustInfer(t, env, ctx, match, "[a : int, b : 'a, c : int] -> int")
+
+	// inferControlFlow (including loops):
+	cfg := ControlFlow("loop", "x", "y")
+	cfg.SetEntry(
+		DerefAssign(Var("x"), Var("someint")),
+		DerefAssign(Var("y"), Var("someint")),
+		Call(Var("cmp"), Deref(Var("x")), Deref(Var("y"))))
+	cfg.SetReturn(Deref(Var("x")))
+	L0 := cfg.AddBlock(
+		DerefAssign(Var("x"), Call(Var("dec"), Deref(Var("x")))),
+		Call(Var("cmp"), Deref(Var("x")), Deref(Var("y"))))
+	cfg.AddJump(cfg.Entry, L0)
+	cfg.AddJump(L0, L0)
+	cfg.AddJump(L0, cfg.Return)
+	mustInfer(t, env, ctx, cfg, "int")
+}
+
+func TestTypeCache(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+	ctx.SetTypeCache(true)
+
+	constructed := 0
+	lit := &ast.Literal{Syntax: "1", Construct: func(env types.TypeEnv, level uint, using []types.Type) (types.Type, error) {
+		constructed++
+		return TConst("int"), nil
+	}}
+	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	env.Declare("y", TConst("int"))
+	sum := Call(Var("add"), lit, lit)
+	expr := Func1("x", Call(Var("add"), Var("x"), sum))
 
 	if err := ctx.AnnotateDirect(expr, env); err != nil {
 		t.Fatal(err)
 	}
-	sccs := expr.StronglyConnectedComponents()
-	sccNames := make([][]string, len(sccs))
-	for i, scc := range sccs {
-		sccNames[i] = make([]string, len(scc))
-		for j, binding := range scc {
-			sccNames[i][j] = binding.Var
-		}
+	if constructed != 2 {
+		t.Fatalf("expected 2 constructed literals, found %d", constructed)
 	}
-	if !reflect.DeepEqual([][]string{{"id"}, {"g", "f"}}, sccNames) {
-		t.Fatalf("invalid strongly connected components, found %#+v", sccNames)
+
+	// The cached subtree is not re-traversed:
+	mustInfer(t, env, ctx, expr, "int -> int")
+	mustInfer(t, env, ctx, Call(Var("add"), Var("y"), sum), "int")
+	if constructed != 2 {
+		t.Fatalf("expected cached literals not to be constructed, found %d", constructed)
+	}
+
+	// Sub-expressions referencing enclosing bindings are not cached, so their captures are recorded again:
+	capture := Call(Var("add"), Var("y"), Var("y"))
+	outer := Let("y", lit, Func1("x", capture))
+	if err := ctx.AnnotateDirect(outer, env); err != nil {
+		t.Fatal(err)
+	}
+	inner := outer.Body.(*ast.Func)
+	ctx.Invalidate(outer)
+	ctx.Invalidate(inner)
+	inner.SetCaptures(nil)
+	if err := ctx.AnnotateDirect(outer, env); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inner.Captures(), []string{"y"}) {
+		t.Fatalf("expected captures to be replayed, found %v", inner.Captures())
+	}
+
+	// Invalidated expressions are re-inferred:
+	constructed = 0
+	ctx.Invalidate(sum)
+	mustInfer(t, env, ctx, sum, "int")
+	if constructed != 0 {
+		t.Fatalf("expected sub-expressions of an invalidated expression to remain cached, found %d", constructed)
+	}
+	ctx.Invalidate(lit)
+	mustInfer(t, env, ctx, sum, "int")
+	if constructed != 2 {
+		t.Fatalf("expected invalidated literals to be constructed, found %d", constructed)
+	}
+
+	// Types with type-variables are not cached:
+	id := Func1("x", Var("x"))
+	if err := ctx.AnnotateDirect(id, env); err != nil {
+		t.Fatal(err)
+	}
+	mustInfer(t, env, ctx, Call(id, Var("y")), "int")
+
+	// Disabling the cache removes cached types:
+	ctx.SetTypeCache(false)
+	mustInfer(t, env, ctx, sum, "int")
+	if constructed != 4 {
+		t.Fatalf("expected literals to be constructed without the cache, found %d", constructed)
 	}
 }
 
-func TestVariantMatch(t *testing.T) {
+func TestTypeCacheReannotate(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
+	ctx.SetTypeCache(true)
 
+	env.Declare("one", TConst("int"))
 	env.Declare("add", TArrow2(TConst("int"), TConst("int"), TConst("int")))
-	a := env.NewGenericVar()
-	env.Declare("if", TArrow3(TConst("bool"), a, a, a))
-	env.Declare("somebool", TConst("bool"))
+	a, b := env.NewGenericVar(), env.NewGenericVar()
+	env.Declare("snd", TArrow2(a, b, b))
+
+	// Ground sub-expressions which constrain variables bound by an enclosing function are re-inferred:
+	exprs := map[string]ast.Expr{
+		"(int, 'a) -> 'a":         Func2("x", "y", Call(Var("snd"), Call(Var("add"), Var("x"), Var("one")), Var("y"))),
+		"'a -> {a : int, b : 'a}": Func1("x", RecordExtend(nil, LabelValue("a", Var("one")), LabelValue("b", Var("x")))),
+	}
+	for expected, expr := range exprs {
+		for i := 0; i < 2; i++ {
+			if err := ctx.AnnotateDirect(expr, env); err != nil {
+				t.Fatal(err)
+			}
+			if types.TypeString(expr.Type()) != expected {
+				t.Fatalf("pass %d: expected %s, found %s", i+1, expected, types.TypeString(expr.Type()))
+			}
+		}
+	}
+}
+
+func TestTimings(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
 	env.Declare("someint", TConst("int"))
-	env.Declare("somebool", TConst("bool"))
+	expr := LetGroup([]ast.LetBinding{
+		{"id", Func1("x", Var("x"))},
+		{"pair", Func2("a", "b", RecordExtend(nil, LabelValue("a", Call(Var("id"), Var("a"))), LabelValue("b", Var("b"))))},
+	}, Call(Var("pair"), Var("someint"), Call(Var("id"), Var("someint"))))
+
+	mustInfer(t, env, ctx, expr, "{a : int, b : int}")
+	if timings := ctx.Timings(); timings != (Timings{}) {
+		t.Fatalf("expected no timings while timing is disabled, found: %+v", timings)
+	}
 
-	ifExpr := Call(Var("if"), Var("somebool"), Variant("i", Var("someint")), Variant("b", Var("somebool")))
-	mustInfer(t, env, ctx, ifExpr, "[b : bool, i : int | 'a]")
+	ctx.SetTiming(true)
+	defer ctx.SetTiming(false)
+	mustInfer(t, env, ctx, expr, "{a : int, b : int}")
+	timings := ctx.Timings()
+	if timings.Analysis <= 0 || timings.Unification <= 0 || timings.Instantiation <= 0 {
+		t.Fatalf("expected time to be recorded for each phase, found: %+v", timings)
+	}
+}
 
-	matchExpr := Match(ifExpr, // [i : int, b : bool | 'a]
-		[]ast.MatchCase{
-			{Label: "i", Var: "i", Value: Call(Var("add"), Var("i"), Var("i"))},
-			{Label: "b", Var: "b", Value: Call(Var("if"), Var("b"), Var("someint"), Var("someint"))},
-		},
-		// default case:
-		nil)
+func TestHoles(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	mustInfer(t, env, ctx, matchExpr, "int")
+	intType, boolType := TConst("int"), TConst("bool")
+	env.Declare("someint", intType)
+	env.Declare("inc", TArrow1(intType, intType))
+	env.Declare("choose", TArrow2(boolType, intType, intType))
 
-	matchExpr = Match(ifExpr, // [i : int, b : bool | 'a]
-		[]ast.MatchCase{
-			{Label: "i", Var: "i", Value: Call(Var("add"), Var("i"), Var("i"))},
-			// does not match variant type for the match argument (bool != int):
-			{Label: "b", Var: "b", Value: Call(Var("add"), Var("b"), Var("b"))},
-		},
-		// default case:
-		nil)
+	// A hole in an argument position is inferred as the argument type:
+	arg := Hole("arg")
+	expr := Call(Var("inc"), arg)
+	if ast.ExprString(expr) != "inc(?arg)" {
+		t.Fatalf("expr: %s", ast.ExprString(expr))
+	}
+	mustInfer(t, env, ctx, expr, "int")
+	if holes := ctx.Holes(); len(holes) != 1 || types.TypeString(holes[arg].Type) != "int" {
+		t.Fatalf("unexpected holes: %v", holes)
+	}
 
-	if _, err := ctx.Infer(matchExpr, env); err == nil {
-		t.Fatalf("expected error due to invalid variant argument for match")
+	// Each hole is inferred as a distinct type-variable, including holes which share a name:
+	cond, value := Hole("h"), Hole("h")
+	mustInfer(t, env, ctx, Call(Var("choose"), cond, value), "int")
+	holes := ctx.Holes()
+	if len(holes) != 2 || types.TypeString(holes[cond].Type) != "bool" || types.TypeString(holes[value].Type) != "int" {
+		t.Fatalf("unexpected holes: %v", holes)
 	}
 
-	expr := Let("f", Func1("x", Match(Var("x"),
-		[]ast.MatchCase{
-			{Label: "a", Var: "i", Value: Call(Var("f"), Variant("b", Var("i")))},
-			{Label: "b", Var: "i", Value: Call(Var("f"), Variant("c", Var("i")))},
-			{Label: "c", Var: "i", Value: Call(Var("add"), Var("i"), Var("someint"))},
-		},
-		// default case:
-		&ast.MatchCase{Var: "_", Value: Var("someint")})),
-		// let-in:
-		Var("f"))
+	// A hole in a function position is inferred as a function from the argument types:
+	f := Hole("f")
+	mustInfer(t, env, ctx, Call(f, Var("someint")), "'a")
+	holes = ctx.Holes()
+	if len(holes) != 1 || types.TypeString(holes[f].Type) != "int -> 'a" {
+		t.Fatalf("unexpected holes: %v", holes)
+	}
 
-	if ast.ExprString(expr) != "let f(x) = match x { :a i -> f(:b i) | :b i -> f(:c i) | :c i -> add(i, someint) | _ -> someint } in f" {
+	// The identifiers in scope at each hole are recorded:
+	body := Hole("body")
+	mustInfer(t, env, ctx, Func1("x", Let("y", Call(Var("inc"), Var("x")), Call(Var("choose"), body, Var("y")))), "int -> int")
+	scope := ctx.Holes()[body].Env
+	if len(scope) != 5 || types.TypeString(scope["x"]) != "int" || types.TypeString(scope["y"]) != "int" || scope["inc"] != env.Lookup("inc") {
+		t.Fatalf("unexpected identifiers in scope: %v", scope)
+	}
+}
+
+func TestPreserveWeakVars(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	a := env.NewGenericVar()
+	env.Assign("f", GeneralizeWeak(TArrow1(a, a)))
+
+	isWeakArg := func(t types.Type) bool {
+		return types.RealType(t).(*types.Arrow).Args[0].(*types.Var).IsWeakVar()
+	}
+
+	// By default, instantiated type-variables remain weak, and are not generalized:
+	expr := Var("f")
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
+		t.Fatal(err)
+	}
+	if !isWeakArg(expr.Type()) {
+		t.Fatalf("expected a weak type-variable, found: %s", types.TypeString(expr.Type()))
+	}
+	if ty, err := ctx.Infer(Var("f"), env); err != nil || !strings.HasPrefix(types.TypeString(ty), "weak ") {
+		t.Fatalf("expected a weak type, found: %s (%v)", types.TypeString(ty), err)
+	}
+
+	ctx.SetPreserveWeakVars(false)
+	defer ctx.SetPreserveWeakVars(true)
+	expr = Var("f")
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
+		t.Fatal(err)
+	}
+	if isWeakArg(expr.Type()) {
+		t.Fatalf("expected a non-weak type-variable, found: %s", types.TypeString(expr.Type()))
+	}
+	mustInfer(t, env, ctx, Var("f"), "'a -> 'a")
+}
+
+func TestTypeOf(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	env.Declare("someint", TConst("int"))
+
+	sel := RecordSelect(Var("r"), "a")
+	fn := Func1("r", sel)
+	record := RecordExtend(nil, LabelValue("a", Var("someint")))
+	call := Call(fn, record)
+	variant := Variant("x", Var("someint"))
+	let := Let("v", variant, call)
+
+	for _, e := range []ast.Expr{let, fn, record, call, sel, variant} {
+		if _, ok := ast.TypeOf(e); ok {
+			t.Fatalf("expected no type before annotation for %s", e.ExprName())
+		}
+	}
+	if err := ctx.AnnotateDirect(let, env); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[ast.Expr]string{
+		let:    "int",
+		fn:     "{a : int} -> int",
+		record: "{a : int}",
+		call:   "int",
+	}
+	for e, ts := range expect {
+		ty, ok := ast.TypeOf(e)
+		if !ok || types.TypeString(ty) != ts {
+			t.Fatalf("expected type %s for %s, found: %s", ts, e.ExprName(), types.TypeString(ty))
+		}
+	}
+	// Variants and record selections do not record a type:
+	for _, e := range []ast.Expr{variant, sel} {
+		if _, ok := ast.TypeOf(e); ok {
+			t.Fatalf("expected no type for %s", e.ExprName())
+		}
+	}
+}
+
+func TestTry(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	intType, boolType, strType := TConst("int"), TConst("bool"), TConst("string")
+	parseErr, ioErr := TConst("parse_error"), TConst("io_error")
+	result := func(ok, err types.Type) types.Type {
+		return TVariant(TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"ok": ok, "err": err})))
+	}
+	env.Declare("somestr", strType)
+	env.Declare("parse", TArrow1(strType, result(intType, parseErr)))
+	env.Declare("check", TArrow1(intType, result(boolType, parseErr)))
+	env.Declare("nested", TArrow1(strType, result(result(intType, parseErr), parseErr)))
+	env.Declare("read", TArrow1(strType, result(strType, ioErr)))
+
+	// Errors are propagated into the result type of the enclosing function:
+	expr := Func1("s", Let("n", Try(Call(Var("parse"), Var("s"))), Let("b", Try(Call(Var("check"), Var("n"))), Variant("ok", Var("b")))))
+	if ast.ExprString(expr) != "fn (s) -> let n = try parse(s) in let b = try check(n) in :ok b" {
 		t.Fatalf("expr: %s", ast.ExprString(expr))
 	}
-	mustInfer(t, env, ctx, expr, "[a : int, b : int, c : int | 'a] -> int")
+	mustInfer(t, env, ctx, expr, "string -> [err : parse_error, ok : bool]")
+	mustInfer(t, env, ctx, Func1("s", Variant("ok", Try(Try(Call(Var("nested"), Var("s")))))), "string -> [err : parse_error, ok : int]")
+	mustInfer(t, env, ctx, Func1("r", Variant("ok", Try(Var("r")))), "[err : 'a, ok : 'b] -> [err : 'a, ok : 'b]")
+
+	// Try expressions within nested functions propagate errors to the innermost function:
+	inner := Func1("x", Variant("ok", Try(Call(Var("parse"), Var("x")))))
+	mustInfer(t, env, ctx, Func1("s", Let("f", inner, Call(Var("f"), Var("s")))), "string -> [err : parse_error, ok : int]")
+
+	// Errors propagated within a function must have matching types:
+	mixed := Func1("s", Let("n", Try(Call(Var("parse"), Var("s"))), Variant("ok", Try(Call(Var("read"), Var("s"))))))
+	if _, err := ctx.Infer(mixed, env); err == nil {
+		t.Fatalf("expected an error for mismatched error types")
+	}
+	// The enclosing function must return a result:
+	_, err := ctx.Infer(Func1("s", Try(Call(Var("parse"), Var("s")))), env)
+	if err == nil || err.Error() != "Function containing try expressions must return a variant with labels ok and err, found int" {
+		t.Fatalf("expected result error, found: %v", err)
+	}
+	// Try expressions must be within a function:
+	_, err = ctx.Infer(Try(Call(Var("parse"), Var("somestr"))), env)
+	if err == nil || err.Error() != "Try expression must be within a function" {
+		t.Fatalf("expected try error, found: %v", err)
+	}
+	_, err = ctx.Infer(Func1("s", Try(Var("somestr"))), env)
+	if err == nil || !strings.HasPrefix(err.Error(), "Try expression requires a variant with labels ok and err") {
+		t.Fatalf("expected try error, found: %v", err)
+	}
+}
 
-	fnExpr := Func2("x", "y",
-		Match(
-			Var("x"),
-			[]ast.MatchCase{
-				{Label: "a", Var: "i", Value: Call(Var("add"), Var("i"), Var("i"))},
-				{Label: "b", Var: "i", Value: Call(Var("add"), Var("i"), Var("i"))},
-				{Label: "c", Var: "_", Value: Var("y")},
-			},
-			nil,
-		))
+func TestValidate(t *testing.T) {
+	valid := Let("f", Func2("a", "b", Pipe("$", Var("a"), Call(Var("b"), Var("$")))),
+		Match(Var("v"), []ast.MatchCase{MatchCase("x", "x", Var("x"))}, nil))
+	if err := ast.Validate(valid); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	unreachable := ControlFlow("unreachable")
+	unreachable.SetEntry(Var("a"))
+	unreachable.SetReturn(Var("b"))
+	L0 := unreachable.AddBlock(Var("c"))
+	unreachable.AddJump(unreachable.Entry, unreachable.Return)
+	unreachable.AddJump(L0, unreachable.Return)
+
+	stuck := ControlFlow("stuck")
+	stuck.SetEntry(Var("a"))
+	stuck.SetReturn(Var("b"))
+	L0 = stuck.AddBlock(Var("c"))
+	stuck.AddJump(stuck.Entry, stuck.Return)
+	stuck.AddJump(stuck.Entry, L0)
+
+	for _, test := range []struct {
+		expr   ast.Expr
+		expect string
+	}{
+		{&ast.Pipe{Sequence: []ast.Expr{Var("a")}}, "Pipe expression is missing Source"},
+		{Pipe("$", Var("a")), "Pipe expression has an empty sequence"},
+		{Match(Var("v"), nil, nil), "Match expression has no cases"},
+		{Func2("a", "a", Var("a")), "Function has duplicate arguments named a"},
+		{LetGroup(nil, Var("a")), "Let-group expression has no bindings"},
+		{LetGroup([]ast.LetBinding{{"a", Var("b")}, {"a", Var("c")}}, Var("a")), "Let-group expression has duplicate bindings for a"},
+		{Where(Var("a")), "Where expression has no bindings"},
+		{Where(Var("a"), ast.LetBinding{"b", Var("c")}, ast.LetBinding{"b", Var("d")}), "Where expression has duplicate bindings for b"},
+		{unreachable, "Control flow block L0 is not reachable from the entry block"},
+		{stuck, "Control flow contains blocks which do not reach the return block: L0"},
+		// Violations are found within nested expressions:
+		{Call(Var("f"), RecordExtend(nil, LabelValue("a", Func2("x", "x", Var("x"))))), "Function has duplicate arguments named x"},
+	} {
+		if err := ast.Validate(test.expr); err == nil || err.Error() != test.expect {
+			t.Fatalf("expected error %q, found %v", test.expect, err)
+		}
+	}
+}
+
+func TestInvalidExpr(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	if ast.ExprString(fnExpr) != "fn (x, y) -> match x { :a i -> add(i, i) | :b i -> add(i, i) | :c _ -> y }" {
-		t.Fatalf("expr: %s", ast.ExprString(fnExpr))
+	env.Declare("a", TConst("A"))
+	env.Declare("b", TConst("B"))
+	env.Declare("f", TArrow1(TConst("A"), TConst("B")))
+
+	mustFail := func(expr ast.Expr, invalid ast.Expr) {
+		t.Helper()
+		if _, err := ctx.Infer(expr, env); err == nil {
+			t.Fatalf("expected error for %s", ast.ExprString(expr))
+		}
+		if ctx.InvalidExpr() != invalid {
+			found := "<nil>"
+			if ctx.InvalidExpr() != nil {
+				found = ast.ExprString(ctx.InvalidExpr())
+			}
+			t.Fatalf("expected invalid expression %s for %s, found %s", ast.ExprString(invalid), ast.ExprString(expr), found)
+		}
 	}
-	mustInfer(t, env, ctx, fnExpr, "([a : int, b : int, c : 'a], int) -> int")
 
-	// Call:
+	// Undefined variables:
 
-	callExpr := Call(fnExpr, Variant("c", Var("somebool")), Var("someint"))
+	undefined := Var("c")
+	mustFail(RecordSelect(RecordExtend(nil, LabelValue("x", Call(Var("f"), undefined))), "x"), undefined)
 
-	if ast.ExprString(callExpr) != "(fn (x, y) -> match x { :a i -> add(i, i) | :b i -> add(i, i) | :c _ -> y })(:c somebool, someint)" {
-		t.Fatalf("expr: %s", ast.ExprString(callExpr))
-	}
-	mustInfer(t, env, ctx, callExpr, "int")
+	literal := &ast.Literal{Syntax: "c_literal", Using: []string{"c"}, Construct: func(env types.TypeEnv, level uint, using []types.Type) (types.Type, error) {
+		return using[0], nil
+	}}
+	mustFail(Call(Var("f"), literal), literal)
+
+	// Mismatched arguments:
+
+	call := Call(Var("f"), Var("b"))
+	mustFail(RecordExtend(nil, LabelValue("x", call)), call)
+
+	// Missing labels:
+
+	selected := RecordSelect(RecordExtend(nil, LabelValue("x", Var("a"))), "y")
+	mustFail(Call(Var("f"), selected), selected)
+
+	// Mismatched match-cases:
+
+	mismatched := Var("b")
+	match := Match(Variant("x", Var("a")),
+		[]ast.MatchCase{
+			MatchCase("x", "v", mismatched),
+			MatchCase("y", "v", Var("a")),
+		}, nil)
+	mustFail(match, mismatched)
+
+	// Mismatched recursive let-bindings:
+
+	binding := Func2("x", "y", Call(Var("h"), Var("x"), Var("y")))
+	group := LetGroup([]ast.LetBinding{
+		{"g", binding},
+		{"h", Func2("x", "y", Call(Var("g"), Var("x")))},
+	}, Var("h"))
+	mustFail(group, binding)
 }
 
-func TestSafeStacks(t *testing.T) {
+func TestMissingSubExpressions(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	// Use scoped labels within records to model a type-safe (polymorphic) stack
-	// with static underflow checking:
+	env.Declare("a", TConst("A"))
 
-	rest, a := env.NewGenericVar(), env.NewGenericVar()
-	env.Declare("push", TArrow2( // ({'rest}, 'a) -> {top : 'a | 'rest}
-		TRecord(rest), a,
-		TRecord(TRowExtend(rest, TypeMap(map[string]types.Type{"top": a})))))
+	for _, test := range []struct {
+		expr   ast.Expr
+		expect string
+	}{
+		{Call(nil, Var("a")), "Call expression is missing Func"},
+		{Call(Var("a"), Var("a"), nil), "Call expression is missing Args[1]"},
+		{Func1("x", nil), "Func expression is missing Body"},
+		{Let("x", nil, Var("x")), "Let expression is missing Value"},
+		{Let("x", Var("a"), nil), "Let expression is missing Body"},
+		{LetGroup([]ast.LetBinding{{"x", Var("a")}, {"y", nil}}, Var("x")), "LetGroup expression is missing Vars[y]"},
+		{Where(nil, LetBinding("x", Var("a"))), "Where expression is missing Body"},
+		{Pipe("$"), "Pipe expression is missing Source"},
+		{RecordSelect(nil, "x"), "RecordSelect expression is missing Record"},
+		{RecordExtend(nil, LabelValue("x", nil)), "RecordExtend expression is missing Labels[x]"},
+		{Variant("x", nil), "Variant expression is missing Value"},
+		{Match(nil, []ast.MatchCase{MatchCase("x", "x", Var("x"))}, nil), "Match expression is missing Value"},
+		{Match(Variant("x", Var("a")), []ast.MatchCase{MatchCase("x", "x", nil)}, nil), "Match expression is missing Cases[x]"},
+		{&ast.Literal{Syntax: "lit"}, "Literal expression is missing Construct"},
+		{Func1("x", Call(Var("x"), Deref(nil))), "Deref expression is missing Ref"},
+	} {
+		if _, err := ctx.Infer(test.expr, env); err == nil || err.Error() != test.expect {
+			t.Fatalf("expected error %q, found %v", test.expect, err)
+		}
+		if _, err := ctx.Annotate(test.expr, env); err == nil || err.Error() != test.expect {
+			t.Fatalf("expected error %q during annotation, found %v", test.expect, err)
+		}
+	}
 
-	rest, a = env.NewGenericVar(), env.NewGenericVar()
-	env.Declare("peek", TArrow1( // {top : 'a | 'rest} -> 'a
-		TRecord(TRowExtend(rest, TypeMap(map[string]types.Type{"top": a}))),
-		a))
+	// A missing record within a record extension is equivalent to an empty record:
+	mustInfer(t, env, ctx, &ast.RecordExtend{Labels: []ast.LabelValue{LabelValue("x", Var("a"))}}, "{x : A}")
+}
 
-	rest, a = env.NewGenericVar(), env.NewGenericVar()
-	env.Declare("pop", TArrow1( // {top : 'a | 'rest} -> 'rest
-		TRecord(TRowExtend(rest, TypeMap(map[string]types.Type{"top": a}))),
-		TRecord(rest)))
+func TestFix(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	env.Declare("i", TConst("int"))
-	env.Declare("b", TConst("bool"))
+	env.Declare("one", TConst("int"))
+	env.Declare("sub", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	env.Declare("mul", TArrow2(TConst("int"), TConst("int"), TConst("int")))
+	env.Declare("is_zero", TArrow1(TConst("int"), TConst("bool")))
+	a := env.NewGenericVar()
+	env.Declare("if", TArrow3(TConst("bool"), a, a, a))
 
-	// push(i), push(b), peek, pop, pop -> b
-	expr := Let("stack", RecordEmpty(),
-		Let("stack", Call(Var("push"), Var("stack"), Var("i")), // i
-			Let("stack", Call(Var("push"), Var("stack"), Var("b")), // i b
-				Let("top", Call(Var("peek"), Var("stack")), // i b
-					Let("stack", Call(Var("pop"), Var("stack")), // i,
-						Let("stack", Call(Var("pop"), Var("stack")), // empty
-							Var("top")))))))
+	// fix (fn (fact) -> fn (n) -> if(is_zero(n), one, mul(n, fact(sub(n, one)))))
+	fact := Fix(Func1("fact", Func1("n",
+		Call(Var("if"), Call(Var("is_zero"), Var("n")), Var("one"),
+			Call(Var("mul"), Var("n"), Call(Var("fact"), Call(Var("sub"), Var("n"), Var("one"))))))))
+	if ast.ExprString(fact) != "fix (fn (fact) -> fn (n) -> if(is_zero(n), one, mul(n, fact(sub(n, one)))))" {
+		t.Fatalf("expr: %s", ast.ExprString(fact))
+	}
+	mustInfer(t, env, ctx, fact, "int -> int")
+	mustInfer(t, env, ctx, Call(fact, Var("one")), "int")
 
-	mustInfer(t, env, ctx, expr, "bool")
+	// The recursive function is generalized by an enclosing let-binding:
+	loop := Fix(Func1("loop", Func1("x", Call(Var("loop"), Var("x")))))
+	mustInfer(t, env, ctx, loop, "'a -> 'b")
+	mustInfer(t, env, ctx, Let("loop", loop, Var("loop")), "'a -> 'b")
 
-	// push(i), push(b), pop, peek, pop -> i
-	expr = Let("stack", RecordEmpty(),
-		Let("stack", Call(Var("push"), Var("stack"), Var("i")), // i
-			Let("stack", Call(Var("push"), Var("stack"), Var("b")), // i b
-				Let("stack", Call(Var("pop"), Var("stack")), // i
-					Let("top", Call(Var("peek"), Var("stack")), // i
-						Let("stack", Call(Var("pop"), Var("stack")), // empty
-							Var("top")))))))
+	expr, err := ctx.Annotate(Call(fact, Var("one")), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(expr.(*ast.Call).Func.Type()) != "int -> int" {
+		t.Fatalf("unexpected annotated type: %s", types.TypeString(expr.(*ast.Call).Func.Type()))
+	}
 
-	mustInfer(t, env, ctx, expr, "int")
+	for _, test := range []struct {
+		expr   ast.Expr
+		expect string
+	}{
+		{Fix(Func1("x", Var("one"))), "Fix expression requires a function which returns a function"},
+		{Fix(Func2("f", "g", Func1("x", Var("x")))), "Fix expression requires a function with a single argument"},
+		{Fix(nil), "Fix expression is missing Func"},
+	} {
+		if _, err := ctx.Infer(test.expr, env); err == nil || err.Error() != test.expect {
+			t.Fatalf("expected error %q, found %v", test.expect, err)
+		}
+	}
+}
 
-	// push(i), push(b), pop, pop, pop -> underflow
-	expr = Let("stack", RecordEmpty(),
-		Let("stack", Call(Var("push"), Var("stack"), Var("i")), // i
-			Let("stack", Call(Var("push"), Var("stack"), Var("b")), // i b
-				Let("stack", Call(Var("pop"), Var("stack")), // i
-					Let("stack", Call(Var("pop"), Var("stack")), // empty
-						Let("stack", Call(Var("pop"), Var("stack")), // underflow
-							Var("stack")))))))
+func TestDegenerateExpressions(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	_, err := ctx.Infer(expr, env)
-	if err == nil {
-		t.Fatalf("expected stack underflow error")
+	env.Declare("a", TConst("A"))
+
+	emptyReturn := ControlFlow("f")
+	emptyReturn.SetEntry(Var("a"))
+	emptyReturn.AddJump(emptyReturn.Entry, emptyReturn.Return)
+
+	for _, test := range []struct {
+		expr   ast.Expr
+		expect string
+	}{
+		{LetGroup(nil, Var("a")), "LetGroup expression has no bindings"},
+		{Where(Var("a")), "Where expression has no bindings"},
+		{Match(Variant("x", Var("a")), nil, nil), "Match expression has no cases"},
+		{MatchTuple(Var("a"), TuplePattern(), Var("a")), "MatchTuple expression has an empty tuple pattern"},
+		{MatchTuple(Var("a"), TuplePattern(PatternVar("x"), TuplePattern()), Var("x")), "MatchTuple expression has an empty tuple pattern"},
+		{ControlFlow("g"), "ControlFlow expression has an empty return block"},
+		{emptyReturn, "ControlFlow expression has an empty return block"},
+	} {
+		if _, err := ctx.Infer(test.expr, env); err == nil || err.Error() != test.expect {
+			t.Fatalf("expected error %q, found %v", test.expect, err)
+		}
+		if ctx.InvalidExpr() != test.expr {
+			t.Fatalf("expected invalid expression %s", ast.ExprString(test.expr))
+		}
 	}
+
+	// Functions without arguments, pipes without steps, matches with only a default case, and record extensions
+	// without labels are not degenerate:
+	mustInfer(t, env, ctx, Func(nil, Var("a")), "() -> A")
+	mustInfer(t, env, ctx, Call(Func(nil, Var("a"))), "A")
+	mustInfer(t, env, ctx, Pipe("$", Var("a")), "A")
+	mustInfer(t, env, ctx, Match(Variant("x", Var("a")), nil, &ast.MatchCase{Var: "_", Value: Var("a")}), "A")
+	mustInfer(t, env, ctx, RecordExtend(nil), "{}")
+
+	noBlocks := ControlFlow("h")
+	noBlocks.SetEntry(Var("a"))
+	noBlocks.SetReturn(Var("a"))
+	noBlocks.AddJump(noBlocks.Entry, noBlocks.Return)
+	mustInfer(t, env, ctx, noBlocks, "A")
 }
 
-func TestHigherKindedTypes(t *testing.T) {
+func TestConstraintStyles(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	// class Functor 'f where
-	//   fmap :: (('a -> 'b), 'f['a]) -> 'f['b]
-	Functor, err := env.DeclareTypeClass("Functor", func(f *types.Var) types.MethodSet {
-		f.SetWeak()
-		f.RestrictConstVar()
-		a, b := env.NewGenericVar(), env.NewGenericVar()
-		return types.MethodSet{
-			"fmap": TArrow2(TArrow1(a, b), TApp(f, a), TApp(f, b)),
+	declare := func(name string) *types.TypeClass {
+		tc, err := env.DeclareTypeClass(name, func(param *types.Var) types.MethodSet { return types.MethodSet{} })
+		if err != nil {
+			t.Fatal(err)
 		}
-	})
-	if err != nil {
-		t.Fatal(err)
+		return tc
 	}
+	Eq, Show, Num := declare("Eq"), declare("Show"), declare("Num")
 
-	// class (Functor 'f) => Applicative 'f where
-	//   pure  :: 'a -> 'f['a]
-	//   (<*>) :: ('f[('a -> 'b)], 'f['a]) -> 'f['b]
-	Applicative, err := env.DeclareTypeClass("Applicative", func(f *types.Var) types.MethodSet {
-		f.SetWeak()
-		f.RestrictConstVar()
-		a, b := env.NewGenericVar(), env.NewGenericVar()
-		return types.MethodSet{
-			"pure":  TArrow1(a, TApp(f, a)),
-			"(<*>)": TArrow2(TApp(f, TArrow1(a, b)), TApp(f, a), TApp(f, b)),
-		}
-	}, Functor) // extends/subsumes Functor
+	// Type-variables are named in order of appearance, so the variable constrained by Num is named first:
+	shown := env.NewQualifiedVar(types.InstanceConstraint{Eq}, types.InstanceConstraint{Show})
+	num := env.NewQualifiedVar(types.InstanceConstraint{Num})
+	env.Declare("f", TArrow2(num, shown, TApp(TConst("list"), shown)))
+	ty, err := ctx.Infer(Var("f"), env)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// class (Applicative 'm) => Monad 'm where
-	//   (>>=) :: ('m['a], (a -> 'm['b])) -> 'm['b]
-	Monad, err := env.DeclareTypeClass("Monad", func(m *types.Var) types.MethodSet {
-		m.SetWeak()
-		m.RestrictConstVar()
-		a, b := env.NewGenericVar(), env.NewGenericVar()
-		return types.MethodSet{
-			"(>>=)": TArrow2(TApp(m, a), TArrow1(a, TApp(m, b)), TApp(m, b)),
+	for _, test := range []struct {
+		opts   types.PrintOptions
+		expect string
+	}{
+		{types.PrintOptions{}, "(Num 'a, Eq 'b, Show 'b) => ('a, 'b) -> list['b]"},
+		{types.PrintOptions{GroupConstraints: true}, "(Num 'a, (Eq + Show) 'b) => ('a, 'b) -> list['b]"},
+		{types.PrintOptions{Constraints: types.ConstraintsWhere}, "('a, 'b) -> list['b] where Num 'a, Eq 'b, Show 'b"},
+		{types.PrintOptions{Constraints: types.ConstraintsWhere, GroupConstraints: true}, "('a, 'b) -> list['b] where Num 'a, (Eq + Show) 'b"},
+		{types.PrintOptions{Constraints: types.ConstraintsWhere, Quantify: true}, "forall 'a 'b. ('a, 'b) -> list['b] where Num 'a, Eq 'b, Show 'b"},
+	} {
+		if s := types.TypeStringWith(ty, test.opts); s != test.expect {
+			t.Fatalf("expected %s, found %s", test.expect, s)
 		}
-	}, Applicative) // extends/subsumes Applicative
+	}
+	if types.TypeString(ty) != types.TypeStringWith(ty, types.PrintOptions{}) {
+		t.Fatalf("expected default options to match TypeString")
+	}
+
+	// A single grouped variable is not enclosed:
+	env.Declare("g", TArrow1(shown, TConst("string")))
+	ty, err = ctx.Infer(Var("g"), env)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if s := types.TypeStringWith(ty, types.PrintOptions{GroupConstraints: true}); s != "(Eq + Show) 'a => 'a -> string" {
+		t.Fatalf("unexpected grouped constraints: %s", s)
+	}
+}
 
-	// fmap       :: (('a -> 'b),     'f['a]) ->     'f['b]
-	// option_map :: (('a -> 'b), Option['a]) -> Option['b]
-	//
-	// pure :: 'a ->     'f['a]
-	// some :: 'a -> Option['a]
-	//
-	// (<*>)     ::     ('f[('a -> 'b)],     'f['a]) ->     'f['b]
-	// option_ap :: (Option[('a -> 'b)], Option['a]) -> Option['b]
-	//
-	// (>>=)       ::     ('m['a], (a ->     'm['b])) ->     'm['b]
-	// option_bind :: (Option['a], (a -> Option['b])) -> Option['b]
-	//
-	// instance Monad Option where
-	//   fmap  = option_map
-	//   pure  = some
-	//   (<*>) = option_ap
-	//   (>>=) = option_bind
-	a, b, option := env.NewGenericVar(), env.NewGenericVar(), TConst("Option")
-	env.Declare("option_map", TArrow2(TArrow1(a, b), TApp(option, a), TApp(option, b)))
-	a = env.NewGenericVar()
-	env.Declare("some", TArrow1(a, TApp(option, a)))
-	a, b = env.NewGenericVar(), env.NewGenericVar()
-	env.Declare("option_ap", TArrow2(TApp(option, TArrow1(a, b)), TApp(option, a), TApp(option, b)))
-	a, b = env.NewGenericVar(), env.NewGenericVar()
-	env.Declare("option_bind", TArrow2(TApp(option, a), TArrow1(a, TApp(option, b)), TApp(option, b)))
-	optionMethods := map[string]string{"fmap": "option_map", "pure": "some", "(<*>)": "option_ap", "(>>=)": "option_bind"}
-	// Declaring instances for Functor and Applicative is not strictly necessary, but should not cause errors
-	// due to overlapping instances:
-	if _, err := env.DeclareInstance(Functor, option, optionMethods); err != nil {
+func TestInferString(t *testing.T) {
+	env := NewTypeEnv(nil)
+
+	env.Declare("a", TConst("A"))
+	Show, err := env.DeclareTypeClass("Show", func(a *types.Var) types.MethodSet {
+		return types.MethodSet{"show": TArrow1(a, TConst("string"))}
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := env.DeclareInstance(Applicative, option, optionMethods); err != nil {
+	env.Declare("a_show", TArrow1(TConst("A"), TConst("string")))
+	if _, err := env.DeclareInstance(Show, TConst("A"), map[string]string{"show": "a_show"}); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := env.DeclareInstance(Monad, option, optionMethods); err != nil {
-		t.Fatal(err)
+
+	for _, test := range []struct {
+		expr   ast.Expr
+		expect string
+	}{
+		{Var("a"), "A"},
+		{Func1("x", Var("x")), "forall 'a. 'a -> 'a"},
+		{Func2("x", "y", Var("y")), "forall 'a 'b. ('a, 'b) -> 'b"},
+		{Func1("r", RecordSelect(Var("r"), "x")), "forall 'a 'b. {x : 'a | 'b} -> 'a"},
+		{RecordExtend(nil, LabelValue("x", Var("a")), LabelValue("f", Func1("x", Var("x")))), "forall 'a. {f : 'a -> 'a, x : A}"},
+		{Func1("x", Call(Var("show"), Var("x"))), "forall 'a. Show 'a => 'a -> string"},
+		{Call(Var("show"), Var("a")), "string"},
+	} {
+		s, err := InferString(env, test.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", ast.ExprString(test.expr), err)
+		}
+		if s != test.expect {
+			t.Fatalf("%s: expected %s, found %s", ast.ExprString(test.expr), test.expect, s)
+		}
 	}
 
-	env.Declare("itoa", TArrow1(TConst("int"), TConst("string")))
-	env.Declare("atoi", TArrow1(TConst("string"), TConst("int")))
-	env.Declare("someintoption", TApp(option, TConst("int")))
+	if _, err := InferString(env, Var("undefined")); err == nil {
+		t.Fatalf("expected undefined variable error")
+	}
+}
 
-	var expr ast.Expr = Call(Var("fmap"), Var("itoa"), Var("someintoption"))
-	mustInfer(t, env, ctx, expr, "Option[string]")
+func TestAlphaEqual(t *testing.T) {
+	env := NewTypeEnv(nil)
 
-	expr = Call(Var("(>>=)"), Var("someintoption"), Func1("i", Call(Var("pure"), Call(Var("itoa"), Var("i")))))
-	if ast.ExprString(expr) != "(>>=)(someintoption, fn (i) -> pure(itoa(i)))" {
-		t.Fatalf("expr: %s", ast.ExprString(expr))
+	a, b, c, d := env.NewGenericVar(), env.NewGenericVar(), env.NewGenericVar(), env.NewGenericVar()
+	if !types.AlphaEqual(TArrow1(a, b), TArrow1(c, d)) {
+		t.Fatalf("expected renamed functions to be equal")
+	}
+	if types.AlphaEqual(TArrow1(a, a), TArrow1(c, d)) || types.AlphaEqual(TArrow1(a, b), TArrow1(c, c)) {
+		t.Fatalf("expected inconsistently renamed functions to be unequal")
+	}
+	if types.AlphaEqual(TArrow1(a, TConst("int")), TArrow1(c, TConst("bool"))) {
+		t.Fatalf("expected functions with different constants to be unequal")
 	}
-	mustInfer(t, env, ctx, expr, "Option[string]")
 
-	expr = Func1("x", Pipe("$", Var("x"),
-		Call(Var("(>>=)"), Var("$"), Func1("i", Call(Var("pure"), Call(Var("itoa"), Var("i"))))),
-		Call(Var("(>>=)"), Var("$"), Func1("s", Call(Var("pure"), Call(Var("atoi"), Var("s"))))),
-		Call(Var("(>>=)"), Var("$"), Func1("i", Call(Var("some"), Var("i"))))))
+	// Rows:
 
-	mustInfer(t, env, ctx, expr, "Option[int] -> Option[int]")
+	r1, r2 := env.NewGenericVar(), env.NewGenericVar()
+	recA := TRecord(TRowExtend(r1, TypeMap(map[string]types.Type{"x": a, "y": TConst("int")})))
+	recB := TRecord(TRowExtend(TRowExtend(r2, TypeMap(map[string]types.Type{"y": TConst("int")})),
+		TypeMap(map[string]types.Type{"x": c})))
+	if !types.AlphaEqual(recA, recB) {
+		t.Fatalf("expected renamed records to be equal")
+	}
+	if types.AlphaEqual(recA, TRecord(TRowExtend(r2, TypeMap(map[string]types.Type{"x": c})))) {
+		t.Fatalf("expected records with different labels to be unequal")
+	}
+	if types.AlphaEqual(recA, TRecord(TRowExtend(nil, TypeMap(map[string]types.Type{"x": c, "y": TConst("int")})))) {
+		t.Fatalf("expected open and closed records to be unequal")
+	}
 
-	// fmap    :: (('a -> 'b),  'f['a]) ->  'f['b]
-	// ref_map :: (('a -> 'b), ref['a]) -> ref['b]
-	//
-	// instance Functor ref where
-	//   fmap = ref_map
-	a, b = env.NewGenericVar(), env.NewGenericVar()
-	env.Declare("ref_map", TArrow2(TArrow1(a, b), TRef(a), TRef(b)))
-	if _, err := env.DeclareInstance(Functor, types.RefType, map[string]string{"fmap": "ref_map"}); err != nil {
+	// Constraints:
+
+	Show, err := env.DeclareTypeClass("Show", func(a *types.Var) types.MethodSet {
+		return types.MethodSet{"show": TArrow1(a, TConst("string"))}
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
-	env.Declare("someintref", TRef(TConst("int")))
-	expr = Call(Var("fmap"), Var("itoa"), Var("someintref"))
-	mustInfer(t, env, ctx, expr, "ref[string]")
+	Eq, err := env.DeclareTypeClass("Eq", func(a *types.Var) types.MethodSet {
+		return types.MethodSet{"eq": TArrow2(a, a, TConst("bool"))}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	showA, showB, eqA := env.NewQualifiedVar(types.InstanceConstraint{Show}), env.NewQualifiedVar(types.InstanceConstraint{Show}), env.NewQualifiedVar(types.InstanceConstraint{Eq})
+	if !types.AlphaEqual(TArrow1(showA, TConst("string")), TArrow1(showB, TConst("string"))) {
+		t.Fatalf("expected renamed qualified functions to be equal")
+	}
+	if types.AlphaEqual(TArrow1(showA, TConst("string")), TArrow1(eqA, TConst("string"))) {
+		t.Fatalf("expected functions with different constraints to be unequal")
+	}
+	if types.AlphaEqual(TArrow1(showA, TConst("string")), TArrow1(a, TConst("string"))) {
+		t.Fatalf("expected qualified and unqualified functions to be unequal")
+	}
 
-	// detect invalid instances
+	// Recursive types:
 
-	// fmap    :: (('a -> 'b), 'f['a]) -> 'f['b]
-	// bad_map :: (('a -> 'b),  A['a]) ->  B['b]
-	//                          ^----------^
-	//
-	// instance Functor A where
-	//   fmap = bad_map
-	a, b = env.NewGenericVar(), env.NewGenericVar()
-	env.Declare("bad_map", TArrow2(TArrow1(a, b), TApp(TConst("A"), a), TApp(TConst("B"), b)))
-	if _, err = env.DeclareInstance(Functor, TConst("A"), map[string]string{"fmap": "bad_map"}); err == nil {
-		t.Fatalf("expected invalid-instance error")
+	params := []*types.Var{env.NewGenericVar()}
+	list := env.NewSimpleRecursive(params, func(rec *types.Recursive, self *types.RecursiveLink) {
+		a := rec.Params[0]
+		rec.AddType("list", TAlias(TApp(TConst("list"), a),
+			TRecordFlat(map[string]types.Type{"head": a, "tail": self})))
+	})
+	listA, listC, listInt := list.WithParams(env, a).GetType("list"), list.WithParams(env, c).GetType("list"), list.WithParams(env, TConst("int")).GetType("list")
+	if !types.AlphaEqual(listA, listC) || !types.AlphaEqual(listA.Underlying, listC.Underlying) {
+		t.Fatalf("expected renamed recursive types to be equal")
+	}
+	if types.AlphaEqual(listA, listInt) || types.AlphaEqual(listA.Underlying, listInt.Underlying) {
+		t.Fatalf("expected recursive types with different parameters to be unequal")
+	}
+}
+
+func TestHash(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
+
+	// Alpha-equal schemes hash equally:
+	id1, err := ctx.Infer(Func1("x", Var("x")), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := ctx.Infer(Func1("y", Var("y")), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !types.AlphaEqual(id1, id2) || types.AlphaHash(id1) != types.AlphaHash(id2) {
+		t.Fatalf("expected alpha-equal schemes to hash equally")
+	}
+	if types.Hash(id1) == types.Hash(id2) {
+		t.Fatalf("expected schemes with distinct type-variables to hash differently")
+	}
+
+	// Row labels are hashed independently of their order:
+	a, b, r := env.NewGenericVar(), env.NewGenericVar(), env.NewGenericVar()
+	recA := TRecord(TRowExtend(r, TypeMap(map[string]types.Type{"x": a, "y": TConst("int")})))
+	recB := TRecord(TRowExtend(TRowExtend(r, TypeMap(map[string]types.Type{"y": TConst("int")})), TypeMap(map[string]types.Type{"x": a})))
+	if types.Hash(recA) != types.Hash(recB) || types.AlphaHash(recA) != types.AlphaHash(recB) {
+		t.Fatalf("expected reordered records to hash equally")
+	}
+
+	// Recursive types:
+	params := []*types.Var{env.NewGenericVar()}
+	list := env.NewSimpleRecursive(params, func(rec *types.Recursive, self *types.RecursiveLink) {
+		a := rec.Params[0]
+		rec.AddType("list", TAlias(TApp(TConst("list"), a),
+			TRecordFlat(map[string]types.Type{"head": a, "tail": self})))
+	})
+	listA, listB := list.WithParams(env, a).GetType("list"), list.WithParams(env, b).GetType("list")
+	if types.AlphaHash(listA.Underlying) != types.AlphaHash(listB.Underlying) {
+		t.Fatalf("expected renamed recursive types to hash equally")
 	}
 
-	// bad applicative (Vec is not declared as a Functor instance)
-	a = env.NewGenericVar()
-	env.Declare("new_vec", TArrow1(a, TApp(TConst("Vec"), a)))
-	a, b = env.NewGenericVar(), env.NewGenericVar()
-	env.Declare("vec_ap", TArrow2(TApp(TConst("Vec"), TArrow1(a, b)), TApp(TConst("Vec"), a), TApp(TConst("Vec"), b)))
-	if _, err := env.DeclareInstance(Applicative, TConst("Vec"), map[string]string{"pure": "new_vec", "(<*>)": "vec_ap"}); err == nil {
-		t.Fatalf("expected invalid-instance error")
+	// Distinct types hash differently:
+	intType, boolType := TConst("int"), TConst("bool")
+	distinct := []types.Type{
+		intType,
+		boolType,
+		TArrow1(intType, intType),
+		TArrow1(intType, boolType),
+		TArrow2(intType, intType, intType),
+		TArrow1(a, a),
+		TArrow1(a, b),
+		TTuple(intType, boolType),
+		TTuple(boolType, intType),
+		TRecordFlat(map[string]types.Type{"x": intType}),
+		TRecordFlat(map[string]types.Type{"y": intType}),
+		TRecordFlat(map[string]types.Type{"x": intType, "y": intType}),
+		TVariant(TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"x": intType}))),
+		recA,
+		TApp(TConst("list"), intType),
+		TApp(TConst("list"), boolType),
+		listA.Underlying,
+		list.WithParams(env, intType).GetType("list").Underlying,
+	}
+	seen := make(map[uint64]types.Type, len(distinct))
+	for _, ty := range distinct {
+		h := types.AlphaHash(ty)
+		if prev, ok := seen[h]; ok {
+			t.Fatalf("unexpected hash collision for %s and %s", types.TypeString(prev), types.TypeString(ty))
+		}
+		seen[h] = ty
 	}
 }
 
-func TestUnionTypeClasses(t *testing.T) {
+func TestConcatRows(t *testing.T) {
 	env := NewTypeEnv(nil)
-	ctx := NewContext()
 
-	ABC, err := env.DeclareUnionTypeClass("ABC", nil, map[string]types.Type{
-		"A": TConst("A"),
-		"B": TConst("B"),
-		"C": TConst("C"),
-	})
+	intType, boolType := TConst("int"), TConst("bool")
+	a := TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"x": intType, "y": boolType}))
+	b := TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"z": intType}))
+	r := env.NewGenericVar()
+	open := TRowExtend(r, TypeMap(map[string]types.Type{"w": boolType}))
+
+	row, err := types.ConcatRows(a, b)
 	if err != nil {
 		t.Fatal(err)
 	}
-	abc := env.NewQualifiedVar(types.InstanceConstraint{ABC})
-	env.Declare("fabc", TArrow1(abc, abc))
-	env.Declare("somea", TConst("A"))
-	env.Declare("someint", TConst("int"))
-
-	call := Call(Var("fabc"), Var("somea"))
-	mustInfer(t, env, ctx, call, "A")
-
-	// (built-in) cast to a tagged variant:
-	mustInfer(t, env, ctx, Var("ABC"), "ABC 'a => 'a -> [A : A, B : B, C : C]")
-
-	call = Call(Var("ABC"), Var("somea"))
-	mustInfer(t, env, ctx, call, "[A : A, B : B, C : C]")
-
-	match := Match(Call(Var("ABC"), Var("somea")),
-		[]ast.MatchCase{
-			{Label: "A", Var: "a", Value: Var("someint")},
-			{Label: "B", Var: "b", Value: Var("someint")},
-			{Label: "C", Var: "c", Value: Var("someint")},
-		},
-		// no default case:
-		nil)
+	if types.TypeString(TRecord(row)) != "{x : int, y : bool, z : int}" {
+		t.Fatalf("unexpected row: %s", types.TypeString(TRecord(row)))
+	}
+	// Labels are attached before the tail of an open row:
+	if row, err = types.ConcatRows(open, a); err != nil {
+		t.Fatal(err)
+	}
+	if types.TypeString(TRecord(row)) != "{w : bool, x : int, y : bool | 'a}" {
+		t.Fatalf("unexpected row: %s", types.TypeString(TRecord(row)))
+	}
+	if !row.IsGeneric() {
+		t.Fatalf("expected a generic row")
+	}
+	if row, err = types.ConcatRows(a, open); err != nil || !types.AlphaEqual(TRecord(row), TRecord(TRowExtend(r, TypeMap(map[string]types.Type{"w": boolType, "x": intType, "y": boolType})))) {
+		t.Fatalf("unexpected row: %s (%v)", types.TypeString(TRecord(row)), err)
+	}
+	if row, err = types.ConcatRows(TRowEmpty(), TRowEmpty()); err != nil || types.TypeString(TRecord(row)) != "{}" {
+		t.Fatalf("unexpected row: %s (%v)", types.TypeString(TRecord(row)), err)
+	}
 
-	mustInfer(t, env, ctx, match, "int")
+	// Conflicting rows:
+	if _, err = types.ConcatRows(a, TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"y": intType}))); err == nil || err.Error() != "Row concatenation contains duplicate label y" {
+		t.Fatalf("expected duplicate label error, found: %v", err)
+	}
+	if _, err = types.ConcatRows(open, TRowExtend(env.NewGenericVar(), TypeMap(map[string]types.Type{"z": intType}))); err == nil || err.Error() != "Row concatenation requires at least one closed row" {
+		t.Fatalf("expected open row error, found: %v", err)
+	}
+	if _, err = types.ConcatRows(a, intType); err == nil {
+		t.Fatalf("expected an error for a non-row type")
+	}
 }
 
-func TestDeferredInstanceMatching(t *testing.T) {
+func TestCheckInterface(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	objA := TRecordFlat(map[string]types.Type{"x": TConst("A")})
-	objB := TRecordFlat(map[string]types.Type{"x": TConst("B")})
-
-	HasX, err := env.DeclareUnionTypeClass("HasX", nil, map[string]types.Type{
-		"A": objA,
-		"B": objB,
+	intType, boolType, stringType := TConst("int"), TConst("bool"), TConst("string")
+	env.Declare("add", TArrow2(intType, intType, intType))
+	Show, err := env.DeclareTypeClass("Show", func(a *types.Var) types.MethodSet {
+		return types.MethodSet{"show": TArrow1(a, stringType)}
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	env.Declare("objA", objA)
-	env.Declare("objB", objB)
-	env.Declare("a_id", TArrow1(TConst("A"), TConst("A")))
+	impls := make(map[string]types.Type)
+	for name, expr := range map[string]ast.Expr{
+		"id":    Func1("x", Var("x")),
+		"const": Func2("x", "y", Var("x")),
+		"incr":  Func1("x", Call(Var("add"), Var("x"), Var("x"))),
+		"show":  Func1("x", Call(Var("show"), Var("x"))),
+	} {
+		ty, err := ctx.Infer(expr, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		impls[name] = ty
+	}
 
-	hasX := env.NewQualifiedVar(types.InstanceConstraint{HasX})
-	env.Declare("obj_id", TArrow1(hasX, hasX))
+	a, b := env.NewGenericVar(), env.NewGenericVar()
+	showA := env.NewQualifiedVar(types.InstanceConstraint{Show})
+
+	// matching: implementations may be alpha-equal to or more general than the declared types
+	defs := map[string]types.Type{
+		"id":    TArrow1(b, b),
+		"const": TArrow2(intType, boolType, intType),
+		"incr":  TArrow1(intType, intType),
+		"show":  TArrow1(showA, stringType),
+	}
+	if errs := CheckInterface(defs, impls); len(errs) != 0 {
+		t.Fatalf("unexpected interface errors: %v", errs)
+	}
 
-	mustInfer(t, env, ctx, Var("obj_id"), "HasX 'a => 'a -> 'a")
-	mustInfer(t, env, ctx, Var("objA"), "{x : A}")
-	mustInfer(t, env, ctx, Call(Var("obj_id"), Var("objA")), "{x : A}")
+	// too-specific implementations: declared types which are more general than the implementation
+	for name, def := range map[string]types.Type{
+		"incr":  TArrow1(a, a),
+		"const": TArrow2(a, b, b),
+		"show":  TArrow1(a, stringType),
+	} {
+		errs := CheckInterface(map[string]types.Type{name: def}, map[string]types.Type{name: impls[name]})
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "does not match the declared type") {
+			t.Fatalf("expected signature error for %s : %s, found: %v", name, types.TypeString(def), errs)
+		}
+	}
 
-	// fn (x) -> let _ = obj_id({x = x}) in a_id(x)
-	expr := Func1("x",
-		Let("_", Call(Var("obj_id"), RecordExtend(RecordEmpty(), LabelValue("x", Var("x")))),
-			Call(Var("a_id"), Var("x"))))
+	// signature mismatch:
+	errs := CheckInterface(map[string]types.Type{"incr": TArrow1(boolType, intType)}, impls)
+	if len(errs) != 4 || !strings.Contains(errs[2].Error(), "Implementation for incr : int -> int does not match") {
+		t.Fatalf("unexpected interface errors: %v", errs)
+	}
 
-	if _, err = ctx.Infer(expr, env); err == nil {
-		t.Fatalf("unexpected match for type-class with missing context")
+	// missing and undeclared definitions:
+	errs = CheckInterface(map[string]types.Type{"id": TArrow1(a, a), "missing": intType}, map[string]types.Type{"id": impls["id"], "extra": intType})
+	if len(errs) != 2 {
+		t.Fatalf("unexpected interface errors: %v", errs)
 	}
-	if !strings.Contains(err.Error(), "Instance cannot be determined") {
-		t.Fatalf("expected context error, found: %s", err.Error())
+	if errs[0].Error() != "Implementation for extra is not declared within the interface" {
+		t.Fatalf("unexpected interface error: %v", errs[0])
 	}
-	if ctx.InvalidExpr() == nil {
-		t.Fatalf("expected invalid expression to be retained")
+	if errs[1].Error() != "Missing implementation for missing : int" {
+		t.Fatalf("unexpected interface error: %v", errs[1])
 	}
-	if ast.ExprString(ctx.InvalidExpr()) != "obj_id({x = x})" {
-		t.Fatalf("invalid expr: %s", ast.ExprString(ctx.InvalidExpr()))
+}
+
+func TestGeneralizeAtLevel(t *testing.T) {
+	env := NewTypeEnv(nil)
+
+	a, b := env.NewVar(1), env.NewVar(types.TopLevel)
+	fn := TArrow2(a, b, a)
+	if fn.IsGeneric() {
+		t.Fatalf("expected unbound type-variables before generalization")
+	}
+	if GeneralizeAtLevel(types.TopLevel, fn) != fn {
+		t.Fatalf("expected generalization in place")
+	}
+	// Only type-variables above the given level are generalized:
+	if !a.IsGenericVar() || b.IsGenericVar() || !fn.IsGeneric() {
+		t.Fatalf("unexpected generalization: %s", types.TypeString(fn))
 	}
 
-	ctx.EnableDeferredInstanceMatching(true)
-	if _, err = ctx.Infer(expr, env); err != nil {
-		t.Fatal(err)
+	// Generic type-variables are replaced with fresh type-variables after instantiation:
+	inst := env.Instantiate(1, fn).(*types.Arrow)
+	arg, ret := types.RealType(inst.Args[0]), types.RealType(inst.Return)
+	if arg == types.Type(a) || arg != ret || !arg.(*types.Var).IsUnboundVar() {
+		t.Fatalf("expected fresh type-variables after instantiation: %s", types.TypeString(inst))
+	}
+	if types.RealType(inst.Args[1]) != types.Type(b) {
+		t.Fatalf("expected non-generic type-variables to be shared after instantiation")
+	}
+	other := env.Instantiate(1, fn).(*types.Arrow)
+	if types.RealType(other.Args[0]) == arg {
+		t.Fatalf("expected distinct type-variables for each instantiation")
 	}
 }
 
-func TestConstraints(t *testing.T) {
+func TestInferAtLevel(t *testing.T) {
 	env := NewTypeEnv(nil)
 	ctx := NewContext()
 
-	// type hierarchy
-
-	intType, shortType, floatType, boolType := TConst("int"), TConst("short"), TConst("float"), TConst("bool")
-	intVecType := TApp(TConst("vec"), intType)
+	// The type of y is bound by an enclosing expression at level 2:
+	y := env.NewVar(2)
+	env.Assign("y", y)
+	expr := Func1("x", RecordExtend(nil, LabelValue("x", Var("x")), LabelValue("y", Var("y"))))
 
-	Add, err := env.DeclareTypeClass("Add", func(param *types.Var) types.MethodSet {
-		return types.MethodSet{
-			"+": TArrow2(param, param, param),
-		}
-	})
+	// Relative to the enclosing level, only the argument is generalized:
+	ty, err := ctx.InferAtLevel(expr, env, 2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	adderVecType := TApp(TConst("vec"), env.NewQualifiedVar(types.InstanceConstraint{Add}))
-	if types.TypeString(adderVecType) != "Add 'a => vec['a]" {
-		t.Fatalf("invalid vec string: %s", types.TypeString(adderVecType))
+	if !y.IsUnboundVar() {
+		t.Fatalf("expected the enclosing type-variable to remain unbound")
+	}
+	if expect := "'a -> {x : 'a, y : " + types.TypeString(y) + "}"; types.TypeString(ty) != expect {
+		t.Fatalf("expected %s, found %s", expect, types.TypeString(ty))
 	}
 
-	Int, err := env.DeclareTypeClass("Int", func(param *types.Var) types.MethodSet {
-		return types.MethodSet{
-			"&": TArrow2(param, param, param),
-		}
-	}, Add) // implements/subsumes Add
-	if err != nil {
-		t.Fatal(err)
+	// At the top level, all unbound type-variables are generalized:
+	mustInfer(t, env, ctx, expr, "'a -> {x : 'a, y : 'b}")
+	if !y.IsGenericVar() {
+		t.Fatalf("expected the enclosing type-variable to be generalized")
 	}
+}
 
-	env.Declare("int_add", TArrow2(intType, intType, intType))
-	env.Declare("int_and", TArrow2(intType, intType, intType))
-	env.Declare("short_add", TArrow2(shortType, shortType, shortType))
-	env.Declare("short_and", TArrow2(shortType, shortType, shortType))
-	env.Declare("float_add", TArrow2(floatType, floatType, floatType))
-	env.Declare("vec_add", TArrow2(adderVecType, adderVecType, adderVecType))
-	env.Declare("int_vec_add", TArrow2(intVecType, intVecType, intVecType))
-	env.Declare("bad_bool_add", TArrow2(boolType, intType, boolType))
+func TestInstantiationSources(t *testing.T) {
+	env := NewTypeEnv(nil)
+	ctx := NewContext()
 
-	if _, err := env.DeclareInstance(Int, intType, map[string]string{"+": "int_add", "&": "int_and"}); err != nil {
+	a, r := env.NewGenericVar(), env.NewGenericVar()
+	params := []*types.Var{env.NewGenericVar()}
+	list := env.NewSimpleRecursive(params, func(rec *types.Recursive, self *types.RecursiveLink) {
+		a := rec.Params[0]
+		rec.AddType("list", TAlias(TApp(TConst("list"), a),
+			TRecordFlat(map[string]types.Type{"head": a, "tail": self})))
+	})
+	listA := list.WithParams(env, a).GetType("list")
+	record := TRecord(TRowExtend(r, TypeMap(map[string]types.Type{"x": a})))
+	variant := TVariant(TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"y": a})))
+	fn := TArrow3(record, variant, listA, a)
+	env.Declare("f", fn)
+
+	// The instantiated type of a variable references the declared scheme:
+	expr := Var("f")
+	if err := ctx.AnnotateDirect(expr, env); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := env.DeclareInstance(Int, shortType, map[string]string{"+": "short_add", "&": "short_and"}); err != nil {
-		t.Fatal(err)
+	inst := expr.Type().(*types.Arrow)
+	if inst == fn || inst.Source != fn {
+		t.Fatalf("expected the instantiated arrow to reference the generalized arrow")
 	}
-	if _, err := env.DeclareInstance(Add, floatType, map[string]string{"+": "float_add"}); err != nil {
-		t.Fatal(err)
+	if rec := inst.Args[0].(*types.Record); rec.Source != record || rec.Row.(*types.RowExtend).Source != record.Row {
+		t.Fatalf("expected the instantiated record to reference the generalized record")
 	}
-	if _, err := env.DeclareInstance(Add, adderVecType, map[string]string{"+": "vec_add"}); err != nil {
-		t.Fatal(err)
+	if v := inst.Args[1].(*types.Variant); v.Source != variant || v.Row.(*types.RowExtend).Source != variant.Row {
+		t.Fatalf("expected the instantiated variant to reference the generalized variant")
 	}
-	// detect overlapping instances:
-	if _, err := env.DeclareInstance(Add, intVecType, map[string]string{"+": "int_vec_add"}); err == nil {
-		t.Fatalf("expected instance-overlap error")
+	app := inst.Args[2].(*types.App)
+	if app.Source != listA {
+		t.Fatalf("expected the instantiated type-application to reference the generalized type-application")
 	}
-
-	env.Declare("somebool", boolType)
-	env.Declare("someint", intType)
-	env.Declare("someshort", shortType)
-	env.Declare("somefloat", floatType)
-	env.Declare("someintvec", TApp(TConst("vec"), intType))
-	env.Declare("somefloatvec", TApp(TConst("vec"), floatType))
-	env.Declare("someboolvec", TApp(TConst("vec"), boolType))
-
-	// method-instance lookups
-
-	call := Call(Var("+"), Var("someint"), Var("someint"))
-	if err = ctx.AnnotateDirect(call, env); err != nil {
-		t.Fatal(err)
+	link := app.Underlying.(*types.Record).Row.(*types.RowExtend).Labels
+	if tail, ok := link.Get("tail"); !ok || tail.Get(0).(*types.RecursiveLink).Source == nil {
+		t.Fatalf("expected the instantiated recursive type to reference the generalized recursive type")
 	}
-	if types.TypeString(call.Type()) != "int" {
-		t.Fatalf("expected int return, found " + types.TypeString(call.Type()))
+	if listA.Underlying.(*types.Record).Row.(*types.RowExtend).Labels.Len() != 2 {
+		t.Fatalf("expected the generalized type to be unmodified")
 	}
+}
 
-	method := call.FuncType().Method
-	if method == nil || method.Name != "+" || method.TypeClass != Add {
-		t.Fatalf("no method annotated on call or method = %#+v", call.FuncType())
-	}
-	methodInstance := env.FindMethodInstance(call.FuncType())
-	if methodInstance == nil {
-		t.Fatal("no method instance found")
+func TestConstNames(t *testing.T) {
+	env := NewTypeEnv(nil)
+
+	a := env.NewGenericVar()
+	ty := TArrow2(
+		TRecordFlat(map[string]types.Type{"id": TConst("int"), "name": TApp(TConst("option"), TConst("string")), "x": a}),
+		TVariant(TRowExtend(TRowEmpty(), TypeMap(map[string]types.Type{"ok": TConst("int"), "err": TConst("error")}))),
+		TTuple(TConst("bool"), TArrow1(a, TConst("string"))))
+	if names := types.ConstNames(ty); !reflect.DeepEqual(names, []string{"bool", "error", "int", "option", "string"}) {
+		t.Fatalf("unexpected constant names: %v", names)
 	}
-	if types.TypeString(methodInstance.Param) != "int" {
-		t.Fatalf("expected int instance, found %s", types.TypeString(methodInstance.Param))
+
+	// Recursive types are visited once:
+	params := []*types.Var{env.NewGenericVar()}
+	list := env.NewSimpleRecursive(params, func(rec *types.Recursive, self *types.RecursiveLink) {
+		a := rec.Params[0]
+		rec.AddType("list", TAlias(TApp(TConst("list"), a),
+			TRecordFlat(map[string]types.Type{"head": a, "tail": self})))
+	})
+	link := &types.RecursiveLink{Recursive: list, Index: 0}
+	if names := types.ConstNames(TArrow1(link, TConst("int"))); !reflect.DeepEqual(names, []string{"int", "list"}) {
+		t.Fatalf("unexpected constant names: %v", names)
 	}
-	if methodInstance.MethodNames["+"] != "int_add" {
-		t.Fatalf("expected int_add, found %s", methodInstance.MethodNames["+"])
+	if names := types.ConstNames(a); len(names) != 0 {
+		t.Fatalf("unexpected constant names: %v", names)
 	}
+}
 
-	// method/instance inference
-
-	var addWrapper ast.Expr = Func2("x", "y", Call(Var("+"), Var("x"), Var("y")))
-	mustInfer(t, env, ctx, addWrapper, "Add 'a => ('a, 'a) -> 'a")
-
-	var expr ast.Expr = Call(addWrapper, Var("someint"), Var("someint"))
-	mustInfer(t, env, ctx, expr, "int")
-
-	expr = Call(addWrapper, Var("someshort"), Var("someshort"))
-	mustInfer(t, env, ctx, expr, "short")
-
-	expr = Call(addWrapper, Var("somefloat"), Var("somefloat"))
-	mustInfer(t, env, ctx, expr, "float")
+func TestTypeSize(t *testing.T) {
+	env := NewTypeEnv(nil)
 
-	expr = Call(addWrapper, Var("someint"), Var("somefloat"))
-	if _, err := ctx.Infer(expr, env); err == nil {
-		t.Fatalf("expected constraint error")
+	// 'a -> ('a -> ('a -> ...)):
+	a := env.NewGenericVar()
+	var arrow types.Type = a
+	for i := 0; i < 100; i++ {
+		arrow = TArrow1(a, arrow)
+	}
+	if n := types.TypeSize(arrow); n != 201 {
+		t.Fatalf("expected nested arrow size 201, found %d", n)
 	}
 
-	expr = Call(addWrapper, Var("somebool"), Var("somebool"))
-	if _, err := ctx.Infer(expr, env); err == nil {
-		t.Fatalf("expected constraint error")
+	// Links are followed:
+	tv := env.NewVar(1)
+	tv.SetLink(arrow)
+	if n := types.TypeSize(TArrow1(tv, TConst("int"))); n != 203 {
+		t.Fatalf("expected linked arrow size 203, found %d", n)
 	}
 
-	expr = Call(addWrapper, Var("someintvec"), Var("someintvec"))
-	mustInfer(t, env, ctx, expr, "vec[int]")
+	// Recursive types are counted once:
+	params := []*types.Var{env.NewGenericVar()}
+	list := env.NewSimpleRecursive(params, func(rec *types.Recursive, self *types.RecursiveLink) {
+		a := rec.Params[0]
+		rec.AddType("list", TAlias(TApp(TConst("list"), a),
+			TRecordFlat(map[string]types.Type{"head": a, "tail": self})))
+	})
+	link := &types.RecursiveLink{Recursive: list, Index: 0}
+	// link + param + list['a] + {head : 'a, tail : link}
+	if n := types.TypeSize(link); n != 10 {
+		t.Fatalf("expected recursive list size 10, found %d", n)
+	}
+	if n := types.TypeSize(TArrow1(link, link)); n != 12 {
+		t.Fatalf("expected recursive list function size 12, found %d", n)
+	}
+}
 
-	expr = Call(addWrapper, Var("somefloatvec"), Var("somefloatvec"))
-	mustInfer(t, env, ctx, expr, "vec[float]")
+func TestSubstitute(t *testing.T) {
+	env := NewTypeEnv(nil)
 
-	expr = Call(addWrapper, Var("someboolvec"), Var("someboolvec"))
-	if _, err := ctx.Infer(expr, env); err == nil {
-		t.Fatalf("expected constraint error")
+	a, b := env.NewGenericVar(), env.NewGenericVar()
+	identity := TArrow1(a, a)
+	specialized := types.Substitute(identity, map[uint]types.Type{a.Id(): TConst("int")})
+	if types.TypeString(specialized) != "int -> int" {
+		t.Fatalf("unexpected substituted type: %s", types.TypeString(specialized))
+	}
+	if specialized.IsGeneric() {
+		t.Fatalf("expected substituted type to be non-generic")
+	}
+	if types.TypeString(identity) != "'a -> 'a" {
+		t.Fatalf("expected original type to be preserved, found %s", types.TypeString(identity))
 	}
 
-	expr = Call(Var("&"), Var("someint"), Var("someint"))
-	mustInfer(t, env, ctx, expr, "int")
-
-	expr = Call(Var("&"), Var("someshort"), Var("someshort"))
-	mustInfer(t, env, ctx, expr, "short")
+	// Rows and unmapped type-variables:
 
-	expr = Call(Var("&"), Var("somebool"), Var("somebool"))
-	if _, err := ctx.Infer(expr, env); err == nil {
-		t.Fatalf("expected constraint error")
+	record := TRecord(TRowExtend(b, TypeMap(map[string]types.Type{"x": a, "y": TArrow1(b, a)})))
+	specialized = types.Substitute(record, map[uint]types.Type{a.Id(): TConst("int")})
+	if types.TypeString(specialized) != "{x : int, y : 'a -> int | 'a}" {
+		t.Fatalf("unexpected substituted type: %s", types.TypeString(specialized))
 	}
-
-	expr = Call(Var("&"), Var("someint"), Var("someshort"))
-	_, err = ctx.Infer(expr, env)
-	if _, err := ctx.Infer(expr, env); err == nil {
-		t.Fatalf("expected constraint error")
+	if types.Substitute(record, map[uint]types.Type{env.NewGenericVar().Id(): TConst("int")}) != record {
+		t.Fatalf("expected unchanged type to be shared")
 	}
 
-	addWrapper = Func1("x", Call(Var("+"), Var("x"), Var("someint")))
-	mustInfer(t, env, ctx, addWrapper, "int -> int")
-
-	// instance validation
+	// Recursive types:
 
-	if _, err := env.DeclareInstance(Int, boolType, map[string]string{"&": "bool_and"}); err == nil {
-		t.Fatalf("expected missing-method error")
+	params := []*types.Var{env.NewGenericVar()}
+	list := env.NewSimpleRecursive(params, func(rec *types.Recursive, self *types.RecursiveLink) {
+		a := rec.Params[0]
+		rec.AddType("list", TAlias(TApp(TConst("list"), a),
+			TRecordFlat(map[string]types.Type{"head": a, "tail": self})))
+	})
+	listA := list.WithParams(env, a).GetType("list")
+	specialized = types.Substitute(listA.Underlying, map[uint]types.Type{a.Id(): TConst("int")})
+	if types.TypeString(specialized) != "{head : int, tail : list[int]}" {
+		t.Fatalf("unexpected substituted type: %s", types.TypeString(specialized))
 	}
-	if _, err := env.DeclareInstance(Add, boolType, map[string]string{"+": "bad_bool_add"}); err == nil {
-		t.Fatalf("expected invalid-method error")
+	// Substituted parameters of recursive types are the only type-variables linked by substitution:
+	tails, _ := types.RealType(specialized).(*types.Record).Row.(*types.RowExtend).Labels.Get("tail")
+	tail := tails.Get(0).(*types.RecursiveLink)
+	if param := tail.Recursive.Params[0]; !param.IsLinkVar() || types.TypeString(param.Link()) != "int" {
+		t.Fatalf("expected the substituted parameter to be linked to int")
 	}
+
+	// Recursive types without a Bind function cannot be substituted:
+	unbound := *tail.Recursive.Source
+	unbound.Bind = nil
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected substitution of an unbound recursive type to panic")
+			}
+		}()
+		types.Substitute(&types.RecursiveLink{Recursive: &unbound}, map[uint]types.Type{unbound.Params[0].Id(): TConst("int")})
+	}()
 }
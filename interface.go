@@ -0,0 +1,70 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package poly
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/wdamron/poly/internal/typeutil"
+	"github.com/wdamron/poly/types"
+)
+
+// Check the inferred types of a module's top-level definitions against a declared interface.
+//
+// The type of each implementation must be at least as general as its declared type; generic type-variables within
+// declared types are treated as rigid. Declared names without an implementation and implementations which are not
+// declared within the interface will be reported. Errors are ordered by name.
+func CheckInterface(defs map[string]types.Type, impls map[string]types.Type) []error {
+	var ctx typeutil.CommonContext
+	ctx.Init()
+	names := make([]string, 0, len(defs)+len(impls))
+	for name := range defs {
+		names = append(names, name)
+	}
+	for name := range impls {
+		if _, ok := defs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		def, declared := defs[name]
+		impl, implemented := impls[name]
+		switch {
+		case !implemented:
+			errs = append(errs, errors.New("Missing implementation for "+name+" : "+types.TypeString(def)))
+		case !declared:
+			errs = append(errs, errors.New("Implementation for "+name+" is not declared within the interface"))
+		case types.AlphaEqual(def, impl):
+		default:
+			if err := ctx.Subsumes(impl, def); err != nil {
+				errs = append(errs, errors.New("Implementation for "+name+" : "+types.TypeString(impl)+
+					" does not match the declared type "+types.TypeString(def)+": "+err.Error()))
+			}
+		}
+	}
+	return errs
+}
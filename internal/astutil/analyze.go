@@ -24,6 +24,8 @@ package astutil
 
 import (
 	"errors"
+	"strconv"
+	"strings"
 
 	"github.com/wdamron/poly/ast"
 	"github.com/wdamron/poly/internal/util"
@@ -34,9 +36,21 @@ type StashedScope struct {
 	GroupNum int
 }
 
+// Variable binding, tracked for detection of unused bindings
+type Binding struct {
+	Name     string
+	Expr     ast.Expr // binding expression
+	used     bool
+	report   bool
+	defining bool // set while the bound value is analyzed, so self-references are not counted as uses
+	hidden   bool // set while a value which shadows an enclosing binding is analyzed, so self-references resolve to it
+}
+
 type Graph struct {
+	Expr  ast.Expr // grouping expression (LetGroup or Where)
 	Verts map[string]int
 	Edges util.Graph
+	Vars  []ast.LetBinding
 }
 
 func (g *Graph) addVert(name string) bool {
@@ -66,6 +80,10 @@ type Analysis struct {
 	SCC         [][][]int      // indexed by let-group number
 	Err         error
 	Invalid     ast.Expr
+	TrackUnused bool      // track unused variables bound by let-bindings, let-groups, and functions
+	StrictPipes bool      // require each step of a pipeline to reference the placeholder
+	Bindings    []Binding // stack of bound variables (if TrackUnused or StrictPipes is set)
+	Unused      []Binding // unused bindings (if TrackUnused is set)
 
 	// initial space:
 	_scopeStash  [16]StashedScope
@@ -98,6 +116,7 @@ func (a *Analysis) Reset() {
 	}
 	a.ScopeStash, a.Graphs, a.CurrentVert, a.SCC, a.Err, a.Invalid =
 		a._scopeStash[:0], a._graphs[:0], a._currentVert[:0], a._sccs[:0], nil, nil
+	a.Bindings, a.Unused = a.Bindings[:0], nil
 }
 
 func (a *Analysis) Analyze(root ast.Expr) error {
@@ -113,6 +132,33 @@ func (a *Analysis) Analyze(root ast.Expr) error {
 	}
 	for groupNum := range a.Graphs {
 		a.SCC[groupNum] = a.Graphs[groupNum].Edges.SCC()
+		if err := a.checkRecursiveValues(groupNum); err != nil {
+			a.Err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// Ensure all recursive bindings within a let-group are functions. A binding is recursive if it references itself
+// directly, or if it belongs to a strongly-connected component with more than one binding.
+func (a *Analysis) checkRecursiveValues(groupNum int) error {
+	graph := &a.Graphs[groupNum]
+	for _, scc := range a.SCC[groupNum] {
+		if len(scc) == 1 && !graph.Edges.HasEdge(scc[0], scc[0]) {
+			continue
+		}
+		for _, bindNum := range scc {
+			v := graph.Vars[bindNum]
+			if ast.IsFunc(v.Value) {
+				continue
+			}
+			a.Invalid = v.Value
+			if len(scc) == 1 {
+				return errors.New("Recursive binding " + v.Var + " within let-group is not a function")
+			}
+			return errors.New("Mutually recursive binding " + v.Var + " within let-group is not a function")
+		}
 	}
 	return nil
 }
@@ -138,10 +184,77 @@ func (a *Analysis) unstash(count int) {
 	a.ScopeStash = a.ScopeStash[0 : len(stash)-unstashed]
 }
 
+// Check if uses of bound variables are tracked.
+func (a *Analysis) tracking() bool { return a.TrackUnused || a.StrictPipes }
+
+// Push a bound variable, if uses are tracked. Unused bindings will be reported if report is set.
+func (a *Analysis) bind(name string, expr ast.Expr, report bool) {
+	if a.tracking() {
+		a.Bindings = append(a.Bindings, Binding{Name: name, Expr: expr, report: report})
+	}
+}
+
+// Pop bound variables, if uses are tracked. Names with a leading underscore are never reported.
+func (a *Analysis) unbind(count int) {
+	if !a.tracking() {
+		return
+	}
+	n := len(a.Bindings)
+	for _, b := range a.Bindings[n-count:] {
+		if a.TrackUnused && b.report && !b.used && !strings.HasPrefix(b.Name, "_") {
+			a.Unused = append(a.Unused, b)
+		}
+	}
+	a.Bindings = a.Bindings[:n-count]
+}
+
+// Mark the innermost binding of a variable as used, if uses are tracked.
+func (a *Analysis) use(name string) {
+	if !a.tracking() {
+		return
+	}
+	for i := len(a.Bindings) - 1; i >= 0; i-- {
+		if a.Bindings[i].Name == name {
+			if a.Bindings[i].hidden {
+				continue
+			}
+			if !a.Bindings[i].defining {
+				a.Bindings[i].used = true
+			}
+			return
+		}
+	}
+}
+
+// Mark the binding at offset from the top of the stack as being defined (or not), if uses are tracked.
+func (a *Analysis) defining(offset int, defining bool) {
+	if a.tracking() {
+		a.Bindings[len(a.Bindings)-1-offset].defining = defining
+	}
+}
+
+// Mark the binding at offset from the top of the stack as being hidden (or not), if uses are tracked.
+func (a *Analysis) hidden(offset int, hidden bool) {
+	if a.tracking() {
+		a.Bindings[len(a.Bindings)-1-offset].hidden = hidden
+	}
+}
+
+// Returns the scope of the binding for name shadowed by the last count stashed scopes, if any.
+func (a *Analysis) shadowed(name string, count int) (int, bool) {
+	for i := len(a.ScopeStash) - 1; count > 0 && i >= 0; i, count = i-1, count-1 {
+		if a.ScopeStash[i].Name == name {
+			return a.ScopeStash[i].GroupNum, true
+		}
+	}
+	return 0, false
+}
+
 func (a *Analysis) analyzeExpr(expr ast.Expr) error {
 	switch expr := expr.(type) {
 	case *ast.Literal:
 		for _, name := range expr.Using {
+			a.use(name)
 			if groupNum, ok := a.Scopes[name]; ok && groupNum >= 0 {
 				graph := &a.Graphs[groupNum]
 				if a.CurrentVert[groupNum] >= 0 {
@@ -151,6 +264,7 @@ func (a *Analysis) analyzeExpr(expr ast.Expr) error {
 		}
 
 	case *ast.Var:
+		a.use(expr.Name)
 		if groupNum, ok := a.Scopes[expr.Name]; ok && groupNum >= 0 {
 			graph := &a.Graphs[groupNum]
 			if a.CurrentVert[groupNum] >= 0 {
@@ -177,10 +291,17 @@ func (a *Analysis) analyzeExpr(expr ast.Expr) error {
 		}
 		stashed := a.stash(expr.As)
 		a.Scopes[expr.As] = -1
-		for _, sub := range expr.Sequence {
+		for i, sub := range expr.Sequence {
+			// The placeholder is rebound for each step:
+			a.bind(expr.As, expr, false)
 			if err := a.analyzeExpr(sub); err != nil {
 				return err
 			}
+			if a.StrictPipes && !a.Bindings[len(a.Bindings)-1].used {
+				a.Invalid = sub
+				return errors.New("Step " + strconv.Itoa(i) + " of pipeline does not use the placeholder " + expr.As)
+			}
+			a.unbind(1)
 		}
 		delete(a.Scopes, expr.As)
 		a.unstash(stashed)
@@ -190,6 +311,7 @@ func (a *Analysis) analyzeExpr(expr ast.Expr) error {
 		for _, local := range expr.Locals {
 			stashed += a.stash(local)
 			a.Scopes[local] = -1
+			a.bind(local, expr, false)
 		}
 		for _, sub := range expr.Entry.Sequence {
 			if err := a.analyzeExpr(sub); err != nil {
@@ -208,6 +330,7 @@ func (a *Analysis) analyzeExpr(expr ast.Expr) error {
 				}
 			}
 		}
+		a.unbind(len(expr.Locals))
 		for _, local := range expr.Locals {
 			delete(a.Scopes, local)
 		}
@@ -228,95 +351,117 @@ func (a *Analysis) analyzeExpr(expr ast.Expr) error {
 		for _, name := range expr.ArgNames {
 			stashed += a.stash(name)
 			a.Scopes[name] = -1
+			a.bind(name, expr, true)
 		}
 		if err := a.analyzeExpr(expr.Body); err != nil {
 			return err
 		}
+		a.unbind(len(expr.ArgNames))
 		for _, name := range expr.ArgNames {
 			delete(a.Scopes, name)
 		}
 		a.unstash(stashed)
 
+	case *ast.Fix:
+		if expr.Func != nil {
+			if err := a.analyzeExpr(expr.Func); err != nil {
+				return err
+			}
+		}
+
 	case *ast.Let:
 		stashed := 0
-		_, isFunc := expr.Value.(*ast.Func)
+		isFunc := ast.IsFunc(expr.Value)
 		// Allow self-references within function types:
 		if isFunc {
 			stashed = a.stash(expr.Var)
 			a.Scopes[expr.Var] = -1
+			a.bind(expr.Var, expr, true)
+			a.defining(0, true)
 		}
 		if err := a.analyzeExpr(expr.Value); err != nil {
 			return err
 		}
-		if !isFunc {
+		if isFunc {
+			a.defining(0, false)
+		} else {
 			stashed = a.stash(expr.Var)
 			a.Scopes[expr.Var] = -1
+			a.bind(expr.Var, expr, true)
 		}
 		if err := a.analyzeExpr(expr.Body); err != nil {
 			return err
 		}
+		a.unbind(1)
 		delete(a.Scopes, expr.Var)
 		a.unstash(stashed)
 
 	case *ast.LetGroup:
-		num := len(a.Graphs)
-		a.Graphs = append(a.Graphs, Graph{
-			Verts: make(map[string]int, len(expr.Vars)),
-			Edges: util.NewGraph(len(expr.Vars)),
-		})
-		a.CurrentVert = append(a.CurrentVert, -1)
-		graph := &a.Graphs[num]
-		stashed := 0
-		for _, v := range expr.Vars {
-			if !graph.addVert(v.Var) {
-				a.Invalid = expr
-				return errors.New("Found duplicate bindings for " + v.Var + " within let-group")
-			}
-			stashed += a.stash(v.Var)
-			a.Scopes[v.Var] = num
+		if err := a.analyzeLetGroup(expr, expr.Vars, expr.Body); err != nil {
+			return err
 		}
-		for i, v := range expr.Vars {
-			a.CurrentVert[num] = i
-			// Allow self-references within function types:
-			if _, isFunc := v.Value.(*ast.Func); isFunc {
-				if err := a.analyzeExpr(v.Value); err != nil {
-					return err
-				}
-				continue
-			}
-			// Disallow self-references within non-function types:
-			exists := false
-			for i := 0; i < stashed; i++ {
-				existing := a.ScopeStash[len(a.ScopeStash)-(1+i)]
-				if existing.Name == v.Var {
-					a.Scopes[v.Var] = existing.GroupNum
-					exists = true
-					break
-				}
-			}
-			if !exists {
-				delete(a.Scopes, v.Var)
-			}
-			if err := a.analyzeExpr(v.Value); err != nil {
+
+	case *ast.Where:
+		if err := a.analyzeLetGroup(expr, expr.Vars, expr.Body); err != nil {
+			return err
+		}
+
+	case *ast.RecordSelect:
+		if err := a.analyzeExpr(expr.Record); err != nil {
+			return err
+		}
+
+	case *ast.FieldPath:
+		if err := a.analyzeExpr(expr.Record); err != nil {
+			return err
+		}
+
+	case *ast.OptionChain:
+		if err := a.analyzeExpr(expr.Expr); err != nil {
+			return err
+		}
+
+	case *ast.Try:
+		if err := a.analyzeExpr(expr.Expr); err != nil {
+			return err
+		}
+
+	case *ast.Signature:
+		if err := a.analyzeExpr(expr.Value); err != nil {
+			return err
+		}
+
+	case *ast.EqualityConstraint:
+		if err := a.analyzeExpr(expr.Body); err != nil {
+			return err
+		}
+
+	case *ast.TypeAbstraction:
+		if err := a.analyzeExpr(expr.Body); err != nil {
+			return err
+		}
+
+	case *ast.WithInstance:
+		for _, name := range expr.MethodNames() {
+			if err := a.analyzeExpr(expr.Methods[name]); err != nil {
 				return err
 			}
-			a.Scopes[v.Var] = num
 		}
-		a.CurrentVert[num] = -1
 		if err := a.analyzeExpr(expr.Body); err != nil {
 			return err
 		}
-		for _, v := range expr.Vars {
-			delete(a.Scopes, v.Var)
-		}
-		a.unstash(stashed)
 
-	case *ast.RecordSelect:
+	case *ast.RecordExtend:
 		if err := a.analyzeExpr(expr.Record); err != nil {
 			return err
 		}
+		for _, label := range expr.Labels {
+			if err := a.analyzeExpr(label.Value); err != nil {
+				return err
+			}
+		}
 
-	case *ast.RecordExtend:
+	case *ast.RecordUpdate:
 		if err := a.analyzeExpr(expr.Record); err != nil {
 			return err
 		}
@@ -331,40 +476,127 @@ func (a *Analysis) analyzeExpr(expr ast.Expr) error {
 			return err
 		}
 
-	case *ast.RecordEmpty:
+	case *ast.RecordMerge:
+		if err := a.analyzeExpr(expr.Left); err != nil {
+			return err
+		}
+		if err := a.analyzeExpr(expr.Right); err != nil {
+			return err
+		}
+
+	case *ast.RecordEmpty, *ast.Hole:
 		// nothing to check
 
+	case *ast.SizedArrayLit:
+		for _, elem := range expr.Elems {
+			if err := a.analyzeExpr(elem); err != nil {
+				return err
+			}
+		}
+
+	case *ast.TupleLit:
+		for _, elem := range expr.Elems {
+			if err := a.analyzeExpr(elem); err != nil {
+				return err
+			}
+		}
+
 	case *ast.Variant:
 		if err := a.analyzeExpr(expr.Value); err != nil {
 			return err
 		}
 
+	case *ast.VariantN:
+		for _, value := range expr.Values {
+			if err := a.analyzeExpr(value); err != nil {
+				return err
+			}
+		}
+
 	case *ast.Match:
 		if err := a.analyzeExpr(expr.Value); err != nil {
 			return err
 		}
 		for _, c := range expr.Cases {
-			stashed := a.stash(c.Var)
-			a.Scopes[c.Var] = -1
+			name := c.BoundVar()
+			stashed := a.stash(name)
+			a.Scopes[name] = -1
+			a.bind(name, expr, false)
 			if err := a.analyzeExpr(c.Value); err != nil {
 				return err
 			}
-			delete(a.Scopes, c.Var)
+			a.unbind(1)
+			delete(a.Scopes, name)
 			a.unstash(stashed)
 		}
 		if expr.Default != nil {
 			c := expr.Default
 			stashed := a.stash(c.Var)
 			a.Scopes[c.Var] = -1
+			a.bind(c.Var, expr, false)
 			if err := a.analyzeExpr(c.Value); err != nil {
 				return err
 			}
+			a.unbind(1)
 			delete(a.Scopes, c.Var)
 			a.unstash(stashed)
 		}
 
+	case *ast.MatchTuple:
+		if err := a.analyzeExpr(expr.Value); err != nil {
+			return err
+		}
+		stashed := 0
+		vars := expr.Pattern.Vars()
+		for _, name := range vars {
+			stashed += a.stash(name)
+			a.Scopes[name] = -1
+			a.bind(name, expr, false)
+		}
+		if err := a.analyzeExpr(expr.Body); err != nil {
+			return err
+		}
+		a.unbind(len(vars))
+		for _, name := range vars {
+			delete(a.Scopes, name)
+		}
+		a.unstash(stashed)
+
+	case *ast.MatchRecord:
+		if err := a.analyzeExpr(expr.Value); err != nil {
+			return err
+		}
+		stashed := 0
+		vars := expr.Pattern.Vars()
+		for _, name := range vars {
+			stashed += a.stash(name)
+			a.Scopes[name] = -1
+			a.bind(name, expr, false)
+		}
+		if err := a.analyzeExpr(expr.Body); err != nil {
+			return err
+		}
+		a.unbind(len(vars))
+		for _, name := range vars {
+			delete(a.Scopes, name)
+		}
+		a.unstash(stashed)
+
+	case *ast.Absurd:
+		if err := a.analyzeExpr(expr.Value); err != nil {
+			return err
+		}
+
+	case *ast.Compare:
+		if err := a.analyzeExpr(expr.Left); err != nil {
+			return err
+		}
+		if err := a.analyzeExpr(expr.Right); err != nil {
+			return err
+		}
+
 	case nil:
-		return errors.New("Failed to analyze nil expression")
+		// Missing sub-expressions are reported during inference.
 
 	default:
 		return errors.New("Failed to analyze " + expr.ExprName() + " expression")
@@ -372,3 +604,56 @@ func (a *Analysis) analyzeExpr(expr ast.Expr) error {
 
 	return nil
 }
+
+// Analyze grouped bindings (LetGroup or Where) which may be mutually-recursive.
+func (a *Analysis) analyzeLetGroup(expr ast.Expr, vars []ast.LetBinding, body ast.Expr) error {
+	num := len(a.Graphs)
+	a.Graphs = append(a.Graphs, Graph{
+		Expr:  expr,
+		Verts: make(map[string]int, len(vars)),
+		Edges: util.NewGraph(len(vars)),
+		Vars:  vars,
+	})
+	a.CurrentVert = append(a.CurrentVert, -1)
+	graph := &a.Graphs[num]
+	stashed := 0
+	for _, v := range vars {
+		if !graph.addVert(v.Var) {
+			a.Invalid = expr
+			return errors.New("Found duplicate bindings for " + v.Var + " within let-group")
+		}
+		stashed += a.stash(v.Var)
+		a.Scopes[v.Var] = num
+		a.bind(v.Var, expr, true)
+	}
+	for i, v := range vars {
+		a.CurrentVert[num] = i
+		// Within a value which is not a function, self-references resolve to the shadowed binding (as during inference):
+		if scope, ok := a.shadowed(v.Var, stashed); ok && !ast.IsFunc(v.Value) {
+			a.Scopes[v.Var] = scope
+			a.hidden(len(vars)-1-i, true)
+			if err := a.analyzeExpr(v.Value); err != nil {
+				return err
+			}
+			a.hidden(len(vars)-1-i, false)
+			a.Scopes[v.Var] = num
+			continue
+		}
+		// Self-references are recorded as edges; recursive bindings which are not functions are rejected after SCC analysis:
+		a.defining(len(vars)-1-i, true)
+		if err := a.analyzeExpr(v.Value); err != nil {
+			return err
+		}
+		a.defining(len(vars)-1-i, false)
+	}
+	a.CurrentVert[num] = -1
+	if err := a.analyzeExpr(body); err != nil {
+		return err
+	}
+	a.unbind(len(vars))
+	for _, v := range vars {
+		delete(a.Scopes, v.Var)
+	}
+	a.unstash(stashed)
+	return nil
+}
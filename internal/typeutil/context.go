@@ -23,10 +23,23 @@
 package typeutil
 
 import (
+	"errors"
+	"strconv"
+
 	"github.com/wdamron/poly/ast"
 	"github.com/wdamron/poly/types"
 )
 
+// External resolution of type-class instances, which returns implementations for each method of the type-class
+type InstanceResolver func(class *types.TypeClass, t types.Type) (methodImpls map[string]types.Type, ok bool)
+
+// User-defined unification of type-applications of an abstract type constant. If handled is false, the
+// type-applications will be unified structurally.
+type AbstractUnifier func(a, b *types.App) (handled bool, err error)
+
+// Observer of instance constraints which are resolved for a type during unification
+type ResolutionObserver func(c types.InstanceConstraint, instance types.Type)
+
 // Shadowed variables
 type StashedType struct {
 	Name string
@@ -47,6 +60,12 @@ type DeferredConstraint struct {
 	Expr ast.Expr
 }
 
+// Resolved instance constraint (during speculative unification)
+type resolvedConstraint struct {
+	c types.InstanceConstraint
+	t types.Type
+}
+
 type CommonContext struct {
 	VarTracker          VarTracker              // type-variables generated during inference
 	EnvStash            []StashedType           // shadowed variables
@@ -56,12 +75,25 @@ type CommonContext struct {
 	ScopeStack          []ast.Scope             // stack of nested binding scopes during inference
 	DeferredConstraints []DeferredConstraint    // deferred instance matching (when multiple instances match)
 	CurrentExpr         ast.Expr                // added to deferred constraints during unification for debugging
+	MaxRowWidth         int                     // maximum number of labels within a row (or 0 for no limit)
+	MaxInstanceDepth    int                     // maximum depth of recursive instance resolution (or 0 for the default depth)
+	InstanceResolver    InstanceResolver        // external instance resolution (consulted before declared instances)
+	AbstractUnifier     AbstractUnifier         // user-defined unification of applied abstract types
+	OnResolved          ResolutionObserver      // observer of resolved instance constraints (or nil)
+	Timer               *PhaseTimer             // wall-clock timing of inference phases (or nil if timing is disabled)
 
 	// modes:
 	Speculate                   bool // stash linked type-variables during unification
 	TrackScopes                 bool // track defining scopes for variables during inference
 	DeferredConstraintsEnabled  bool // allow deferred unification when multiple instances match
 	CheckingDeferredConstraints bool // prevent additional deferred constraints
+	StripWeakVars               bool // instantiate weak type-variables as non-weak type-variables
+	SkipOccursCheck             bool // link type-variables without checking for cycles (levels are still adjusted)
+
+	instanceDepth int   // current depth of recursive instance resolution
+	depthErr      error // depth-limit error, retained until the outermost instance resolution fails
+
+	resolvedStash []resolvedConstraint // resolved instance constraints (during speculative unification)
 
 	// initial space:
 	_envStash            [32]StashedType
@@ -81,7 +113,10 @@ func (ctx *CommonContext) Init() {
 
 func (ctx *CommonContext) Reset() {
 	ctx.VarTracker.Reset()
-	ctx.TrackScopes, ctx.DeferredConstraintsEnabled = false, false
+	ctx.TrackScopes, ctx.DeferredConstraintsEnabled, ctx.MaxRowWidth, ctx.InstanceResolver = false, false, 0, nil
+	ctx.AbstractUnifier, ctx.Timer, ctx.StripWeakVars = nil, nil, false
+	ctx.MaxInstanceDepth, ctx.instanceDepth, ctx.depthErr, ctx.SkipOccursCheck = 0, 0, nil, false
+	ctx.OnResolved, ctx.resolvedStash = nil, nil
 	for i := range ctx._envStash {
 		ctx._envStash[i] = StashedType{}
 	}
@@ -99,6 +134,55 @@ func (ctx *CommonContext) Reset() {
 	ctx.ResetScopeStack()
 }
 
+// Default maximum depth of recursive instance resolution; each instance with constrained type-parameters
+// resolves a sub-goal for each constraint, at the next depth.
+const DefaultMaxInstanceDepth = 64
+
+// Enter a nested instance resolution for the type-class tc, which fails if the maximum depth is exceeded.
+func (ctx *CommonContext) enterInstance(tc *types.TypeClass) error {
+	max := ctx.MaxInstanceDepth
+	if max <= 0 {
+		max = DefaultMaxInstanceDepth
+	}
+	if ctx.instanceDepth >= max {
+		if ctx.depthErr == nil {
+			ctx.depthErr = errors.New("Instance resolution for type-class " + tc.Name + " exceeded the maximum depth " + strconv.Itoa(max))
+		}
+		return ctx.depthErr
+	}
+	ctx.instanceDepth++
+	return nil
+}
+
+// Leave a nested instance resolution. The depth-limit error is cleared when the outermost resolution is left.
+func (ctx *CommonContext) leaveInstance() {
+	ctx.instanceDepth--
+	if ctx.instanceDepth == 0 {
+		ctx.depthErr = nil
+	}
+}
+
+// Notify the observer of a resolved instance constraint. Constraints resolved during speculative unification are
+// stashed until the outermost transaction is committed.
+func (ctx *CommonContext) constraintResolved(c types.InstanceConstraint, t types.Type) {
+	if ctx.OnResolved == nil {
+		return
+	}
+	if ctx.Speculate {
+		ctx.resolvedStash = append(ctx.resolvedStash, resolvedConstraint{c, t})
+		return
+	}
+	ctx.OnResolved(c, t)
+}
+
+// Check the number of labels within a row against the maximum row width.
+func (ctx *CommonContext) CheckRowWidth(width int) error {
+	if ctx.MaxRowWidth > 0 && width > ctx.MaxRowWidth {
+		return errors.New("Row width " + strconv.Itoa(width) + " exceeds the maximum row width " + strconv.Itoa(ctx.MaxRowWidth))
+	}
+	return nil
+}
+
 func (ctx *CommonContext) ClearInstantiationLookup() {
 	for k := range ctx.InstLookup {
 		delete(ctx.InstLookup, k)
@@ -33,6 +33,95 @@ func GeneralizeOpts(level uint, t types.Type, forceGeneralize, weak bool) types.
 	return t
 }
 
+// Create a recursive type or group of mutually-recursive types, generalizing the type-parameters and the types added
+// by bind. Params will not be modified.
+func NewRecursive(params []*types.Var, bind func(recursive *types.Recursive)) *types.Recursive {
+	rec := &types.Recursive{Params: make([]*types.Var, len(params)), Bind: bind, Flags: types.NeedsGeneralization}
+	for i, tv := range params {
+		rec.Params[i] = GeneralizeOpts(types.TopLevel, tv, false, false).(*types.Var)
+	}
+	bind(rec)
+	for i, alias := range rec.Types {
+		rec.Types[i] = GeneralizeOpts(types.TopLevel, alias, false, false).(*types.App)
+	}
+	return rec
+}
+
+// Find the weak type-variable with the lowest id within t which would be generalized at level, or nil if t does
+// not contain such a type-variable.
+func FindGeneralizableWeakVar(level uint, t types.Type) *types.Var {
+	vars := make(map[uint]*types.Var)
+	collectUnboundVars(t, vars)
+	var found *types.Var
+	for _, tv := range vars {
+		if tv.IsWeakVar() && tv.LevelNum() > level && (found == nil || tv.Id() < found.Id()) {
+			found = tv
+		}
+	}
+	return found
+}
+
+// Check if t does not contain any (unbound, weak, or generic) type-variables.
+func IsGround(t types.Type) bool {
+	switch t := t.(type) {
+	case *types.Var:
+		if t.IsLinkVar() {
+			return IsGround(t.Link())
+		}
+		return false
+
+	case *types.RecursiveLink:
+		for _, param := range t.Recursive.Params {
+			if !IsGround(param) {
+				return false
+			}
+		}
+
+	case *types.App:
+		if !IsGround(t.Const) || (t.Underlying != nil && !IsGround(t.Underlying)) {
+			return false
+		}
+		for _, param := range t.Params {
+			if !IsGround(param) {
+				return false
+			}
+		}
+
+	case *types.Arrow:
+		for _, arg := range t.Args {
+			if !IsGround(arg) {
+				return false
+			}
+		}
+		return IsGround(t.Return)
+
+	case *types.Tuple:
+		for _, elem := range t.Elems {
+			if !IsGround(elem) {
+				return false
+			}
+		}
+
+	case *types.Record:
+		return IsGround(t.Row)
+
+	case *types.Variant:
+		return IsGround(t.Row)
+
+	case *types.RowExtend:
+		ground := true
+		t.Labels.Range(func(label string, ts types.TypeList) bool {
+			ts.Range(func(i int, t types.Type) bool {
+				ground = IsGround(t)
+				return ground
+			})
+			return ground
+		})
+		return ground && IsGround(t.Row)
+	}
+	return true
+}
+
 func visitTypeVars(level uint, t types.Type, forceGeneralize, weak bool) (tf types.TypeFlags) {
 	switch t := t.(type) {
 	case *types.Unit:
@@ -112,6 +201,13 @@ func visitTypeVars(level uint, t types.Type, forceGeneralize, weak bool) (tf typ
 		tf |= visitTypeVars(level, t.Return, forceGeneralize, weak)
 		t.Flags |= tf
 
+	case *types.Tuple:
+		for i, elem := range t.Elems {
+			t.Elems[i] = types.RealType(elem)
+			tf |= visitTypeVars(level, t.Elems[i], forceGeneralize, weak)
+		}
+		t.Flags |= tf
+
 	case *types.Record:
 		t.Row = types.RealType(t.Row)
 		tf |= visitTypeVars(level, t.Row, forceGeneralize, weak)
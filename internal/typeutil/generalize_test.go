@@ -0,0 +1,44 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package typeutil_test
+
+import (
+	"testing"
+
+	. "github.com/wdamron/poly/construct"
+	"github.com/wdamron/poly/internal/typeutil"
+	"github.com/wdamron/poly/types"
+)
+
+func TestIsGround(t *testing.T) {
+	if !typeutil.IsGround(TRecordFlat(map[string]types.Type{"a": TConst("int"), "b": TConst("bool")})) {
+		t.Fatalf("expected record without type-variables to be ground")
+	}
+	// Each label is checked, not only the first:
+	if typeutil.IsGround(TRecordFlat(map[string]types.Type{"a": TConst("int"), "b": TVar(0, 0)})) {
+		t.Fatalf("expected record with a type-variable in the second label not to be ground")
+	}
+	if typeutil.IsGround(TRecordFlat(map[string]types.Type{"a": TVar(0, 0), "b": TConst("int")})) {
+		t.Fatalf("expected record with a type-variable in the first label not to be ground")
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"github.com/wdamron/poly/types"
 )
 
+// Instantiate t at the given level. Copied composite types record the generic types they were copied from
+// as their Source.
 func (ctx *CommonContext) Instantiate(level uint, t types.Type) types.Type {
 	// Path compression:
 	t = types.RealType(t)
@@ -33,11 +35,39 @@ func (ctx *CommonContext) Instantiate(level uint, t types.Type) types.Type {
 	if !t.IsGeneric() {
 		return t
 	}
-	t = ctx.visitInstantiate(level, t)
+	if ctx.Timer != nil {
+		ctx.Timer.Enter(PhaseInstantiation)
+		t = ctx.visitInstantiate(level, t)
+		ctx.Timer.Leave()
+	} else {
+		t = ctx.visitInstantiate(level, t)
+	}
 	ctx.ClearInstantiationLookup()
 	return t
 }
 
+// Instantiate t, returning the substitution from the ids of generic type-variables within t to the fresh
+// type-variables which replace them. The substitution is empty if t is not generic.
+func (ctx *CommonContext) InstantiateWithSubst(level uint, t types.Type) (types.Type, map[uint]*types.Var) {
+	t = types.RealType(t)
+	if !t.IsGeneric() {
+		return t, map[uint]*types.Var{}
+	}
+	if ctx.Timer != nil {
+		ctx.Timer.Enter(PhaseInstantiation)
+		t = ctx.visitInstantiate(level, t)
+		ctx.Timer.Leave()
+	} else {
+		t = ctx.visitInstantiate(level, t)
+	}
+	subst := make(map[uint]*types.Var, len(ctx.InstLookup))
+	for id, tv := range ctx.InstLookup {
+		subst[id] = tv
+	}
+	ctx.ClearInstantiationLookup()
+	return t, subst
+}
+
 func (ctx *CommonContext) visitInstantiate(level uint, t types.Type) types.Type {
 	// Path compression:
 	t = types.RealType(t)
@@ -55,7 +85,7 @@ func (ctx *CommonContext) visitInstantiate(level uint, t types.Type) types.Type
 		}
 		next := ctx.VarTracker.New(level)
 		next.Restrict(t.Level())
-		if t.IsWeakVar() {
+		if t.IsWeakVar() && !ctx.StripWeakVars {
 			next.SetWeak()
 		}
 		constraints := t.Constraints()
@@ -109,6 +139,13 @@ func (ctx *CommonContext) visitInstantiate(level uint, t types.Type) types.Type
 		}
 		return &types.Arrow{Args: args, Return: ctx.visitInstantiate(level, t.Return), Method: t.Method, Source: t}
 
+	case *types.Tuple:
+		elems := make([]types.Type, len(t.Elems))
+		for i, elem := range t.Elems {
+			elems[i] = ctx.visitInstantiate(level, elem)
+		}
+		return &types.Tuple{Elems: elems, Source: t}
+
 	case *types.Method:
 		arrow := ctx.visitInstantiate(level, t.TypeClass.Methods[t.Name]).(*types.Arrow)
 		arrow.Method = t
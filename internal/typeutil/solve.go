@@ -0,0 +1,148 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package typeutil
+
+import (
+	"errors"
+
+	"github.com/wdamron/poly/types"
+)
+
+// Maximum number of rounds of constraint solving; each round resolves the constraints introduced by the previous round.
+const maxSolveRounds = 32
+
+// Resolve residual instance constraints on type-variables within t. Each constrained type-variable is linked
+// to the parameter of the unique instance which satisfies all of its constraints. Type-variables introduced by
+// linked instances are solved in subsequent rounds.
+func (ctx *CommonContext) SolveConstraints(t types.Type) error {
+	level := uint(types.TopLevel + 1)
+	seen := make(map[uint]bool)
+	var pending []*types.Var
+	collectConstrainedVars(t, seen, &pending)
+	for round := 0; len(pending) > 0; round++ {
+		if round == maxSolveRounds {
+			return errors.New("Constraint solving did not terminate")
+		}
+		vars := pending
+		pending = nil
+		for _, tv := range vars {
+			if tv.IsLinkVar() || len(tv.Constraints()) == 0 {
+				continue
+			}
+			inst, err := ctx.solveVar(level, tv)
+			if err != nil {
+				return err
+			}
+			probe, param := ctx.Instantiate(level, tv), ctx.Instantiate(level, inst.Param)
+			if err := ctx.Unify(probe, param); err != nil {
+				return err
+			}
+			if !tv.IsLinkVar() {
+				tv.SetLink(param)
+			}
+			collectConstrainedVars(param, seen, &pending)
+		}
+	}
+	return nil
+}
+
+// Find the unique instance which satisfies all constraints on tv. Instances of sub-classes with equivalent
+// parameters are not considered distinct.
+func (ctx *CommonContext) solveVar(level uint, tv *types.Var) (*types.Instance, error) {
+	constraints := tv.Constraints()
+	var match *types.Instance
+	ambiguous := false
+	constraints[0].TypeClass.FindInstance(func(inst *types.Instance) bool {
+		if match != nil && types.AlphaEqual(match.Param, inst.Param) {
+			return false
+		}
+		if !ctx.CanUnify(ctx.Instantiate(level, tv), ctx.Instantiate(level, inst.Param)) {
+			return false
+		}
+		if match != nil {
+			ambiguous = true
+			return true
+		}
+		match = inst
+		return false
+	})
+	switch {
+	case ambiguous:
+		return nil, errors.New("Ambiguous instances found for type-class " + constraints[0].TypeClass.Name)
+	case match == nil:
+		return nil, types.NewConstraintFailure(constraints[0].TypeClass, tv)
+	}
+	return match, nil
+}
+
+func collectConstrainedVars(t types.Type, seen map[uint]bool, vars *[]*types.Var) {
+	switch t := t.(type) {
+	case *types.Var:
+		if t.IsLinkVar() {
+			collectConstrainedVars(t.Link(), seen, vars)
+			return
+		}
+		if len(t.Constraints()) != 0 && !seen[t.Id()] {
+			seen[t.Id()] = true
+			*vars = append(*vars, t)
+		}
+
+	case *types.RecursiveLink:
+		for _, param := range t.Recursive.Params {
+			collectConstrainedVars(param, seen, vars)
+		}
+
+	case *types.App:
+		collectConstrainedVars(t.Const, seen, vars)
+		for _, param := range t.Params {
+			collectConstrainedVars(param, seen, vars)
+		}
+
+	case *types.Arrow:
+		for _, arg := range t.Args {
+			collectConstrainedVars(arg, seen, vars)
+		}
+		collectConstrainedVars(t.Return, seen, vars)
+
+	case *types.Tuple:
+		for _, elem := range t.Elems {
+			collectConstrainedVars(elem, seen, vars)
+		}
+
+	case *types.Record:
+		collectConstrainedVars(t.Row, seen, vars)
+
+	case *types.Variant:
+		collectConstrainedVars(t.Row, seen, vars)
+
+	case *types.RowExtend:
+		t.Labels.Range(func(label string, ts types.TypeList) bool {
+			ts.Range(func(i int, t types.Type) bool {
+				collectConstrainedVars(t, seen, vars)
+				return true
+			})
+			return true
+		})
+		collectConstrainedVars(t.Row, seen, vars)
+	}
+}
@@ -0,0 +1,77 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package typeutil
+
+import (
+	"errors"
+
+	"github.com/wdamron/poly/types"
+)
+
+// Check if impl is at least as general as decl. Generic type-variables within decl are treated as rigid; each must
+// remain unbound and distinct after unifying decl with an instance of impl, without gaining additional constraints.
+func (ctx *CommonContext) Subsumes(impl, decl types.Type) error {
+	level := uint(types.TopLevel + 1)
+	rigid := ctx.visitInstantiate(level, decl)
+	vars := make([]*types.Var, 0, len(ctx.InstLookup))
+	for _, tv := range ctx.InstLookup {
+		vars = append(vars, tv)
+	}
+	ctx.ClearInstantiationLookup()
+	declared := make([][]types.InstanceConstraint, len(vars))
+	for i, tv := range vars {
+		declared[i] = tv.Constraints()
+	}
+
+	txn := ctx.NewUnifyTxn()
+	defer ctx.Rollback(txn)
+	if err := ctx.Unify(ctx.Instantiate(level, impl), rigid); err != nil {
+		return err
+	}
+	seen := make(map[uint]bool, len(vars))
+	for i, tv := range vars {
+		bound, ok := types.RealType(tv).(*types.Var)
+		if !ok {
+			return errors.New("Type-variable " + types.TypeString(tv) + " is bound to " + types.TypeString(types.RealType(tv)))
+		}
+		if seen[bound.Id()] {
+			return errors.New("Distinct type-variables are unified within " + types.TypeString(decl))
+		}
+		seen[bound.Id()] = true
+		for _, c := range bound.Constraints() {
+			if !hasConstraint(declared[i], c.TypeClass) {
+				return errors.New("Type-variable requires an undeclared constraint for type-class " + c.TypeClass.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func hasConstraint(constraints []types.InstanceConstraint, tc *types.TypeClass) bool {
+	for _, c := range constraints {
+		if c.TypeClass == tc {
+			return true
+		}
+	}
+	return false
+}
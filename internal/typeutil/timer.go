@@ -0,0 +1,77 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package typeutil
+
+import "time"
+
+// Phase of inference measured by a PhaseTimer
+type Phase uint8
+
+const (
+	PhaseNone Phase = iota
+	PhaseAnalysis
+	PhaseUnification
+	PhaseInstantiation
+	PhaseCount
+)
+
+// PhaseTimer records wall-clock time spent within each phase of inference. Time spent within a phase which is
+// entered while another phase is running (e.g. instantiation during unification) is attributed only to the
+// innermost phase.
+type PhaseTimer struct {
+	Durations [PhaseCount]time.Duration
+
+	stack  []Phase
+	start  time.Time
+	_stack [8]Phase
+}
+
+// Clear all recorded durations.
+func (t *PhaseTimer) Reset() {
+	t.Durations = [PhaseCount]time.Duration{}
+	t.stack, t.start = t._stack[:0], time.Time{}
+}
+
+// Get the innermost running phase.
+func (t *PhaseTimer) Current() Phase {
+	if len(t.stack) == 0 {
+		return PhaseNone
+	}
+	return t.stack[len(t.stack)-1]
+}
+
+// Begin timing phase p, pausing the current phase.
+func (t *PhaseTimer) Enter(p Phase) {
+	now := time.Now()
+	if len(t.stack) != 0 {
+		t.Durations[t.stack[len(t.stack)-1]] += now.Sub(t.start)
+	}
+	t.stack, t.start = append(t.stack, p), now
+}
+
+// Stop timing the current phase, resuming the enclosing phase.
+func (t *PhaseTimer) Leave() {
+	now := time.Now()
+	t.Durations[t.stack[len(t.stack)-1]] += now.Sub(t.start)
+	t.stack, t.start = t.stack[:len(t.stack)-1], now
+}
@@ -24,6 +24,7 @@ package typeutil
 
 import (
 	"errors"
+	"strconv"
 
 	"github.com/wdamron/poly/ast"
 	"github.com/wdamron/poly/types"
@@ -32,7 +33,8 @@ import (
 // See "Efficient Generalization with Levels" (Oleg Kiselyov)
 // http://okmij.org/ftp/ML/generalization.html#levels
 //
-// This implementation follows the sound_eager algorithm.
+// This implementation follows the sound_eager algorithm. Levels are adjusted even if the occurs check is skipped,
+// since generalization depends on the adjusted levels.
 func (ctx *CommonContext) occursAdjustLevels(id, level uint, t types.Type) error {
 	switch t := t.(type) {
 	case *types.Var:
@@ -42,7 +44,7 @@ func (ctx *CommonContext) occursAdjustLevels(id, level uint, t types.Type) error
 		case t.IsGenericVar():
 			return errors.New("Types must be instantiated before checking for recursion")
 		default: // weak or unbound
-			if t.Id() == id {
+			if t.Id() == id && !ctx.SkipOccursCheck {
 				return errors.New("Implicitly recursive types are not supported")
 			}
 			if t.LevelNum() > level {
@@ -78,6 +80,14 @@ func (ctx *CommonContext) occursAdjustLevels(id, level uint, t types.Type) error
 		}
 		return ctx.occursAdjustLevels(id, level, t.Return)
 
+	case *types.Tuple:
+		for _, elem := range t.Elems {
+			if err := ctx.occursAdjustLevels(id, level, elem); err != nil {
+				return err
+			}
+		}
+		return nil
+
 	case *types.Record:
 		return ctx.occursAdjustLevels(id, level, t.Row)
 
@@ -107,10 +117,11 @@ type UnifyTxn struct {
 	Speculate           bool
 	LinkStash           []StashedLink
 	DeferredConstraints []DeferredConstraint
+	Resolved            int
 }
 
 func (ctx *CommonContext) NewUnifyTxn() UnifyTxn {
-	txn := UnifyTxn{ctx.Speculate, ctx.LinkStash, ctx.DeferredConstraints}
+	txn := UnifyTxn{ctx.Speculate, ctx.LinkStash, ctx.DeferredConstraints, len(ctx.resolvedStash)}
 	ctx.Speculate = true
 	return txn
 }
@@ -118,10 +129,17 @@ func (ctx *CommonContext) NewUnifyTxn() UnifyTxn {
 func (ctx *CommonContext) Rollback(txn UnifyTxn) {
 	ctx.UnstashLinks(len(ctx.LinkStash) - len(txn.LinkStash))
 	ctx.Speculate, ctx.LinkStash, ctx.DeferredConstraints = txn.Speculate, txn.LinkStash, txn.DeferredConstraints
+	ctx.resolvedStash = ctx.resolvedStash[:txn.Resolved]
 }
 
 func (ctx *CommonContext) Commit(txn UnifyTxn) {
 	ctx.Speculate, ctx.LinkStash = txn.Speculate, txn.LinkStash
+	if !ctx.Speculate && len(ctx.resolvedStash) > txn.Resolved {
+		for _, r := range ctx.resolvedStash[txn.Resolved:] {
+			ctx.OnResolved(r.c, r.t)
+		}
+		ctx.resolvedStash = ctx.resolvedStash[:txn.Resolved]
+	}
 }
 
 func (ctx *CommonContext) CanUnify(a, b types.Type) bool {
@@ -131,6 +149,28 @@ func (ctx *CommonContext) CanUnify(a, b types.Type) bool {
 	return err == nil
 }
 
+// Check if a and b could be unified, without modifying a or b. Unbound type-variables within a and b are copied
+// (preserving ids, levels, restrictions, and constraints) before unification, so only the copies are linked.
+func (ctx *CommonContext) CanUnifyCopies(a, b types.Type) bool {
+	vars := make(map[uint]*types.Var)
+	collectUnboundVars(a, vars)
+	collectUnboundVars(b, vars)
+	subst := make(map[uint]types.Type, len(vars))
+	for id, tv := range vars {
+		next := *tv
+		constraints := tv.Constraints()
+		constraintsCopy := make([]types.InstanceConstraint, len(constraints))
+		copy(constraintsCopy, constraints)
+		next.SetConstraints(constraintsCopy)
+		subst[id] = &next
+		// Type-variables created during unification must not share ids with the copies:
+		if ctx.VarTracker.NextId <= id {
+			ctx.VarTracker.NextId = id + 1
+		}
+	}
+	return ctx.Unify(types.Substitute(a, subst), types.Substitute(b, subst)) == nil
+}
+
 func (ctx *CommonContext) TryUnify(a, b types.Type) error {
 	txn := ctx.NewUnifyTxn()
 	if err := ctx.Unify(a, b); err != nil {
@@ -193,50 +233,125 @@ func (ctx *CommonContext) applyConstraints(a *types.Var, b types.Type) error {
 		a.SetConstraints(nil)
 		return nil
 	}
-	// Eliminate instance constraints (find a matching instance for each type-class):
+	// Eliminate instance constraints (find a matching instance for each type-class). Constraints on the type-parameters
+	// of a matching instance are resolved recursively as sub-goals, up to the maximum instance depth:
 	for _, c := range acs {
-		// Overlapping instances are detected when they are declared. Overlap is only allowed
-		// between instances where one is a subclass of the other, and the search order ensures
-		// sub-classes are visited first. If the linked type b unifies with multiple instances,
-		// overlap will be re-checked after inference during deferred unification (when enabled).
-		var firstMatch, lastMatch *types.Instance
-		overlapping := false
-		c.TypeClass.MatchInstance(b, func(inst *types.Instance) (done bool) {
-			if ctx.CanUnify(b, ctx.Instantiate(a.LevelNum(), inst.Param)) {
-				// Sub-classes are visited first:
-				if lastMatch != nil && !lastMatch.TypeClass.HasSuperClass(inst.TypeClass) {
-					overlapping = true
-				}
-				if firstMatch == nil {
-					firstMatch = inst
-				}
-				lastMatch = inst
+		if err := ctx.resolveInstance(a, c, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find a matching instance of the type-class constraint c for the type b, which was linked to the type-variable a.
+func (ctx *CommonContext) resolveInstance(a *types.Var, c types.InstanceConstraint, b types.Type) error {
+	if err := ctx.enterInstance(c.TypeClass); err != nil {
+		return err
+	}
+	defer ctx.leaveInstance()
+	if ctx.InstanceResolver != nil {
+		if impls, ok := ctx.InstanceResolver(c.TypeClass, b); ok {
+			if err := ctx.checkResolvedInstance(a.LevelNum(), c.TypeClass, b, impls); err != nil {
+				return err
 			}
-			return overlapping
-		})
-		if firstMatch == nil {
-			return errors.New("No matching instance found for type-class " + c.TypeClass.Name)
+			ctx.constraintResolved(c, b)
+			return nil
 		}
-		if overlapping {
-			if ctx.CheckingDeferredConstraints || !ctx.DeferredConstraintsEnabled {
-				return errors.New("Instance cannot be determined from the context for type-class " + c.TypeClass.Name)
+	}
+	// Overlapping instances are detected when they are declared. Overlap is only allowed
+	// between instances where one is a subclass of the other, and the search order ensures
+	// sub-classes are visited first. If the linked type b unifies with multiple instances,
+	// overlap will be re-checked after inference during deferred unification (when enabled).
+	var firstMatch, lastMatch *types.Instance
+	overlapping := false
+	c.TypeClass.MatchInstance(b, func(inst *types.Instance) (done bool) {
+		if ctx.CanUnify(b, ctx.Instantiate(a.LevelNum(), inst.Param)) {
+			// Sub-classes are visited first:
+			if lastMatch != nil && !lastMatch.TypeClass.HasSuperClass(inst.TypeClass) {
+				overlapping = true
 			}
-			// Deferred constraints are applied after inference. Type-variables within the linked type b
-			// should not be generalized, to ensure constraints propagate during the deferred unification:
-			const forceGeneralize, weak = false, true
-			GeneralizeOpts(a.Level(), b, forceGeneralize, weak)
-			ctx.DeferredConstraints = append(ctx.DeferredConstraints, DeferredConstraint{a, ctx.CurrentExpr})
-			continue
+			if firstMatch == nil {
+				firstMatch = inst
+			}
+			lastMatch = inst
 		}
-		// If only one matching instance is found, it can be safely unified with the candidate type (err should always be nil):
-		if err := ctx.Unify(b, ctx.Instantiate(a.LevelNum(), firstMatch.Param)); err != nil {
-			return err
+		return overlapping
+	})
+	if firstMatch == nil {
+		// Report the depth limit, rather than the failure of the outermost instance, when the limit was exceeded:
+		if ctx.depthErr != nil {
+			return ctx.depthErr
+		}
+		return types.NewConstraintFailure(c.TypeClass, b)
+	}
+	if overlapping {
+		if ctx.CheckingDeferredConstraints || !ctx.DeferredConstraintsEnabled {
+			return errors.New("Instance cannot be determined from the context for type-class " + c.TypeClass.Name)
+		}
+		// Deferred constraints are applied after inference. Type-variables within the linked type b
+		// should not be generalized, to ensure constraints propagate during the deferred unification:
+		const forceGeneralize, weak = false, true
+		GeneralizeOpts(a.Level(), b, forceGeneralize, weak)
+		ctx.DeferredConstraints = append(ctx.DeferredConstraints, DeferredConstraint{a, ctx.CurrentExpr})
+		return nil
+	}
+	// If only one matching instance is found, it can be safely unified with the candidate type (err should always be nil).
+	// Sub-goals are resolved before the constraint:
+	if err := ctx.Unify(b, ctx.Instantiate(a.LevelNum(), firstMatch.Param)); err != nil {
+		return err
+	}
+	ctx.constraintResolved(c, b)
+	return nil
+}
+
+// Check if a and b are applications of the same abstract type constant.
+func isAbstractApp(a, b *types.App) bool {
+	ca, ok := types.RealType(a.Const).(*types.Const)
+	if !ok || !ca.Abstract {
+		return false
+	}
+	cb, ok := types.RealType(b.Const).(*types.Const)
+	return ok && cb.Abstract && ca.Name == cb.Name
+}
+
+// Ensure methods supplied by an external instance resolver implement all methods of the type-class for the type-parameter t.
+func (ctx *CommonContext) checkResolvedInstance(level uint, tc *types.TypeClass, t types.Type, impls map[string]types.Type) error {
+	for name, def := range tc.Methods {
+		impl, ok := impls[name]
+		if !ok {
+			return errors.New("Resolved instance of type-class " + tc.Name + " for " + types.TypeString(t) + " is missing method " + name)
+		}
+		// Instantiate the method with the type-parameter of the type-class, without the type-class constraint:
+		param := ctx.visitInstantiate(level, tc.Param)
+		method := ctx.visitInstantiate(level, def)
+		ctx.ClearInstantiationLookup()
+		if tv, ok := param.(*types.Var); ok {
+			tv.SetConstraints(nil)
+		}
+		txn := ctx.NewUnifyTxn()
+		err := ctx.Unify(param, t)
+		if err == nil {
+			err = ctx.Unify(method, ctx.Instantiate(level, impl))
+		}
+		ctx.Rollback(txn)
+		if err != nil {
+			return errors.New("Resolved method " + name + " does not implement type-class " + tc.Name + " for " + types.TypeString(t))
 		}
 	}
 	return nil
 }
 
 func (ctx *CommonContext) Unify(a, b types.Type) error {
+	if ctx.Timer != nil && ctx.Timer.Current() != PhaseUnification {
+		ctx.Timer.Enter(PhaseUnification)
+		err := ctx.unify(a, b)
+		ctx.Timer.Leave()
+		return err
+	}
+	return ctx.unify(a, b)
+}
+
+func (ctx *CommonContext) unify(a, b types.Type) error {
 	// Path compression:
 	a, b = types.RealType(a), types.RealType(b)
 
@@ -348,14 +463,18 @@ func (ctx *CommonContext) Unify(a, b types.Type) error {
 		// a is a type application; swapping a/b will fallthrough to the case above
 		return ctx.Unify(b, a)
 	case underA != nil: // both are aliases
-		// Const and Args are unified in the main switch below
-		if err := ctx.Unify(underA, underB); err != nil {
-			return err
-		}
+		// Const and Args are unified in the main switch below, before the underlying types
 	}
 
 	// unify types:
 
+	// Sizes are only unified with sizes and type-variables:
+	if _, ok := b.(types.Size); ok {
+		if _, ok := a.(types.Size); !ok {
+			return ctx.Unify(b, a)
+		}
+	}
+
 	switch a := a.(type) {
 	// Var and RecursiveLink are handled above
 
@@ -376,27 +495,39 @@ func (ctx *CommonContext) Unify(a, b types.Type) error {
 	case types.Size:
 		if b, ok := b.(types.Size); ok {
 			if a != b {
-				return errors.New("Failed to unify sized types with different sizes")
+				return errors.New("Size mismatch: failed to unify size " + strconv.Itoa(int(a)) + " with size " + strconv.Itoa(int(b)))
 			}
 			return nil
 		}
+		return errors.New("Failed to unify size " + strconv.Itoa(int(a)) + " with " + types.TypeName(b))
 
 	case *types.App:
 		bapp, ok := b.(*types.App)
 		if !ok {
 			return errors.New("Failed to unify type-application with " + types.TypeName(b))
 		}
+		if ctx.AbstractUnifier != nil && isAbstractApp(a, bapp) {
+			if handled, err := ctx.AbstractUnifier(a, bapp); handled {
+				return err
+			}
+		}
 		if err := ctx.Unify(a.Const, bapp.Const); err != nil {
 			return err
 		}
 		if len(a.Params) != len(bapp.Params) {
 			return errors.New("Cannot unify type-applications with differing arity")
 		}
+		// Phantom type-parameters (which do not appear within the underlying types of aliases) must match:
 		for i := range a.Params {
 			if err := ctx.Unify(a.Params[i], bapp.Params[i]); err != nil {
 				return err
 			}
 		}
+		if underA != nil && underB != nil {
+			if err := ctx.Unify(underA, underB); err != nil {
+				return err
+			}
+		}
 		if underA != nil && aliasB != nil {
 			aliasB.Underlying = underA
 		}
@@ -420,6 +551,21 @@ func (ctx *CommonContext) Unify(a, b types.Type) error {
 		}
 		return nil
 
+	case *types.Tuple:
+		b, ok := b.(*types.Tuple)
+		if !ok {
+			return errors.New("Failed to unify tuple with type " + types.TypeName(b))
+		}
+		if len(a.Elems) != len(b.Elems) {
+			return errors.New("Cannot unify tuples with differing arity")
+		}
+		for i := range a.Elems {
+			if err := ctx.Unify(a.Elems[i], b.Elems[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+
 	case *types.Record:
 		if b, ok := b.(*types.Record); ok {
 			return ctx.Unify(a.Row, b.Row)
@@ -487,12 +633,12 @@ func (ctx *CommonContext) unifyRows(a, b types.Type) error {
 		return err
 	}
 
-	// labels missing from labelsA/labelsA:
+	// labels missing from labelsA/labelsB:
 	var missingA, missingB types.TypeMapBuilder
 	iterA, iterB := labelsA.Iterator(), labelsB.Iterator()
 	for !iterA.Done() {
 		label, va := iterA.Next()
-		if _, ok := labelsA.Get(label); !ok {
+		if _, ok := labelsB.Get(label); !ok {
 			missingB.EnsureInitialized()
 			missingB.Set(label, va)
 		}
@@ -520,6 +666,10 @@ func (ctx *CommonContext) unifyRows(a, b types.Type) error {
 		}
 	}
 
+	if err := ctx.CheckRowWidth(labelsA.Len() + missingA.Len()); err != nil {
+		return err
+	}
+
 	za, zb := missingA.Len() == 0, missingB.Len() == 0
 	switch {
 	case za && zb: // all labels match
@@ -538,17 +688,72 @@ func (ctx *CommonContext) unifyRows(a, b types.Type) error {
 				return errors.New("Invalid state while unifying type-variables for rows")
 			}
 			tv := ctx.VarTracker.New(restA.LevelNum())
-			ext := types.RowExtend{Row: tv, Labels: missingB.Build()}
-			if err := ctx.Unify(restB, &ext); err != nil {
+			// restB may be linked to extB, so each extension must be allocated separately:
+			extB := &types.RowExtend{Row: tv, Labels: missingB.Build()}
+			if err := ctx.Unify(restB, extB); err != nil {
 				return err
 			}
 			if restA.IsLinkVar() {
 				return errors.New("Invalid recursive row-types")
 			}
-			ext = types.RowExtend{Row: tv, Labels: missingA.Build()}
-			return ctx.Unify(restA, &ext)
+			extA := &types.RowExtend{Row: tv, Labels: missingA.Build()}
+			return ctx.Unify(restA, extA)
 		}
 	}
 
 	return errors.New("Invalid state while unifying rows")
 }
+
+func collectUnboundVars(t types.Type, vars map[uint]*types.Var) {
+	switch t := t.(type) {
+	case *types.Var:
+		if t.IsLinkVar() {
+			collectUnboundVars(t.Link(), vars)
+			return
+		}
+		if t.IsUnboundVar() {
+			vars[t.Id()] = t
+		}
+
+	case *types.RecursiveLink:
+		for _, param := range t.Recursive.Params {
+			collectUnboundVars(param, vars)
+		}
+
+	case *types.App:
+		collectUnboundVars(t.Const, vars)
+		for _, param := range t.Params {
+			collectUnboundVars(param, vars)
+		}
+		if t.Underlying != nil {
+			collectUnboundVars(t.Underlying, vars)
+		}
+
+	case *types.Arrow:
+		for _, arg := range t.Args {
+			collectUnboundVars(arg, vars)
+		}
+		collectUnboundVars(t.Return, vars)
+
+	case *types.Tuple:
+		for _, elem := range t.Elems {
+			collectUnboundVars(elem, vars)
+		}
+
+	case *types.Record:
+		collectUnboundVars(t.Row, vars)
+
+	case *types.Variant:
+		collectUnboundVars(t.Row, vars)
+
+	case *types.RowExtend:
+		t.Labels.Range(func(label string, ts types.TypeList) bool {
+			ts.Range(func(i int, t types.Type) bool {
+				collectUnboundVars(t, vars)
+				return true
+			})
+			return true
+		})
+		collectUnboundVars(t.Row, vars)
+	}
+}
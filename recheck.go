@@ -0,0 +1,146 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package poly
+
+import (
+	"errors"
+
+	"github.com/wdamron/poly/ast"
+	"github.com/wdamron/poly/types"
+)
+
+// Recheck a let-group after the value of the binding for name has been edited, where the let-group was previously
+// annotated within env (see Annotate). The group should have been inferred as a root expression, so the annotated
+// type-schemes of its bindings are independent of enclosing bindings.
+//
+// Only the strongly-connected component which contains the edited binding is inferred, within env and the annotated
+// type-schemes of the other bindings. If the type-scheme of a binding changes, each later component which references
+// the binding is also inferred, and changes are propagated in dependency order; the body of the group is rechecked
+// if any type-scheme changes. Components are not split when references are removed from the edited binding. If the
+// edited binding references bindings of later components, or if bindings were added or removed, the dependency order
+// is stale and the entire group is annotated again.
+//
+// The type-schemes and components of group will be updated after rechecking succeeds.
+func (ti *InferenceContext) RecheckBinding(env *TypeEnv, group *ast.LetGroup, name string) error {
+	schemes, sccs := group.Schemes(), group.StronglyConnectedComponents()
+	if schemes == nil || sccs == nil {
+		return errors.New("Let-group must be annotated before rechecking bindings")
+	}
+	values := make(map[string]ast.Expr, len(group.Vars))
+	for _, v := range group.Vars {
+		values[v.Var] = v.Value
+	}
+	if _, ok := values[name]; !ok {
+		return errors.New("Let-group does not bind " + name)
+	}
+	components := make(map[string]int, len(values))
+	for i, scc := range sccs {
+		for _, v := range scc {
+			components[v.Var] = i
+		}
+	}
+	edited, ok := components[name]
+	if !ok || len(components) != len(values) || referencesComponent(values[name], components, edited+1) {
+		return ti.AnnotateDirect(group, env)
+	}
+	for v := range values {
+		if _, ok := components[v]; !ok {
+			return ti.AnnotateDirect(group, env)
+		}
+	}
+
+	scoped := NewTypeEnv(env)
+	next := make(map[string]types.Type, len(schemes))
+	for v, scheme := range schemes {
+		scoped.Assign(v, scheme)
+		next[v] = scheme
+	}
+	changed := make(map[string]bool)
+	for i := edited; i < len(sccs); i++ {
+		vars := make([]ast.LetBinding, len(sccs[i]))
+		dependent := i == edited
+		for j, v := range sccs[i] {
+			vars[j] = ast.LetBinding{Var: v.Var, Value: values[v.Var]}
+			dependent = dependent || referencesChanged(vars[j].Value, changed)
+		}
+		if !dependent {
+			continue
+		}
+		component := &ast.LetGroup{Vars: vars, Body: &ast.RecordEmpty{}}
+		if err := ti.AnnotateDirect(component, scoped); err != nil {
+			return err
+		}
+		for v, scheme := range component.Schemes() {
+			if !types.AlphaEqual(schemes[v], scheme) {
+				changed[v] = true
+			}
+			scoped.Assign(v, scheme)
+			next[v] = scheme
+		}
+	}
+	if len(changed) != 0 {
+		if err := ti.AnnotateDirect(group.Body, scoped); err != nil {
+			return err
+		}
+	}
+
+	updated := make([][]ast.LetBinding, len(sccs))
+	for i, scc := range sccs {
+		updated[i] = make([]ast.LetBinding, len(scc))
+		for j, v := range scc {
+			updated[i][j] = ast.LetBinding{Var: v.Var, Value: values[v.Var]}
+		}
+	}
+	group.SetStronglyConnectedComponents(updated)
+	group.SetSchemes(next)
+	return nil
+}
+
+// Check if e references a variable which is bound by a component at or after the given index. Shadowing is ignored,
+// so references may be over-approximated.
+func referencesComponent(e ast.Expr, components map[string]int, index int) bool {
+	found := false
+	ast.WalkExpr(e, func(e ast.Expr) {
+		if v, ok := e.(*ast.Var); ok {
+			if i, ok := components[v.Name]; ok && i >= index {
+				found = true
+			}
+		}
+	})
+	return found
+}
+
+// Check if e references a variable with a changed type-scheme. Shadowing is ignored, so references may be
+// over-approximated.
+func referencesChanged(e ast.Expr, changed map[string]bool) bool {
+	if len(changed) == 0 {
+		return false
+	}
+	found := false
+	ast.WalkExpr(e, func(e ast.Expr) {
+		if v, ok := e.(*ast.Var); ok && changed[v.Name] {
+			found = true
+		}
+	})
+	return found
+}
@@ -0,0 +1,61 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package poly
+
+import (
+	"github.com/wdamron/poly/ast"
+	"github.com/wdamron/poly/types"
+)
+
+// Session is an incremental typing session (e.g. for a REPL), which retains the types of previous definitions
+// within a persistent type-environment. Context state is reset for each inferred expression.
+//
+// A session cannot be used concurrently.
+type Session struct {
+	Env     *TypeEnv
+	Context *InferenceContext
+}
+
+// Create a session with a new type-environment, which will inherit bindings from the parent if the parent is not nil.
+// The parent environment will not be modified by definitions within the session.
+func NewSession(parent *TypeEnv) *Session {
+	return &Session{Env: NewTypeEnv(parent), Context: NewContext()}
+}
+
+// Infer the type of expr, then assign the generalized type to name within the session's type-environment. The
+// definition may refer to itself by name (e.g. a recursive function), and shadows previous definitions of name.
+//
+// If inference fails, the session's type-environment will not be modified.
+func (s *Session) Define(name string, expr ast.Expr) (types.Type, error) {
+	t, err := s.Context.Infer(&ast.Let{Var: name, Value: expr, Body: &ast.Var{Name: name}}, s.Env)
+	if err != nil {
+		return nil, err
+	}
+	s.Env.Assign(name, t)
+	return t, nil
+}
+
+// Infer the type of expr within the session's type-environment, without assigning the type.
+func (s *Session) Eval(expr ast.Expr) (types.Type, error) {
+	return s.Context.Infer(expr, s.Env)
+}
@@ -24,6 +24,7 @@ package poly
 
 import (
 	"errors"
+	"sort"
 
 	"github.com/wdamron/poly/ast"
 	"github.com/wdamron/poly/internal/typeutil"
@@ -44,7 +45,9 @@ type TypeEnv struct {
 	// Predeclared types in the parent of the current type-environment
 	Parent *TypeEnv
 
-	common typeutil.CommonContext
+	common  typeutil.CommonContext
+	frozen  bool
+	overlay map[string]types.Type // bindings assigned after the type-environment was frozen
 }
 
 // Create a type-environment. The new environment will inherit bindings from the parent, if the parent is not nil.
@@ -64,6 +67,87 @@ func NewTypeEnv(parent *TypeEnv) *TypeEnv {
 	return env
 }
 
+// Create a type-environment which inherits from base, with a type assigned for each identifier within schemes.
+// The base environment will not be modified.
+//
+// Types inferred for a batch of definitions may be folded into a new environment for a subsequent batch.
+func EnvFromSchemes(base *TypeEnv, schemes map[string]types.Type) *TypeEnv {
+	env := NewTypeEnv(base)
+	env.AssignAll(schemes)
+	return env
+}
+
+// Conflict is a name declared with different types in more than one type-environment passed to MergeEnvs.
+type Conflict struct {
+	Name string
+	// Types declared for the name, in the order of the merged type-environments
+	Types []types.Type
+}
+
+// Create a type-environment containing the bindings and type-classes declared within each of envs. Bindings inherited
+// from parent environment(s) are not merged; if all of envs share the same parent, the merged type-environment will
+// inherit from that parent. None of envs will be modified.
+//
+// Names declared with different types in more than one of envs are returned as conflicts, sorted by name, and the
+// merged type-environment will contain the type declared in the first of envs. Names declared with the same type
+// (up to a renaming of generic type-variables, see types.AlphaEqual) in more than one of envs do not conflict. Type-classes declared with the same name in more than one of envs are not
+// reported; the type-class declared in the first of envs will be retained.
+func MergeEnvs(envs ...*TypeEnv) (*TypeEnv, []Conflict) {
+	var parent *TypeEnv
+	if len(envs) != 0 {
+		parent = envs[0].Parent
+	}
+	for _, e := range envs {
+		if e.Parent != parent {
+			parent = nil
+			break
+		}
+	}
+	merged := NewTypeEnv(parent)
+	var conflicts []Conflict
+	conflictIndex := make(map[string]int)
+	merge := func(name string, t types.Type) {
+		existing, ok := merged.Types[name]
+		if !ok {
+			merged.Types[name] = t
+			return
+		}
+		if types.AlphaEqual(existing, t) {
+			return
+		}
+		i, ok := conflictIndex[name]
+		if !ok {
+			i = len(conflicts)
+			conflictIndex[name] = i
+			conflicts = append(conflicts, Conflict{Name: name, Types: []types.Type{existing}})
+		}
+		conflicts[i].Types = append(conflicts[i].Types, t)
+	}
+	for _, e := range envs {
+		for name, t := range e.Types {
+			if _, shadowed := e.overlay[name]; !shadowed {
+				merge(name, t)
+			}
+		}
+		for name, t := range e.overlay {
+			merge(name, t)
+		}
+		for name, tc := range e.TypeClasses {
+			if merged.TypeClasses == nil {
+				merged.TypeClasses = make(map[string]*types.TypeClass)
+			}
+			if _, ok := merged.TypeClasses[name]; !ok {
+				merged.TypeClasses[name] = tc
+			}
+		}
+		if next := e.common.VarTracker.NextId; next > merged.common.VarTracker.NextId {
+			merged.common.VarTracker.NextId = next
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Name < conflicts[j].Name })
+	return merged, conflicts
+}
+
 // Get the id which will be assigned to the next type-variable generated within the type-environment.
 func (e *TypeEnv) NextVarId() uint { return e.common.VarTracker.NextId }
 
@@ -100,15 +184,7 @@ func (e *TypeEnv) NewQualifiedVar(constraints ...types.InstanceConstraint) *type
 // The bind function should add aliased types with underlying types which are recursively linked
 // to one or more types in the Recursive.
 func (e *TypeEnv) NewRecursive(params []*types.Var, bind func(recursive *types.Recursive)) *types.Recursive {
-	rec := &types.Recursive{Params: params, Bind: bind, Flags: types.NeedsGeneralization}
-	for i, tv := range rec.Params {
-		rec.Params[i] = Generalize(tv).(*types.Var)
-	}
-	bind(rec)
-	for i, alias := range rec.Types {
-		rec.Types[i] = Generalize(alias).(*types.App)
-	}
-	return rec
+	return typeutil.NewRecursive(params, bind)
 }
 
 // Create a new recursive type.
@@ -121,38 +197,106 @@ func (e *TypeEnv) NewSimpleRecursive(params []*types.Var, bindSelf func(*types.R
 	})
 }
 
+// Mark the type-environment as read-only. Bindings within a frozen type-environment will not be replaced or removed
+// by inference, or by subsequent calls to Declare, Assign, or Remove; identifiers assigned after the type-environment
+// is frozen are bound within an overlay, which shadows the frozen bindings. Type-classes and instances are not
+// affected, though methods of type-classes declared after freezing are bound within the overlay.
+//
+// Only the bindings are protected, not the types they refer to: unification links unbound (non-generic) type-variables
+// in place, so inference may still refine a frozen binding which contains them. Untrusted expressions may be checked
+// against a frozen prelude without modifying the prelude's bindings, if the prelude declares only generic types.
+func (e *TypeEnv) Freeze() { e.frozen = true }
+
+// Check if the type-environment is read-only (see Freeze).
+func (e *TypeEnv) IsFrozen() bool { return e.frozen }
+
+// Get the mutable bindings of the type-environment (the overlay, if the type-environment is frozen).
+func (e *TypeEnv) bindings() map[string]types.Type {
+	if !e.frozen {
+		return e.Types
+	}
+	if e.overlay == nil {
+		e.overlay = make(map[string]types.Type)
+	}
+	return e.overlay
+}
+
+// Bind a type for an identifier within the mutable bindings of the type-environment. Rebinding the type declared
+// within a frozen type-environment removes the identifier from the overlay, so the frozen binding is visible again.
+func (e *TypeEnv) bind(name string, t types.Type) {
+	if e.frozen {
+		if frozen, ok := e.Types[name]; ok && frozen == t {
+			delete(e.overlay, name)
+			return
+		}
+	}
+	e.bindings()[name] = t
+}
+
 // Declare a type for an identifier within the type environment.
 //
 // Type-variables contained within mutable reference-types will be generalized.
 func (e *TypeEnv) Declare(name string, t types.Type) {
-	e.Types[name] = GeneralizeRefs(t)
+	e.bind(name, GeneralizeRefs(t))
 }
 
 // Declare a weakly-polymorphic type for an identifier within the type environment.
 //
 // Type-variables contained within mutable reference-types will not be generalized.
 func (e *TypeEnv) DeclareWeak(name string, t types.Type) {
-	e.Types[name] = Generalize(t)
+	e.bindings()[name] = Generalize(t)
 }
 
 // Declare a type for an identifier within the type environment.
 //
 // Type-variables will not be generalized.
-func (e *TypeEnv) DeclareInvariant(name string, t types.Type) { e.Types[name] = t }
+func (e *TypeEnv) DeclareInvariant(name string, t types.Type) { e.bind(name, t) }
 
 // Declare a type for an identifier within the type environment.
 //
 // Type-variables will not be generalized.
 //
 // Assign is an alias for DeclareInvariant.
-func (e *TypeEnv) Assign(name string, t types.Type) { e.Types[name] = t }
+func (e *TypeEnv) Assign(name string, t types.Type) { e.bind(name, t) }
+
+// Declare types for a set of identifiers within the type environment.
+//
+// Type-variables will not be generalized. AssignAll is equivalent to calling Assign for each identifier, though
+// the mappings within the type environment may be pre-sized.
+func (e *TypeEnv) AssignAll(assigned map[string]types.Type) {
+	if e.frozen {
+		for name, t := range assigned {
+			e.bind(name, t)
+		}
+		return
+	}
+	if len(e.Types) == 0 {
+		e.Types = make(map[string]types.Type, len(assigned))
+	}
+	for name, t := range assigned {
+		e.Types[name] = t
+	}
+}
 
 // Remove the assigned type for an identifier within the type environment. Parent environment(s) will not be affected,
-// and the identifier's type will still be visible if defined in a parent environment.
-func (e *TypeEnv) Remove(name string) { delete(e.Types, name) }
+// and the identifier's type will still be visible if defined in a parent environment. If the type-environment is
+// frozen, only the overlay will be affected.
+func (e *TypeEnv) Remove(name string) { delete(e.bindings(), name) }
+
+// Remove the assigned types for a set of identifiers within the type environment. RemoveAll is equivalent to calling
+// Remove for each identifier.
+func (e *TypeEnv) RemoveAll(names []string) {
+	bindings := e.bindings()
+	for _, name := range names {
+		delete(bindings, name)
+	}
+}
 
 // Lookup the type for an identifier in the environment or its parent environment(s).
 func (e *TypeEnv) Lookup(name string) types.Type {
+	if t, ok := e.overlay[name]; ok {
+		return t
+	}
 	if t, ok := e.Types[name]; ok {
 		return t
 	}
@@ -162,8 +306,26 @@ func (e *TypeEnv) Lookup(name string) types.Type {
 	return e.Parent.Lookup(name)
 }
 
+// Collect the types of all identifiers visible within the type-environment, including identifiers inherited from
+// parent environment(s).
+func (e *TypeEnv) collectBindings(bindings map[string]types.Type) {
+	if e.Parent != nil {
+		e.Parent.collectBindings(bindings)
+	}
+	for name, t := range e.Types {
+		bindings[name] = t
+	}
+	for name, t := range e.overlay {
+		bindings[name] = t
+	}
+}
+
 func (e *TypeEnv) scopeLookup(name string) (types.Type, *ast.Scope) {
-	if t, ok := e.Types[name]; ok {
+	t, ok := e.overlay[name]
+	if !ok {
+		t, ok = e.Types[name]
+	}
+	if ok {
 		scopes := e.common.VarScopes[name]
 		if len(scopes) == 0 {
 			return t, ast.PredeclaredScope
@@ -179,6 +341,10 @@ func (e *TypeEnv) scopeLookup(name string) (types.Type, *ast.Scope) {
 // Instantiate a type at a given let-binding level. Instantiation should only occur indirectly during inference.
 //
 // Literal expressions may need to instantiate types at the level they are being instantiated at.
+//
+// Each composite type which is copied during instantiation (App, Arrow, Tuple, Record, Variant, RowExtend, or
+// RecursiveLink) records the generic type it was copied from as its Source. Non-generic types are shared rather
+// than copied, and their sources are not modified.
 func (e *TypeEnv) Instantiate(level uint, t types.Type) types.Type {
 	return e.common.Instantiate(level, t)
 }
@@ -187,6 +353,9 @@ func (e *TypeEnv) Instantiate(level uint, t types.Type) types.Type {
 //
 // If the type-parameter is not linked within the bind function, an instance constraint will be added to the parameter.
 //
+// Each method of the type-class is declared as an identifier within the type environment. Bindings for the same name
+// within an expression (e.g. let-bindings or function arguments) shadow the method while in scope.
+//
 // Each super-class which the type-class implements will be modified to add a sub-class entry; changes will be visible across all uses
 // of the super-classes, and changes must not be made to type-classes concurrently.
 func (e *TypeEnv) DeclareTypeClass(name string, bind func(*types.Var) types.MethodSet, implements ...*types.TypeClass) (*types.TypeClass, error) {
@@ -205,7 +374,7 @@ func (e *TypeEnv) DeclareTypeClass(name string, bind func(*types.Var) types.Meth
 	for name, arrow := range methods {
 		arrow = GeneralizeRefs(arrow).(*types.Arrow)
 		generalizedMethods[name] = arrow
-		e.Types[name] = &types.Method{TypeClass: tc, Name: name, Flags: arrow.Flags}
+		e.bind(name, &types.Method{TypeClass: tc, Name: name, Flags: arrow.Flags})
 	}
 	if param.IsGeneric() {
 		param.AddConstraint(types.InstanceConstraint{tc})
@@ -331,7 +500,7 @@ func (e *TypeEnv) DeclareInstance(tc *types.TypeClass, param types.Type, methodN
 	e.common.VarTracker.FlattenLinks()
 	e.common.VarTracker.Reset()
 	if err != nil {
-		tc.Instances = tc.Instances[:len(tc.Instances)-1]
+		tc.RemoveInstance(inst)
 		return nil, err
 	}
 	return inst, nil
@@ -0,0 +1,103 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package types
+
+// Count the nodes within the type-graph of t. Links are followed, and type-variables which are bound to a type are
+// not counted. Each group of recursive types is counted once, regardless of the number of links to the group.
+//
+// TypeSize may be used to detect excessively large types, or to decide whether a type should be cached. (The name Size
+// is already taken by the size-constant type.)
+func TypeSize(t Type) int {
+	counter := sizeCounter{}
+	return counter.size(t)
+}
+
+type sizeCounter struct {
+	seen map[*Recursive]bool
+}
+
+func (c *sizeCounter) size(t Type) int {
+	t = RealType(t)
+	switch t := t.(type) {
+	case *App:
+		n := 1 + c.size(t.Const) + c.sizeList(t.Params)
+		if t.Underlying != nil {
+			n += c.size(t.Underlying)
+		}
+		return n
+
+	case *Arrow:
+		return 1 + c.sizeList(t.Args) + c.size(t.Return)
+
+	case *Tuple:
+		return 1 + c.sizeList(t.Elems)
+
+	case *Record:
+		return 1 + c.size(t.Row)
+
+	case *Variant:
+		return 1 + c.size(t.Row)
+
+	case *RowExtend:
+		n := 1 + c.size(t.Row)
+		t.Labels.Range(func(label string, ts TypeList) bool {
+			ts.Range(func(i int, t Type) bool {
+				n += c.size(t)
+				return true
+			})
+			return true
+		})
+		return n
+
+	case *RecursiveLink:
+		rec := t.Recursive
+		if c.seen[rec] {
+			return 1
+		}
+		if c.seen == nil {
+			c.seen = make(map[*Recursive]bool)
+		}
+		c.seen[rec] = true
+		n := 1
+		for _, p := range rec.Params {
+			n += c.size(p)
+		}
+		for _, alias := range rec.Types {
+			n += c.size(alias)
+		}
+		return n
+
+	case nil:
+		return 0
+	}
+	// Unit, Var, Const, Size, Method, RowEmpty:
+	return 1
+}
+
+func (c *sizeCounter) sizeList(ts []Type) int {
+	n := 0
+	for _, t := range ts {
+		n += c.size(t)
+	}
+	return n
+}
@@ -0,0 +1,120 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package types
+
+import "sort"
+
+// Get the sorted names of all type constants within t, including constructors of type-applications. Links are
+// followed, and the types within each group of recursive types are visited once.
+//
+// ConstNames may be used to determine which declared types a type depends on.
+func ConstNames(t Type) []string {
+	c := constCollector{names: make(map[string]bool)}
+	c.visit(t)
+	names := make([]string, 0, len(c.names))
+	for name := range c.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get the sorted names of all scoped type constants within t (see Const).
+func ScopedConstNames(t Type) []string {
+	c := constCollector{names: make(map[string]bool), scoped: true}
+	c.visit(t)
+	names := make([]string, 0, len(c.names))
+	for name := range c.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type constCollector struct {
+	names  map[string]bool
+	seen   map[*Recursive]bool
+	scoped bool // only collect scoped type constants
+}
+
+func (c *constCollector) visit(t Type) {
+	t = RealType(t)
+	switch t := t.(type) {
+	case *Const:
+		if !c.scoped || t.Scoped {
+			c.names[t.Name] = true
+		}
+
+	case *App:
+		c.visit(t.Const)
+		c.visitList(t.Params)
+		if t.Underlying != nil {
+			c.visit(t.Underlying)
+		}
+
+	case *Arrow:
+		c.visitList(t.Args)
+		c.visit(t.Return)
+
+	case *Tuple:
+		c.visitList(t.Elems)
+
+	case *Record:
+		c.visit(t.Row)
+
+	case *Variant:
+		c.visit(t.Row)
+
+	case *RowExtend:
+		c.visit(t.Row)
+		t.Labels.Range(func(label string, ts TypeList) bool {
+			ts.Range(func(i int, t Type) bool {
+				c.visit(t)
+				return true
+			})
+			return true
+		})
+
+	case *RecursiveLink:
+		rec := t.Recursive
+		if c.seen[rec] {
+			return
+		}
+		if c.seen == nil {
+			c.seen = make(map[*Recursive]bool)
+		}
+		c.seen[rec] = true
+		for _, p := range rec.Params {
+			c.visit(p)
+		}
+		for _, alias := range rec.Types {
+			c.visit(alias)
+		}
+	}
+}
+
+func (c *constCollector) visitList(ts []Type) {
+	for _, t := range ts {
+		c.visit(t)
+	}
+}
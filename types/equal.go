@@ -0,0 +1,188 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package types
+
+// Check if a and b are equal up to a consistent renaming of their generic type-variables.
+//
+// Generic type-variables must be paired one-to-one, and paired type-variables must share the same
+// constraints and restrictions. Other (non-generic) type-variables must be identical. Row labels are
+// compared independently of their order, and recursive links are compared by their root type-group,
+// index, and type-parameters.
+func AlphaEqual(a, b Type) bool {
+	eq := alphaEquality{}
+	return eq.equal(a, b)
+}
+
+type alphaEquality struct {
+	ab, ba map[uint]uint
+}
+
+func (eq *alphaEquality) equal(a, b Type) bool {
+	a, b = RealType(a), RealType(b)
+	switch a := a.(type) {
+	case *Var:
+		b, ok := b.(*Var)
+		return ok && eq.equalVars(a, b)
+
+	case *Unit:
+		_, ok := b.(*Unit)
+		return ok
+
+	case *Const:
+		b, ok := b.(*Const)
+		return ok && a.Name == b.Name
+
+	case Size:
+		b, ok := b.(Size)
+		return ok && a == b
+
+	case *App:
+		b, ok := b.(*App)
+		return ok && eq.equal(a.Const, b.Const) && eq.equalLists(a.Params, b.Params)
+
+	case *Arrow:
+		b, ok := b.(*Arrow)
+		return ok && eq.equalLists(a.Args, b.Args) && eq.equal(a.Return, b.Return)
+
+	case *Tuple:
+		b, ok := b.(*Tuple)
+		return ok && eq.equalLists(a.Elems, b.Elems)
+
+	case *Method:
+		b, ok := b.(*Method)
+		return ok && a.TypeClass == b.TypeClass && a.Name == b.Name
+
+	case *Record:
+		b, ok := b.(*Record)
+		return ok && eq.equalRows(a.Row, b.Row)
+
+	case *Variant:
+		b, ok := b.(*Variant)
+		return ok && eq.equalRows(a.Row, b.Row)
+
+	case *RowExtend:
+		if _, ok := b.(*RowExtend); !ok {
+			return false
+		}
+		return eq.equalRows(a, b)
+
+	case *RowEmpty:
+		_, ok := b.(*RowEmpty)
+		return ok
+
+	case *RecursiveLink:
+		b, ok := b.(*RecursiveLink)
+		if !ok || a.Index != b.Index || !a.Recursive.Matches(b.Recursive) || len(a.Recursive.Params) != len(b.Recursive.Params) {
+			return false
+		}
+		for i, p := range a.Recursive.Params {
+			if !eq.equal(p, b.Recursive.Params[i]) {
+				return false
+			}
+		}
+		return true
+
+	case nil:
+		return b == nil
+	}
+	return false
+}
+
+func (eq *alphaEquality) equalLists(a, b []Type) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !eq.equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (eq *alphaEquality) equalRows(a, b Type) bool {
+	labelsA, restA, err := FlattenRowType(a)
+	if err != nil {
+		return false
+	}
+	labelsB, restB, err := FlattenRowType(b)
+	if err != nil || labelsA.Len() != labelsB.Len() {
+		return false
+	}
+	equal := true
+	labelsA.Range(func(label string, ts TypeList) bool {
+		other, ok := labelsB.Get(label)
+		if !ok || ts.Len() != other.Len() {
+			equal = false
+			return false
+		}
+		// Scoped labels are ordered:
+		ts.Range(func(i int, t Type) bool {
+			equal = eq.equal(t, other.Get(i))
+			return equal
+		})
+		return equal
+	})
+	return equal && eq.equal(restA, restB)
+}
+
+func (eq *alphaEquality) equalVars(a, b *Var) bool {
+	if !a.IsGenericVar() || !b.IsGenericVar() {
+		return !a.IsGenericVar() && !b.IsGenericVar() && a.Id() == b.Id()
+	}
+	if a.RestrictedLevel() != b.RestrictedLevel() || a.IsWeakVar() != b.IsWeakVar() {
+		return false
+	}
+	mappedB, seenA := eq.ab[a.Id()]
+	mappedA, seenB := eq.ba[b.Id()]
+	if seenA || seenB {
+		return seenA && seenB && mappedB == b.Id() && mappedA == a.Id()
+	}
+	if !equalConstraints(a.Constraints(), b.Constraints()) {
+		return false
+	}
+	if eq.ab == nil {
+		eq.ab, eq.ba = make(map[uint]uint), make(map[uint]uint)
+	}
+	eq.ab[a.Id()], eq.ba[b.Id()] = b.Id(), a.Id()
+	return true
+}
+
+func equalConstraints(a, b []InstanceConstraint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ca := range a {
+		found := false
+		for _, cb := range b {
+			if ca.TypeClass.Id == cb.TypeClass.Id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package types
+
+// Kinds of errors which may occur during unification.
+type UnifyErrorKind uint8
+
+const (
+	// A type-variable with an instance constraint was linked to a type which does not implement the type-class
+	ConstraintFailure UnifyErrorKind = iota + 1
+)
+
+// Error which occurs during unification. The type-class and type are set for constraint failures.
+type UnifyError struct {
+	Kind UnifyErrorKind
+	// Type-class of the unsatisfied constraint
+	TypeClass *TypeClass
+	// Type which does not satisfy the constraint
+	Type Type
+
+	message string
+}
+
+// Create an error for a type which does not satisfy a constraint for the type-class tc.
+//
+// The error message is formatted when the error is created, since t may be modified after unification fails.
+func NewConstraintFailure(tc *TypeClass, t Type) *UnifyError {
+	return &UnifyError{
+		Kind:      ConstraintFailure,
+		TypeClass: tc,
+		Type:      t,
+		message:   TypeString(t) + " does not satisfy constraint " + tc.Name,
+	}
+}
+
+// Describe the unification failure.
+func (e *UnifyError) Error() string { return e.message }
@@ -0,0 +1,208 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package types
+
+// Compute a structural hash of t. Structurally identical types, including the ids of their type-variables,
+// hash equally.
+//
+// Recursive links are hashed by their index and type-parameters, so hashing is safe for recursive types.
+func Hash(t Type) uint64 {
+	h := typeHasher{sum: fnvOffset}
+	h.hash(t)
+	return h.sum
+}
+
+// Compute a structural hash of t which is consistent with AlphaEqual. Types which are equal up to a consistent
+// renaming of their generic type-variables hash equally.
+func AlphaHash(t Type) uint64 {
+	h := typeHasher{sum: fnvOffset, alpha: true}
+	h.hash(t)
+	return h.sum
+}
+
+const (
+	fnvOffset uint64 = 14695981039346656037
+	fnvPrime  uint64 = 1099511628211
+)
+
+const (
+	hashNil byte = iota
+	hashVar
+	hashGenericVar
+	hashUnit
+	hashConst
+	hashSize
+	hashApp
+	hashArrow
+	hashTuple
+	hashMethod
+	hashRecord
+	hashVariant
+	hashRow
+	hashRowEmpty
+	hashRecursiveLink
+)
+
+type typeHasher struct {
+	sum     uint64
+	alpha   bool
+	generic map[uint]uint64 // canonical indexes of generic type-variables, in order of appearance
+}
+
+func (h *typeHasher) writeByte(b byte) { h.sum = (h.sum ^ uint64(b)) * fnvPrime }
+
+func (h *typeHasher) writeUint(n uint64) {
+	for i := uint(0); i < 64; i += 8 {
+		h.writeByte(byte(n >> i))
+	}
+}
+
+func (h *typeHasher) writeString(s string) {
+	h.writeUint(uint64(len(s)))
+	for i := 0; i < len(s); i++ {
+		h.writeByte(s[i])
+	}
+}
+
+func (h *typeHasher) hash(t Type) {
+	t = RealType(t)
+	switch t := t.(type) {
+	case *Var:
+		h.hashVar(t)
+
+	case *Unit:
+		h.writeByte(hashUnit)
+
+	case *Const:
+		h.writeByte(hashConst)
+		h.writeString(t.Name)
+
+	case Size:
+		h.writeByte(hashSize)
+		h.writeUint(uint64(t))
+
+	case *App:
+		h.writeByte(hashApp)
+		h.hash(t.Const)
+		h.hashList(t.Params)
+
+	case *Arrow:
+		h.writeByte(hashArrow)
+		h.hashList(t.Args)
+		h.hash(t.Return)
+
+	case *Tuple:
+		h.writeByte(hashTuple)
+		h.hashList(t.Elems)
+
+	case *Method:
+		h.writeByte(hashMethod)
+		h.writeUint(uint64(t.TypeClass.Id))
+		h.writeString(t.Name)
+
+	case *Record:
+		h.writeByte(hashRecord)
+		h.hashRow(t.Row)
+
+	case *Variant:
+		h.writeByte(hashVariant)
+		h.hashRow(t.Row)
+
+	case *RowExtend:
+		h.hashRow(t)
+
+	case *RowEmpty:
+		h.writeByte(hashRowEmpty)
+
+	case *RecursiveLink:
+		// The aliased types are not visited, to break cycles:
+		h.writeByte(hashRecursiveLink)
+		h.writeUint(uint64(t.Index))
+		h.writeUint(uint64(len(t.Recursive.Params)))
+		for _, p := range t.Recursive.Params {
+			h.hash(p)
+		}
+
+	case nil:
+		h.writeByte(hashNil)
+	}
+}
+
+func (h *typeHasher) hashList(ts []Type) {
+	h.writeUint(uint64(len(ts)))
+	for _, t := range ts {
+		h.hash(t)
+	}
+}
+
+// Row labels are hashed in sorted order, independently of the order of row extensions.
+func (h *typeHasher) hashRow(t Type) {
+	labels, rest, err := FlattenRowType(t)
+	h.writeByte(hashRow)
+	if err != nil {
+		return
+	}
+	h.writeUint(uint64(labels.Len()))
+	labels.Range(func(label string, ts TypeList) bool {
+		h.writeString(label)
+		h.writeUint(uint64(ts.Len()))
+		ts.Range(func(i int, t Type) bool {
+			h.hash(t)
+			return true
+		})
+		return true
+	})
+	h.hash(rest)
+}
+
+func (h *typeHasher) hashVar(t *Var) {
+	if !h.alpha || !t.IsGenericVar() {
+		h.writeByte(hashVar)
+		h.writeUint(uint64(t.Id()))
+		return
+	}
+	h.writeByte(hashGenericVar)
+	if index, ok := h.generic[t.Id()]; ok {
+		h.writeUint(index)
+		return
+	}
+	if h.generic == nil {
+		h.generic = make(map[uint]uint64)
+	}
+	index := uint64(len(h.generic))
+	h.generic[t.Id()] = index
+	h.writeUint(index)
+	h.writeUint(uint64(t.RestrictedLevel()))
+	if t.IsWeakVar() {
+		h.writeByte(1)
+	} else {
+		h.writeByte(0)
+	}
+	// Constraints are compared independently of their order:
+	var constraints uint64
+	for _, c := range t.Constraints() {
+		constraints += uint64(c.TypeClass.Id)*fnvPrime + 1
+	}
+	h.writeUint(uint64(len(t.Constraints())))
+	h.writeUint(constraints)
+}
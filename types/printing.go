@@ -35,7 +35,7 @@ var printerPool = sync.Pool{
 			idNames: make(map[uint]string, 16),
 			preds:   make(map[uint][]string, 16),
 		}
-		p.order = p._order[:0]
+		p.order, p.generic = p._order[:0], p._generic[:0]
 		return p
 	},
 }
@@ -49,37 +49,103 @@ func (p *typePrinter) Release() {
 	for k := range p.preds {
 		delete(p.preds, k)
 	}
-	p.order = p._order[:0]
+	p.order, p.generic = p._order[:0], p._generic[:0]
 	p.sb.Reset()
 	printerPool.Put(p)
 }
 
 // TypeString returns a string representation of a Type.
-func TypeString(t Type) string {
+func TypeString(t Type) string { return TypeStringWith(t, PrintOptions{}) }
+
+// SchemeString returns a string representation of a Type as a type-scheme, with leading quantifiers
+// for generic type-variables: `forall 'a 'b. Show 'a => 'a -> 'b`
+func SchemeString(t Type) string { return TypeStringWith(t, PrintOptions{Quantify: true}) }
+
+// ConstraintStyle determines how type-class constraints (and other predicates of type-variables) are rendered.
+type ConstraintStyle int
+
+const (
+	// Constraints are rendered as a leading context: `(Eq 'a, Show 'a) => 'a -> string`
+	ConstraintsPrefix ConstraintStyle = iota
+	// Constraints are rendered as a trailing clause: `'a -> string where Eq 'a, Show 'a`
+	ConstraintsWhere
+)
+
+// PrintOptions control the string representation of a Type (see TypeStringWith).
+type PrintOptions struct {
+	// Render leading quantifiers for generic type-variables (see SchemeString)
+	Quantify bool
+	// Render constraints as a leading context or a trailing where-clause
+	Constraints ConstraintStyle
+	// Group multiple constraints on the same type-variable: `(Eq + Show) 'a`
+	GroupConstraints bool
+}
+
+// TypeStringWith returns a string representation of a Type with the given options. Type-variables are named
+// in order of appearance within the type, and constraints are ordered by the names of their type-variables.
+func TypeStringWith(t Type, opts PrintOptions) string {
 	p := newTypePrinter()
 	typeString(p, false, t)
-	if len(p.preds) == 0 {
+	quantify := opts.Quantify && len(p.generic) != 0
+	if len(p.preds) == 0 && !quantify {
 		s := p.sb.String()
 		p.Release()
 		return s
 	}
 
+	var sb strings.Builder
+	if quantify {
+		sb.WriteString("forall")
+		for _, name := range p.generic {
+			sb.WriteByte(' ')
+			sb.WriteString(name)
+		}
+		sb.WriteString(". ")
+	}
+	if len(p.preds) == 0 {
+		sb.WriteString(p.sb.String())
+		p.Release()
+		return sb.String()
+	}
+
+	if opts.Constraints == ConstraintsWhere {
+		sb.WriteString(p.sb.String())
+		sb.WriteString(" where ")
+		p.predsString(&sb, opts.GroupConstraints, false)
+	} else {
+		p.predsString(&sb, opts.GroupConstraints, true)
+		sb.WriteString(" => ")
+		sb.WriteString(p.sb.String())
+	}
+	p.Release()
+	return sb.String()
+}
+
+// Write the predicates of each type-variable, ordered by name. Multiple predicates are enclosed in parentheses
+// if enclose is true.
+func (p *typePrinter) predsString(sb *strings.Builder, group, enclose bool) {
 	order := p.order
 	for id := range p.preds {
 		order = append(order, id)
 	}
 	sort.Slice(order, func(i, j int) bool { return p.idNames[order[i]] < p.idNames[order[j]] })
-	var sb strings.Builder
-	multiplePreds := len(order) > 1 || len(p.preds[order[0]]) > 1
-	if multiplePreds {
+	multiplePreds := len(order) > 1 || (len(p.preds[order[0]]) > 1 && !group)
+	if enclose && multiplePreds {
 		sb.WriteByte('(')
 	}
 	for i, id := range order {
 		if i > 0 {
 			sb.WriteString(", ")
 		}
-		idName := p.idNames[id]
-		for j, pred := range p.preds[id] {
+		idName, preds := p.idNames[id], p.preds[id]
+		if group && len(preds) > 1 {
+			sb.WriteByte('(')
+			sb.WriteString(strings.Join(preds, " + "))
+			sb.WriteString(") ")
+			sb.WriteString(idName)
+			continue
+		}
+		for j, pred := range preds {
 			if j > 0 {
 				sb.WriteString(", ")
 			}
@@ -88,22 +154,19 @@ func TypeString(t Type) string {
 			sb.WriteString(idName)
 		}
 	}
-	if multiplePreds {
+	if enclose && multiplePreds {
 		sb.WriteByte(')')
 	}
-
-	sb.WriteString(" => ")
-	sb.WriteString(p.sb.String())
-	p.Release()
-	return sb.String()
 }
 
 type typePrinter struct {
-	idNames map[uint]string
-	preds   map[uint][]string
-	order   []uint
-	_order  [16]uint
-	sb      strings.Builder
+	idNames  map[uint]string
+	preds    map[uint][]string
+	order    []uint
+	_order   [16]uint
+	generic  []string // names of generic type-variables, in order of appearance
+	_generic [16]string
+	sb       strings.Builder
 }
 
 var _names [128]string
@@ -167,7 +230,9 @@ func typeString(p *typePrinter, simple bool, t Type) {
 			p.idNames[t.Id()] = name
 
 		case t.IsLinkVar():
+			// Predicates of linked type-variables are not printed (restricted levels are retained after linking):
 			typeString(p, simple, t.Link())
+			return
 
 		case t.IsGenericVar():
 			if len(p.idNames) == 0 {
@@ -178,6 +243,7 @@ func typeString(p *typePrinter, simple bool, t Type) {
 			}
 			name := p.nextName()
 			p.idNames[t.Id()] = name
+			p.generic = append(p.generic, name)
 			p.sb.WriteString(name)
 		}
 		if len(t.constraints) == 0 && !t.IsWeakVar() && !t.IsRestrictedVar() {
@@ -224,7 +290,8 @@ func typeString(p *typePrinter, simple bool, t Type) {
 		if simple {
 			p.sb.WriteByte('(')
 		}
-		if len(t.Args) == 1 {
+		// Single tuple arguments are wrapped to distinguish them from multiple arguments:
+		if len(t.Args) == 1 && !isTuple(t.Args[0]) {
 			typeString(p, true, t.Args[0])
 			p.sb.WriteString(" -> ")
 			typeString(p, false, t.Return)
@@ -243,6 +310,16 @@ func typeString(p *typePrinter, simple bool, t Type) {
 			p.sb.WriteByte(')')
 		}
 
+	case *Tuple:
+		p.sb.WriteByte('(')
+		for i, elem := range t.Elems {
+			if i > 0 {
+				p.sb.WriteString(", ")
+			}
+			typeString(p, false, elem)
+		}
+		p.sb.WriteByte(')')
+
 	case *Method:
 		arrow := t.TypeClass.Methods[t.Name]
 		typeString(p, false, arrow)
@@ -294,3 +371,8 @@ func typeString(p *typePrinter, simple bool, t Type) {
 		}
 	}
 }
+
+func isTuple(t Type) bool {
+	_, ok := RealType(t).(*Tuple)
+	return ok
+}
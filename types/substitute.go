@@ -0,0 +1,263 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2019 West Damron
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package types
+
+// Substitute type-variables within t by id, without modifying t. Unbound and generic type-variables
+// with ids in subst are replaced; all other type-variables are preserved. Composite types are only
+// copied if they contain substituted type-variables. Linked type-variables are followed, and new
+// links are only created for the type-parameters of recursive types (see below).
+//
+// Constraints on replaced type-variables are dropped, and are not checked against the replacement types.
+//
+// Recursive types are substituted through their type-parameters: a new instance of the recursive
+// type-group is bound with substituted parameters by calling Bind, and the bound types are not traversed.
+// Since recursive type-parameters must be type-variables, parameters which are substituted with other
+// types are wrapped in new type-variables linked to the replacement types. Substitute panics if the
+// parameters of a recursive type-group without a Bind function are substituted.
+func Substitute(t Type, subst map[uint]Type) Type {
+	if len(subst) == 0 {
+		return t
+	}
+	s := substitution{subst: subst}
+	t, _ = s.visit(t)
+	return t
+}
+
+// Substitute scoped type constants (see Const) within t by name, without modifying t. Scoped type constants with
+// names in scoped are replaced; all other type constants are preserved. Composite types are copied as with Substitute.
+func SubstituteScoped(t Type, scoped map[string]Type) Type {
+	if len(scoped) == 0 {
+		return t
+	}
+	s := substitution{scoped: scoped}
+	t, _ = s.visit(t)
+	return t
+}
+
+type substitution struct {
+	subst  map[uint]Type
+	scoped map[string]Type
+	recs   map[*Recursive]*Recursive
+}
+
+func (s *substitution) visit(t Type) (Type, bool) {
+	t = RealType(t)
+	switch t := t.(type) {
+	case *Var:
+		if replacement, ok := s.subst[t.Id()]; ok {
+			return replacement, true
+		}
+		return t, false
+
+	case *Const:
+		if replacement, ok := s.scoped[t.Name]; ok && t.Scoped {
+			return replacement, true
+		}
+		return t, false
+
+	case *App:
+		c, changed := s.visit(t.Const)
+		params, paramsChanged := s.visitList(t.Params)
+		var underlying Type
+		underlyingChanged := false
+		if t.Underlying != nil {
+			underlying, underlyingChanged = s.visit(t.Underlying)
+		}
+		if !changed && !paramsChanged && !underlyingChanged {
+			return t, false
+		}
+		app := &App{Const: c, Params: params, Underlying: underlying, Source: t.Source}
+		app.Flags = flagsOf(params...) | flagsOf(c)
+		if IsRefType(app) {
+			app.Flags |= ContainsRefs
+		}
+		return app, true
+
+	case *Arrow:
+		args, argsChanged := s.visitList(t.Args)
+		ret, retChanged := s.visit(t.Return)
+		if !argsChanged && !retChanged {
+			return t, false
+		}
+		return &Arrow{Args: args, Return: ret, Method: t.Method, Source: t.Source, Flags: flagsOf(args...) | flagsOf(ret)}, true
+
+	case *Tuple:
+		elems, changed := s.visitList(t.Elems)
+		if !changed {
+			return t, false
+		}
+		return &Tuple{Elems: elems, Source: t.Source, Flags: flagsOf(elems...)}, true
+
+	case *Record:
+		row, changed := s.visit(t.Row)
+		if !changed {
+			return t, false
+		}
+		return &Record{Row: row, Source: t.Source, Flags: flagsOf(row)}, true
+
+	case *Variant:
+		row, changed := s.visit(t.Row)
+		if !changed {
+			return t, false
+		}
+		return &Variant{Row: row, Source: t.Source, Flags: flagsOf(row)}, true
+
+	case *RowExtend:
+		var row Type = RowEmptyPointer
+		rowChanged := false
+		if t.Row != nil {
+			row, rowChanged = s.visit(t.Row)
+		}
+		var mb TypeMapBuilder
+		labelsChanged := false
+		flags := flagsOf(row)
+		t.Labels.Range(func(label string, ts TypeList) bool {
+			var lb TypeListBuilder
+			listChanged := false
+			ts.Range(func(i int, t Type) bool {
+				next, changed := s.visit(t)
+				flags |= flagsOf(next)
+				if changed {
+					if !listChanged {
+						lb, listChanged = ts.Builder(), true
+					}
+					lb.Set(i, next)
+				}
+				return true
+			})
+			if listChanged {
+				if !labelsChanged {
+					mb, labelsChanged = t.Labels.Builder(), true
+				}
+				mb.Set(label, lb.Build())
+			}
+			return true
+		})
+		if !rowChanged && !labelsChanged {
+			return t, false
+		}
+		labels := t.Labels
+		if labelsChanged {
+			labels = mb.Build()
+		}
+		return &RowExtend{Row: row, Labels: labels, Source: t.Source, Flags: flags}, true
+
+	case *RecursiveLink:
+		rec, changed := s.visitRecursive(t.Recursive)
+		if !changed {
+			return t, false
+		}
+		return &RecursiveLink{Recursive: rec, Index: t.Index, Source: t.Source}, true
+	}
+	return t, false
+}
+
+func (s *substitution) visitList(ts []Type) ([]Type, bool) {
+	var next []Type
+	for i, t := range ts {
+		sub, changed := s.visit(t)
+		if !changed {
+			if next != nil {
+				next[i] = t
+			}
+			continue
+		}
+		if next == nil {
+			next = make([]Type, len(ts))
+			copy(next, ts[:i])
+		}
+		next[i] = sub
+	}
+	if next == nil {
+		return ts, false
+	}
+	return next, true
+}
+
+// Recursive type-groups are substituted once, and shared across all links to the group.
+func (s *substitution) visitRecursive(rec *Recursive) (*Recursive, bool) {
+	if next, ok := s.recs[rec]; ok {
+		return next, next != rec
+	}
+	if s.recs == nil {
+		s.recs = make(map[*Recursive]*Recursive)
+	}
+	var params []*Var
+	flags := rec.Flags &^ (ContainsGenericVars | ContainsRefs)
+	for i, tv := range rec.Params {
+		p, changed := s.visit(tv)
+		flags |= flagsOf(p)
+		if !changed {
+			if params != nil {
+				params[i] = tv
+			}
+			continue
+		}
+		if params == nil {
+			params = make([]*Var, len(rec.Params))
+			copy(params, rec.Params[:i])
+		}
+		if pv, ok := p.(*Var); ok {
+			params[i] = pv
+			continue
+		}
+		link := NewVar(tv.Id(), TopLevel)
+		link.SetLink(p)
+		params[i] = link
+	}
+	if params == nil {
+		s.recs[rec] = rec
+		return rec, false
+	}
+	if rec.Bind == nil {
+		panic("cannot substitute type-parameters of a recursive type without a Bind function")
+	}
+	next := &Recursive{
+		Source:  rec,
+		Params:  params,
+		Types:   make([]*App, 0, len(rec.Types)),
+		Names:   rec.Names,
+		Indexes: rec.Indexes,
+		Flags:   flags,
+		Bind:    rec.Bind,
+	}
+	s.recs[rec] = next
+	next.Bind(next)
+	return next, true
+}
+
+func flagsOf(ts ...Type) TypeFlags {
+	var flags TypeFlags
+	for _, t := range ts {
+		if t == nil {
+			continue
+		}
+		if t.IsGeneric() {
+			flags |= ContainsGenericVars
+		}
+		if t.HasRefs() {
+			flags |= ContainsRefs
+		}
+	}
+	return flags
+}
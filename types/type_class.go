@@ -125,6 +125,40 @@ func (tc *TypeClass) AddInstance(param Type, methods MethodSet, methodNames map[
 	return inst
 }
 
+// Remove an instance from the type-class.
+func (tc *TypeClass) RemoveInstance(inst *Instance) {
+	switch param := inst.Param.(type) {
+	case *Const:
+		if tc.tconst[param.Name] == inst {
+			delete(tc.tconst, param.Name)
+		}
+	case *App:
+		if c, ok := param.Const.(*Const); ok {
+			tc.tappconst[c.Name] = removeInstance(tc.tappconst[c.Name], inst)
+			break
+		}
+		tc.tmisc = removeInstance(tc.tmisc, inst)
+	case *Record:
+		tc.trecord = removeInstance(tc.trecord, inst)
+	case *Variant:
+		tc.tvariant = removeInstance(tc.tvariant, inst)
+	default:
+		tc.tmisc = removeInstance(tc.tmisc, inst)
+	}
+	tc.Instances = removeInstance(tc.Instances, inst)
+}
+
+func removeInstance(instances []*Instance, inst *Instance) []*Instance {
+	for i, existing := range instances {
+		if existing == inst {
+			copy(instances[i:], instances[i+1:])
+			instances[len(instances)-1] = nil
+			return instances[:len(instances)-1]
+		}
+	}
+	return instances
+}
+
 // Check if a type-class is declared as a sub-class of another type-class.
 func (tc *TypeClass) HasSuperClass(super *TypeClass) bool {
 	seen := util.NewUintDedupeMap()
@@ -28,6 +28,7 @@
 //   Size:           size constant
 //   App:            type application
 //   Arrow:          function type
+//   Tuple:          tuple type
 //   Method:         type-class method type
 //   Record:         record type
 //   Variant:        tagged (ad-hoc) variant-type
@@ -47,6 +48,7 @@ var (
 	_ Type = Size(0)
 	_ Type = (*App)(nil)
 	_ Type = (*Arrow)(nil)
+	_ Type = (*Tuple)(nil)
 	_ Type = (*Method)(nil)
 	_ Type = (*Record)(nil)
 	_ Type = (*Variant)(nil)
@@ -65,6 +67,7 @@ var (
 //   Size:           size constant
 //   App:            type application
 //   Arrow:          function type
+//   Tuple:          tuple type
 //   Method:         type-class method type
 //   Record:         record type
 //   Variant:        tagged (ad-hoc) variant-type
@@ -116,7 +119,7 @@ var UnitPointer *Unit = &Unit{}
 func NewUnit() *Unit { return UnitPointer }
 
 // Mutable references are applications of RefType (a mutable reference-type) with a single referenced type-parameter.
-var RefType = &Const{"ref"}
+var RefType = &Const{Name: "ref"}
 
 // Check if a type application is a mutable reference-type.
 func IsRefType(app *App) bool {
@@ -132,6 +135,11 @@ func NewRef(deref Type) *App {
 // Type constant: `int`, `bool`, etc
 type Const struct {
 	Name string
+	// Type-applications of abstract type constants may be unified by a user-defined unifier
+	Abstract bool
+	// Scoped type constants refer to type-variables bound by an enclosing type-abstraction, and are replaced by the
+	// bound type-variables within signatures
+	Scoped bool
 }
 
 // Size constant: `array[int, 8]`
@@ -161,6 +169,14 @@ type Arrow struct {
 	Flags  TypeFlags
 }
 
+// Tuple type: `(int, bool)`
+type Tuple struct {
+	Elems []Type
+	// Source which this type was instantiated from, or nil
+	Source *Tuple
+	Flags  TypeFlags
+}
+
 // Type-class method type: `('a, int) -> 'a`
 type Method struct {
 	TypeClass *TypeClass
@@ -229,6 +245,9 @@ func (t *App) TypeName() string { return "App" }
 // "Arrow"
 func (t *Arrow) TypeName() string { return "Arrow" }
 
+// "Tuple"
+func (t *Tuple) TypeName() string { return "Tuple" }
+
 // "Method"
 func (t *Method) TypeName() string { return "Method" }
 
@@ -292,6 +311,23 @@ func (t *Arrow) IsGeneric() bool { return t.Flags&ContainsGenericVars != 0 }
 // Check if t contains mutable reference-types.
 func (t *Arrow) HasRefs() bool { return t.Flags&ContainsRefs != 0 }
 
+// Check if t is an instantiation of a type-class method.
+func (t *Arrow) IsMethod() bool { return t.Method != nil }
+
+// Get the type-class and name of the method which t instantiates. If t is not a method, the type-class will be nil.
+func (t *Arrow) MethodInfo() (*TypeClass, string) {
+	if t.Method == nil {
+		return nil, ""
+	}
+	return t.Method.TypeClass, t.Method.Name
+}
+
+// Check if t contains generic types.
+func (t *Tuple) IsGeneric() bool { return t.Flags&ContainsGenericVars != 0 }
+
+// Check if t contains mutable reference-types.
+func (t *Tuple) HasRefs() bool { return t.Flags&ContainsRefs != 0 }
+
 // Check if t contains generic types.
 func (t *Method) IsGeneric() bool { return t.TypeClass.Methods[t.Name].Flags&ContainsGenericVars != 0 }
 
@@ -345,7 +381,9 @@ func FlattenRowType(t Type) (labels TypeMap, rest Type, err error) {
 		case *RowEmpty:
 			return t.Labels, rest, err
 		case *Var:
-			return t.Labels, rest, err
+			if !rest.IsLinkVar() {
+				return t.Labels, rest, err
+			}
 		}
 	}
 	b := NewTypeMapBuilder()
@@ -355,6 +393,56 @@ func FlattenRowType(t Type) (labels TypeMap, rest Type, err error) {
 	return b.Build(), rest, nil
 }
 
+// Concatenate the labels of row types a and b into a single row extension. Concatenation fails if a and b share any
+// labels. If either row is open, the labels of both rows are attached before its tail; if both rows are open,
+// concatenation fails.
+func ConcatRows(a, b Type) (Type, error) {
+	labelsA, restA, err := FlattenRowType(a)
+	if err != nil {
+		return nil, err
+	}
+	labelsB, restB, err := FlattenRowType(b)
+	if err != nil {
+		return nil, err
+	}
+	rest := restA
+	if _, closed := restB.(*RowEmpty); !closed && restB != nil {
+		if _, closed := restA.(*RowEmpty); !closed && restA != nil {
+			return nil, errors.New("Row concatenation requires at least one closed row")
+		}
+		rest = restB
+	}
+	if rest == nil {
+		rest = RowEmptyPointer
+	}
+	mb := labelsA.Builder()
+	var duplicate string
+	labelsB.Range(func(label string, ts TypeList) bool {
+		if _, ok := labelsA.Get(label); ok {
+			duplicate = label
+			return false
+		}
+		mb.Set(label, ts)
+		return true
+	})
+	if duplicate != "" {
+		return nil, errors.New("Row concatenation contains duplicate label " + duplicate)
+	}
+	labels := mb.Build()
+	if labels.Len() == 0 {
+		return rest, nil
+	}
+	flags := flagsOf(rest)
+	labels.Range(func(label string, ts TypeList) bool {
+		ts.Range(func(i int, t Type) bool {
+			flags |= flagsOf(t)
+			return true
+		})
+		return true
+	})
+	return &RowExtend{Row: rest, Labels: labels, Flags: flags}, nil
+}
+
 func flattenRowType(labels TypeMapBuilder, t Type) (Type, error) {
 	switch t := t.(type) {
 	case *RowExtend: